@@ -0,0 +1,515 @@
+// Package audit wraps a table.Table so that every mutation leaves a record
+// of who changed what: the actor, the operation, the columns it touched and
+// hashes of their new and previous values.
+//
+// Records go to a family of the changed row, written in the same mutation
+// as the change, or to a separate table keyed by table and row:
+//
+//	tbl := audit.Wrap(client.Open("tbl"), "tbl", audit.Options{Family: "audit"})
+//	err := tbl.Apply(audit.WithActor(ctx, "alice"), "token:101", m)
+//	entries, err := tbl.History(ctx, "token:101")
+//
+// In the changed rows, a DeleteRow is turned into deletes of the row's
+// families but the audit family, so that the records survive it; a family
+// that gets its first cell between the read of the families and the delete
+// keeps it.
+// Mutations of the audit family are refused with InvalidArgument.
+//
+// The previous values are read before the mutation, a write racing with it
+// may be attributed the wrong prior hash. Conditional mutations and read
+// modify writes are opaque to the wrapper until they ran, their records
+// are written after them and may be lost if that write fails. Give the
+// audit family a maxage gc policy, see Setup, to keep it from growing
+// forever.
+package audit
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type actorKey struct{}
+
+// WithActor returns ctx with the actor recorded for its mutations.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFrom returns the actor of ctx, "" if there is none.
+func ActorFrom(ctx context.Context) string {
+	a, _ := ctx.Value(actorKey{}).(string)
+	return a
+}
+
+// Entry is the record of one mutation of a row.
+type Entry struct {
+	Time    time.Time `json:"time"`
+	Actor   string    `json:"actor"`
+	Op      string    `json:"op"`
+	Changes []Change  `json:"changes,omitempty"`
+}
+
+// Change is what happened to one column. Column is family:qualifier,
+// family:* or * when a family or row without cells was deleted.
+type Change struct {
+	Column string `json:"column"`
+	// Action is set, delete or readModifyWrite.
+	Action string `json:"action"`
+	// Value and Prior are hashes of the new and the previous newest value.
+	Value string `json:"value,omitempty"`
+	Prior string `json:"prior,omitempty"`
+}
+
+// Hash returns the hash recorded for a value.
+func Hash(v []byte) string {
+	h := sha256.Sum256(v)
+	return hex.EncodeToString(h[:8])
+}
+
+// Options configure the records.
+type Options struct {
+	// Family holds the records, "audit" if empty. It has to exist in the
+	// wrapped table or in Table.
+	Family string
+	// Table receives the records instead of the changed rows if set.
+	Table table.Table
+	// Actor is recorded for contexts without WithActor.
+	Actor string
+	// SkipPrior leaves out the prior hashes and saves the read before
+	// every mutation.
+	SkipPrior bool
+}
+
+// Table records the mutations of the table it wraps.
+type Table struct {
+	tbl  table.Table
+	name string
+	opts Options
+
+	mu   sync.Mutex
+	seq  uint16
+	last int64
+}
+
+var _ table.Table = (*Table)(nil)
+
+// Wrap returns tbl recording its mutations, name keys its records in a
+// separate table.
+func Wrap(tbl table.Table, name string, opts Options) *Table {
+	if opts.Family == "" {
+		opts.Family = "audit"
+	}
+	return &Table{tbl: tbl, name: name, opts: opts}
+}
+
+// Setup creates family in tbl, and tbl if needed, with a maxage gc policy
+// of retention, none if zero.
+func Setup(ctx context.Context, admin *bigtable.AdminClient, tbl, family string, retention time.Duration) error {
+	tables, err := admin.Tables(ctx)
+	if err != nil {
+		return err
+	}
+	exists := false
+	for _, t := range tables {
+		exists = exists || t == tbl
+	}
+	if !exists {
+		if err := admin.CreateTable(ctx, tbl); err != nil {
+			return err
+		}
+	}
+	info, err := admin.TableInfo(ctx, tbl)
+	if err != nil {
+		return err
+	}
+	hasFamily := false
+	for _, f := range info.Families {
+		hasFamily = hasFamily || f == family
+	}
+	if !hasFamily {
+		if err := admin.CreateColumnFamily(ctx, tbl, family); err != nil {
+			return err
+		}
+	}
+	if retention <= 0 {
+		return nil
+	}
+	return admin.SetGCPolicy(ctx, tbl, family, bigtable.MaxAgePolicy(retention))
+}
+
+// suffix returns a qualifier or key suffix that sorts newer records first
+// and is unique within the process.
+func (t *Table) suffix(now time.Time) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	micros := now.UnixNano() / 1e3
+	if micros == t.last {
+		t.seq++
+	} else {
+		t.last, t.seq = micros, 0
+	}
+	return fmt.Sprintf("%016x%04x", math.MaxInt64-micros, math.MaxUint16-t.seq)
+}
+
+// prefix is the key prefix of the records of row in a separate table.
+func (t *Table) prefix(row string) string {
+	return t.name + "\x00" + row + "\x00"
+}
+
+// otherFamilies matches every family name but name.
+func otherFamilies(name string) string {
+	alts := []string{regexp.QuoteMeta(name) + ".+"}
+	for i := 0; i < len(name); i++ {
+		p := regexp.QuoteMeta(name[:i])
+		alts = append(alts, p, p+"[^"+regexp.QuoteMeta(name[i:i+1])+"].*")
+	}
+	return "^(" + strings.Join(alts, "|") + ")$"
+}
+
+// prior reads the newest value of every column of rows, without records.
+func (t *Table) prior(ctx context.Context, rows []string) (map[string]map[string][]byte, error) {
+	out := map[string]map[string][]byte{}
+	if t.opts.SkipPrior {
+		return out, nil
+	}
+	filter := bigtable.ChainFilters(bigtable.FamilyFilter(otherFamilies(t.opts.Family)), bigtable.LatestNFilter(1))
+	err := t.tbl.ReadRows(ctx, bigtable.RowList(rows), func(r bigtable.Row) bool {
+		cols := map[string][]byte{}
+		for _, items := range r {
+			for _, it := range items {
+				cols[it.Column] = it.Value
+			}
+		}
+		out[r.Key()] = cols
+		return true
+	}, bigtable.RowFilter(filter))
+	if err != nil {
+		return nil, fmt.Errorf("audit: reading prior values: %w", err)
+	}
+	return out, nil
+}
+
+// changes describes ops given the prior values of the row.
+func (t *Table) changes(ops []*btpb.Mutation, prior map[string][]byte) []Change {
+	var cs []Change
+	deleted := func(match func(col string) bool, none string) {
+		n := 0
+		for col, v := range prior {
+			if match(col) {
+				cs = append(cs, Change{Column: col, Action: "delete", Prior: Hash(v)})
+				n++
+			}
+		}
+		if n == 0 {
+			cs = append(cs, Change{Column: none, Action: "delete"})
+		}
+	}
+	for _, op := range ops {
+		switch m := op.Mutation.(type) {
+		case *btpb.Mutation_SetCell_:
+			col := m.SetCell.FamilyName + ":" + string(m.SetCell.ColumnQualifier)
+			c := Change{Column: col, Action: "set", Value: Hash(m.SetCell.Value)}
+			if v, ok := prior[col]; ok {
+				c.Prior = Hash(v)
+			}
+			cs = append(cs, c)
+		case *btpb.Mutation_DeleteFromColumn_:
+			col := m.DeleteFromColumn.FamilyName + ":" + string(m.DeleteFromColumn.ColumnQualifier)
+			c := Change{Column: col, Action: "delete"}
+			if v, ok := prior[col]; ok {
+				c.Prior = Hash(v)
+			}
+			cs = append(cs, c)
+		case *btpb.Mutation_DeleteFromFamily_:
+			fam := m.DeleteFromFamily.FamilyName
+			deleted(func(col string) bool { return strings.HasPrefix(col, fam+":") }, fam+":*")
+		case *btpb.Mutation_DeleteFromRow_:
+			deleted(func(string) bool { return true }, "*")
+		}
+	}
+	return cs
+}
+
+// record returns the cell of an entry, its qualifier or key suffix and value.
+func (t *Table) record(ctx context.Context, op string, cs []Change) (string, []byte) {
+	actor := ActorFrom(ctx)
+	if actor == "" {
+		actor = t.opts.Actor
+	}
+	now := time.Now()
+	v, _ := json.Marshal(Entry{Time: now.UTC(), Actor: actor, Op: op, Changes: cs})
+	return t.suffix(now), v
+}
+
+// protect returns m for a row that keeps its records: DeleteRow becomes
+// deletes of the other families and mutations of the audit family are
+// refused. Conditional mutations are rebuilt with both branches protected.
+func (t *Table) protect(ctx context.Context, row string, m *bigtable.Mutation) (*bigtable.Mutation, error) {
+	if m == nil || t.opts.Table != nil {
+		return m, nil
+	}
+	if table.IsConditional(m) {
+		cond, mtrue, mfalse := table.Cond(m)
+		pt, err := t.protect(ctx, row, mtrue)
+		if err != nil {
+			return nil, err
+		}
+		pf, err := t.protect(ctx, row, mfalse)
+		if err != nil {
+			return nil, err
+		}
+		return bigtable.NewCondMutation(cond, pt, pf), nil
+	}
+	ops := table.Ops(m)
+	var out []*btpb.Mutation
+	for i, op := range ops {
+		fam := ""
+		switch o := op.Mutation.(type) {
+		case *btpb.Mutation_SetCell_:
+			fam = o.SetCell.FamilyName
+		case *btpb.Mutation_DeleteFromColumn_:
+			fam = o.DeleteFromColumn.FamilyName
+		case *btpb.Mutation_DeleteFromFamily_:
+			fam = o.DeleteFromFamily.FamilyName
+		case *btpb.Mutation_DeleteFromRow_:
+			if out == nil {
+				out = append([]*btpb.Mutation(nil), ops[:i]...)
+			}
+			fams, err := t.families(ctx, row, out)
+			if err != nil {
+				return nil, err
+			}
+			for _, f := range fams {
+				out = append(out, &btpb.Mutation{Mutation: &btpb.Mutation_DeleteFromFamily_{
+					DeleteFromFamily: &btpb.Mutation_DeleteFromFamily{FamilyName: f},
+				}})
+			}
+			continue
+		}
+		if fam == t.opts.Family {
+			return nil, status.Errorf(codes.InvalidArgument, "audit: row %q: mutations of the audit family %s are not allowed", row, fam)
+		}
+		if out != nil {
+			out = append(out, op)
+		}
+	}
+	if out == nil {
+		return m, nil
+	}
+	return table.NewMutation(out), nil
+}
+
+// families returns the families of row that have cells or are set by the
+// earlier ops, but the audit family.
+func (t *Table) families(ctx context.Context, row string, earlier []*btpb.Mutation) ([]string, error) {
+	filter := bigtable.ChainFilters(bigtable.FamilyFilter(otherFamilies(t.opts.Family)), bigtable.LatestNFilter(1), bigtable.StripValueFilter())
+	r, err := t.tbl.ReadRow(ctx, row, bigtable.RowFilter(filter))
+	if err != nil {
+		return nil, fmt.Errorf("audit: reading families of %q: %w", row, err)
+	}
+	seen := map[string]bool{}
+	for fam := range r {
+		seen[fam] = true
+	}
+	for _, op := range earlier {
+		if set := op.GetSetCell(); set != nil {
+			seen[set.FamilyName] = true
+		}
+	}
+	fams := make([]string, 0, len(seen))
+	for fam := range seen {
+		fams = append(fams, fam)
+	}
+	sort.Strings(fams)
+	return fams, nil
+}
+
+// withRecord returns m followed by the record of it in the row.
+func (t *Table) withRecord(ops []*btpb.Mutation, qual string, v []byte) *bigtable.Mutation {
+	m := table.NewMutation(ops)
+	m.Set(t.opts.Family, qual, bigtable.Now(), v)
+	return m
+}
+
+// writeRecords writes records after their operations ran, to the rows or
+// to the separate table.
+func (t *Table) writeRecords(ctx context.Context, rows []string, quals []string, values [][]byte) error {
+	if len(rows) == 0 {
+		return nil
+	}
+	keys := make([]string, len(rows))
+	muts := make([]*bigtable.Mutation, len(rows))
+	dst := t.tbl
+	for i, row := range rows {
+		muts[i] = bigtable.NewMutation()
+		if t.opts.Table != nil {
+			keys[i] = t.prefix(row) + quals[i]
+			muts[i].Set(t.opts.Family, "e", bigtable.Now(), values[i])
+			dst = t.opts.Table
+		} else {
+			keys[i] = row
+			muts[i].Set(t.opts.Family, quals[i], bigtable.Now(), values[i])
+		}
+	}
+	errs, err := dst.ApplyBulk(ctx, keys, muts)
+	if err != nil {
+		return fmt.Errorf("audit: writing records: %w", err)
+	}
+	for i, e := range errs {
+		if e != nil {
+			return fmt.Errorf("audit: writing record of %q: %w", rows[i], e)
+		}
+	}
+	return nil
+}
+
+func (t *Table) Apply(ctx context.Context, row string, m *bigtable.Mutation, opts ...bigtable.ApplyOption) error {
+	m, err := t.protect(ctx, row, m)
+	if err != nil {
+		return err
+	}
+	if table.IsConditional(m) {
+		if err := t.tbl.Apply(ctx, row, m, opts...); err != nil {
+			return err
+		}
+		qual, v := t.record(ctx, "CondMutation", nil)
+		return t.writeRecords(ctx, []string{row}, []string{qual}, [][]byte{v})
+	}
+	prior, err := t.prior(ctx, []string{row})
+	if err != nil {
+		return err
+	}
+	ops := table.Ops(m)
+	qual, v := t.record(ctx, "Apply", t.changes(ops, prior[row]))
+	if t.opts.Table == nil {
+		return t.tbl.Apply(ctx, row, t.withRecord(ops, qual, v), opts...)
+	}
+	if err := t.tbl.Apply(ctx, row, m, opts...); err != nil {
+		return err
+	}
+	return t.writeRecords(ctx, []string{row}, []string{qual}, [][]byte{v})
+}
+
+func (t *Table) ApplyBulk(ctx context.Context, rowKeys []string, muts []*bigtable.Mutation, opts ...bigtable.ApplyOption) ([]error, error) {
+	orig := muts
+	muts = make([]*bigtable.Mutation, len(orig))
+	for i, m := range orig {
+		var err error
+		if muts[i], err = t.protect(ctx, rowKeys[i], m); err != nil {
+			return nil, err
+		}
+	}
+	prior, err := t.prior(ctx, rowKeys)
+	if err != nil {
+		return nil, err
+	}
+	quals := make([]string, len(muts))
+	values := make([][]byte, len(muts))
+	sent := muts
+	if t.opts.Table == nil {
+		sent = make([]*bigtable.Mutation, len(muts))
+	}
+	for i, m := range muts {
+		ops := table.Ops(m)
+		quals[i], values[i] = t.record(ctx, "ApplyBulk", t.changes(ops, prior[rowKeys[i]]))
+		if t.opts.Table == nil {
+			sent[i] = t.withRecord(ops, quals[i], values[i])
+		}
+	}
+	errs, err := t.tbl.ApplyBulk(ctx, rowKeys, sent, opts...)
+	if err != nil || t.opts.Table == nil {
+		return errs, err
+	}
+	var rows, qs []string
+	var vs [][]byte
+	for i := range rowKeys {
+		if errs == nil || errs[i] == nil {
+			rows, qs, vs = append(rows, rowKeys[i]), append(qs, quals[i]), append(vs, values[i])
+		}
+	}
+	return errs, t.writeRecords(ctx, rows, qs, vs)
+}
+
+func (t *Table) ApplyReadModifyWrite(ctx context.Context, row string, m *bigtable.ReadModifyWrite) (bigtable.Row, error) {
+	prior, err := t.prior(ctx, []string{row})
+	if err != nil {
+		return nil, err
+	}
+	r, err := t.tbl.ApplyReadModifyWrite(ctx, row, m)
+	if err != nil {
+		return r, err
+	}
+	var cs []Change
+	for _, items := range r {
+		for _, it := range items {
+			c := Change{Column: it.Column, Action: "readModifyWrite", Value: Hash(it.Value)}
+			if v, ok := prior[row][it.Column]; ok {
+				c.Prior = Hash(v)
+			}
+			cs = append(cs, c)
+		}
+	}
+	qual, v := t.record(ctx, "ReadModifyWrite", cs)
+	return r, t.writeRecords(ctx, []string{row}, []string{qual}, [][]byte{v})
+}
+
+func (t *Table) ReadRows(ctx context.Context, arg bigtable.RowSet, f func(bigtable.Row) bool, opts ...bigtable.ReadOption) error {
+	return t.tbl.ReadRows(ctx, arg, f, opts...)
+}
+
+func (t *Table) ReadRow(ctx context.Context, row string, opts ...bigtable.ReadOption) (bigtable.Row, error) {
+	return t.tbl.ReadRow(ctx, row, opts...)
+}
+
+func (t *Table) SampleRowKeys(ctx context.Context) ([]string, error) {
+	return t.tbl.SampleRowKeys(ctx)
+}
+
+// History returns the records of row, newest first.
+func (t *Table) History(ctx context.Context, row string) ([]Entry, error) {
+	var values [][]byte
+	if t.opts.Table != nil {
+		err := t.opts.Table.ReadRows(ctx, bigtable.PrefixRange(t.prefix(row)), func(r bigtable.Row) bool {
+			for _, it := range r[t.opts.Family] {
+				values = append(values, it.Value)
+			}
+			return true
+		}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		family := bigtable.FamilyFilter("^" + regexp.QuoteMeta(t.opts.Family) + "$")
+		r, err := t.tbl.ReadRow(ctx, row, bigtable.RowFilter(bigtable.ChainFilters(family, bigtable.LatestNFilter(1))))
+		if err != nil {
+			return nil, err
+		}
+		for _, it := range r[t.opts.Family] {
+			values = append(values, it.Value)
+		}
+	}
+	entries := make([]Entry, 0, len(values))
+	for _, v := range values {
+		var e Entry
+		if err := json.Unmarshal(v, &e); err != nil {
+			return nil, fmt.Errorf("audit: bad record of %q: %w", row, err)
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
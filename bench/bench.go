@@ -0,0 +1,645 @@
+// Package bench generates load against a table and measures it.
+//
+// A Workload mixes reads, writes, scans and read modify writes over a key
+// space of ids, picked uniformly, zipfian (few hot rows) or sequentially
+// (time ordered ids), and encoded with a keycodec scheme. Run reports
+// throughput and latency percentiles per interval and for the whole run,
+// together with how evenly the operations hit the key space, which is
+// what tells key schemes apart:
+//
+//	w := bench.Workload{Keys: 100000, Distribution: bench.Sequential, Mix: bench.Mix{Write: 1}}
+//	w.Codec, _ = keycodec.Parse("salted:16", "token:")
+//	res, err := bench.Run(ctx, client.Open("bench"), w, func(iv bench.Interval) { fmt.Println(iv) })
+package bench
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bigworkshop/keycodec"
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+)
+
+// Op is an operation of the mix.
+type Op int
+
+const (
+	Read Op = iota
+	Write
+	Scan
+	RMW
+
+	numOps
+)
+
+var opNames = [numOps]string{"read", "write", "scan", "rmw"}
+
+func (o Op) String() string {
+	if o >= 0 && o < numOps {
+		return opNames[o]
+	}
+	return "Op(" + strconv.Itoa(int(o)) + ")"
+}
+
+// Mix are the relative weights of the operations.
+type Mix struct {
+	Read, Write, Scan, RMW int
+}
+
+func (m Mix) weights() [numOps]int {
+	return [numOps]int{m.Read, m.Write, m.Scan, m.RMW}
+}
+
+func (m Mix) String() string {
+	var parts []string
+	for op, w := range m.weights() {
+		if w > 0 {
+			parts = append(parts, fmt.Sprintf("%v=%d", Op(op), w))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseMix parses weights like read=80,write=15,scan=4,rmw=1.
+func ParseMix(s string) (Mix, error) {
+	var m Mix
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(part, "=")
+		w, err := strconv.Atoi(v)
+		if !ok || err != nil || w < 0 {
+			return m, fmt.Errorf("bench: expected op=weight, got %q", part)
+		}
+		switch k {
+		case "read":
+			m.Read = w
+		case "write":
+			m.Write = w
+		case "scan":
+			m.Scan = w
+		case "rmw":
+			m.RMW = w
+		default:
+			return m, fmt.Errorf("bench: unknown op %q, use read, write, scan or rmw", k)
+		}
+	}
+	if m.Read+m.Write+m.Scan+m.RMW == 0 {
+		return m, fmt.Errorf("bench: mix %q has no operations", s)
+	}
+	return m, nil
+}
+
+// Distribution is how ids are picked.
+type Distribution string
+
+const (
+	// Uniform picks every id equally often.
+	Uniform Distribution = "uniform"
+	// Zipfian picks low ids far more often, like popular rows.
+	Zipfian Distribution = "zipfian"
+	// Sequential counts up, like ids derived from the time of an event.
+	Sequential Distribution = "sequential"
+)
+
+// ParseDistribution parses uniform, zipfian or sequential.
+func ParseDistribution(s string) (Distribution, error) {
+	switch d := Distribution(s); d {
+	case Uniform, Zipfian, Sequential:
+		return d, nil
+	}
+	return "", fmt.Errorf("bench: unknown distribution %q, use uniform, zipfian or sequential", s)
+}
+
+// Workload describes the load of a run.
+type Workload struct {
+	// Codec encodes the ids, plain token: keys if nil.
+	Codec keycodec.Codec
+	// Keys is the number of ids, 10000 if zero.
+	Keys uint64
+	// Distribution of the ids, Uniform if empty.
+	Distribution Distribution
+	// ZipfS is the skew of Zipfian, 1.1 if zero, must be above 1.
+	ZipfS float64
+	// Mix of operations, only reads if zero.
+	Mix Mix
+	// Family written and read, "fam" if empty.
+	Family string
+	// ValueSize is the size of written values, 100 if zero.
+	ValueSize int
+	// ScanRows is the number of rows per scan, 100 if zero.
+	ScanRows int
+	// Concurrency is the number of workers, 8 if zero.
+	Concurrency int
+	// Duration ends the run, unless Ops ends it first.
+	Duration time.Duration
+	// Ops ends the run after this many operations.
+	Ops int64
+	// Interval between reports, a second if zero.
+	Interval time.Duration
+	// Ranges is the number of key ranges the spread is measured over, 16
+	// if zero.
+	Ranges int
+}
+
+func (w Workload) withDefaults() Workload {
+	if w.Codec == nil {
+		w.Codec = keycodec.Plain{Prefix: "token:"}
+	}
+	if w.Keys == 0 {
+		w.Keys = 10000
+	}
+	if w.Distribution == "" {
+		w.Distribution = Uniform
+	}
+	if w.ZipfS <= 1 {
+		w.ZipfS = 1.1
+	}
+	if w.Mix == (Mix{}) {
+		w.Mix = Mix{Read: 1}
+	}
+	if w.Family == "" {
+		w.Family = "fam"
+	}
+	if w.ValueSize <= 0 {
+		w.ValueSize = 100
+	}
+	if w.ScanRows <= 0 {
+		w.ScanRows = 100
+	}
+	if w.Concurrency <= 0 {
+		w.Concurrency = 8
+	}
+	if w.Interval <= 0 {
+		w.Interval = time.Second
+	}
+	if w.Ranges <= 0 {
+		w.Ranges = 16
+	}
+	return w
+}
+
+// Load writes a row for every id of the workload, so that reads find
+// them, using ApplyBulk with the workload's concurrency.
+func Load(ctx context.Context, tbl table.Table, w Workload) error {
+	w = w.withDefaults()
+	const batch = 1000
+	ids := make(chan uint64)
+	errc := make(chan error, w.Concurrency)
+	var wg sync.WaitGroup
+	for i := 0; i < w.Concurrency; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for first := range ids {
+				var keys []string
+				var muts []*bigtable.Mutation
+				for id := first; id < first+batch && id < w.Keys; id++ {
+					keys = append(keys, w.Codec.Encode(id))
+					muts = append(muts, w.mutation(rnd))
+				}
+				errs, err := tbl.ApplyBulk(ctx, keys, muts)
+				if err == nil {
+					for _, e := range errs {
+						if e != nil {
+							err = e
+							break
+						}
+					}
+				}
+				if err != nil {
+					errc <- err
+					return
+				}
+			}
+		}(int64(i))
+	}
+	var err error
+feed:
+	for first := uint64(0); first < w.Keys; first += batch {
+		select {
+		case ids <- first:
+		case err = <-errc:
+			break feed
+		case <-ctx.Done():
+			err = ctx.Err()
+			break feed
+		}
+	}
+	close(ids)
+	wg.Wait()
+	if err == nil {
+		select {
+		case err = <-errc:
+		default:
+		}
+	}
+	return err
+}
+
+func (w Workload) mutation(rnd *rand.Rand) *bigtable.Mutation {
+	v := make([]byte, w.ValueSize)
+	rnd.Read(v)
+	m := bigtable.NewMutation()
+	m.Set(w.Family, "v", bigtable.Now(), v)
+	return m
+}
+
+// OpStats are the results of one operation, latencies are rounded to three
+// significant digits or so.
+type OpStats struct {
+	Count  int64
+	Errors int64
+	Mean   time.Duration
+	P50    time.Duration
+	P90    time.Duration
+	P99    time.Duration
+	Max    time.Duration
+}
+
+func (s OpStats) String() string {
+	return fmt.Sprintf("%d ops, %d errors, p50 %v, p90 %v, p99 %v, max %v",
+		s.Count, s.Errors, s.P50, s.P90, s.P99, s.Max)
+}
+
+func round(d time.Duration) time.Duration {
+	switch {
+	case d >= time.Second:
+		return d.Round(time.Millisecond)
+	case d >= time.Millisecond:
+		return d.Round(10 * time.Microsecond)
+	}
+	return d.Round(time.Microsecond)
+}
+
+// Interval are the results of one report interval, or of the whole run.
+type Interval struct {
+	// Elapsed is the time since the start at the end of the interval.
+	Elapsed time.Duration
+	// Duration is the length of the interval.
+	Duration time.Duration
+	Ops      map[Op]OpStats
+	// Hottest is the share of the operations that hit the busiest key
+	// range, 1/Workload.Ranges if the key space is hit evenly and 1 if
+	// everything hits one range. For a whole run it is the mean over the
+	// intervals, weighted by their operations: sequential ids move
+	// through the key space and only hit a few ranges at a time.
+	Hottest float64
+}
+
+// Count returns the operations and errors of all kinds.
+func (iv Interval) Count() (ops, errors int64) {
+	for _, s := range iv.Ops {
+		ops += s.Count
+		errors += s.Errors
+	}
+	return ops, errors
+}
+
+// Throughput returns the operations per second.
+func (iv Interval) Throughput() float64 {
+	if iv.Duration <= 0 {
+		return 0
+	}
+	ops, _ := iv.Count()
+	return float64(ops) / iv.Duration.Seconds()
+}
+
+func (iv Interval) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%6v %8.0f ops/s", iv.Elapsed.Round(time.Second), iv.Throughput())
+	for op := Op(0); op < numOps; op++ {
+		if s, ok := iv.Ops[op]; ok {
+			fmt.Fprintf(&b, "  %v p50 %v p99 %v", op, s.P50, s.P99)
+			if s.Errors > 0 {
+				fmt.Fprintf(&b, " %d errors", s.Errors)
+			}
+		}
+	}
+	fmt.Fprintf(&b, "  hottest range %.0f%%", 100*iv.Hottest)
+	return b.String()
+}
+
+// Result is the outcome of a run.
+type Result struct {
+	Workload Workload
+	Interval
+	// Spread is the share of all operations that hit each key range, the
+	// ranges split the encoded keys into parts with as many ids.
+	Spread []float64
+	// FirstError is the first failed operation, errors do not stop a run.
+	FirstError error
+}
+
+// recorder collects the latencies of all workers.
+type recorder struct {
+	mu       sync.Mutex
+	interval [numOps]*histogram
+	total    [numOps]*histogram
+	errs     [numOps][2]int64 // interval, total
+	ranges   [2][]int64       // interval, total
+	// hottest sums the hottest share of each interval times its operations
+	hottest  float64
+	firstErr error
+}
+
+func newRecorder(ranges int) *recorder {
+	r := &recorder{ranges: [2][]int64{make([]int64, ranges), make([]int64, ranges)}}
+	for op := range r.total {
+		r.interval[op] = newHistogram()
+		r.total[op] = newHistogram()
+	}
+	return r
+}
+
+func (r *recorder) record(op Op, d time.Duration, rng int, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.interval[op].record(d)
+	r.ranges[0][rng]++
+	r.ranges[1][rng]++
+	if err != nil {
+		r.errs[op][0]++
+		r.errs[op][1]++
+		if r.firstErr == nil {
+			r.firstErr = fmt.Errorf("%v: %w", op, err)
+		}
+	}
+}
+
+func stats(h *histogram, errs int64) OpStats {
+	return OpStats{
+		Count:  h.n,
+		Errors: errs,
+		Mean:   round(h.mean()),
+		P50:    round(h.quantile(0.5)),
+		P90:    round(h.quantile(0.9)),
+		P99:    round(h.quantile(0.99)),
+		Max:    round(h.max),
+	}
+}
+
+// flush ends an interval, moving its latencies into the totals.
+func (r *recorder) flush(elapsed, d time.Duration) Interval {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	iv := Interval{Elapsed: elapsed, Duration: d, Ops: map[Op]OpStats{}}
+	for op := Op(0); op < numOps; op++ {
+		h := r.interval[op]
+		if h.n == 0 {
+			continue
+		}
+		iv.Ops[op] = stats(h, r.errs[op][0])
+		r.total[op].merge(h)
+		r.interval[op] = newHistogram()
+		r.errs[op][0] = 0
+	}
+	var ops, max int64
+	for i, n := range r.ranges[0] {
+		ops += n
+		if n > max {
+			max = n
+		}
+		r.ranges[0][i] = 0
+	}
+	if ops > 0 {
+		iv.Hottest = float64(max) / float64(ops)
+		r.hottest += float64(max)
+	}
+	return iv
+}
+
+// boundaries splits the encoded keys into n ranges of equal size, from a
+// sample of the ids.
+func boundaries(w Workload, n int) []string {
+	const samples = 4096
+	step := w.Keys / samples
+	if step == 0 {
+		step = 1
+	}
+	var keys []string
+	for id := uint64(0); id < w.Keys; id += step {
+		keys = append(keys, w.Codec.Encode(id))
+	}
+	sort.Strings(keys)
+	b := make([]string, n-1)
+	for i := range b {
+		b[i] = keys[(i+1)*len(keys)/n]
+	}
+	return b
+}
+
+// worker runs operations until ctx is done or the budget is used up.
+type worker struct {
+	w      Workload
+	tbl    table.Table
+	rnd    *rand.Rand
+	zipf   *rand.Zipf
+	next   func() uint64
+	bounds []string
+	rec    *recorder
+	total  int
+}
+
+func (wk *worker) pickOp() Op {
+	n := wk.rnd.Intn(wk.total)
+	for op, weight := range wk.w.Mix.weights() {
+		if n < weight {
+			return Op(op)
+		}
+		n -= weight
+	}
+	return Read
+}
+
+func (wk *worker) pickID() uint64 {
+	switch wk.w.Distribution {
+	case Zipfian:
+		return wk.zipf.Uint64()
+	case Sequential:
+		return wk.next()
+	}
+	return uint64(wk.rnd.Int63n(int64(wk.w.Keys)))
+}
+
+func (wk *worker) run(ctx context.Context, budget func() bool) {
+	for ctx.Err() == nil && budget() {
+		op := wk.pickOp()
+		key := wk.w.Codec.Encode(wk.pickID())
+		start := time.Now()
+		err := wk.do(ctx, op, key)
+		d := time.Since(start)
+		if ctx.Err() != nil {
+			return // cut off by the end of the run, not a result
+		}
+		wk.rec.record(op, d, sort.SearchStrings(wk.bounds, key+"\x00"), err)
+	}
+}
+
+func (wk *worker) do(ctx context.Context, op Op, key string) error {
+	switch op {
+	case Write:
+		return wk.tbl.Apply(ctx, key, wk.w.mutation(wk.rnd))
+	case Scan:
+		return wk.tbl.ReadRows(ctx, bigtable.NewRange(key, ""), func(bigtable.Row) bool { return true },
+			bigtable.LimitRows(int64(wk.w.ScanRows)), bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	case RMW:
+		m := bigtable.NewReadModifyWrite()
+		m.Increment(wk.w.Family, "n", 1)
+		_, err := wk.tbl.ApplyReadModifyWrite(ctx, key, m)
+		return err
+	}
+	_, err := wk.tbl.ReadRow(ctx, key, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	return err
+}
+
+// Run runs the workload against tbl until its Duration or Ops are reached
+// or ctx is done, and calls report, if not nil, after every interval. A run
+// ended early by ctx still returns the results so far.
+func Run(ctx context.Context, tbl table.Table, w Workload, report func(Interval)) (*Result, error) {
+	w = w.withDefaults()
+	if w.Duration <= 0 && w.Ops <= 0 {
+		return nil, fmt.Errorf("bench: workload needs a duration or a number of operations")
+	}
+	if w.Duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.Duration)
+		defer cancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var mu sync.Mutex
+	var issued int64
+	var seq uint64
+	budget := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if w.Ops > 0 && issued >= w.Ops {
+			return false
+		}
+		issued++
+		return true
+	}
+	next := func() uint64 {
+		mu.Lock()
+		defer mu.Unlock()
+		id := seq % w.Keys
+		seq++
+		return id
+	}
+
+	total := 0
+	for _, weight := range w.Mix.weights() {
+		total += weight
+	}
+	rec := newRecorder(w.Ranges)
+	bounds := boundaries(w, w.Ranges)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < w.Concurrency; i++ {
+		rnd := rand.New(rand.NewSource(start.UnixNano() + int64(i)))
+		wk := &worker{
+			w:      w,
+			tbl:    tbl,
+			rnd:    rnd,
+			zipf:   rand.NewZipf(rnd, w.ZipfS, 1, w.Keys-1),
+			next:   next,
+			bounds: bounds,
+			rec:    rec,
+			total:  total,
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wk.run(ctx, budget)
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(w.Interval)
+	defer ticker.Stop()
+	last := start
+loop:
+	for {
+		select {
+		case now := <-ticker.C:
+			iv := rec.flush(now.Sub(start), now.Sub(last))
+			last = now
+			if report != nil {
+				report(iv)
+			}
+		case <-done:
+			break loop
+		}
+	}
+	now := time.Now()
+	// the rest of an interval cut short is only reported if it is not
+	// just a few stragglers
+	if iv := rec.flush(now.Sub(start), now.Sub(last)); report != nil && len(iv.Ops) > 0 && iv.Duration > w.Interval/10 {
+		report(iv)
+	}
+
+	res := &Result{Workload: w, FirstError: rec.firstErr}
+	res.Elapsed = now.Sub(start)
+	res.Duration = res.Elapsed
+	res.Ops = map[Op]OpStats{}
+	for op := Op(0); op < numOps; op++ {
+		if h := rec.total[op]; h.n > 0 {
+			res.Ops[op] = stats(h, rec.errs[op][1])
+		}
+	}
+	var hits int64
+	for _, n := range rec.ranges[1] {
+		hits += n
+	}
+	res.Spread = make([]float64, len(rec.ranges[1]))
+	if hits > 0 {
+		for i, n := range rec.ranges[1] {
+			res.Spread[i] = float64(n) / float64(hits)
+		}
+		res.Hottest = rec.hottest / float64(hits)
+	}
+	return res, nil
+}
+
+// CreateTable creates the table and the family if they are missing.
+func CreateTable(ctx context.Context, admin *bigtable.AdminClient, table, family string) error {
+	tables, err := admin.Tables(ctx)
+	if err != nil {
+		return err
+	}
+	exists := false
+	for _, t := range tables {
+		exists = exists || t == table
+	}
+	if !exists {
+		if err := admin.CreateTable(ctx, table); err != nil {
+			return err
+		}
+	}
+	info, err := admin.TableInfo(ctx, table)
+	if err != nil {
+		return err
+	}
+	for _, f := range info.Families {
+		if f == family {
+			return nil
+		}
+	}
+	return admin.CreateColumnFamily(ctx, table, family)
+}
@@ -0,0 +1,82 @@
+package bench
+
+import (
+	"math"
+	"time"
+)
+
+// histogram buckets latencies logarithmically, 2% apart from a microsecond
+// up, which keeps percentiles within 2% at a fixed size.
+type histogram struct {
+	counts []int64
+	n      int64
+	sum    time.Duration
+	max    time.Duration
+}
+
+const (
+	histGrowth  = 1.02
+	histBuckets = 1024 // 1µs * 1.02^1024 is several hours
+)
+
+var logGrowth = math.Log(histGrowth)
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]int64, histBuckets)}
+}
+
+func (h *histogram) record(d time.Duration) {
+	i := 0
+	if us := float64(d) / float64(time.Microsecond); us > 1 {
+		i = int(math.Log(us)/logGrowth) + 1
+	}
+	if i >= histBuckets {
+		i = histBuckets - 1
+	}
+	h.counts[i]++
+	h.n++
+	h.sum += d
+	if d > h.max {
+		h.max = d
+	}
+}
+
+func (h *histogram) merge(o *histogram) {
+	for i, c := range o.counts {
+		h.counts[i] += c
+	}
+	h.n += o.n
+	h.sum += o.sum
+	if o.max > h.max {
+		h.max = o.max
+	}
+}
+
+// quantile returns the upper bound of the bucket holding quantile q.
+func (h *histogram) quantile(q float64) time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	rank := int64(math.Ceil(q * float64(h.n)))
+	if rank < 1 {
+		rank = 1
+	}
+	var seen int64
+	for i, c := range h.counts {
+		if seen += c; seen >= rank {
+			d := time.Duration(math.Pow(histGrowth, float64(i)) * float64(time.Microsecond))
+			if d > h.max {
+				d = h.max
+			}
+			return d
+		}
+	}
+	return h.max
+}
+
+func (h *histogram) mean() time.Duration {
+	if h.n == 0 {
+		return 0
+	}
+	return h.sum / time.Duration(h.n)
+}
@@ -0,0 +1,412 @@
+// Package blob stores values larger than a cell should be, split into
+// chunks. A manifest cell with the size and sha256 of the value commits a
+// write, readers never see a blob whose chunks are incomplete:
+//
+//	store := blob.New(client.Open("tbl"), blob.Options{})
+//	err := store.Put(ctx, "doc:1", "pdf", f, size)
+//	r, err := store.Open(ctx, "doc:1", "pdf")
+//	defer r.Close()
+//	_, err = io.Copy(w, r)
+//
+// The manifest is the column family:name of the row. Its chunks are the
+// columns family:name/version/seq of the same row, or, for blobs above
+// Options.RowBytes, rows of their own right behind it,
+// row\x00blob\x00name/version/seq, so that the row stays small. Blobs up
+// to Options.AtomicBytes are written with their manifest in one mutation.
+//
+// Every write gets a new version, chunks of the replaced version are
+// deleted after the new manifest is written. Chunks left by failed writes
+// or deletes are orphans, Collect removes them.
+package blob
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+)
+
+// Layouts of the chunks.
+const (
+	Cells = "cells"
+	Rows  = "rows"
+)
+
+// chunkRows separates the key of a chunk row from its blob's row.
+const chunkRows = "\x00blob\x00"
+
+// Options configure a Store.
+type Options struct {
+	// Family holds manifests and chunks, blob if empty.
+	Family string
+	// ChunkSize is the size of the chunks, 1 MiB if zero.
+	ChunkSize int
+	// AtomicBytes is the size up to which a blob is written in one
+	// mutation, buffered in memory, 16 MiB if zero.
+	AtomicBytes int64
+	// RowBytes is the size above which chunks get rows of their own, 64
+	// MiB if zero.
+	RowBytes int64
+}
+
+// Manifest describes a stored blob.
+type Manifest struct {
+	Name      string    `json:"-"`
+	Size      int64     `json:"size"`
+	Chunks    int       `json:"chunks"`
+	ChunkSize int       `json:"chunk_size"`
+	SHA256    string    `json:"sha256"`
+	Version   string    `json:"version"`
+	Layout    string    `json:"layout"`
+	Created   time.Time `json:"created"`
+}
+
+// ErrNotFound is returned for blobs without a manifest.
+var ErrNotFound = fmt.Errorf("blob: not found")
+
+// Store reads and writes blobs in a table.
+type Store struct {
+	tbl  table.Table
+	opts Options
+}
+
+// New returns a Store of tbl.
+func New(tbl table.Table, opts Options) *Store {
+	if opts.Family == "" {
+		opts.Family = "blob"
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = 1 << 20
+	}
+	if opts.AtomicBytes <= 0 {
+		opts.AtomicBytes = 16 << 20
+	}
+	if opts.RowBytes <= 0 {
+		opts.RowBytes = 64 << 20
+	}
+	return &Store{tbl: tbl, opts: opts}
+}
+
+func checkName(name string) error {
+	if name == "" || strings.ContainsAny(name, "/\x00") {
+		return fmt.Errorf("blob: bad name %q, names are not empty and have no / or NUL", name)
+	}
+	return nil
+}
+
+func chunkQualifier(name, version string, seq int) string {
+	return fmt.Sprintf("%s/%s/%08d", name, version, seq)
+}
+
+// parseChunk splits a chunk qualifier, false for manifests.
+func parseChunk(qual string) (name, version string, ok bool) {
+	parts := strings.Split(qual, "/")
+	if len(parts) != 3 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func newVersion() (string, error) {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return strconv.FormatInt(time.Now().UnixNano(), 36) + hex.EncodeToString(b), nil
+}
+
+func (s *Store) column(qual string) bigtable.Filter {
+	return bigtable.ChainFilters(
+		bigtable.FamilyFilter("^"+regexp.QuoteMeta(s.opts.Family)+"$"),
+		bigtable.ColumnFilter("^"+regexp.QuoteMeta(qual)+"$"),
+		bigtable.LatestNFilter(1),
+	)
+}
+
+// manifests filters the manifests of a row, the qualifiers without /.
+func (s *Store) manifests() bigtable.Filter {
+	return bigtable.ChainFilters(
+		bigtable.FamilyFilter("^"+regexp.QuoteMeta(s.opts.Family)+"$"),
+		bigtable.ColumnFilter("^[^/]*$"),
+		bigtable.LatestNFilter(1),
+	)
+}
+
+func (s *Store) parseManifest(it bigtable.ReadItem) (Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(it.Value, &m); err != nil {
+		return m, fmt.Errorf("blob: manifest %s of %q: %w", it.Column, it.Row, err)
+	}
+	m.Name = strings.TrimPrefix(it.Column, s.opts.Family+":")
+	return m, nil
+}
+
+// Stat returns the manifest of a blob.
+func (s *Store) Stat(ctx context.Context, row, name string) (Manifest, error) {
+	if err := checkName(name); err != nil {
+		return Manifest{}, err
+	}
+	r, err := s.tbl.ReadRow(ctx, row, bigtable.RowFilter(s.column(name)))
+	if err != nil {
+		return Manifest{}, err
+	}
+	items := r[s.opts.Family]
+	if len(items) == 0 {
+		return Manifest{}, ErrNotFound
+	}
+	return s.parseManifest(items[0])
+}
+
+// List returns the manifests of the blobs of a row.
+func (s *Store) List(ctx context.Context, row string) ([]Manifest, error) {
+	r, err := s.tbl.ReadRow(ctx, row, bigtable.RowFilter(s.manifests()))
+	if err != nil {
+		return nil, err
+	}
+	var out []Manifest
+	for _, it := range r[s.opts.Family] {
+		m, err := s.parseManifest(it)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// Put stores size bytes of r as the blob name of row, replacing the blob
+// if it exists. It fails if r has more or fewer bytes.
+func (s *Store) Put(ctx context.Context, row, name string, r io.Reader, size int64) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	old, err := s.Stat(ctx, row, name)
+	if err != nil && err != ErrNotFound {
+		return err
+	}
+	version, err := newVersion()
+	if err != nil {
+		return err
+	}
+	m := Manifest{
+		Name:      name,
+		Size:      size,
+		ChunkSize: s.opts.ChunkSize,
+		Version:   version,
+		Layout:    Cells,
+		Created:   time.Now().UTC(),
+	}
+	if size > s.opts.RowBytes {
+		m.Layout = Rows
+	}
+	m.Chunks = int((size + int64(m.ChunkSize) - 1) / int64(m.ChunkSize))
+
+	h := sha256.New()
+	r = io.TeeReader(io.LimitReader(r, size+1), h)
+	ts := bigtable.Now()
+	atomic := m.Layout == Cells && size <= s.opts.AtomicBytes
+	mut := bigtable.NewMutation()
+	buf := make([]byte, m.ChunkSize)
+	var written int64
+	var chunkKeys []string
+	for seq := 0; seq < m.Chunks; seq++ {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+			return s.abort(ctx, row, m, chunkKeys, fmt.Errorf("blob: reading %s: %w", name, err))
+		}
+		err = nil
+		written += int64(n)
+		qual := chunkQualifier(name, version, seq)
+		switch {
+		case atomic:
+			mut.Set(s.opts.Family, qual, ts, append([]byte(nil), buf[:n]...))
+		case m.Layout == Cells:
+			cm := bigtable.NewMutation()
+			cm.Set(s.opts.Family, qual, ts, buf[:n])
+			err = s.tbl.Apply(ctx, row, cm)
+		default:
+			key := row + chunkRows + qual
+			cm := bigtable.NewMutation()
+			cm.Set(s.opts.Family, qual, ts, buf[:n])
+			err = s.tbl.Apply(ctx, key, cm)
+			chunkKeys = append(chunkKeys, key)
+		}
+		if err != nil {
+			return s.abort(ctx, row, m, chunkKeys, fmt.Errorf("blob: writing chunk %d of %s: %w", seq, name, err))
+		}
+	}
+	if extra, _ := r.Read(buf[:1]); written != size || extra > 0 {
+		return s.abort(ctx, row, m, chunkKeys, fmt.Errorf("blob: %s has not %d bytes", name, size))
+	}
+	m.SHA256 = hex.EncodeToString(h.Sum(nil))
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	mut.Set(s.opts.Family, name, ts, data)
+	if err := s.tbl.Apply(ctx, row, mut); err != nil {
+		return s.abort(ctx, row, m, chunkKeys, err)
+	}
+	if old.Version != "" {
+		// best effort, Collect finds what is left
+		s.deleteChunks(ctx, row, old)
+	}
+	return nil
+}
+
+// abort deletes the chunks of a failed write, what it misses is left to
+// Collect.
+func (s *Store) abort(ctx context.Context, row string, m Manifest, chunkKeys []string, err error) error {
+	if m.Layout == Rows {
+		for _, key := range chunkKeys {
+			s.tbl.Apply(ctx, key, deleteRow())
+		}
+		return err
+	}
+	s.deleteChunks(ctx, row, m)
+	return err
+}
+
+func deleteRow() *bigtable.Mutation {
+	m := bigtable.NewMutation()
+	m.DeleteRow()
+	return m
+}
+
+// deleteChunks deletes the chunks of a manifest.
+func (s *Store) deleteChunks(ctx context.Context, row string, m Manifest) error {
+	if m.Layout == Rows {
+		keys := make([]string, 0, m.Chunks)
+		muts := make([]*bigtable.Mutation, 0, m.Chunks)
+		for seq := 0; seq < m.Chunks; seq++ {
+			keys = append(keys, row+chunkRows+chunkQualifier(m.Name, m.Version, seq))
+			muts = append(muts, deleteRow())
+		}
+		return applyBulk(ctx, s.tbl, keys, muts)
+	}
+	mut := bigtable.NewMutation()
+	for seq := 0; seq < m.Chunks; seq++ {
+		mut.DeleteCellsInColumn(s.opts.Family, chunkQualifier(m.Name, m.Version, seq))
+	}
+	return s.tbl.Apply(ctx, row, mut)
+}
+
+// applyBulk applies muts in batches of 1000 and returns the first error.
+func applyBulk(ctx context.Context, tbl table.Table, keys []string, muts []*bigtable.Mutation) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > 1000 {
+			n = 1000
+		}
+		errs, err := tbl.ApplyBulk(ctx, keys[:n], muts[:n])
+		if err != nil {
+			return err
+		}
+		for i, e := range errs {
+			if e != nil {
+				return fmt.Errorf("blob: %q: %w", keys[i], e)
+			}
+		}
+		keys, muts = keys[n:], muts[n:]
+	}
+	return nil
+}
+
+// Delete deletes a blob, its manifest first so that it is gone even if
+// deleting the chunks fails.
+func (s *Store) Delete(ctx context.Context, row, name string) error {
+	m, err := s.Stat(ctx, row, name)
+	if err != nil {
+		return err
+	}
+	mut := bigtable.NewMutation()
+	mut.DeleteCellsInColumn(s.opts.Family, name)
+	if err := s.tbl.Apply(ctx, row, mut); err != nil {
+		return err
+	}
+	return s.deleteChunks(ctx, row, m)
+}
+
+// Reader streams a blob one chunk at a time and checks its size and
+// checksum at the end.
+type Reader struct {
+	s    *Store
+	ctx  context.Context
+	row  string
+	m    Manifest
+	seq  int
+	buf  []byte
+	read int64
+	hash hash.Hash
+}
+
+// Open returns a reader of a blob.
+func (s *Store) Open(ctx context.Context, row, name string) (*Reader, error) {
+	m, err := s.Stat(ctx, row, name)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{s: s, ctx: ctx, row: row, m: m, hash: sha256.New()}, nil
+}
+
+// Manifest returns the manifest of the blob.
+func (r *Reader) Manifest() Manifest {
+	return r.m
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.seq == r.m.Chunks {
+			if r.read != r.m.Size {
+				return 0, fmt.Errorf("blob: %s has %d bytes, manifest says %d", r.m.Name, r.read, r.m.Size)
+			}
+			if sum := hex.EncodeToString(r.hash.Sum(nil)); sum != r.m.SHA256 {
+				return 0, fmt.Errorf("blob: %s checksum mismatch", r.m.Name)
+			}
+			return 0, io.EOF
+		}
+		if err := r.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+func (r *Reader) next() error {
+	qual := chunkQualifier(r.m.Name, r.m.Version, r.seq)
+	key := r.row
+	if r.m.Layout == Rows {
+		key += chunkRows + qual
+	}
+	row, err := r.s.tbl.ReadRow(r.ctx, key, bigtable.RowFilter(r.s.column(qual)))
+	if err != nil {
+		return err
+	}
+	items := row[r.s.opts.Family]
+	if len(items) == 0 {
+		return fmt.Errorf("blob: %s is missing chunk %d", r.m.Name, r.seq)
+	}
+	r.seq++
+	r.buf = items[0].Value
+	r.read += int64(len(r.buf))
+	r.hash.Write(r.buf)
+	return nil
+}
+
+// Close releases nothing, it makes Reader an io.ReadCloser.
+func (r *Reader) Close() error {
+	return nil
+}
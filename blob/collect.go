@@ -0,0 +1,185 @@
+package blob
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"time"
+
+	"bigworkshop/pager"
+	"cloud.google.com/go/bigtable"
+)
+
+// CollectOptions limit a collection.
+type CollectOptions struct {
+	// Prefix limits the scan to rows with this prefix, the whole table if
+	// empty.
+	Prefix string
+	// MinAge spares chunks younger than this, they may belong to a write
+	// in progress and it has to exceed the longest write; an hour if zero.
+	MinAge time.Duration
+	// Batch is the number of rows read per request, 500 if zero.
+	Batch int
+	// DryRun only counts the orphans.
+	DryRun bool
+}
+
+// CollectReport counts the rows and chunks of a collection.
+type CollectReport struct {
+	Rows, Chunks int64
+	// Orphans are chunks no manifest refers to.
+	Orphans int64
+}
+
+// Collect deletes chunks whose version is not the one of their blob's
+// manifest. The manifests of a chunk row are read from its blob's row, the
+// row its key names, from the scan if the page has it or else by a point
+// read, so rows sorting between a blob's row and its chunk rows do not
+// matter.
+func (s *Store) Collect(ctx context.Context, opts CollectOptions) (CollectReport, error) {
+	var rep CollectReport
+	if opts.MinAge <= 0 {
+		opts.MinAge = time.Hour
+	}
+	if opts.Batch <= 0 {
+		opts.Batch = 500
+	}
+	cutoff := bigtable.Time(time.Now().Add(-opts.MinAge))
+	family := bigtable.FamilyFilter("^" + regexp.QuoteMeta(s.opts.Family) + "$")
+	filter := bigtable.ChainFilters(family, bigtable.InterleaveFilters(
+		s.manifests(),
+		bigtable.ChainFilters(bigtable.ColumnFilter(".*/.*"), bigtable.LatestNFilter(1), bigtable.StripValueFilter()),
+	))
+
+	after := ""
+	for {
+		var keys []string
+		var muts []*bigtable.Mutation
+		collect := func(r bigtable.Row, live map[string]string) {
+			chunks, orphans := s.orphans(r, live, cutoff)
+			rep.Chunks += chunks
+			rep.Orphans += int64(len(orphans))
+			if len(orphans) == 0 || opts.DryRun {
+				return
+			}
+			m := bigtable.NewMutation()
+			if _, isChunkRow := chunkOwner(r.Key()); isChunkRow {
+				m.DeleteRow()
+			} else {
+				for _, q := range orphans {
+					m.DeleteCellsInColumn(s.opts.Family, q)
+				}
+			}
+			keys, muts = append(keys, r.Key()), append(muts, m)
+		}
+
+		// live versions of the manifests of the rows of this page, by row
+		// and name
+		live := map[string]map[string]string{}
+		var pending []bigtable.Row
+		var perr error
+		n := 0
+		err := s.tbl.ReadRows(ctx, pager.ResumeRange(opts.Prefix, "", "", after), func(r bigtable.Row) bool {
+			n++
+			after = r.Key()
+			rep.Rows++
+			if _, isChunkRow := chunkOwner(r.Key()); isChunkRow {
+				pending = append(pending, r)
+				return true
+			}
+			if live[r.Key()], perr = s.rowManifests(r); perr != nil {
+				return false
+			}
+			collect(r, live[r.Key()])
+			return true
+		}, bigtable.RowFilter(filter), bigtable.LimitRows(int64(opts.Batch)))
+		if err == nil {
+			err = perr
+		}
+		if err != nil {
+			return rep, err
+		}
+
+		var owners bigtable.RowList
+		for _, r := range pending {
+			if owner, _ := chunkOwner(r.Key()); live[owner] == nil {
+				live[owner] = map[string]string{}
+				owners = append(owners, owner)
+			}
+		}
+		if len(owners) > 0 {
+			err := s.tbl.ReadRows(ctx, owners, func(r bigtable.Row) bool {
+				live[r.Key()], perr = s.rowManifests(r)
+				return perr == nil
+			}, bigtable.RowFilter(s.manifests()))
+			if err == nil {
+				err = perr
+			}
+			if err != nil {
+				return rep, err
+			}
+		}
+		for _, r := range pending {
+			owner, _ := chunkOwner(r.Key())
+			collect(r, live[owner])
+		}
+
+		if err := applyBulk(ctx, s.tbl, keys, muts); err != nil {
+			return rep, err
+		}
+		if n < opts.Batch {
+			return rep, nil
+		}
+	}
+}
+
+// chunkOwner returns the row of the blob of a chunk row, false for other
+// rows. Names and versions have no NUL, so the last separator is the one
+// Put wrote even if the row of the blob has one.
+func chunkOwner(key string) (string, bool) {
+	i := strings.LastIndex(key, chunkRows)
+	if i < 0 {
+		return "", false
+	}
+	if _, _, ok := parseChunk(key[i+len(chunkRows):]); !ok {
+		return "", false
+	}
+	return key[:i], true
+}
+
+// rowManifests returns the versions of the manifests of r by name.
+func (s *Store) rowManifests(r bigtable.Row) (map[string]string, error) {
+	live := map[string]string{}
+	for _, it := range r[s.opts.Family] {
+		qual := strings.TrimPrefix(it.Column, s.opts.Family+":")
+		if _, _, ok := parseChunk(qual); ok {
+			continue
+		}
+		m, err := s.parseManifest(it)
+		if err != nil {
+			return nil, err
+		}
+		live[m.Name] = m.Version
+	}
+	return live, nil
+}
+
+// orphans counts the chunks of r and returns the qualifiers of those older
+// than cutoff whose version is not live.
+func (s *Store) orphans(r bigtable.Row, live map[string]string, cutoff bigtable.Timestamp) (int64, []string) {
+	var chunks int64
+	var orphans []string
+	for _, it := range r[s.opts.Family] {
+		qual := strings.TrimPrefix(it.Column, s.opts.Family+":")
+		name, version, ok := parseChunk(qual)
+		if !ok {
+			continue
+		}
+		chunks++
+		if live[name] == version || it.Timestamp > cutoff {
+			continue
+		}
+		orphans = append(orphans, qual)
+	}
+	return chunks, orphans
+}
@@ -0,0 +1,140 @@
+package blob
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"bigworkshop/table/tabletest"
+	"cloud.google.com/go/bigtable"
+)
+
+func put(t *testing.T, s *Store, row, name, value string) {
+	t.Helper()
+	if err := s.Put(context.Background(), row, name, strings.NewReader(value), int64(len(value))); err != nil {
+		t.Fatalf("put %q %s: %v", row, name, err)
+	}
+}
+
+func get(t *testing.T, s *Store, row, name string) string {
+	t.Helper()
+	r, err := s.Open(context.Background(), row, name)
+	if err != nil {
+		t.Fatalf("open %q %s: %v", row, name, err)
+	}
+	defer r.Close()
+	var b bytes.Buffer
+	if _, err := io.Copy(&b, r); err != nil {
+		t.Fatalf("read %q %s: %v", row, name, err)
+	}
+	return b.String()
+}
+
+func setChunk(t *testing.T, tbl *bigtable.Table, key, qual string) {
+	t.Helper()
+	m := bigtable.NewMutation()
+	m.Set("blob", qual, bigtable.Now(), []byte("x"))
+	if err := tbl.Apply(context.Background(), key, m); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollect(t *testing.T) {
+	for _, batch := range []int{1, 2, 500} {
+		srv := tabletest.Start(t)
+		tbl := srv.Table(t, "docs", "blob")
+		s := New(tbl, Options{ChunkSize: 4, AtomicBytes: 8, RowBytes: 16})
+
+		big := strings.Repeat("0123456789", 3)
+		put(t, s, "doc:1", "pdf", big)
+		// sorts between doc:1 and the chunk rows of its pdf
+		put(t, s, "doc:1\x00a", "txt", "small")
+		put(t, s, "doc:1\x00blob\x00x", "pdf", big)
+		put(t, s, "doc:2", "txt", "0123456789")
+
+		setChunk(t, tbl, "doc:1"+chunkRows+"pdf/old/00000000", "pdf/old/00000000")
+		setChunk(t, tbl, "doc:1\x00a"+chunkRows+"txt/old/00000000", "txt/old/00000000")
+		setChunk(t, tbl, "doc:3"+chunkRows+"pdf/old/00000000", "pdf/old/00000000")
+		setChunk(t, tbl, "doc:2", "txt/old/00000000")
+		time.Sleep(10 * time.Millisecond)
+
+		ctx := context.Background()
+		rep, err := s.Collect(ctx, CollectOptions{MinAge: time.Millisecond, Batch: batch, DryRun: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Orphans != 4 {
+			t.Errorf("batch %d: dry run found %d orphans, want 4", batch, rep.Orphans)
+		}
+		rep, err = s.Collect(ctx, CollectOptions{MinAge: time.Millisecond, Batch: batch})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Orphans != 4 {
+			t.Errorf("batch %d: collected %d orphans, want 4", batch, rep.Orphans)
+		}
+		for _, key := range tabletest.Keys(t, tbl) {
+			if strings.Contains(key, "/old/") {
+				t.Errorf("batch %d: orphan row %q is left", batch, key)
+			}
+		}
+		r, err := tbl.ReadRow(ctx, "doc:2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, it := range r["blob"] {
+			if strings.Contains(it.Column, "/old/") {
+				t.Errorf("batch %d: orphan cell %s of doc:2 is left", batch, it.Column)
+			}
+		}
+
+		if got := get(t, s, "doc:1", "pdf"); got != big {
+			t.Errorf("batch %d: doc:1 pdf = %q, want %q", batch, got, big)
+		}
+		if got := get(t, s, "doc:1\x00a", "txt"); got != "small" {
+			t.Errorf("batch %d: doc:1\\x00a txt = %q", batch, got)
+		}
+		if got := get(t, s, "doc:1\x00blob\x00x", "pdf"); got != big {
+			t.Errorf("batch %d: doc:1\\x00blob\\x00x pdf = %q", batch, got)
+		}
+		if got := get(t, s, "doc:2", "txt"); got != "0123456789" {
+			t.Errorf("batch %d: doc:2 txt = %q", batch, got)
+		}
+	}
+}
+
+func TestCollectSparesYoungChunks(t *testing.T) {
+	srv := tabletest.Start(t)
+	tbl := srv.Table(t, "docs", "blob")
+	s := New(tbl, Options{})
+	setChunk(t, tbl, "doc:1"+chunkRows+"pdf/new/00000000", "pdf/new/00000000")
+
+	rep, err := s.Collect(context.Background(), CollectOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Chunks != 1 || rep.Orphans != 0 {
+		t.Errorf("report %+v, want 1 chunk and no orphans", rep)
+	}
+}
+
+func TestChunkOwner(t *testing.T) {
+	for _, tc := range []struct {
+		key, owner string
+		ok         bool
+	}{
+		{"doc:1", "", false},
+		{"doc:1\x00a", "", false},
+		{"doc:1" + chunkRows + "pdf/v/00000001", "doc:1", true},
+		{"doc:1" + chunkRows + "x" + chunkRows + "pdf/v/00000001", "doc:1" + chunkRows + "x", true},
+		{"doc:1" + chunkRows + "pdf", "", false},
+	} {
+		owner, ok := chunkOwner(tc.key)
+		if owner != tc.owner || ok != tc.ok {
+			t.Errorf("chunkOwner(%q) = %q, %v, want %q, %v", tc.key, owner, ok, tc.owner, tc.ok)
+		}
+	}
+}
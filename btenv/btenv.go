@@ -0,0 +1,129 @@
+// Package btenv holds the client setup shared by the workshop tools.
+//
+// It is the same setup as connect/main.go: project "test", instance "test"
+// and an emulator picked up from BIGTABLE_EMULATOR_HOST. The emulator can
+// also be given explicitly so that a tool can talk to two different targets
+// at the same time.
+package btenv
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"cloud.google.com/go/bigtable"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// EmulatorHostEnv is the env variable the bigtable client reads the emulator address from.
+const EmulatorHostEnv = "BIGTABLE_EMULATOR_HOST"
+
+// Config describes which bigtable instance to connect to.
+type Config struct {
+	Project  string
+	Instance string
+	// Emulator is the host:port of a bigtable emulator, if empty the
+	// client falls back to BIGTABLE_EMULATOR_HOST and then to production.
+	Emulator string
+	// DialOptions are added when dialing, e.g. interceptors.
+	DialOptions []grpc.DialOption
+}
+
+// Default returns the configuration used throughout the exercises.
+func Default() Config {
+	return Config{
+		Project:  "test",
+		Instance: "test",
+		Emulator: os.Getenv(EmulatorHostEnv),
+	}
+}
+
+// RegisterFlags registers -project, -instance and -emulator on fs. The prefix
+// is prepended to every flag name so that a command can take several targets,
+// e.g. -src-project and -dst-project.
+func (c *Config) RegisterFlags(fs *flag.FlagSet, prefix string) {
+	fs.StringVar(&c.Project, prefix+"project", c.Project, "bigtable project")
+	fs.StringVar(&c.Instance, prefix+"instance", c.Instance, "bigtable instance")
+	fs.StringVar(&c.Emulator, prefix+"emulator", c.Emulator, "emulator host:port (defaults to $"+EmulatorHostEnv+")")
+}
+
+func (c Config) options() ([]option.ClientOption, error) {
+	if c.Emulator == "" {
+		logrus.Warnf("%s not set, connecting to production bigtable", EmulatorHostEnv)
+		var opts []option.ClientOption
+		for _, o := range c.DialOptions {
+			opts = append(opts, option.WithGRPCDialOption(o))
+		}
+		return opts, nil
+	}
+
+	opts := append([]grpc.DialOption{grpc.WithInsecure()}, c.DialOptions...)
+	conn, err := grpc.Dial(c.Emulator, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("dialing emulator %s: %w", c.Emulator, err)
+	}
+	return []option.ClientOption{option.WithGRPCConn(conn)}, nil
+}
+
+// NewClient sets up a bigtable data operations client.
+func (c Config) NewClient(ctx context.Context) (*bigtable.Client, error) {
+	opts, err := c.options()
+	if err != nil {
+		return nil, err
+	}
+	client, err := bigtable.NewClient(ctx, c.Project, c.Instance, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create data operations client: %w", err)
+	}
+	return client, nil
+}
+
+// NewAdminClient sets up a bigtable admin client to manage tables and column families.
+func (c Config) NewAdminClient(ctx context.Context) (*bigtable.AdminClient, error) {
+	opts, err := c.options()
+	if err != nil {
+		return nil, err
+	}
+	admin, err := bigtable.NewAdminClient(ctx, c.Project, c.Instance, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("could not create admin client: %w", err)
+	}
+	return admin, nil
+}
+
+// Clients bundles a data and an admin client for the same instance.
+type Clients struct {
+	Data  *bigtable.Client
+	Admin *bigtable.AdminClient
+}
+
+// Dial creates both the data and the admin client.
+func (c Config) Dial(ctx context.Context) (*Clients, error) {
+	logrus.Infof("%s: %v", EmulatorHostEnv, c.Emulator)
+
+	data, err := c.NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	admin, err := c.NewAdminClient(ctx)
+	if err != nil {
+		data.Close()
+		return nil, err
+	}
+	return &Clients{Data: data, Admin: admin}, nil
+}
+
+// Close closes both clients.
+func (cs *Clients) Close() error {
+	errAdmin := cs.Admin.Close()
+	if err := cs.Data.Close(); err != nil {
+		return fmt.Errorf("could not close data operations client: %w", err)
+	}
+	if errAdmin != nil {
+		return fmt.Errorf("could not close admin client: %w", errAdmin)
+	}
+	return nil
+}
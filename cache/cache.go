@@ -0,0 +1,358 @@
+// Package cache puts a read-through cache in front of ReadRow.
+//
+// Rows are kept in an LRU bounded by entries and bytes, each for at most a
+// TTL. Concurrent reads of the same row share one rpc. The read options are
+// part of the cache key, so a read with a filter never gets the row cached
+// for another filter; reads with options the cache cannot tell apart are
+// not cached. Mutations through the same Table invalidate every
+// cached variant of their row, mutations by other clients are only seen
+// once the TTL expires.
+//
+//	tbl := cache.Wrap(client.Open("tokens"), "tokens", cache.Options{TTL: time.Minute})
+//
+// Cached rows are shared, callers must not modify the values they read.
+package cache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bigworkshop/table"
+	"bigworkshop/telemetry"
+	"cloud.google.com/go/bigtable"
+	"google.golang.org/protobuf/proto"
+)
+
+// Options configure the cache.
+type Options struct {
+	// MaxEntries bounds the cached reads, 10000 if zero.
+	MaxEntries int
+	// MaxBytes bounds the size of the cached rows, 64MiB if zero.
+	MaxBytes int
+	// TTL is how long a row is served from the cache, a minute if zero.
+	TTL time.Duration
+	// Metrics receives hits, misses, evictions and invalidations.
+	Metrics *Metrics
+}
+
+// Metrics are the cache counters in a telemetry registry, shared by all
+// caches and labeled with the table.
+type Metrics struct {
+	hits, misses, evictions, invalidations *telemetry.Counter
+}
+
+// NewMetrics registers the cache counters in r.
+func NewMetrics(r *telemetry.Registry) *Metrics {
+	return &Metrics{
+		hits:          r.Counter("bigtable_cache_hits_total", "ReadRow calls served from the cache.", "table"),
+		misses:        r.Counter("bigtable_cache_misses_total", "ReadRow calls read from bigtable.", "table"),
+		evictions:     r.Counter("bigtable_cache_evictions_total", "Cached rows evicted for space or expired.", "table"),
+		invalidations: r.Counter("bigtable_cache_invalidations_total", "Cached rows dropped by mutations.", "table"),
+	}
+}
+
+// Stats are the counters of one cache.
+type Stats struct {
+	Hits          int64
+	Misses        int64
+	Evictions     int64
+	Invalidations int64
+	Entries       int
+	Bytes         int
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d hits, %d misses, %d evictions, %d invalidations, %d entries, %d bytes",
+		s.Hits, s.Misses, s.Evictions, s.Invalidations, s.Entries, s.Bytes)
+}
+
+// Table is a table.Table with a cache in front of ReadRow.
+type Table struct {
+	tbl  table.Table
+	name string
+	opts Options
+
+	mu    sync.Mutex
+	lru   *list.List
+	rows  map[string]map[string]*list.Element // row key, read options
+	calls map[string]*call
+	// reads in flight per row and the invalidations they missed, so that
+	// a read racing a mutation does not cache the old row
+	reading map[string]int
+	gen     map[string]uint64
+	stats   Stats
+}
+
+var _ table.Table = (*Table)(nil)
+
+type entry struct {
+	row     string
+	opts    string
+	value   bigtable.Row
+	size    int
+	expires time.Time
+}
+
+// call is a read in flight that other readers of the same key wait for.
+type call struct {
+	done chan struct{}
+	row  bigtable.Row
+	err  error
+}
+
+// Wrap caches reads of tbl, name labels the metrics.
+func Wrap(tbl table.Table, name string, opts Options) *Table {
+	if opts.MaxEntries <= 0 {
+		opts.MaxEntries = 10000
+	}
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 64 << 20
+	}
+	if opts.TTL <= 0 {
+		opts.TTL = time.Minute
+	}
+	return &Table{
+		tbl:     tbl,
+		name:    name,
+		opts:    opts,
+		lru:     list.New(),
+		rows:    map[string]map[string]*list.Element{},
+		calls:   map[string]*call{},
+		reading: map[string]int{},
+		gen:     map[string]uint64{},
+	}
+}
+
+// Stats returns the counters of the cache.
+func (t *Table) Stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := t.stats
+	s.Entries = t.lru.Len()
+	return s
+}
+
+var limitRowsType = reflect.TypeOf(bigtable.LimitRows(0))
+
+// optsKey identifies the read options by the serialized proto of their
+// filter and their limit. Options it cannot serialize are not cached, false.
+func optsKey(opts []bigtable.ReadOption) (string, bool) {
+	f, rest := table.SplitFilter(opts)
+	var parts []string
+	if f != nil {
+		p, ok := table.FilterProto(f)
+		if !ok {
+			return "", false
+		}
+		b, err := proto.MarshalOptions{Deterministic: true}.Marshal(p)
+		if err != nil {
+			return "", false
+		}
+		parts = append(parts, string(b))
+	}
+	for _, o := range rest {
+		v := reflect.ValueOf(o)
+		if v.Type() != limitRowsType {
+			return "", false
+		}
+		parts = append(parts, "limit="+strconv.FormatInt(v.Field(0).Int(), 10))
+	}
+	return strings.Join(parts, "\x00"), true
+}
+
+func rowSize(r bigtable.Row) int {
+	n := 0
+	for fam, items := range r {
+		n += len(fam)
+		for _, it := range items {
+			n += len(it.Row) + len(it.Column) + len(it.Value) + 8
+		}
+	}
+	return n
+}
+
+// copyRow copies the map and item slices of r, the values are shared.
+func copyRow(r bigtable.Row) bigtable.Row {
+	if r == nil {
+		return nil
+	}
+	c := make(bigtable.Row, len(r))
+	for fam, items := range r {
+		c[fam] = append([]bigtable.ReadItem(nil), items...)
+	}
+	return c
+}
+
+func (t *Table) count(c func(m *Metrics) *telemetry.Counter, n int) {
+	if t.opts.Metrics != nil && n > 0 {
+		c(t.opts.Metrics).Add(float64(n), t.name)
+	}
+}
+
+// lookup returns a fresh cached row, t.mu must be held.
+func (t *Table) lookup(row, opts string) (bigtable.Row, bool) {
+	el, ok := t.rows[row][opts]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*entry)
+	if time.Now().After(e.expires) {
+		t.remove(el)
+		t.stats.Evictions++
+		t.count(func(m *Metrics) *telemetry.Counter { return m.evictions }, 1)
+		return nil, false
+	}
+	t.lru.MoveToFront(el)
+	return e.value, true
+}
+
+// remove drops an entry, t.mu must be held.
+func (t *Table) remove(el *list.Element) {
+	e := t.lru.Remove(el).(*entry)
+	t.stats.Bytes -= e.size
+	if variants := t.rows[e.row]; variants != nil {
+		delete(variants, e.opts)
+		if len(variants) == 0 {
+			delete(t.rows, e.row)
+		}
+	}
+}
+
+// store caches a row unless it was invalidated since gen, t.mu must be held.
+func (t *Table) store(row, opts string, gen uint64, value bigtable.Row) {
+	if t.gen[row] != gen {
+		return
+	}
+	size := rowSize(value) + len(row) + len(opts)
+	if size > t.opts.MaxBytes {
+		return
+	}
+	if el, ok := t.rows[row][opts]; ok {
+		t.remove(el)
+	}
+	e := &entry{row: row, opts: opts, value: value, size: size, expires: time.Now().Add(t.opts.TTL)}
+	if t.rows[row] == nil {
+		t.rows[row] = map[string]*list.Element{}
+	}
+	t.rows[row][opts] = t.lru.PushFront(e)
+	t.stats.Bytes += size
+
+	evicted := 0
+	for t.lru.Len() > t.opts.MaxEntries || t.stats.Bytes > t.opts.MaxBytes {
+		t.remove(t.lru.Back())
+		evicted++
+	}
+	t.stats.Evictions += int64(evicted)
+	t.count(func(m *Metrics) *telemetry.Counter { return m.evictions }, evicted)
+}
+
+// Invalidate drops every cached read of the rows.
+func (t *Table) Invalidate(rows ...string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	dropped := 0
+	for _, row := range rows {
+		if t.reading[row] > 0 {
+			t.gen[row]++
+		}
+		for _, el := range t.rows[row] {
+			t.remove(el)
+			dropped++
+		}
+	}
+	t.stats.Invalidations += int64(dropped)
+	t.count(func(m *Metrics) *telemetry.Counter { return m.invalidations }, dropped)
+}
+
+// ReadRow serves row from the cache or reads it, concurrent reads of the
+// same row and options share one read. Missing rows are cached as well.
+func (t *Table) ReadRow(ctx context.Context, row string, opts ...bigtable.ReadOption) (bigtable.Row, error) {
+	variant, ok := optsKey(opts)
+	if !ok {
+		return t.tbl.ReadRow(ctx, row, opts...)
+	}
+	key := row + "\x00" + variant
+
+	t.mu.Lock()
+	if r, hit := t.lookup(row, variant); hit {
+		t.stats.Hits++
+		t.mu.Unlock()
+		t.count(func(m *Metrics) *telemetry.Counter { return m.hits }, 1)
+		return copyRow(r), nil
+	}
+	t.stats.Misses++
+	t.count(func(m *Metrics) *telemetry.Counter { return m.misses }, 1)
+	if c, inflight := t.calls[key]; inflight {
+		t.mu.Unlock()
+		select {
+		case <-c.done:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if c.err != nil && isContextErr(c.err) && ctx.Err() == nil {
+			// the reader we waited for gave up, not our problem
+			return t.tbl.ReadRow(ctx, row, opts...)
+		}
+		return copyRow(c.row), c.err
+	}
+	c := &call{done: make(chan struct{})}
+	t.calls[key] = c
+	t.reading[row]++
+	gen := t.gen[row]
+	t.mu.Unlock()
+
+	c.row, c.err = t.tbl.ReadRow(ctx, row, opts...)
+
+	t.mu.Lock()
+	delete(t.calls, key)
+	if c.err == nil {
+		t.store(row, variant, gen, c.row)
+	}
+	if t.reading[row]--; t.reading[row] == 0 {
+		delete(t.reading, row)
+		delete(t.gen, row)
+	}
+	t.mu.Unlock()
+	close(c.done)
+	return copyRow(c.row), c.err
+}
+
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// ReadRows is not cached.
+func (t *Table) ReadRows(ctx context.Context, arg bigtable.RowSet, f func(bigtable.Row) bool, opts ...bigtable.ReadOption) error {
+	return t.tbl.ReadRows(ctx, arg, f, opts...)
+}
+
+// Apply invalidates the row, before and after the write so that no read
+// started in between caches the old row.
+func (t *Table) Apply(ctx context.Context, row string, m *bigtable.Mutation, opts ...bigtable.ApplyOption) error {
+	t.Invalidate(row)
+	defer t.Invalidate(row)
+	return t.tbl.Apply(ctx, row, m, opts...)
+}
+
+func (t *Table) ApplyBulk(ctx context.Context, rowKeys []string, muts []*bigtable.Mutation, opts ...bigtable.ApplyOption) ([]error, error) {
+	t.Invalidate(rowKeys...)
+	defer t.Invalidate(rowKeys...)
+	return t.tbl.ApplyBulk(ctx, rowKeys, muts, opts...)
+}
+
+func (t *Table) ApplyReadModifyWrite(ctx context.Context, row string, m *bigtable.ReadModifyWrite) (bigtable.Row, error) {
+	t.Invalidate(row)
+	defer t.Invalidate(row)
+	return t.tbl.ApplyReadModifyWrite(ctx, row, m)
+}
+
+func (t *Table) SampleRowKeys(ctx context.Context) ([]string, error) {
+	return t.tbl.SampleRowKeys(ctx)
+}
@@ -0,0 +1,215 @@
+// Package cellfmt turns bigtable rows into readable output: values are decoded
+// as text, hex, big-endian int64 (what ReadModifyWrite Increment writes) or
+// JSON and cells are printed as an aligned table.
+package cellfmt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"unicode"
+	"unicode/utf8"
+
+	"cloud.google.com/go/bigtable"
+)
+
+// Decoding selects how cell values are shown.
+type Decoding string
+
+const (
+	// Auto shows printable values as text, 8 byte values as int64 and the rest as hex.
+	Auto  Decoding = "auto"
+	UTF8  Decoding = "utf8"
+	Hex   Decoding = "hex"
+	Int64 Decoding = "int64"
+	JSON  Decoding = "json"
+)
+
+// Decodings lists every supported decoding.
+func Decodings() []Decoding {
+	return []Decoding{Auto, UTF8, Hex, Int64, JSON}
+}
+
+// ParseDecoding validates a decoding name.
+func ParseDecoding(s string) (Decoding, error) {
+	for _, d := range Decodings() {
+		if string(d) == s {
+			return d, nil
+		}
+	}
+	return "", fmt.Errorf("unknown decoding %q, use one of %v", s, Decodings())
+}
+
+// Decode renders v on a single line.
+func Decode(d Decoding, v []byte) string {
+	switch d {
+	case UTF8:
+		return escape(string(v))
+	case Hex:
+		return hex.EncodeToString(v)
+	case Int64:
+		if len(v) != 8 {
+			return fmt.Sprintf("<%d bytes, not an int64> %s", len(v), hex.EncodeToString(v))
+		}
+		return strconv.FormatInt(int64(binary.BigEndian.Uint64(v)), 10)
+	case JSON:
+		var buf bytes.Buffer
+		if err := json.Compact(&buf, v); err != nil {
+			return "<invalid json> " + escape(string(v))
+		}
+		return buf.String()
+	}
+
+	switch Detect(v) {
+	case UTF8:
+		return string(v)
+	case Int64:
+		return Decode(Int64, v)
+	}
+	return "0x" + hex.EncodeToString(v)
+}
+
+// Detect returns the decoding Auto picks for v: UTF8, Int64 or Hex.
+func Detect(v []byte) Decoding {
+	switch {
+	case isPrintable(v):
+		return UTF8
+	case len(v) == 8:
+		return Int64
+	}
+	return Hex
+}
+
+// DecodeIndent renders v for a detail view, JSON is indented.
+func DecodeIndent(d Decoding, v []byte) string {
+	if d != JSON {
+		return Decode(d, v)
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, v, "", "  "); err != nil {
+		return "<invalid json> " + escape(string(v))
+	}
+	return buf.String()
+}
+
+func isPrintable(v []byte) bool {
+	if !utf8.Valid(v) {
+		return false
+	}
+	for _, r := range string(v) {
+		if !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// escape keeps control characters from breaking the table layout.
+func escape(s string) string {
+	if isPrintable([]byte(s)) {
+		return s
+	}
+	q := strconv.Quote(s)
+	return q[1 : len(q)-1]
+}
+
+// Cell is a single flattened cell of a row.
+type Cell struct {
+	Row       string
+	Family    string
+	Qualifier string
+	Timestamp bigtable.Timestamp
+	Value     []byte
+	Labels    []string
+}
+
+// Column returns family:qualifier.
+func (c Cell) Column() string {
+	return c.Family + ":" + c.Qualifier
+}
+
+// Cells flattens a row into its cells ordered by family, qualifier and newest version first.
+func Cells(row bigtable.Row) []Cell {
+	var cells []Cell
+	for fam, items := range row {
+		for _, item := range items {
+			cells = append(cells, Cell{
+				Row:       item.Row,
+				Family:    fam,
+				Qualifier: strings.TrimPrefix(item.Column, fam+":"),
+				Timestamp: item.Timestamp,
+				Value:     item.Value,
+				Labels:    item.Labels,
+			})
+		}
+	}
+	sort.SliceStable(cells, func(i, j int) bool {
+		if cells[i].Family != cells[j].Family {
+			return cells[i].Family < cells[j].Family
+		}
+		if cells[i].Qualifier != cells[j].Qualifier {
+			return cells[i].Qualifier < cells[j].Qualifier
+		}
+		return cells[i].Timestamp > cells[j].Timestamp
+	})
+	return cells
+}
+
+// FormatTimestamp prints a cell timestamp in UTC with microsecond precision.
+func FormatTimestamp(ts bigtable.Timestamp) string {
+	return ts.Time().UTC().Format("2006-01-02 15:04:05.000000")
+}
+
+// WriteRows prints rows as a table with one line per cell. The row key is
+// only printed on the first line of each row.
+func WriteRows(w io.Writer, rows []bigtable.Row, d Decoding) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ROW\tCOLUMN\tTIMESTAMP\tVALUE")
+	for _, row := range rows {
+		key := escape(row.Key())
+		cells := Cells(row)
+		if len(cells) == 0 {
+			fmt.Fprintf(tw, "%s\t\t\t\n", key)
+		}
+		for i, c := range cells {
+			if i > 0 {
+				key = ""
+			}
+			value := Decode(d, c.Value)
+			if len(c.Labels) > 0 {
+				value += fmt.Sprintf(" %v", c.Labels)
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", key, escape(c.Column()), FormatTimestamp(c.Timestamp), value)
+		}
+	}
+	return tw.Flush()
+}
+
+// Encode is the reverse of Decode, it turns user input into a value.
+// Auto and UTF8 take the input as is, use Detect to encode like an existing value.
+func Encode(d Decoding, s string) ([]byte, error) {
+	switch d {
+	case Hex:
+		return hex.DecodeString(strings.TrimPrefix(s, "0x"))
+	case Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		v := make([]byte, 8)
+		binary.BigEndian.PutUint64(v, uint64(n))
+		return v, nil
+	case JSON:
+		if !json.Valid([]byte(s)) {
+			return nil, fmt.Errorf("invalid json")
+		}
+	}
+	return []byte(s), nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"bigworkshop/btenv"
+	"bigworkshop/valuecodec"
+)
+
+var analyzeCmd = &command{
+	name:  "analyze",
+	usage: "-table t [-prefix p] [-limit rows] [-codecs gzip,snappy,zstd] [-threshold n]",
+	help:  "samples a table and reports per family how well its values are compressed and would be with each codec, see gateway -compress",
+}
+
+func init() {
+	analyzeCmd.run = runAnalyze
+	register(analyzeCmd)
+}
+
+func runAnalyze(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(analyzeCmd)
+	tableName := fs.String("table", "", "table to analyze")
+	prefix := fs.String("prefix", "", "only rows with this prefix")
+	limit := fs.Int64("limit", 10000, "rows sampled, 0 for all")
+	codecs := fs.String("codecs", strings.Join(valuecodec.Codecs(), ","), "codecs to try")
+	threshold := fs.Int("threshold", valuecodec.DefaultThreshold, "values from this size are compressed by the tried codecs")
+	fs.Parse(args)
+
+	if *tableName == "" || fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	opts := valuecodec.AnalyzeOptions{Prefix: *prefix, Limit: *limit, Threshold: *threshold}
+	for _, name := range strings.Split(*codecs, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		c, err := valuecodec.Lookup(name)
+		if err != nil {
+			return err
+		}
+		opts.Codecs = append(opts.Codecs, c)
+	}
+
+	clients, err := cfg.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer clients.Close()
+	stats, err := valuecodec.Analyze(ctx, clients.Data.Open(*tableName), opts)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprint(tw, "FAMILY\tCELLS\tCOMPRESSED\tRAW\tSTORED\tRATIO")
+	for _, c := range opts.Codecs {
+		fmt.Fprintf(tw, "\t%s", strings.ToUpper(c.Name()))
+	}
+	fmt.Fprintln(tw)
+	row := func(s valuecodec.FamilyStats) {
+		fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%d\t%.2f", s.Family, s.Cells, s.Compressed, s.Raw, s.Stored, s.Ratio())
+		for _, c := range opts.Codecs {
+			fmt.Fprintf(tw, "\t%.2f", s.TrialRatio(c.Name()))
+		}
+		fmt.Fprintln(tw)
+	}
+	total := valuecodec.FamilyStats{Family: "(all)", Trial: map[string]int64{}}
+	for _, s := range stats {
+		row(s)
+		total.Cells += s.Cells
+		total.Compressed += s.Compressed
+		total.Raw += s.Raw
+		total.Stored += s.Stored
+		for name, n := range s.Trial {
+			total.Trial[name] += n
+		}
+	}
+	if len(stats) > 1 {
+		row(total)
+	}
+	return tw.Flush()
+}
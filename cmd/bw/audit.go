@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"bigworkshop/audit"
+	"bigworkshop/btenv"
+)
+
+var auditCmd = &command{
+	name:  "audit",
+	usage: "-table t [-family audit] [-audit-table a] [-retention d] (setup | history key)",
+	help:  "sets up the audit family with its retention and lists the recorded changes of a row, see gateway -audit",
+}
+
+func init() {
+	auditCmd.run = runAudit
+	register(auditCmd)
+}
+
+func runAudit(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(auditCmd)
+	tableName := fs.String("table", "", "audited table")
+	family := fs.String("family", "audit", "family of the records")
+	auditTable := fs.String("audit-table", "", "table of the records if they are not kept in the audited rows")
+	retention := fs.Duration("retention", 90*24*time.Hour, "setup gives the family a maxage gc policy of this, 0 keeps records forever")
+	fs.Parse(args)
+
+	if *tableName == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	clients, err := cfg.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer clients.Close()
+	opts := audit.Options{Family: *family}
+	if *auditTable != "" {
+		opts.Table = clients.Data.Open(*auditTable)
+	}
+	tbl := audit.Wrap(clients.Data.Open(*tableName), *tableName, opts)
+
+	switch fs.Arg(0) {
+	case "setup":
+		target := *tableName
+		if *auditTable != "" {
+			target = *auditTable
+		}
+		if err := audit.Setup(ctx, clients.Admin, target, *family, *retention); err != nil {
+			return err
+		}
+		fmt.Printf("records go to %s:%s, kept for %v\n", target, *family, *retention)
+		return nil
+	case "history":
+		if fs.NArg() != 2 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		entries, err := tbl.History(ctx, fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "TIME\tACTOR\tOP\tCOLUMN\tACTION\tVALUE\tPRIOR")
+		for _, e := range entries {
+			when := e.Time.Local().Format("2006-01-02 15:04:05.000")
+			if len(e.Changes) == 0 {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t\t\t\t\n", when, e.Actor, e.Op)
+			}
+			for _, c := range e.Changes {
+				fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", when, e.Actor, e.Op, c.Column, c.Action, c.Value, c.Prior)
+			}
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown audit command %q, use setup or history", fs.Arg(0))
+}
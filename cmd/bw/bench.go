@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"bigworkshop/bench"
+	"bigworkshop/btenv"
+	"bigworkshop/keycodec"
+	"cloud.google.com/go/bigtable/bttest"
+	"github.com/sirupsen/logrus"
+)
+
+var benchCmd = &command{
+	name:  "bench",
+	usage: "[-bttest] [-table bench] [-schemes plain,padded-desc,salted:16] [-keys n] [-dist uniform|zipfian|sequential] [-mix read=80,write=20] [-duration 10s] [-ops n] [-c 8] [-load]",
+	help:  "generates load and reports throughput and latency percentiles, comparing key schemes",
+}
+
+func init() {
+	benchCmd.run = runBench
+	register(benchCmd)
+}
+
+func runBench(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(benchCmd)
+	useBttest := fs.Bool("bttest", false, "run against an in-process bttest server instead of the emulator")
+	tableName := fs.String("table", "bench", "table to run against, created with its family if missing")
+	family := fs.String("family", "fam", "column family written and read")
+	schemes := fs.String("schemes", "plain", "comma separated key schemes to compare: plain, padded, padded-desc, salted:n[:scheme]")
+	prefix := fs.String("prefix", "token:", "prefix of the keys")
+	keys := fs.Uint64("keys", 10000, "number of distinct ids")
+	dist := fs.String("dist", "uniform", "id distribution: uniform, zipfian or sequential")
+	zipfS := fs.Float64("zipf-s", 1.1, "skew of the zipfian distribution, above 1")
+	mixFlag := fs.String("mix", "read=80,write=20", "weights of read, write, scan and rmw")
+	valueSize := fs.Int("value-size", 100, "bytes per written value")
+	scanRows := fs.Int("scan-rows", 100, "rows per scan")
+	concurrency := fs.Int("c", 8, "concurrent workers")
+	duration := fs.Duration("duration", 10*time.Second, "length of each run, 0 to stop after -ops")
+	ops := fs.Int64("ops", 0, "stop each run after this many operations")
+	interval := fs.Duration("interval", time.Second, "report interval")
+	load := fs.Bool("load", true, "write every id before the run, so that reads find rows")
+	drop := fs.Bool("drop", false, "drop all rows of the table before each scheme, always done with -bttest")
+	fs.Parse(args)
+
+	dis, err := bench.ParseDistribution(*dist)
+	if err != nil {
+		return err
+	}
+	mix, err := bench.ParseMix(*mixFlag)
+	if err != nil {
+		return err
+	}
+	var codecs []keycodec.Codec
+	for _, s := range strings.Split(*schemes, ",") {
+		c, err := keycodec.Parse(strings.TrimSpace(s), *prefix)
+		if err != nil {
+			return err
+		}
+		codecs = append(codecs, c)
+	}
+
+	if *useBttest {
+		srv, err := bttest.NewServer("localhost:0")
+		if err != nil {
+			return err
+		}
+		defer srv.Close()
+		cfg.Emulator = srv.Addr
+		*drop = true
+	}
+	clients, err := cfg.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer clients.Close()
+	if err := bench.CreateTable(ctx, clients.Admin, *tableName, *family); err != nil {
+		return err
+	}
+	tbl := clients.Data.Open(*tableName)
+
+	var results []*bench.Result
+	for _, codec := range codecs {
+		w := bench.Workload{
+			Codec:        codec,
+			Keys:         *keys,
+			Distribution: dis,
+			ZipfS:        *zipfS,
+			Mix:          mix,
+			Family:       *family,
+			ValueSize:    *valueSize,
+			ScanRows:     *scanRows,
+			Concurrency:  *concurrency,
+			Duration:     *duration,
+			Ops:          *ops,
+			Interval:     *interval,
+		}
+		if *drop {
+			if err := clients.Admin.DropAllRows(ctx, *tableName); err != nil {
+				return err
+			}
+		}
+		if *load {
+			start := time.Now()
+			if err := bench.Load(ctx, tbl, w); err != nil {
+				return fmt.Errorf("loading %v keys: %w", codec, err)
+			}
+			logrus.Infof("loaded %d rows with %v keys in %v", *keys, codec, time.Since(start).Round(time.Millisecond))
+		}
+
+		fmt.Printf("%v, %v ids, %s, mix %v, %d workers\n", codec, *keys, dis, mix, *concurrency)
+		res, err := bench.Run(ctx, tbl, w, func(iv bench.Interval) { fmt.Println(iv) })
+		if err != nil {
+			return err
+		}
+		if res.FirstError != nil {
+			logrus.WithError(res.FirstError).Warnf("%v: operations failed", codec)
+		}
+		printResult(res)
+		results = append(results, res)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if len(results) > 1 {
+		printComparison(results)
+	}
+	return nil
+}
+
+func printResult(res *bench.Result) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "\nop\tops\tops/s\terrors\tmean\tp50\tp90\tp99\tmax\n")
+	for op := bench.Read; op <= bench.RMW; op++ {
+		s, ok := res.Ops[op]
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(tw, "%v\t%d\t%.0f\t%d\t%v\t%v\t%v\t%v\t%v\n", op, s.Count, float64(s.Count)/res.Duration.Seconds(),
+			s.Errors, s.Mean, s.P50, s.P90, s.P99, s.Max)
+	}
+	tw.Flush()
+	fmt.Printf("the hottest of %d key ranges got %.1f%% of the operations per interval, %.1f%% is even\n\n",
+		len(res.Spread), 100*res.Hottest, 100/float64(len(res.Spread)))
+}
+
+func printComparison(results []*bench.Result) {
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "scheme\tops/s\terrors")
+	for op := bench.Read; op <= bench.RMW; op++ {
+		if _, ok := results[0].Ops[op]; ok {
+			fmt.Fprintf(tw, "\t%v p50\t%v p99", op, op)
+		}
+	}
+	fmt.Fprintf(tw, "\thottest range\n")
+	for _, res := range results {
+		_, errs := res.Count()
+		fmt.Fprintf(tw, "%v\t%.0f\t%d", res.Workload.Codec, res.Throughput(), errs)
+		for op := bench.Read; op <= bench.RMW; op++ {
+			if _, ok := results[0].Ops[op]; ok {
+				s := res.Ops[op]
+				fmt.Fprintf(tw, "\t%v\t%v", s.P50, s.P99)
+			}
+		}
+		fmt.Fprintf(tw, "\t%.1f%%\n", 100*res.Hottest)
+	}
+	tw.Flush()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"bigworkshop/blob"
+	"bigworkshop/btenv"
+)
+
+var blobCmd = &command{
+	name:  "blob",
+	usage: "-table t [-family blob] [-chunk n] (put key name file | get key name [file] | ls key | rm key name | [-prefix p] [-min-age d] [-dry-run] gc)",
+	help:  "stores large values as chunks with a checksummed manifest, reads them back and removes orphaned chunks",
+}
+
+func init() {
+	blobCmd.run = runBlob
+	register(blobCmd)
+}
+
+func runBlob(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(blobCmd)
+	tableName := fs.String("table", "", "table")
+	family := fs.String("family", "blob", "family of manifests and chunks, created by put if missing")
+	chunk := fs.Int("chunk", 1<<20, "chunk size of put")
+	rowBytes := fs.Int64("row-bytes", 64<<20, "put stores the chunks of larger blobs in rows of their own")
+	prefix := fs.String("prefix", "", "gc only rows with this prefix")
+	minAge := fs.Duration("min-age", time.Hour, "gc spares chunks younger than this")
+	dryRun := fs.Bool("dry-run", false, "gc only counts the orphans")
+	fs.Parse(args)
+
+	if *tableName == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	nargs := map[string]int{"put": 4, "get": 3, "ls": 2, "rm": 3, "gc": 1}
+	n, ok := nargs[fs.Arg(0)]
+	if !ok {
+		return fmt.Errorf("unknown blob command %q, use put, get, ls, rm or gc", fs.Arg(0))
+	}
+	// get takes an optional file
+	if fs.NArg() != n && !(fs.Arg(0) == "get" && fs.NArg() == 4) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	clients, err := cfg.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer clients.Close()
+	store := blob.New(clients.Data.Open(*tableName), blob.Options{Family: *family, ChunkSize: *chunk, RowBytes: *rowBytes})
+
+	switch fs.Arg(0) {
+	case "put":
+		f, err := os.Open(fs.Arg(3))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		fi, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		if err := ensureFamily(ctx, clients.Admin, *tableName, *family); err != nil {
+			return err
+		}
+		start := time.Now()
+		if err := store.Put(ctx, fs.Arg(1), fs.Arg(2), f, fi.Size()); err != nil {
+			return err
+		}
+		m, err := store.Stat(ctx, fs.Arg(1), fs.Arg(2))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("stored %d bytes in %d chunks (%s) in %v, sha256 %s\n", m.Size, m.Chunks, m.Layout, time.Since(start).Round(time.Millisecond), m.SHA256)
+		return nil
+	case "get":
+		r, err := store.Open(ctx, fs.Arg(1), fs.Arg(2))
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		var w io.Writer = os.Stdout
+		if fs.NArg() == 4 {
+			f, err := os.Create(fs.Arg(3))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			w = f
+		}
+		_, err = io.Copy(w, r)
+		return err
+	case "ls":
+		ms, err := store.List(ctx, fs.Arg(1))
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "NAME\tSIZE\tCHUNKS\tLAYOUT\tCREATED\tSHA256")
+		for _, m := range ms {
+			fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\n", m.Name, m.Size, m.Chunks, m.Layout, m.Created.Local().Format("2006-01-02 15:04:05"), m.SHA256)
+		}
+		return tw.Flush()
+	case "rm":
+		return store.Delete(ctx, fs.Arg(1), fs.Arg(2))
+	default:
+		rep, err := store.Collect(ctx, blob.CollectOptions{Prefix: *prefix, MinAge: *minAge, DryRun: *dryRun})
+		verb := "deleted"
+		if *dryRun {
+			verb = "would delete"
+		}
+		fmt.Printf("%s %d orphaned of %d chunks in %d rows\n", verb, rep.Orphans, rep.Chunks, rep.Rows)
+		return err
+	}
+}
@@ -0,0 +1,652 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"bigworkshop/btenv"
+	"bigworkshop/cellfmt"
+	"bigworkshop/pager"
+	"cloud.google.com/go/bigtable"
+	"golang.org/x/term"
+)
+
+var browseCmd = &command{
+	name:  "browse",
+	usage: "[-table tbl] [-prefix p] [-page n]",
+	help:  "full screen browser for tables, families, rows and cells with editing",
+}
+
+func init() {
+	browseCmd.run = runBrowse
+	register(browseCmd)
+}
+
+func runBrowse(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(browseCmd)
+	table := fs.String("table", "", "table to open right away")
+	prefix := fs.String("prefix", "", "only browse rows starting with this prefix")
+	pageSize := fs.Int("page", 20, "rows per page")
+	fs.Parse(args)
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return fmt.Errorf("browse needs a terminal, use bw shell for scripts")
+	}
+
+	clients, err := cfg.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer clients.Close()
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	b := &browser{
+		clients:  clients,
+		in:       bufio.NewReader(os.Stdin),
+		out:      bufio.NewWriter(os.Stdout),
+		fd:       int(os.Stdout.Fd()),
+		decoding: cellfmt.Auto,
+		pageSize: *pageSize,
+		prefix:   *prefix,
+		gc:       map[string][]bigtable.FamilyInfo{},
+	}
+	b.out.WriteString("\x1b[?1049h\x1b[?25l")
+	defer func() {
+		b.out.WriteString("\x1b[?25h\x1b[?1049l")
+		b.out.Flush()
+	}()
+
+	b.loadTables(ctx)
+	if *table != "" {
+		for i, t := range b.tables {
+			if t == *table {
+				b.tableIdx = i
+			}
+		}
+		b.openTable(ctx, *table)
+	}
+	return b.loop(ctx)
+}
+
+type view int
+
+const (
+	viewTables view = iota
+	viewRows
+	viewRow
+)
+
+// special keys are negative so they never clash with runes
+const (
+	keyUp rune = -(iota + 1)
+	keyDown
+	keyLeft
+	keyRight
+	keyPgUp
+	keyPgDn
+	keyHome
+	keyEnd
+	keyEnter
+	keyEsc
+	keyBackspace
+	keyCtrlC
+	keyUnknown
+)
+
+type browser struct {
+	clients  *btenv.Clients
+	in       *bufio.Reader
+	out      *bufio.Writer
+	fd       int
+	width    int
+	height   int
+	decoding cellfmt.Decoding
+	pageSize int
+	prefix   string
+	status   string
+
+	view view
+
+	tables   []string
+	tableIdx int
+	gc       map[string][]bigtable.FamilyInfo
+
+	table  string
+	tbl    *bigtable.Table
+	pager  *pager.Pager
+	rows   []bigtable.Row
+	rowIdx int
+
+	row      bigtable.Row
+	cells    []cellfmt.Cell
+	cellIdx  int
+	expanded bool
+}
+
+func (b *browser) loop(ctx context.Context) error {
+	for {
+		b.draw()
+		k, err := b.readKey()
+		if err != nil {
+			return err
+		}
+		b.status = ""
+		if k == 'q' || k == keyCtrlC {
+			return nil
+		}
+		b.handle(ctx, k)
+	}
+}
+
+func (b *browser) readKey() (rune, error) {
+	r, _, err := b.in.ReadRune()
+	if err != nil {
+		return 0, err
+	}
+	switch r {
+	case '\r', '\n':
+		return keyEnter, nil
+	case 3:
+		return keyCtrlC, nil
+	case 127, 8:
+		return keyBackspace, nil
+	case 27:
+		if b.in.Buffered() == 0 {
+			return keyEsc, nil
+		}
+		if next, _ := b.in.ReadByte(); next != '[' && next != 'O' {
+			return keyUnknown, nil
+		}
+		code, _ := b.in.ReadByte()
+		switch code {
+		case 'A':
+			return keyUp, nil
+		case 'B':
+			return keyDown, nil
+		case 'C':
+			return keyRight, nil
+		case 'D':
+			return keyLeft, nil
+		case 'H':
+			return keyHome, nil
+		case 'F':
+			return keyEnd, nil
+		case '5', '6':
+			b.in.ReadByte() // ~
+			if code == '5' {
+				return keyPgUp, nil
+			}
+			return keyPgDn, nil
+		}
+		return keyUnknown, nil
+	}
+	return r, nil
+}
+
+func (b *browser) handle(ctx context.Context, k rune) {
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+
+	switch k {
+	case 'd':
+		b.cycleDecoding()
+		return
+	case keyEsc, keyLeft, keyBackspace, 'h':
+		if b.view > viewTables {
+			b.view--
+		}
+		return
+	}
+
+	switch b.view {
+	case viewTables:
+		switch k {
+		case keyUp, 'k':
+			b.tableIdx = clamp(b.tableIdx-1, len(b.tables))
+		case keyDown, 'j':
+			b.tableIdx = clamp(b.tableIdx+1, len(b.tables))
+		case keyEnter, keyRight, 'l':
+			if len(b.tables) > 0 {
+				b.openTable(ctx, b.tables[b.tableIdx])
+			}
+		case 'r':
+			b.loadTables(ctx)
+		}
+		if len(b.tables) > 0 {
+			b.loadFamilies(ctx, b.tables[b.tableIdx])
+		}
+
+	case viewRows:
+		switch k {
+		case keyUp, 'k':
+			b.rowIdx = clamp(b.rowIdx-1, len(b.rows))
+		case keyDown, 'j':
+			b.rowIdx = clamp(b.rowIdx+1, len(b.rows))
+		case 'n', keyPgDn, ' ':
+			if !b.pager.HasNext() {
+				b.status = "last page"
+				return
+			}
+			rows, err := b.pager.Next(ctx)
+			b.setRows(rows, err, true)
+		case 'p', keyPgUp:
+			rows, err := b.pager.Prev(ctx)
+			b.setRows(rows, err, true)
+		case 'r':
+			b.reloadRows(ctx)
+		case '/':
+			prefix, ok := b.prompt("row key prefix: ", b.prefix)
+			if ok {
+				b.prefix = prefix
+				b.openTable(ctx, b.table)
+			}
+		case keyEnter, keyRight, 'l':
+			if len(b.rows) > 0 {
+				b.openRow(b.rows[b.rowIdx])
+			}
+		case 'X':
+			if len(b.rows) > 0 {
+				b.deleteRow(ctx, b.rows[b.rowIdx].Key())
+			}
+		}
+
+	case viewRow:
+		switch k {
+		case keyUp, 'k':
+			b.cellIdx = clamp(b.cellIdx-1, len(b.cells))
+		case keyDown, 'j':
+			b.cellIdx = clamp(b.cellIdx+1, len(b.cells))
+		case keyEnter, keyRight, 'l':
+			b.expanded = !b.expanded
+		case 'r':
+			b.reloadRow(ctx)
+		case 'e':
+			b.editCell(ctx)
+		case 'x':
+			b.deleteCell(ctx, false)
+		case 'D':
+			b.deleteCell(ctx, true)
+		case 'X':
+			if b.deleteRow(ctx, b.row.Key()) {
+				b.view = viewRows
+			}
+		}
+	}
+}
+
+func (b *browser) cycleDecoding() {
+	ds := cellfmt.Decodings()
+	for i, d := range ds {
+		if d == b.decoding {
+			b.decoding = ds[(i+1)%len(ds)]
+			return
+		}
+	}
+}
+
+func (b *browser) loadTables(ctx context.Context) {
+	tables, err := b.clients.Admin.Tables(ctx)
+	if err != nil {
+		b.status = "error: " + err.Error()
+		return
+	}
+	sort.Strings(tables)
+	b.tables = tables
+	b.tableIdx = clamp(b.tableIdx, len(tables))
+	b.gc = map[string][]bigtable.FamilyInfo{}
+	if len(tables) > 0 {
+		b.loadFamilies(ctx, tables[b.tableIdx])
+	}
+}
+
+func (b *browser) loadFamilies(ctx context.Context, table string) {
+	if _, ok := b.gc[table]; ok {
+		return
+	}
+	info, err := b.clients.Admin.TableInfo(ctx, table)
+	if err != nil {
+		b.status = "error: " + err.Error()
+		return
+	}
+	fams := info.FamilyInfos
+	sort.Slice(fams, func(i, j int) bool { return fams[i].Name < fams[j].Name })
+	b.gc[table] = fams
+}
+
+func (b *browser) openTable(ctx context.Context, table string) {
+	b.table = table
+	b.tbl = b.clients.Data.Open(table)
+	b.pager = pager.New(b.tbl, pager.PrefixRange(b.prefix), b.pageSize)
+	b.view = viewRows
+	rows, err := b.pager.Next(ctx)
+	b.setRows(rows, err, true)
+}
+
+func (b *browser) setRows(rows []bigtable.Row, err error, reset bool) {
+	if err != nil {
+		b.status = "error: " + err.Error()
+		return
+	}
+	b.rows = rows
+	if reset {
+		b.rowIdx = 0
+	}
+	b.rowIdx = clamp(b.rowIdx, len(rows))
+}
+
+func (b *browser) reloadRows(ctx context.Context) {
+	rows, err := b.pager.Reload(ctx)
+	b.setRows(rows, err, false)
+}
+
+func (b *browser) openRow(row bigtable.Row) {
+	b.row = row
+	b.cells = cellfmt.Cells(row)
+	b.cellIdx = 0
+	b.expanded = false
+	b.view = viewRow
+}
+
+func (b *browser) reloadRow(ctx context.Context) {
+	key := b.row.Key()
+	row, err := b.tbl.ReadRow(ctx, key)
+	if err != nil {
+		b.status = "error: " + err.Error()
+		return
+	}
+	if len(row) == 0 {
+		b.status = fmt.Sprintf("row %q no longer exists", key)
+		b.view = viewRows
+		b.reloadRows(ctx)
+		return
+	}
+	b.row = row
+	b.cells = cellfmt.Cells(row)
+	b.cellIdx = clamp(b.cellIdx, len(b.cells))
+	b.reloadRows(ctx)
+}
+
+// editCell writes a new version of the selected cell, the input is encoded
+// with the current decoding so int64 and hex values can be typed in. With
+// auto the input is encoded like the existing value.
+func (b *browser) editCell(ctx context.Context) {
+	if len(b.cells) == 0 {
+		return
+	}
+	c := b.cells[b.cellIdx]
+	d := b.decoding
+	if d == cellfmt.Auto {
+		d = cellfmt.Detect(c.Value)
+	}
+	input, ok := b.prompt(fmt.Sprintf("new %s value for %s: ", d, c.Column()), cellfmt.Decode(d, c.Value))
+	if !ok {
+		return
+	}
+	value, err := cellfmt.Encode(d, input)
+	if err != nil {
+		b.status = "error: " + err.Error()
+		return
+	}
+	if !b.confirm(fmt.Sprintf("write %q to %s %s?", input, c.Row, c.Column())) {
+		return
+	}
+	mut := bigtable.NewMutation()
+	mut.Set(c.Family, c.Qualifier, bigtable.Now(), value)
+	if err := b.tbl.Apply(ctx, c.Row, mut); err != nil {
+		b.status = "error: " + err.Error()
+		return
+	}
+	b.status = "written"
+	b.reloadRow(ctx)
+}
+
+// deleteCell deletes the selected version or, with column set, all versions of its column.
+func (b *browser) deleteCell(ctx context.Context, column bool) {
+	if len(b.cells) == 0 {
+		return
+	}
+	c := b.cells[b.cellIdx]
+	mut := bigtable.NewMutation()
+	question := fmt.Sprintf("delete %s %s version %s?", c.Row, c.Column(), cellfmt.FormatTimestamp(c.Timestamp))
+	if column {
+		question = fmt.Sprintf("delete all versions of %s %s?", c.Row, c.Column())
+		mut.DeleteCellsInColumn(c.Family, c.Qualifier)
+	} else {
+		// bigtable timestamps have millisecond granularity
+		mut.DeleteTimestampRange(c.Family, c.Qualifier, c.Timestamp, c.Timestamp+1000)
+	}
+	if !b.confirm(question) {
+		return
+	}
+	if err := b.tbl.Apply(ctx, c.Row, mut); err != nil {
+		b.status = "error: " + err.Error()
+		return
+	}
+	b.status = "deleted"
+	b.reloadRow(ctx)
+}
+
+func (b *browser) deleteRow(ctx context.Context, key string) bool {
+	if !b.confirm(fmt.Sprintf("delete row %q with all of its cells?", key)) {
+		return false
+	}
+	mut := bigtable.NewMutation()
+	mut.DeleteRow()
+	if err := b.tbl.Apply(ctx, key, mut); err != nil {
+		b.status = "error: " + err.Error()
+		return false
+	}
+	b.status = "deleted " + key
+	b.reloadRows(ctx)
+	return true
+}
+
+// prompt reads a line in the status bar, esc cancels.
+func (b *browser) prompt(question, value string) (string, bool) {
+	input := []rune(value)
+	for {
+		b.status = question + string(input)
+		b.draw()
+		k, err := b.readKey()
+		if err != nil {
+			return "", false
+		}
+		switch {
+		case k == keyEnter:
+			b.status = ""
+			return string(input), true
+		case k == keyEsc || k == keyCtrlC:
+			b.status = "cancelled"
+			return "", false
+		case k == keyBackspace:
+			if len(input) > 0 {
+				input = input[:len(input)-1]
+			}
+		case k == 21: // ctrl-u
+			input = input[:0]
+		case k > 0 && unicode.IsPrint(k):
+			input = append(input, k)
+		}
+	}
+}
+
+func (b *browser) confirm(question string) bool {
+	b.status = question + " [y/N]"
+	b.draw()
+	k, err := b.readKey()
+	if err != nil || (k != 'y' && k != 'Y') {
+		b.status = "cancelled"
+		return false
+	}
+	b.status = ""
+	return true
+}
+
+func (b *browser) draw() {
+	b.width, b.height = 80, 24
+	if w, h, err := term.GetSize(b.fd); err == nil {
+		b.width, b.height = w, h
+	}
+
+	var header, keys string
+	var body []string
+	selected := -1
+	switch b.view {
+	case viewTables:
+		header = "tables"
+		keys = "enter open  r reload  q quit"
+		body, selected = b.tablesBody()
+	case viewRows:
+		header = fmt.Sprintf("%s  prefix %q  page %d", b.table, b.prefix, b.pager.Page())
+		keys = "enter open  n/p page  / prefix  X delete row  r reload  esc back  q quit"
+		body, selected = b.rowsBody()
+	case viewRow:
+		header = fmt.Sprintf("%s  row %q", b.table, b.row.Key())
+		keys = "enter expand  e edit  x delete version  D delete column  X delete row  esc back"
+		body, selected = b.rowBody()
+	}
+	header = fmt.Sprintf("bw browse  %s  decoding %s (d)", header, b.decoding)
+
+	// keep the selected line visible
+	avail := b.height - 3
+	offset := 0
+	if selected >= avail {
+		offset = selected - avail + 1
+	}
+
+	b.out.WriteString("\x1b[H")
+	b.line(1, "\x1b[7m"+pad(header, b.width)+"\x1b[0m")
+	for i := 0; i < avail; i++ {
+		text := ""
+		if i+offset < len(body) {
+			text = body[i+offset]
+		}
+		if i+offset == selected {
+			text = "\x1b[7m" + pad(text, b.width) + "\x1b[0m"
+		} else {
+			text = truncate(text, b.width)
+		}
+		b.line(i+2, text)
+	}
+	b.line(b.height-1, truncate(b.status, b.width))
+	b.line(b.height, "\x1b[2m"+truncate(keys, b.width)+"\x1b[0m")
+	b.out.Flush()
+}
+
+func (b *browser) line(y int, text string) {
+	fmt.Fprintf(b.out, "\x1b[%d;1H%s\x1b[K", y, text)
+}
+
+func (b *browser) tablesBody() ([]string, int) {
+	var fams []string
+	if len(b.tables) > 0 {
+		for _, f := range b.gc[b.tables[b.tableIdx]] {
+			gc := f.GCPolicy
+			if gc == "" {
+				gc = "never"
+			}
+			fams = append(fams, fmt.Sprintf("%-20s gc: %s", f.Name, gc))
+		}
+	}
+	width := 24
+	var lines []string
+	for i := 0; i < len(b.tables) || i < len(fams); i++ {
+		left, right := "", ""
+		if i < len(b.tables) {
+			left = b.tables[i]
+		}
+		if i < len(fams) {
+			right = fams[i]
+		}
+		lines = append(lines, pad(truncate(left, width-1), width)+"│ "+right)
+	}
+	if len(b.tables) == 0 {
+		lines = append(lines, "no tables, create one with bw shell: createtable tbl")
+		return lines, -1
+	}
+	return lines, b.tableIdx
+}
+
+func (b *browser) rowsBody() ([]string, int) {
+	if len(b.rows) == 0 {
+		return []string{"no rows"}, -1
+	}
+	var lines []string
+	for _, row := range b.rows {
+		cells := cellfmt.Cells(row)
+		preview := ""
+		if len(cells) > 0 {
+			preview = cells[0].Column() + "=" + cellfmt.Decode(b.decoding, cells[0].Value)
+		}
+		lines = append(lines, fmt.Sprintf("%-32s %4d cells  %s", cellfmt.Decode(cellfmt.UTF8, []byte(row.Key())), len(cells), preview))
+	}
+	if b.pager.HasNext() {
+		lines = append(lines, "-- more, n for the next page --")
+	}
+	return lines, b.rowIdx
+}
+
+func (b *browser) rowBody() ([]string, int) {
+	if len(b.cells) == 0 {
+		return []string{"no cells"}, -1
+	}
+	colWidth := 8
+	for _, c := range b.cells {
+		if n := utf8.RuneCountInString(c.Column()); n > colWidth {
+			colWidth = n
+		}
+	}
+	lines := []string{fmt.Sprintf("%-*s  %-26s  %s", colWidth, "FAMILY:QUALIFIER", "TIMESTAMP", "VALUE")}
+	prev := ""
+	for _, c := range b.cells {
+		col := c.Column()
+		if col == prev {
+			col = "" // older versions of the same column
+		}
+		prev = c.Column()
+		lines = append(lines, fmt.Sprintf("%-*s  %-26s  %s", colWidth, col, cellfmt.FormatTimestamp(c.Timestamp), cellfmt.Decode(b.decoding, c.Value)))
+	}
+	if b.expanded {
+		c := b.cells[b.cellIdx]
+		lines = append(lines, "", fmt.Sprintf("%s @ %s, %d bytes:", c.Column(), cellfmt.FormatTimestamp(c.Timestamp), len(c.Value)))
+		for _, l := range strings.Split(cellfmt.DecodeIndent(b.decoding, c.Value), "\n") {
+			lines = append(lines, "  "+l)
+		}
+	}
+	return lines, b.cellIdx + 1
+}
+
+func clamp(i, n int) int {
+	if i >= n {
+		i = n - 1
+	}
+	if i < 0 {
+		i = 0
+	}
+	return i
+}
+
+func truncate(s string, width int) string {
+	if utf8.RuneCountInString(s) <= width {
+		return s
+	}
+	return string([]rune(s)[:width])
+}
+
+func pad(s string, width int) string {
+	s = truncate(s, width)
+	return s + strings.Repeat(" ", width-utf8.RuneCountInString(s))
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"bigworkshop/btenv"
+	"bigworkshop/filterexpr"
+	"bigworkshop/ratelimit"
+	"bigworkshop/table"
+	"bigworkshop/tablecopy"
+	"cloud.google.com/go/bigtable"
+	"github.com/sirupsen/logrus"
+)
+
+var copyCmd = &command{
+	name:  "copy",
+	usage: "-table t [-to-table t] [-to-emulator host:port | -to-project p -to-instance i] [-prefix p | -start k -end k] [-filter expr] [-keys from=to | -replace old=new] [-ratelimit limits]",
+	help:  "copies the schema and rows of a table to another table or instance, in parallel shards and with every cell version",
+}
+
+func init() {
+	copyCmd.run = runCopy
+	register(copyCmd)
+}
+
+func runCopy(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(copyCmd)
+	dstCfg := cfg
+	dstCfg.RegisterFlags(fs, "to-")
+	tableName := fs.String("table", "", "table to copy")
+	toTable := fs.String("to-table", "", "table to write, -table if empty")
+	prefix := fs.String("prefix", "", "only rows with this prefix")
+	start := fs.String("start", "", "first row key")
+	end := fs.String("end", "", "row key after the last one")
+	filter := fs.String("filter", "", "only copy the cells this filter returns, see the shell's help filter")
+	keys := fs.String("keys", "", "change keys from one key scheme to another, e.g. plain=padded-desc:5:10000 with -prefix as the key prefix")
+	replace := fs.String("replace", "", "replace a key prefix, old=new")
+	schema := fs.Bool("schema", true, "create the table and missing families with their gc policies")
+	split := fs.Bool("split", false, "split a new table at the sampled keys of the source")
+	shards := fs.Int("shards", 8, "key ranges copied in parallel")
+	batch := fs.Int("batch", 500, "rows per ApplyBulk")
+	rateLimits := fs.String("ratelimit", "", "limits of the writes like mutations=1000,bytes=1048576, rate:burst per second")
+	adaptive := fs.Duration("adaptive", 0, "with -ratelimit, slow down while the average write latency exceeds this")
+	fs.Parse(args)
+
+	if *tableName == "" || (*keys != "" && *replace != "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if *toTable == "" {
+		*toTable = *tableName
+	}
+	if *toTable == *tableName && dstCfg.Project == cfg.Project && dstCfg.Instance == cfg.Instance && dstCfg.Emulator == cfg.Emulator {
+		return fmt.Errorf("source and destination are both %s, give -to-table or another instance", *tableName)
+	}
+
+	opts := tablecopy.Options{Prefix: *prefix, Start: *start, End: *end, Shards: *shards, Batch: *batch}
+	if *filter != "" {
+		f, err := filterexpr.Parse(*filter)
+		if err != nil {
+			return err
+		}
+		opts.Filter = f
+	}
+	var from, to string
+	if *keys != "" {
+		var ok bool
+		if from, to, ok = strings.Cut(*keys, "="); !ok {
+			return fmt.Errorf("bad -keys %q, want from=to", *keys)
+		}
+	}
+	t, err := keyTransform(from, to, *replace, *prefix)
+	if err != nil {
+		return err
+	}
+	if t != nil {
+		opts.Transform = func(r bigtable.Row) (string, bigtable.Row, error) {
+			key, ok, err := t(r.Key())
+			if err != nil {
+				return "", nil, err
+			}
+			if ok {
+				return key, r, nil
+			}
+			return r.Key(), r, nil
+		}
+	}
+
+	src, err := cfg.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := dstCfg.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	srcTbl := src.Data.Open(*tableName)
+	if *schema {
+		var splits []string
+		if *split {
+			if splits, err = tablecopy.SampleKeys(ctx, srcTbl, opts); err != nil {
+				return err
+			}
+		}
+		if err := tablecopy.Schema(ctx, src.Admin, *tableName, dst.Admin, *toTable, splits); err != nil {
+			return err
+		}
+	}
+
+	var dstTbl table.Table = dst.Data.Open(*toTable)
+	if *rateLimits != "" {
+		limits, err := ratelimit.ParseLimits(*rateLimits)
+		if err != nil {
+			return err
+		}
+		lcfg := ratelimit.Config{Default: limits}
+		if *adaptive > 0 {
+			lcfg.Adaptive = &ratelimit.Adaptive{TargetLatency: *adaptive}
+		}
+		dstTbl = ratelimit.New(lcfg).Wrap(dstTbl, *toTable)
+	}
+
+	began := time.Now()
+	last := began
+	opts.Progress = func(rep tablecopy.Report) {
+		if time.Since(last) > 2*time.Second {
+			last = time.Now()
+			logrus.Infof("%d rows copied", rep.Rows)
+		}
+	}
+	rep, err := tablecopy.Run(ctx, srcTbl, dstTbl, opts)
+	fmt.Printf("%v in %v\n", rep, time.Since(began).Round(time.Millisecond))
+	return err
+}
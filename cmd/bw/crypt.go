@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+
+	"bigworkshop/btenv"
+	"bigworkshop/envelope"
+)
+
+var cryptCmd = &command{
+	name:  "crypt",
+	usage: "-keys keys.json (init | rotate | keys | -table t -columns fam:qual,... [-prefix p] [-dry-run] reencrypt)",
+	help:  "manages the master keys of encrypted columns and re-encrypts values after a rotation, see gateway -encrypt",
+}
+
+func init() {
+	cryptCmd.run = runCrypt
+	register(cryptCmd)
+}
+
+func runCrypt(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(cryptCmd)
+	keysPath := fs.String("keys", "keys.json", "key file")
+	tableName := fs.String("table", "", "table to re-encrypt")
+	columns := fs.String("columns", "", "encrypted columns, family:qualifier or family:*")
+	prefix := fs.String("prefix", "", "re-encrypt only rows with this prefix")
+	dryRun := fs.Bool("dry-run", false, "only count the values that would be re-encrypted")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	if fs.Arg(0) == "init" {
+		keys, err := envelope.CreateFileKeys(*keysPath)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("created %s with master key %s, keep it secret\n", *keysPath, keys.PrimaryKey())
+		return nil
+	}
+	keys, err := envelope.LoadFileKeys(*keysPath)
+	if err != nil {
+		return err
+	}
+
+	switch fs.Arg(0) {
+	case "rotate":
+		id, err := keys.Rotate()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("new values are encrypted under %s, run reencrypt to move existing ones\n", id)
+		return nil
+	case "keys":
+		for _, id := range keys.IDs() {
+			if id == keys.PrimaryKey() {
+				id += " (primary)"
+			}
+			fmt.Println(id)
+		}
+		return nil
+	case "reencrypt":
+		cols, err := envelope.ParseColumns(*columns)
+		if err != nil {
+			return err
+		}
+		if *tableName == "" || len(cols) == 0 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		clients, err := cfg.Dial(ctx)
+		if err != nil {
+			return err
+		}
+		defer clients.Close()
+		tbl := envelope.Wrap(clients.Data.Open(*tableName), envelope.Options{Columns: cols, Keys: keys})
+		rep, err := tbl.Reencrypt(ctx, envelope.ReencryptOptions{Prefix: *prefix, DryRun: *dryRun})
+		verb := "re-encrypted"
+		if *dryRun {
+			verb = "would re-encrypt"
+		}
+		fmt.Printf("%s %d of %d values of %s in %d rows under %s\n", verb, rep.Rewritten, rep.Values, strings.Join(cols, ","), rep.Rows, keys.PrimaryKey())
+		return err
+	}
+	return fmt.Errorf("unknown crypt command %q, use init, rotate, keys or reencrypt", fs.Arg(0))
+}
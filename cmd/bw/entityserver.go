@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net"
+
+	"bigworkshop/btenv"
+	"bigworkshop/entity"
+	"bigworkshop/entitypb"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+)
+
+var entityServerCmd = &command{
+	name:  "entity-server",
+	usage: "[-addr localhost:9090] [-table tokens] [-create]",
+	help:  "serves the typed token entity service of entitypb over grpc",
+}
+
+func init() {
+	entityServerCmd.run = runEntityServer
+	register(entityServerCmd)
+}
+
+func runEntityServer(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(entityServerCmd)
+	addr := fs.String("addr", "localhost:9090", "address to listen on")
+	table := fs.String("table", "tokens", "table holding the tokens")
+	create := fs.Bool("create", false, "create the table and its families if missing")
+	fs.Parse(args)
+
+	clients, err := cfg.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer clients.Close()
+
+	if *create {
+		if err := entity.CreateTable(ctx, clients.Admin, *table); err != nil {
+			return err
+		}
+	}
+
+	lis, err := net.Listen("tcp", *addr)
+	if err != nil {
+		return err
+	}
+	srv := grpc.NewServer()
+	entitypb.RegisterTokenServiceServer(srv, entity.NewServer(clients.Data.Open(*table)))
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+
+	logrus.Infof("serving %s on %s", entitypb.TokenService_ServiceDesc.ServiceName, lis.Addr())
+	return srv.Serve(lis)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"time"
+
+	"bigworkshop/btenv"
+	"bigworkshop/faultproxy"
+	"github.com/sirupsen/logrus"
+)
+
+var faultProxyCmd = &command{
+	name:  "faultproxy",
+	usage: "[-listen localhost:8087] [-fault method:key=value,...]...",
+	help:  "proxies the emulator and injects latency, errors, stream aborts and partial MutateRows failures",
+}
+
+func init() {
+	faultProxyCmd.run = runFaultProxy
+	register(faultProxyCmd)
+}
+
+// faultFlags collects repeated -fault flags.
+type faultFlags []faultproxy.Fault
+
+func (f *faultFlags) String() string {
+	return ""
+}
+
+func (f *faultFlags) Set(s string) error {
+	fault, err := faultproxy.ParseFault(s)
+	if err != nil {
+		return err
+	}
+	*f = append(*f, fault)
+	return nil
+}
+
+func runFaultProxy(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(faultProxyCmd)
+	listen := fs.String("listen", "localhost:8087", "address to listen on, point "+btenv.EmulatorHostEnv+" of the client here")
+	var faults faultFlags
+	fs.Var(&faults, "fault", "fault to inject, e.g. ReadRows:abort-after=2,abort=0.5 or *:latency=20ms,error=0.1,code=aborted, the first matching one is used")
+	fs.Parse(args)
+
+	if cfg.Emulator == "" {
+		return errors.New("faultproxy needs the emulator address, set -emulator or " + btenv.EmulatorHostEnv)
+	}
+	p, err := faultproxy.New(cfg.Emulator, faults...)
+	if err != nil {
+		return err
+	}
+	lis, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		p.Close()
+	}()
+	go func() {
+		for range time.Tick(10 * time.Second) {
+			logrus.Infof("faultproxy: %v", p.Stats())
+		}
+	}()
+
+	var names []string
+	for _, f := range faults {
+		names = append(names, f.Method)
+	}
+	logrus.Infof("proxying %s to %s, faults for [%s]", lis.Addr(), cfg.Emulator, strings.Join(names, " "))
+	err = p.Serve(lis)
+	logrus.Infof("faultproxy: %v", p.Stats())
+	return err
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"bigworkshop/audit"
+	"bigworkshop/btenv"
+	"bigworkshop/cache"
+	"bigworkshop/envelope"
+	"bigworkshop/gateway"
+	"bigworkshop/oplog"
+	"bigworkshop/ratelimit"
+	"bigworkshop/retry"
+	"bigworkshop/sizeguard"
+	"bigworkshop/softdelete"
+	"bigworkshop/table"
+	"bigworkshop/telemetry"
+	"bigworkshop/valuecodec"
+	"github.com/sirupsen/logrus"
+)
+
+var gatewayCmd = &command{
+	name:  "gateway",
+	usage: "[-addr localhost:8081] [-limit n] [-retries n] [-metrics] [-trace file] [-oplog] [-oplog-values mode] [-oplog-redact family,...] [-slow d] [-cache ttl] [-ratelimit limits] [-adaptive latency] [-softdelete family] [-audit family [-audit-table t]] [-encrypt columns [-keys file]] [-compress codecs] [-sizeguard warn|reject]",
+	help:  "serves a REST/JSON api for rows, mutations, read modify write and NDJSON scans",
+}
+
+func init() {
+	gatewayCmd.run = runGateway
+	register(gatewayCmd)
+}
+
+func runGateway(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(gatewayCmd)
+	addr := fs.String("addr", "localhost:8081", "address to listen on")
+	limit := fs.Int("limit", 100, "rows per scan page when the request has no limit")
+	retries := fs.Int("retries", 0, "attempts of idempotent operations with transient errors, including the first; 0 or 1 disables retries")
+	metrics := fs.Bool("metrics", false, "serve prometheus metrics of the table operations on /metrics")
+	trace := fs.String("trace", "", "write spans of the table operations as json lines to this file, - is stdout")
+	logOps := fs.Bool("oplog", false, "log every table operation, keys are hashed")
+	logValues := fs.String("oplog-values", "omit", "how -oplog logs cell values: omit, hash, redact or show")
+	redact := fs.String("oplog-redact", "", "comma separated families whose values -oplog always redacts")
+	cacheTTL := fs.Duration("cache", 0, "serve single row reads from a cache for this long, mutations through the gateway invalidate it")
+	slow := fs.Duration("slow", 0, "log operations slower than this as warnings, with or without -oplog")
+	rateLimits := fs.String("ratelimit", "", "per table limits like reads=100,mutations=500:1000,bytes=1048576, rate:burst per second")
+	auditFamily := fs.String("audit", "", "record who changed what in this family of the changed rows, the actor is the X-Actor header")
+	auditTable := fs.String("audit-table", "", "with -audit, keep the records in this table instead")
+	encrypt := fs.String("encrypt", "", "comma separated columns stored encrypted, family:qualifier or family:*")
+	keysPath := fs.String("keys", "keys.json", "with -encrypt, the key file created by crypt init")
+	compress := fs.String("compress", "", "compress values like gzip:1024,blob=snappy,img=none, codec:threshold by default or per family, reads decompress any codec")
+	guard := fs.String("sizeguard", "", "warn about or reject mutations over Bigtable's cell, row and entry limits: warn or reject")
+	softDelete := fs.String("softdelete", "", "turn row deletes into tombstones in this family, reads skip tombstoned rows")
+	adaptive := fs.Duration("adaptive", 0, "with -ratelimit, lower the limits while the average latency exceeds this or the server is exhausted")
+	fs.Parse(args)
+
+	var limiter *ratelimit.Limiter
+	if *rateLimits != "" {
+		limits, err := ratelimit.ParseLimits(*rateLimits)
+		if err != nil {
+			return err
+		}
+		lcfg := ratelimit.Config{Default: limits}
+		if *adaptive > 0 {
+			lcfg.Adaptive = &ratelimit.Adaptive{TargetLatency: *adaptive}
+		}
+		limiter = ratelimit.New(lcfg)
+	}
+
+	var keys *envelope.FileKeys
+	var encrypted []string
+	if *encrypt != "" {
+		var err error
+		if encrypted, err = envelope.ParseColumns(*encrypt); err != nil {
+			return err
+		}
+		if keys, err = envelope.LoadFileKeys(*keysPath); err != nil {
+			return err
+		}
+	}
+
+	if *guard != "" && *guard != "warn" && *guard != "reject" {
+		return fmt.Errorf("bad -sizeguard %q, use warn or reject", *guard)
+	}
+
+	var compression *valuecodec.Options
+	if *compress != "" {
+		opts, err := valuecodec.ParseOptions(*compress)
+		if err != nil {
+			return err
+		}
+		compression = &opts
+	}
+
+	var logOpts *oplog.Options
+	if *logOps || *slow > 0 {
+		values, err := oplog.ParseMode(*logValues)
+		if err != nil {
+			return err
+		}
+		logOpts = &oplog.Options{Level: logrus.InfoLevel, Values: values, Slow: *slow}
+		if !*logOps {
+			// only the slow and failed ones
+			logOpts.Sample = -1
+		}
+		for _, f := range strings.Split(*redact, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				logOpts.Rules = append(logOpts.Rules, oplog.Rule{Family: f, Mode: oplog.Redact})
+			}
+		}
+	}
+
+	clients, err := cfg.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer clients.Close()
+
+	var tel *telemetry.Telemetry
+	if *metrics || *trace != "" {
+		var exp telemetry.Exporter
+		if *trace != "" {
+			fexp, err := telemetry.CreateFileExporter(*trace)
+			if err != nil {
+				return err
+			}
+			defer fexp.Close()
+			exp = fexp
+		}
+		tel = telemetry.New(exp)
+	}
+
+	var cacheMetrics *cache.Metrics
+	if tel != nil && *cacheTTL > 0 {
+		cacheMetrics = cache.NewMetrics(tel.Registry)
+	}
+
+	// the wrapped tables are kept, the cache, rate limits and retry budgets
+	// live in them
+	var mu sync.Mutex
+	tables := map[string]table.Table{}
+	open := func(name string) table.Table {
+		mu.Lock()
+		defer mu.Unlock()
+		if tbl, ok := tables[name]; ok {
+			return tbl
+		}
+		var tbl table.Table = clients.Data.Open(name)
+		if *guard != "" {
+			// lowest, it sees the values as stored
+			tbl = sizeguard.Wrap(tbl, name, sizeguard.Options{Reject: *guard == "reject"})
+		}
+		if keys != nil {
+			// everything above sees plain values
+			tbl = envelope.Wrap(tbl, envelope.Options{Columns: encrypted, Keys: keys})
+		}
+		if compression != nil {
+			// above envelope, ciphertext does not compress
+			tbl = valuecodec.Wrap(tbl, *compression)
+		}
+		if limiter != nil {
+			// below retry, so that every attempt is charged
+			tbl = limiter.Wrap(tbl, name)
+		}
+		if *retries > 1 {
+			p := retry.Policy{MaxAttempts: *retries}
+			if tel != nil {
+				p.OnRetry = tel.OnRetry(name)
+			}
+			tbl = retry.Wrap(tbl, p)
+		}
+		if tel != nil {
+			tbl = tel.Wrap(tbl, name)
+		}
+		if logOpts != nil {
+			tbl = oplog.Wrap(tbl, name, *logOpts)
+		}
+		if *auditFamily != "" {
+			// below softdelete, which only recognizes mutations ending in
+			// DeleteRow
+			aopts := audit.Options{Family: *auditFamily, Actor: "anonymous"}
+			if *auditTable != "" {
+				aopts.Table = clients.Data.Open(*auditTable)
+			}
+			tbl = audit.Wrap(tbl, name, aopts)
+		}
+		if *softDelete != "" {
+			// below the cache, cached rows are already filtered
+			tbl = softdelete.Wrap(tbl, softdelete.Options{Family: *softDelete})
+		}
+		if *cacheTTL > 0 {
+			tbl = cache.Wrap(tbl, name, cache.Options{TTL: *cacheTTL, Metrics: cacheMetrics})
+		}
+		tables[name] = tbl
+		return tbl
+	}
+
+	mux := http.NewServeMux()
+	var api http.Handler = gateway.New(clients.Data, clients.Admin, gateway.Options{DefaultLimit: *limit, Open: open})
+	if *auditFamily != "" {
+		next := api
+		api = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if actor := r.Header.Get("X-Actor"); actor != "" {
+				r = r.WithContext(audit.WithActor(r.Context(), actor))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	mux.Handle("/", api)
+	if *metrics {
+		mux.Handle("/metrics", tel.Handler())
+	}
+	return serve(ctx, &http.Server{Addr: *addr, Handler: mux})
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+)
+
+// parseGCPolicy parses the cbt setgcpolicy syntax:
+//
+//	never | maxversions=<n> | maxage=<d> | <policy> and <policy> | <policy> or <policy>
+//
+// maxage takes go durations and also accepts days, e.g. 7d.
+func parseGCPolicy(s string) (bigtable.GCPolicy, error) {
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		return nil, fmt.Errorf("empty gc policy")
+	}
+
+	var policies []bigtable.GCPolicy
+	op := ""
+	for i, w := range words {
+		if i%2 == 1 {
+			w = strings.ToLower(w)
+			if w != "and" && w != "or" {
+				return nil, fmt.Errorf("expected and/or, got %q", w)
+			}
+			if op != "" && op != w {
+				return nil, fmt.Errorf("cannot mix and and or in one gc policy")
+			}
+			op = w
+			continue
+		}
+		p, err := parseSingleGCPolicy(w)
+		if err != nil {
+			return nil, err
+		}
+		policies = append(policies, p)
+	}
+	if len(words)%2 == 0 {
+		return nil, fmt.Errorf("gc policy %q ends with %q", s, words[len(words)-1])
+	}
+
+	switch op {
+	case "and":
+		return bigtable.IntersectionPolicy(policies...), nil
+	case "or":
+		return bigtable.UnionPolicy(policies...), nil
+	}
+	return policies[0], nil
+}
+
+func parseSingleGCPolicy(s string) (bigtable.GCPolicy, error) {
+	if strings.EqualFold(s, "never") {
+		return bigtable.NoGcPolicy(), nil
+	}
+	key, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return nil, fmt.Errorf("bad gc policy %q", s)
+	}
+	switch strings.ToLower(key) {
+	case "maxversions":
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("bad maxversions %q", value)
+		}
+		return bigtable.MaxVersionsPolicy(n), nil
+	case "maxage":
+		d, err := parseDays(value)
+		if err != nil {
+			return nil, fmt.Errorf("bad maxage %q: %w", value, err)
+		}
+		return bigtable.MaxAgePolicy(d), nil
+	}
+	return nil, fmt.Errorf("unknown gc policy %q", key)
+}
+
+// parseDays is time.ParseDuration with support for a d (day) suffix.
+func parseDays(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
@@ -0,0 +1,89 @@
+// Command bw bundles the tools built around the workshop exercises.
+//
+//	go run ./cmd/bw [-project test] [-instance test] [-emulator localhost:8086] <command> [args]
+//
+// Like the exercises it expects the emulator from the SETUP notes in
+// connect/main.go, BIGTABLE_EMULATOR_HOST is picked up automatically.
+// Run go run ./cmd/bw help for the list of commands.
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+
+	"bigworkshop/btenv"
+	"github.com/sirupsen/logrus"
+)
+
+type command struct {
+	name  string
+	usage string
+	help  string
+	run   func(ctx context.Context, cfg btenv.Config, args []string) error
+}
+
+var commands = map[string]*command{}
+
+func register(c *command) {
+	if _, ok := commands[c.name]; ok {
+		panic("bw: command registered twice: " + c.name)
+	}
+	commands[c.name] = c
+}
+
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "usage: bw [flags] <command> [args]\n\nflags:\n")
+	flag.PrintDefaults()
+	fmt.Fprintf(out, "\ncommands:\n")
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %-12s %s\n", name, commands[name].help)
+	}
+}
+
+func main() {
+	cfg := btenv.Default()
+	cfg.RegisterFlags(flag.CommandLine, "")
+	flag.Usage = usage
+	flag.Parse()
+
+	if flag.NArg() == 0 || flag.Arg(0) == "help" {
+		if c, ok := commands[flag.Arg(1)]; ok {
+			fmt.Fprintf(os.Stderr, "usage: bw %s %s\n\n%s\n", c.name, c.usage, c.help)
+			return
+		}
+		usage()
+		return
+	}
+
+	c, ok := commands[flag.Arg(0)]
+	if !ok {
+		logrus.Fatalf("unknown command %q, run bw help", flag.Arg(0))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	if err := c.run(ctx, cfg, flag.Args()[1:]); err != nil {
+		logrus.WithError(err).Fatalf("%s failed", c.name)
+	}
+}
+
+// newFlagSet returns the flag set for a command, -h prints its usage.
+func newFlagSet(c *command) *flag.FlagSet {
+	fs := flag.NewFlagSet(c.name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: bw %s %s\n\n%s\n\n", c.name, c.usage, c.help)
+		fs.PrintDefaults()
+	}
+	return fs
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"text/tabwriter"
+
+	"bigworkshop/btenv"
+	"bigworkshop/keycodec"
+	"bigworkshop/migrate"
+	"cloud.google.com/go/bigtable"
+)
+
+var migrateCmd = &command{
+	name:  "migrate",
+	usage: "[-file migrations.json] [-meta schema_migrations] [-dry-run] up [version] | down [version] | status | unlock",
+	help:  "applies, undoes and lists versioned schema and data migrations, see migrate/example.json",
+}
+
+func init() {
+	migrateCmd.run = runMigrate
+	register(migrateCmd)
+}
+
+// migrationFile is the json form of migrations.
+type migrationFile struct {
+	MetaTable  string `json:"metaTable"`
+	Migrations []struct {
+		Version int        `json:"version"`
+		Name    string     `json:"name"`
+		Up      []stepSpec `json:"up"`
+		Down    []stepSpec `json:"down"`
+	} `json:"migrations"`
+}
+
+type stepSpec struct {
+	Op        string `json:"op"`
+	Table     string `json:"table"`
+	Family    string `json:"family"`
+	Qualifier string `json:"qualifier"`
+	GCPolicy  string `json:"gcPolicy"`
+	Prefix    string `json:"prefix"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	KeepOld   bool   `json:"keepOld"`
+}
+
+func (s stepSpec) step() (migrate.Step, error) {
+	var gc bigtable.GCPolicy
+	if s.GCPolicy != "" {
+		var err error
+		if gc, err = parseGCPolicy(s.GCPolicy); err != nil {
+			return nil, err
+		}
+	}
+	switch s.Op {
+	case "createTable":
+		return migrate.CreateTable{Table: s.Table}, nil
+	case "deleteTable":
+		return migrate.DeleteTable{Table: s.Table}, nil
+	case "createFamily":
+		return migrate.CreateFamily{Table: s.Table, Family: s.Family, GCPolicy: gc}, nil
+	case "deleteFamily":
+		return migrate.DeleteFamily{Table: s.Table, Family: s.Family}, nil
+	case "setGCPolicy":
+		if gc == nil {
+			return nil, errors.New("setGCPolicy needs gcPolicy")
+		}
+		return migrate.SetGCPolicy{Table: s.Table, Family: s.Family, Policy: gc}, nil
+	case "rekey":
+		from, err := keycodec.Parse(s.From, s.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		to, err := keycodec.Parse(s.To, s.Prefix)
+		if err != nil {
+			return nil, err
+		}
+		return migrate.Rekey{Table: s.Table, Prefix: s.Prefix, From: from, To: to, KeepOld: s.KeepOld}, nil
+	case "deleteColumn":
+		return migrate.Rewrite{
+			Name:   fmt.Sprintf("delete column %s:%s in", s.Family, s.Qualifier),
+			Table:  s.Table,
+			Prefix: s.Prefix,
+			Filter: bigtable.ChainFilters(
+				bigtable.FamilyFilter("^"+regexp.QuoteMeta(s.Family)+"$"),
+				bigtable.ColumnFilter("^"+regexp.QuoteMeta(s.Qualifier)+"$"),
+				bigtable.LatestNFilter(1),
+				bigtable.StripValueFilter(),
+			),
+			Fn: func(r bigtable.Row) ([]migrate.Write, error) {
+				m := bigtable.NewMutation()
+				m.DeleteCellsInColumn(s.Family, s.Qualifier)
+				return []migrate.Write{{Row: r.Key(), Mutation: m}}, nil
+			},
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown op %q, use createTable, deleteTable, createFamily, deleteFamily, setGCPolicy, rekey or deleteColumn", s.Op)
+}
+
+func loadMigrations(path string) (string, []migrate.Migration, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+	var f migrationFile
+	if err := json.Unmarshal(data, &f); err != nil {
+		return "", nil, fmt.Errorf("%s: %w", path, err)
+	}
+	var ms []migrate.Migration
+	for _, spec := range f.Migrations {
+		m := migrate.Migration{Version: spec.Version, Name: spec.Name}
+		for _, s := range spec.Up {
+			step, err := s.step()
+			if err != nil {
+				return "", nil, fmt.Errorf("%s: migration %d: %w", path, spec.Version, err)
+			}
+			m.Up = append(m.Up, step)
+		}
+		for _, s := range spec.Down {
+			step, err := s.step()
+			if err != nil {
+				return "", nil, fmt.Errorf("%s: migration %d: %w", path, spec.Version, err)
+			}
+			m.Down = append(m.Down, step)
+		}
+		ms = append(ms, m)
+	}
+	return f.MetaTable, ms, nil
+}
+
+func runMigrate(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(migrateCmd)
+	file := fs.String("file", "migrations.json", "migrations file")
+	meta := fs.String("meta", "", "table recording the applied migrations, overrides the file, schema_migrations if neither sets it")
+	dryRun := fs.Bool("dry-run", false, "log the steps and count the rows data migrations would change without writing")
+	fs.Parse(args)
+	if fs.NArg() == 0 || fs.NArg() > 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	target := 0
+	if fs.NArg() == 2 {
+		var err error
+		if target, err = strconv.Atoi(fs.Arg(1)); err != nil {
+			return fmt.Errorf("bad version %q", fs.Arg(1))
+		}
+	}
+
+	metaTable, migrations, err := loadMigrations(*file)
+	if err != nil {
+		return err
+	}
+	if *meta != "" {
+		metaTable = *meta
+	}
+
+	clients, err := cfg.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer clients.Close()
+	m, err := migrate.New(clients.Admin, clients.Data, migrate.Options{MetaTable: metaTable, DryRun: *dryRun}, migrations...)
+	if err != nil {
+		return err
+	}
+
+	switch fs.Arg(0) {
+	case "up":
+		return m.Up(ctx, target)
+	case "down":
+		if fs.NArg() == 1 {
+			target = -1 // only the newest
+		}
+		return m.Down(ctx, target)
+	case "unlock":
+		return m.Unlock(ctx)
+	case "status":
+		st, err := m.Status(ctx)
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tSTATE\tAPPLIED\tPROGRESS")
+		for _, s := range st {
+			state, applied, progress := s.State, "", ""
+			switch {
+			case s.Unknown:
+				state += ", unknown to this file"
+			case state == "":
+				state = "pending"
+			}
+			if !s.AppliedAt.IsZero() {
+				applied = s.AppliedAt.Local().Format("2006-01-02 15:04:05")
+			}
+			if s.State != "applied" && s.State != "" {
+				progress = fmt.Sprintf("step %d", s.Step+1)
+				if s.Checkpoint != "" {
+					progress += fmt.Sprintf(", %d rows up to %q", s.Rows, s.Checkpoint)
+				}
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", s.Version, s.Name, state, applied, progress)
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown migrate command %q, use up, down, status or unlock", fs.Arg(0))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"time"
+
+	"bigworkshop/btenv"
+	"bigworkshop/purge"
+	"github.com/sirupsen/logrus"
+)
+
+var purgeCmd = &command{
+	name:  "purge",
+	usage: "-table t (-prefix p | -start k -end k | -all) [-scan] [-dry-run] [-yes] [-audit file]",
+	help:  "deletes all rows with a prefix or in a key range after showing how many and asking, and logs every deleted key",
+}
+
+func init() {
+	purgeCmd.run = runPurge
+	register(purgeCmd)
+}
+
+func runPurge(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(purgeCmd)
+	tableName := fs.String("table", "", "table to delete from")
+	prefix := fs.String("prefix", "", "delete the rows with this prefix")
+	start := fs.String("start", "", "first row key to delete")
+	end := fs.String("end", "", "row key after the last one to delete")
+	all := fs.Bool("all", false, "delete every row of the table")
+	scan := fs.Bool("scan", false, "scan and delete in batches even where DropRowRange works")
+	dryRun := fs.Bool("dry-run", false, "only show what would be deleted")
+	yes := fs.Bool("yes", false, "do not ask before deleting")
+	auditPath := fs.String("audit", "purge-audit.jsonl", "json lines file the deleted keys are appended to, empty for none")
+	batch := fs.Int("batch", 500, "rows per ApplyBulk when scanning")
+	fs.Parse(args)
+
+	if *tableName == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	opts := purge.Options{Prefix: *prefix, Start: *start, End: *end, All: *all, Scan: *scan, Batch: *batch}
+
+	clients, err := cfg.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer clients.Close()
+	tbl := clients.Data.Open(*tableName)
+
+	p, err := purge.Count(ctx, tbl, opts)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s of %s: %d rows with %d cells\n", opts, *tableName, p.Rows, p.Cells)
+	if p.Rows == 0 {
+		return nil
+	}
+	fmt.Printf("from %q to %q, first rows:\n", p.First, p.Last)
+	for _, k := range p.Sample {
+		fmt.Printf("  %s\n", k)
+	}
+	if *dryRun {
+		return nil
+	}
+	if !*yes {
+		fmt.Printf("type the table name to delete them: ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if strings.TrimSpace(answer) != *tableName {
+			return fmt.Errorf("not confirmed, nothing deleted")
+		}
+	}
+
+	if *auditPath != "" {
+		f, err := os.OpenFile(*auditPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		opts.Audit = f
+		if u, err := user.Current(); err == nil {
+			opts.User = u.Username
+		}
+	}
+	began := time.Now()
+	last := began
+	opts.Progress = func(rows int64) {
+		if time.Since(last) > 2*time.Second {
+			last = time.Now()
+			logrus.Infof("%d rows deleted", rows)
+		}
+	}
+	rep, err := purge.Run(ctx, clients.Admin, *tableName, tbl, opts)
+	if err != nil {
+		return err
+	}
+	if rep.Method == purge.Drop && opts.Audit == nil {
+		fmt.Printf("dropped %s in %v\n", opts, time.Since(began).Round(time.Millisecond))
+	} else {
+		fmt.Printf("deleted %d rows with %d cells with %s in %v\n", rep.Rows, rep.Cells, rep.Method, time.Since(began).Round(time.Millisecond))
+	}
+	if *auditPath != "" {
+		fmt.Printf("deleted keys are logged in %s\n", *auditPath)
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"bigworkshop/btenv"
+	"bigworkshop/queue"
+)
+
+var queueCmd = &command{
+	name:  "queue",
+	usage: "-table t -queue q [-priority n] [-delay d] [-lease d] [-max-attempts n] [-n n] (enqueue body... | claim | ack key token | nack key token | peek | stats)",
+	help:  "enqueues, claims and acks messages of a work queue in a table and shows its head and counts",
+}
+
+func init() {
+	queueCmd.run = runQueue
+	register(queueCmd)
+}
+
+func runQueue(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(queueCmd)
+	tableName := fs.String("table", "", "table")
+	name := fs.String("queue", "", "queue name, -dead for its dead letters")
+	family := fs.String("family", "q", "family of the messages, created by enqueue if missing")
+	priority := fs.Int("priority", 5, "enqueue priority, 0 is the highest")
+	delay := fs.Duration("delay", 0, "enqueue and nack hide messages for this long")
+	lease := fs.Duration("lease", 30*time.Second, "visibility timeout of claimed messages")
+	maxAttempts := fs.Int("max-attempts", 5, "claims after which a message is dead lettered")
+	n := fs.Int("n", 10, "messages claimed or peeked")
+	fs.Parse(args)
+
+	if *tableName == "" || *name == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	nargs := map[string]int{"claim": 1, "ack": 3, "nack": 3, "peek": 1, "stats": 1}
+	if want, ok := nargs[fs.Arg(0)]; (ok && fs.NArg() != want) || (fs.Arg(0) == "enqueue" && fs.NArg() < 2) {
+		fs.Usage()
+		os.Exit(2)
+	} else if !ok && fs.Arg(0) != "enqueue" {
+		return fmt.Errorf("unknown queue command %q, use enqueue, claim, ack, nack, peek or stats", fs.Arg(0))
+	}
+	clients, err := cfg.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer clients.Close()
+	q := queue.New(clients.Data.Open(*tableName), *name, queue.Options{Family: *family, Lease: *lease, MaxAttempts: *maxAttempts})
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	switch fs.Arg(0) {
+	case "enqueue":
+		if err := ensureFamily(ctx, clients.Admin, *tableName, *family); err != nil {
+			return err
+		}
+		for _, body := range fs.Args()[1:] {
+			key, err := q.Enqueue(ctx, []byte(body), queue.EnqueueOptions{Priority: *priority, Delay: *delay})
+			if err != nil {
+				return err
+			}
+			fmt.Println(key)
+		}
+		return nil
+	case "claim":
+		msgs, err := q.Claim(ctx, *n)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(tw, "KEY\tTOKEN\tATTEMPTS\tEXPIRES\tBODY")
+		for _, m := range msgs {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%q\n", m.Key, m.Token, m.Attempts, m.LeaseExpiry.Local().Format("15:04:05.000"), m.Body)
+		}
+		return tw.Flush()
+	case "ack", "nack":
+		m := &queue.Message{Key: fs.Arg(1), Token: fs.Arg(2)}
+		if fs.Arg(0) == "ack" {
+			return q.Ack(ctx, m)
+		}
+		return q.Nack(ctx, m, *delay)
+	case "peek":
+		msgs, err := q.Peek(ctx, *n)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(tw, "KEY\tATTEMPTS\tLEASED UNTIL\tBODY")
+		for _, m := range msgs {
+			until := ""
+			if m.LeaseExpiry.After(time.Now()) {
+				until = m.LeaseExpiry.Local().Format("15:04:05.000")
+			}
+			fmt.Fprintf(tw, "%s\t%d\t%s\t%q\n", m.Key, m.Attempts, until, m.Body)
+		}
+		return tw.Flush()
+	default:
+		s, err := q.Stats(ctx)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d messages, %d leased or delayed\n", s.Total(), s.Leased)
+		if !s.Oldest.IsZero() {
+			fmt.Printf("oldest ready message waits for %v\n", time.Since(s.Oldest).Round(time.Millisecond))
+		}
+		fmt.Fprintln(tw, "PRIORITY\tREADY")
+		for p, r := range s.Ready {
+			if r > 0 {
+				fmt.Fprintf(tw, "%d\t%d\n", p, r)
+			}
+		}
+		return tw.Flush()
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"bigworkshop/btenv"
+	"bigworkshop/keycodec"
+	"bigworkshop/rekey"
+	"github.com/sirupsen/logrus"
+)
+
+var rekeyCmd = &command{
+	name:  "rekey",
+	usage: "-table t [-to-table t] [-prefix p | -start k -end k] (-from scheme -to scheme | -replace old=new) [-delete] [-dry-run]",
+	help:  "moves rows to new keys with all cell versions, verifies the copies by checksum and optionally deletes the old rows",
+}
+
+func init() {
+	rekeyCmd.run = runRekey
+	register(rekeyCmd)
+}
+
+func runRekey(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(rekeyCmd)
+	tableName := fs.String("table", "", "table to read")
+	toTable := fs.String("to-table", "", "table to write, -table if empty")
+	prefix := fs.String("prefix", "", "only rows with this prefix, also the key prefix of -from and -to")
+	start := fs.String("start", "", "first row key")
+	end := fs.String("end", "", "row key after the last one")
+	from := fs.String("from", "", "key scheme of the old keys, see keycodec")
+	to := fs.String("to", "", "key scheme of the new keys, e.g. padded-desc:5:10000")
+	replace := fs.String("replace", "", "replace a key prefix instead, old=new")
+	del := fs.Bool("delete", false, "delete the old rows once their copies are verified")
+	dryRun := fs.Bool("dry-run", false, "only count the rows that would be moved")
+	batch := fs.Int("batch", 500, "rows per batch")
+	concurrency := fs.Int("c", 8, "concurrent deletes")
+	fs.Parse(args)
+
+	codecs := *from != "" || *to != ""
+	if *tableName == "" || codecs == (*replace != "") {
+		fs.Usage()
+		os.Exit(2)
+	}
+	t, err := keyTransform(*from, *to, *replace, *prefix)
+	if err != nil {
+		return err
+	}
+	if *toTable == "" {
+		*toTable = *tableName
+	}
+
+	clients, err := cfg.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer clients.Close()
+
+	began := time.Now()
+	last := began
+	rep, err := rekey.Run(ctx, clients.Data.Open(*tableName), clients.Data.Open(*toTable), t, rekey.Options{
+		Prefix:      *prefix,
+		Start:       *start,
+		End:         *end,
+		DeleteOld:   *del,
+		Batch:       *batch,
+		Concurrency: *concurrency,
+		DryRun:      *dryRun,
+		Progress: func(rep rekey.Report) {
+			if time.Since(last) > 2*time.Second {
+				last = time.Now()
+				logrus.Infof("%d rows scanned, %d moved", rep.Scanned, rep.Moved)
+			}
+		},
+	})
+	if *dryRun {
+		fmt.Printf("would move %d of %d rows with %d cells\n", rep.Moved, rep.Scanned, rep.Cells)
+		return err
+	}
+	fmt.Printf("%v in %v\n", rep, time.Since(began).Round(time.Millisecond))
+	if err != nil {
+		return err
+	}
+	if !rep.Verified() {
+		return fmt.Errorf("%d copies do not match their source rows, their old rows were kept", rep.Mismatched)
+	}
+	if rep.Rejected > 0 {
+		return fmt.Errorf("%d rows have no key in the new scheme and kept their old keys", rep.Rejected)
+	}
+	return nil
+}
+
+// keyTransform returns the key change of -from and -to key schemes or of
+// -replace old=new, nil if neither is given.
+func keyTransform(from, to, replace, prefix string) (rekey.Transform, error) {
+	switch {
+	case from != "" || to != "":
+		fromCodec, err := keycodec.Parse(from, prefix)
+		if err != nil {
+			return nil, err
+		}
+		toCodec, err := keycodec.Parse(to, prefix)
+		if err != nil {
+			return nil, err
+		}
+		return rekey.Codec(fromCodec, toCodec), nil
+	case replace != "":
+		old, new, ok := strings.Cut(replace, "=")
+		if !ok || old == new {
+			return nil, fmt.Errorf("bad -replace %q, want old=new", replace)
+		}
+		return rekey.Prefix(old, new), nil
+	}
+	return nil, nil
+}
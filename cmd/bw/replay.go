@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"bigworkshop/btenv"
+	"bigworkshop/replay"
+	"github.com/sirupsen/logrus"
+)
+
+var recordCmd = &command{
+	name:  "record",
+	usage: "-out session.jsonl <command> [args]",
+	help:  "runs another command and records its bigtable rpcs for replay",
+}
+
+var replayCmd = &command{
+	name:  "replay",
+	usage: "-file session.jsonl [-listen localhost:8088] [-strict]",
+	help:  "serves recorded rpcs back in place of the emulator",
+}
+
+func init() {
+	recordCmd.run = runRecord
+	replayCmd.run = runReplay
+	register(recordCmd)
+	register(replayCmd)
+}
+
+func runRecord(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(recordCmd)
+	out := fs.String("out", "session.jsonl", "file to record to")
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("missing command to record")
+	}
+	c, ok := commands[fs.Arg(0)]
+	if !ok || c == recordCmd {
+		return fmt.Errorf("unknown command %q, run bw help", fs.Arg(0))
+	}
+
+	rec, err := replay.Create(*out)
+	if err != nil {
+		return err
+	}
+	cfg.DialOptions = append(cfg.DialOptions, rec.DialOptions()...)
+	err = c.run(ctx, cfg, fs.Args()[1:])
+	if cerr := rec.Close(); err == nil {
+		err = cerr
+	}
+	logrus.Infof("recorded to %s", *out)
+	return err
+}
+
+func runReplay(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(replayCmd)
+	file := fs.String("file", "session.jsonl", "recording to serve")
+	listen := fs.String("listen", "localhost:8088", "address to listen on, point "+btenv.EmulatorHostEnv+" of the client here")
+	strict := fs.Bool("strict", false, "only replay calls whose request matches the recording exactly")
+	fs.Parse(args)
+
+	srv, err := replay.Load(*file)
+	if err != nil {
+		return err
+	}
+	srv.Strict = *strict
+	lis, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return err
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	logrus.Infof("replaying %s on %s", *file, lis.Addr())
+	err = srv.Serve(lis)
+	if unused := srv.Unused(); len(unused) > 0 {
+		logrus.Warnf("%d recorded calls were not replayed", len(unused))
+	}
+	return err
+}
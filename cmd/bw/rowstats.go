@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"bigworkshop/btenv"
+	"bigworkshop/sizeguard"
+	"cloud.google.com/go/bigtable"
+)
+
+var rowstatsCmd = &command{
+	name:  "rowstats",
+	usage: "-table t [-prefix p | -start k [-end k]] [-top n] [-limit rows] [-cell-limit bytes] [-row-limit bytes]",
+	help:  "estimates the sizes of the rows in a range and lists the largest and widest ones and those over the limits",
+}
+
+func init() {
+	rowstatsCmd.run = runRowstats
+	register(rowstatsCmd)
+}
+
+func runRowstats(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(rowstatsCmd)
+	tableName := fs.String("table", "", "table")
+	prefix := fs.String("prefix", "", "only rows with this prefix")
+	start := fs.String("start", "", "first row key")
+	end := fs.String("end", "", "row key after the last one")
+	top := fs.Int("top", 10, "number of largest and widest rows")
+	limit := fs.Int64("limit", 0, "rows scanned, 0 for all")
+	cellLimit := fs.Int64("cell-limit", sizeguard.MaxCellBytes, "cells over this many bytes are reported")
+	rowLimit := fs.Int64("row-limit", sizeguard.MaxRowBytes, "rows over this many bytes are reported")
+	fs.Parse(args)
+
+	if *tableName == "" || fs.NArg() != 0 || (*prefix != "" && (*start != "" || *end != "")) {
+		fs.Usage()
+		os.Exit(2)
+	}
+	var rs bigtable.RowSet = bigtable.InfiniteRange(*start)
+	switch {
+	case *prefix != "":
+		rs = bigtable.PrefixRange(*prefix)
+	case *end != "":
+		rs = bigtable.NewRange(*start, *end)
+	}
+
+	clients, err := cfg.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer clients.Close()
+	limits := sizeguard.Limits{CellBytes: *cellLimit, RowBytes: *rowLimit}
+	rep, err := sizeguard.Scan(ctx, clients.Data.Open(*tableName), rs, sizeguard.ScanOptions{Limits: limits, Top: *top, Limit: *limit})
+	if err != nil {
+		return err
+	}
+
+	avg := int64(0)
+	if rep.Rows > 0 {
+		avg = rep.Bytes / rep.Rows
+	}
+	fmt.Printf("%d rows, %d cells, %d bytes, %d bytes per row\n", rep.Rows, rep.Cells, rep.Bytes, avg)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	list := func(title string, rows []sizeguard.RowStat) {
+		if len(rows) == 0 {
+			return
+		}
+		fmt.Fprintf(tw, "\n%s\n", title)
+		fmt.Fprintln(tw, "ROW\tBYTES\tCELLS\tCOLUMNS\tLARGEST CELL\tCOLUMN")
+		for _, s := range rows {
+			fmt.Fprintf(tw, "%q\t%d\t%d\t%d\t%d\t%s\n", s.Key, s.Stored, s.Cells, s.Columns, s.LargestCell, s.LargestColumn)
+		}
+	}
+	list("largest rows", rep.Largest)
+	list("widest rows", rep.Widest)
+	list(fmt.Sprintf("rows over the limits, cells %d and rows %d bytes", *cellLimit, *rowLimit), rep.OverLimit)
+	return tw.Flush()
+}
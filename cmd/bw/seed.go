@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"os"
+	"time"
+
+	"bigworkshop/btenv"
+	"bigworkshop/cellfmt"
+	"bigworkshop/datagen"
+	"cloud.google.com/go/bigtable"
+	"github.com/sirupsen/logrus"
+)
+
+var seedCmd = &command{
+	name:  "seed",
+	usage: "-schema file.json [-table t] [-rows n] [-seed n] [-first n] [-create] [-dry-run n]",
+	help:  "populates a table with reproducible synthetic rows from a schema file, see datagen/example.json",
+}
+
+func init() {
+	seedCmd.run = runSeed
+	register(seedCmd)
+}
+
+func runSeed(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(seedCmd)
+	schemaPath := fs.String("schema", "", "schema file")
+	tableName := fs.String("table", "", "table to write, overrides the schema")
+	rows := fs.Int64("rows", -1, "number of rows, overrides the schema")
+	seed := fs.Int64("seed", 0, "seed, overrides the schema if not zero")
+	first := fs.Int64("first", 0, "index of the first row, to add rows to an earlier run")
+	create := fs.Bool("create", false, "create the table and its families with their gc policies if missing")
+	dryRun := fs.Int("dry-run", 0, "print this many rows instead of writing")
+	concurrency := fs.Int("c", 4, "concurrent ApplyBulk calls")
+	fs.Parse(args)
+
+	if *schemaPath == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+	schema, err := datagen.Load(*schemaPath)
+	if err != nil {
+		return err
+	}
+	if *tableName != "" {
+		schema.Table = *tableName
+	}
+	if *rows >= 0 {
+		schema.Rows = *rows
+	}
+	if *seed != 0 {
+		schema.Seed = *seed
+	}
+
+	if *dryRun > 0 {
+		var out []bigtable.Row
+		for i := *first; i < *first+int64(*dryRun) && i < schema.Rows; i++ {
+			if _, row := schema.Row(i); len(row) > 0 {
+				out = append(out, row)
+			}
+		}
+		return cellfmt.WriteRows(os.Stdout, out, cellfmt.Auto)
+	}
+
+	clients, err := cfg.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer clients.Close()
+
+	if *create {
+		if err := createSchemaTable(ctx, clients.Admin, schema); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	last := start
+	n, err := datagen.Populate(ctx, clients.Data.Open(schema.Table), schema, datagen.Options{
+		First:       *first,
+		Concurrency: *concurrency,
+		Progress: func(rows int64) {
+			if time.Since(last) > 2*time.Second {
+				last = time.Now()
+				logrus.Infof("%d rows written", rows)
+			}
+		},
+	})
+	logrus.Infof("wrote %d rows to %s in %v", n, schema.Table, time.Since(start).Round(time.Millisecond))
+	return err
+}
+
+// createSchemaTable creates the table and the families of the schema that
+// are missing, new families get their gc policy.
+func createSchemaTable(ctx context.Context, admin *bigtable.AdminClient, s *datagen.Schema) error {
+	tables, err := admin.Tables(ctx)
+	if err != nil {
+		return err
+	}
+	exists := false
+	for _, t := range tables {
+		exists = exists || t == s.Table
+	}
+	if !exists {
+		if err := admin.CreateTable(ctx, s.Table); err != nil {
+			return err
+		}
+	}
+	info, err := admin.TableInfo(ctx, s.Table)
+	if err != nil {
+		return err
+	}
+	have := map[string]bool{}
+	for _, f := range info.Families {
+		have[f] = true
+	}
+	for _, f := range s.Families {
+		if have[f.Name] {
+			continue
+		}
+		if err := admin.CreateColumnFamily(ctx, s.Table, f.Name); err != nil {
+			return err
+		}
+		if f.GCPolicy == "" {
+			continue
+		}
+		gc, err := parseGCPolicy(f.GCPolicy)
+		if err != nil {
+			return err
+		}
+		if err := admin.SetGCPolicy(ctx, s.Table, f.Name, gc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
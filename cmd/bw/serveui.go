@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"bigworkshop/btenv"
+	"bigworkshop/webui"
+	"github.com/sirupsen/logrus"
+)
+
+var serveUICmd = &command{
+	name:  "serve-ui",
+	usage: "[-addr localhost:8080] [-write] [-page n]",
+	help:  "serves a web based data explorer, read only unless -write is given",
+}
+
+func init() {
+	serveUICmd.run = runServeUI
+	register(serveUICmd)
+}
+
+func runServeUI(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(serveUICmd)
+	addr := fs.String("addr", "localhost:8080", "address to listen on")
+	write := fs.Bool("write", false, "allow setting and deleting cells")
+	pageSize := fs.Int("page", 25, "rows per page")
+	fs.Parse(args)
+
+	clients, err := cfg.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer clients.Close()
+
+	srv := &http.Server{
+		Addr:    *addr,
+		Handler: webui.New(clients.Data, clients.Admin, webui.Options{Writable: *write, PageSize: *pageSize}),
+	}
+	return serve(ctx, srv)
+}
+
+// serve runs srv until ctx is done and then shuts it down gracefully.
+func serve(ctx context.Context, srv *http.Server) error {
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	logrus.Infof("listening on http://%s", srv.Addr)
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,774 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bigworkshop/btenv"
+	"bigworkshop/cellfmt"
+	"bigworkshop/filterexpr"
+	"cloud.google.com/go/bigtable"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/term"
+)
+
+var shellCmd = &command{
+	name:  "shell",
+	usage: "[-table tbl]",
+	help:  "interactive shell with get, scan, set, delete, rmw, filters and schema commands",
+}
+
+func init() {
+	shellCmd.run = runShell
+	register(shellCmd)
+}
+
+func runShell(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(shellCmd)
+	table := fs.String("table", "tbl", "table to start with")
+	fs.Parse(args)
+
+	clients, err := cfg.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer clients.Close()
+
+	sh := &shell{
+		clients:    clients,
+		decoding:   cellfmt.Auto,
+		families:   map[string][]string{},
+		qualifiers: map[string][]string{},
+	}
+	sh.use(ctx, *table)
+
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		// scripted use: bw shell < commands.txt
+		sh.out = os.Stdout
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if sh.exec(ctx, scanner.Text()) {
+				break
+			}
+		}
+		return scanner.Err()
+	}
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "")
+	t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		return sh.complete(ctx, t, line, pos)
+	}
+	sh.out = t
+	logrus.SetOutput(t)
+	defer logrus.SetOutput(os.Stderr)
+
+	fmt.Fprintln(t, "bigtable shell, type help for the list of commands, tab completes")
+	for {
+		t.SetPrompt(sh.table + "> ")
+		line, err := t.ReadLine()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && err != term.ErrPasteIndicator {
+			return err
+		}
+		if sh.exec(ctx, line) {
+			return nil
+		}
+	}
+}
+
+type shellCommand struct {
+	usage string
+	help  string
+	// complete says what the n-th argument completes to.
+	complete func(n int) completion
+	run      func(sh *shell, ctx context.Context, l *cmdLine) error
+}
+
+type completion int
+
+const (
+	completeNothing completion = iota
+	completeTable
+	completeColumn
+	completeFamily
+	completeDecoding
+	completeFilter
+)
+
+func completeAlways(c completion) func(int) completion {
+	return func(int) completion { return c }
+}
+
+// completeAfterRow completes columns for everything after the row key.
+func completeAfterRow(n int) completion {
+	if n == 0 {
+		return completeNothing
+	}
+	return completeColumn
+}
+
+var shellCommands map[string]shellCommand
+
+func init() {
+	shellCommands = map[string]shellCommand{
+		"help":         {"[command]", "lists commands or shows the help of one command", nil, (*shell).cmdHelp},
+		"exit":         {"", "leaves the shell, same as quit or ctrl-d", nil, nil},
+		"quit":         {"", "leaves the shell", nil, nil},
+		"tables":       {"", "lists the tables of the instance", nil, (*shell).cmdTables},
+		"use":          {"<table>", "switches the current table", completeAlways(completeTable), (*shell).cmdUse},
+		"schema":       {"[table]", "shows column families and gc policies", completeAlways(completeTable), (*shell).cmdSchema},
+		"createtable":  {"<table>", "creates a table", nil, (*shell).cmdCreateTable},
+		"deletetable":  {"<table>", "deletes a table and all of its data", completeAlways(completeTable), (*shell).cmdDeleteTable},
+		"createfamily": {"<family> [gcpolicy]", "creates a column family in the current table", nil, (*shell).cmdCreateFamily},
+		"deletefamily": {"<family>", "deletes a column family and all of its cells", completeAlways(completeFamily), (*shell).cmdDeleteFamily},
+		"setgcpolicy":  {"<family> <never|maxversions=n|maxage=d> [and|or ...]", "sets the gc policy of a family", completeAlways(completeFamily), (*shell).cmdSetGCPolicy},
+		"get":          {"<row> [filter]", "reads a single row, see filter help for the filter syntax", completeAfterRow, (*shell).cmdGet},
+		"scan":         {"[prefix=p] [start=k] [end=k] [limit=n] [filter=expr]", "reads a range of rows, filter= has to come last, limit=0 reads everything", nil, (*shell).cmdScan},
+		"set":          {"<row> family:qualifier=value ... [ts=time]", "writes cells, ts takes RFC3339 or a duration relative to now", completeAfterRow, (*shell).cmdSet},
+		"delete":       {"<row> [family:qualifier | family ...]", "deletes columns, families or the whole row", completeAfterRow, (*shell).cmdDelete},
+		"rmw":          {"<row> append family:qualifier=value | incr family:qualifier=delta ...", "read modify write, prints the modified cells", completeAfterRow, (*shell).cmdRMW},
+		"filter":       {"[expr | off | help]", "sets the filter applied to every get and scan", completeAlways(completeFilter), (*shell).cmdFilter},
+		"decode":       {"[auto|utf8|hex|int64|json]", "sets how values are printed", completeAlways(completeDecoding), (*shell).cmdDecode},
+		"refresh":      {"", "reloads tables, families and qualifiers used for completion", nil, (*shell).cmdRefresh},
+	}
+}
+
+type shell struct {
+	clients  *btenv.Clients
+	out      io.Writer
+	table    string
+	tbl      *bigtable.Table
+	decoding cellfmt.Decoding
+	filter   string
+
+	tables     []string
+	families   map[string][]string
+	qualifiers map[string][]string
+}
+
+// exec runs one line and reports whether the shell should exit.
+func (sh *shell) exec(ctx context.Context, line string) bool {
+	l, err := splitLine(line)
+	if err != nil {
+		fmt.Fprintf(sh.out, "error: %v\n", err)
+		return false
+	}
+	if len(l.args) == 0 || strings.HasPrefix(l.args[0], "#") {
+		return false
+	}
+	name := l.args[0]
+	if name == "exit" || name == "quit" {
+		return true
+	}
+	c, ok := shellCommands[name]
+	if !ok {
+		fmt.Fprintf(sh.out, "unknown command %q, type help for the list of commands\n", name)
+		return false
+	}
+
+	l.shift()
+	ctx, cancel := context.WithTimeout(ctx, time.Second*30)
+	defer cancel()
+	if err := c.run(sh, ctx, l); err != nil {
+		fmt.Fprintf(sh.out, "error: %v\n", err)
+	}
+	return false
+}
+
+func (sh *shell) use(ctx context.Context, table string) {
+	sh.table = table
+	sh.tbl = sh.clients.Data.Open(table)
+	sh.loadSchema(ctx, table)
+}
+
+func (sh *shell) cmdHelp(_ context.Context, l *cmdLine) error {
+	if len(l.args) > 0 {
+		c, ok := shellCommands[l.args[0]]
+		if !ok {
+			return fmt.Errorf("unknown command %q", l.args[0])
+		}
+		fmt.Fprintf(sh.out, "%s %s\n  %s\n", l.args[0], c.usage, c.help)
+		return nil
+	}
+	for _, name := range sortedKeys(shellCommands) {
+		fmt.Fprintf(sh.out, "  %-13s %s\n", name, shellCommands[name].help)
+	}
+	return nil
+}
+
+func (sh *shell) cmdTables(ctx context.Context, _ *cmdLine) error {
+	tables, err := sh.clients.Admin.Tables(ctx)
+	if err != nil {
+		return err
+	}
+	sort.Strings(tables)
+	sh.tables = tables
+	for _, t := range tables {
+		fmt.Fprintln(sh.out, t)
+	}
+	return nil
+}
+
+func (sh *shell) cmdUse(ctx context.Context, l *cmdLine) error {
+	if len(l.args) != 1 {
+		return errUsage
+	}
+	sh.use(ctx, l.args[0])
+	return nil
+}
+
+func (sh *shell) cmdSchema(ctx context.Context, l *cmdLine) error {
+	table := sh.table
+	if len(l.args) > 0 {
+		table = l.args[0]
+	}
+	info, err := sh.clients.Admin.TableInfo(ctx, table)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(sh.out, "table %s\n", table)
+	sort.Slice(info.FamilyInfos, func(i, j int) bool { return info.FamilyInfos[i].Name < info.FamilyInfos[j].Name })
+	for _, fam := range info.FamilyInfos {
+		gc := fam.GCPolicy
+		if gc == "" {
+			gc = "never"
+		}
+		fmt.Fprintf(sh.out, "  %-16s gc: %s\n", fam.Name, gc)
+	}
+	return nil
+}
+
+func (sh *shell) cmdCreateTable(ctx context.Context, l *cmdLine) error {
+	if len(l.args) != 1 {
+		return errUsage
+	}
+	if err := sh.clients.Admin.CreateTable(ctx, l.args[0]); err != nil {
+		return err
+	}
+	sh.tables = nil
+	return nil
+}
+
+func (sh *shell) cmdDeleteTable(ctx context.Context, l *cmdLine) error {
+	if len(l.args) != 1 {
+		return errUsage
+	}
+	if err := sh.clients.Admin.DeleteTable(ctx, l.args[0]); err != nil {
+		return err
+	}
+	sh.tables = nil
+	return nil
+}
+
+func (sh *shell) cmdCreateFamily(ctx context.Context, l *cmdLine) error {
+	if len(l.args) == 0 {
+		return errUsage
+	}
+	if err := sh.clients.Admin.CreateColumnFamily(ctx, sh.table, l.args[0]); err != nil {
+		return err
+	}
+	if len(l.args) > 1 {
+		if err := sh.setGCPolicy(ctx, l.args[0], l.rest(1)); err != nil {
+			return err
+		}
+	}
+	sh.loadSchema(ctx, sh.table)
+	return nil
+}
+
+func (sh *shell) cmdDeleteFamily(ctx context.Context, l *cmdLine) error {
+	if len(l.args) != 1 {
+		return errUsage
+	}
+	if err := sh.clients.Admin.DeleteColumnFamily(ctx, sh.table, l.args[0]); err != nil {
+		return err
+	}
+	sh.loadSchema(ctx, sh.table)
+	return nil
+}
+
+func (sh *shell) cmdSetGCPolicy(ctx context.Context, l *cmdLine) error {
+	if len(l.args) < 2 {
+		return errUsage
+	}
+	return sh.setGCPolicy(ctx, l.args[0], l.rest(1))
+}
+
+func (sh *shell) setGCPolicy(ctx context.Context, family, policy string) error {
+	gc, err := parseGCPolicy(policy)
+	if err != nil {
+		return err
+	}
+	return sh.clients.Admin.SetGCPolicy(ctx, sh.table, family, gc)
+}
+
+// readOpts combines the shell filter with the filter given to a single command.
+func (sh *shell) readOpts(expr string) ([]bigtable.ReadOption, error) {
+	var fs []bigtable.Filter
+	for _, e := range []string{sh.filter, expr} {
+		if e == "" {
+			continue
+		}
+		f, err := filterexpr.Parse(e)
+		if err != nil {
+			return nil, err
+		}
+		fs = append(fs, f)
+	}
+	switch len(fs) {
+	case 0:
+		return nil, nil
+	case 1:
+		return []bigtable.ReadOption{bigtable.RowFilter(fs[0])}, nil
+	}
+	return []bigtable.ReadOption{bigtable.RowFilter(bigtable.ChainFilters(fs...))}, nil
+}
+
+func (sh *shell) cmdGet(ctx context.Context, l *cmdLine) error {
+	if len(l.args) == 0 {
+		return errUsage
+	}
+	opts, err := sh.readOpts(l.rest(1))
+	if err != nil {
+		return err
+	}
+	row, err := sh.tbl.ReadRow(ctx, l.args[0], opts...)
+	if err != nil {
+		return err
+	}
+	if len(row) == 0 {
+		fmt.Fprintf(sh.out, "row %q not found\n", l.args[0])
+		return nil
+	}
+	return cellfmt.WriteRows(sh.out, []bigtable.Row{row}, sh.decoding)
+}
+
+func (sh *shell) cmdScan(ctx context.Context, l *cmdLine) error {
+	var (
+		prefix, start, end, expr string
+		limit                    = int64(25)
+	)
+	for i, arg := range l.args {
+		key, value, ok := strings.Cut(arg, "=")
+		if !ok {
+			return errUsage
+		}
+		switch key {
+		case "prefix":
+			prefix = value
+		case "start":
+			start = value
+		case "end":
+			end = value
+		case "limit":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return err
+			}
+			limit = n
+		case "filter":
+			expr = strings.TrimPrefix(l.rest(i), "filter=")
+		default:
+			return fmt.Errorf("unknown option %q", key)
+		}
+		if expr != "" {
+			break
+		}
+	}
+
+	var rr bigtable.RowSet = bigtable.NewRange(start, end)
+	if prefix != "" {
+		if start != "" || end != "" {
+			return fmt.Errorf("prefix cannot be combined with start or end")
+		}
+		rr = bigtable.PrefixRange(prefix)
+	}
+	opts, err := sh.readOpts(expr)
+	if err != nil {
+		return err
+	}
+	if limit > 0 {
+		opts = append(opts, bigtable.LimitRows(limit))
+	}
+
+	var rows []bigtable.Row
+	err = sh.tbl.ReadRows(ctx, rr, func(row bigtable.Row) bool {
+		rows = append(rows, row)
+		return true
+	}, opts...)
+	if err != nil {
+		return err
+	}
+	if err := cellfmt.WriteRows(sh.out, rows, sh.decoding); err != nil {
+		return err
+	}
+	fmt.Fprintf(sh.out, "%d rows\n", len(rows))
+	return nil
+}
+
+func (sh *shell) cmdSet(ctx context.Context, l *cmdLine) error {
+	if len(l.args) < 2 {
+		return errUsage
+	}
+	ts := bigtable.Now()
+	type cell struct{ fam, qual, value string }
+	var cells []cell
+	for _, arg := range l.args[1:] {
+		if strings.HasPrefix(arg, "ts=") {
+			t, err := filterexpr.ParseTime(strings.TrimPrefix(arg, "ts="), time.Now())
+			if err != nil {
+				return err
+			}
+			ts = bigtable.Time(t)
+			continue
+		}
+		fam, qual, value, err := parseCell(arg)
+		if err != nil {
+			return err
+		}
+		cells = append(cells, cell{fam, qual, value})
+	}
+
+	mut := bigtable.NewMutation()
+	for _, c := range cells {
+		mut.Set(c.fam, c.qual, ts, []byte(c.value))
+	}
+	if err := sh.tbl.Apply(ctx, l.args[0], mut); err != nil {
+		return err
+	}
+	for _, c := range cells {
+		sh.addQualifier(c.fam + ":" + c.qual)
+	}
+	return nil
+}
+
+func (sh *shell) cmdDelete(ctx context.Context, l *cmdLine) error {
+	if len(l.args) == 0 {
+		return errUsage
+	}
+	mut := bigtable.NewMutation()
+	if len(l.args) == 1 {
+		mut.DeleteRow()
+	}
+	for _, col := range l.args[1:] {
+		if fam, qual, ok := strings.Cut(col, ":"); ok {
+			mut.DeleteCellsInColumn(fam, qual)
+		} else {
+			mut.DeleteCellsInFamily(col)
+		}
+	}
+	return sh.tbl.Apply(ctx, l.args[0], mut)
+}
+
+func (sh *shell) cmdRMW(ctx context.Context, l *cmdLine) error {
+	if len(l.args) < 3 || len(l.args)%2 != 1 {
+		return errUsage
+	}
+	rmw := bigtable.NewReadModifyWrite()
+	for i := 1; i < len(l.args); i += 2 {
+		fam, qual, value, err := parseCell(l.args[i+1])
+		if err != nil {
+			return err
+		}
+		switch l.args[i] {
+		case "append":
+			rmw.AppendValue(fam, qual, []byte(value))
+		case "incr", "increment":
+			delta, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return err
+			}
+			rmw.Increment(fam, qual, delta)
+		default:
+			return fmt.Errorf("unknown read modify write %q, use append or incr", l.args[i])
+		}
+	}
+	row, err := sh.tbl.ApplyReadModifyWrite(ctx, l.args[0], rmw)
+	if err != nil {
+		return err
+	}
+	return cellfmt.WriteRows(sh.out, []bigtable.Row{row}, sh.decoding)
+}
+
+func (sh *shell) cmdFilter(_ context.Context, l *cmdLine) error {
+	switch {
+	case len(l.args) == 0:
+		if sh.filter == "" {
+			fmt.Fprintln(sh.out, "no filter")
+		} else {
+			fmt.Fprintln(sh.out, sh.filter)
+		}
+		return nil
+	case l.args[0] == "off":
+		sh.filter = ""
+		return nil
+	case l.args[0] == "help":
+		fmt.Fprintln(sh.out, "combine with && (chain) and || (interleave), group with ( )")
+		for _, line := range filterexpr.Help() {
+			fmt.Fprintf(sh.out, "  %s\n", line)
+		}
+		return nil
+	}
+	expr := l.rest(0)
+	if _, err := filterexpr.Parse(expr); err != nil {
+		return err
+	}
+	sh.filter = expr
+	return nil
+}
+
+func (sh *shell) cmdDecode(_ context.Context, l *cmdLine) error {
+	if len(l.args) == 0 {
+		fmt.Fprintln(sh.out, sh.decoding)
+		return nil
+	}
+	d, err := cellfmt.ParseDecoding(l.args[0])
+	if err != nil {
+		return err
+	}
+	sh.decoding = d
+	return nil
+}
+
+func (sh *shell) cmdRefresh(ctx context.Context, _ *cmdLine) error {
+	sh.tables = nil
+	sh.loadSchema(ctx, sh.table)
+	return nil
+}
+
+// parseCell splits family:qualifier=value.
+func parseCell(s string) (fam, qual, value string, err error) {
+	col, value, ok := strings.Cut(s, "=")
+	if !ok {
+		return "", "", "", fmt.Errorf("%q is not family:qualifier=value", s)
+	}
+	fam, qual, ok = strings.Cut(col, ":")
+	if !ok {
+		return "", "", "", fmt.Errorf("%q is not family:qualifier=value", s)
+	}
+	return fam, qual, value, nil
+}
+
+// loadSchema caches the families of a table and samples its qualifiers for completion.
+func (sh *shell) loadSchema(ctx context.Context, table string) {
+	info, err := sh.clients.Admin.TableInfo(ctx, table)
+	if err != nil {
+		logrus.WithError(err).Warnf("could not load schema of %s", table)
+		return
+	}
+	fams := append([]string(nil), info.Families...)
+	sort.Strings(fams)
+	sh.families[table] = fams
+
+	// qualifiers are not part of the schema, sample them from the first rows
+	seen := map[string]bool{}
+	filter := bigtable.RowFilter(bigtable.ChainFilters(bigtable.LatestNFilter(1), bigtable.StripValueFilter()))
+	err = sh.clients.Data.Open(table).ReadRows(ctx, bigtable.InfiniteRange(""), func(row bigtable.Row) bool {
+		for _, c := range cellfmt.Cells(row) {
+			seen[c.Column()] = true
+		}
+		return true
+	}, filter, bigtable.LimitRows(100))
+	if err != nil {
+		logrus.WithError(err).Warnf("could not sample qualifiers of %s", table)
+	}
+	sh.qualifiers[table] = sortedKeys(seen)
+}
+
+func (sh *shell) addQualifier(col string) {
+	quals := sh.qualifiers[sh.table]
+	i := sort.SearchStrings(quals, col)
+	if i < len(quals) && quals[i] == col {
+		return
+	}
+	quals = append(quals, "")
+	copy(quals[i+1:], quals[i:])
+	quals[i] = col
+	sh.qualifiers[sh.table] = quals
+}
+
+// complete completes the word under the cursor. Ambiguous completions are
+// extended to their common prefix and listed above the prompt.
+func (sh *shell) complete(ctx context.Context, t *term.Terminal, line string, pos int) (string, int, bool) {
+	start := strings.LastIndexAny(line[:pos], " \t") + 1
+	word := line[start:pos]
+	fields := strings.Fields(line[:start])
+
+	var candidates []string
+	if len(fields) == 0 {
+		candidates = sortedKeys(shellCommands)
+	} else if c, ok := shellCommands[fields[0]]; ok && c.complete != nil {
+		candidates = sh.candidates(ctx, c.complete(len(fields)-1), word)
+	}
+
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, word) {
+			matches = append(matches, c)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+
+	completed := commonPrefix(matches)
+	if len(matches) == 1 && !strings.HasSuffix(completed, ":") && !strings.HasSuffix(completed, "(") {
+		completed += " "
+	}
+	if completed == word && len(matches) > 1 {
+		fmt.Fprintln(t, strings.Join(matches, "  "))
+	}
+	return line[:start] + completed + line[pos:], start + len(completed), true
+}
+
+func (sh *shell) candidates(ctx context.Context, c completion, word string) []string {
+	switch c {
+	case completeTable:
+		if sh.tables == nil {
+			tables, err := sh.clients.Admin.Tables(ctx)
+			if err != nil {
+				return nil
+			}
+			sort.Strings(tables)
+			sh.tables = tables
+		}
+		return sh.tables
+	case completeFamily:
+		return sh.families[sh.table]
+	case completeColumn:
+		if strings.Contains(word, ":") {
+			return sh.qualifiers[sh.table]
+		}
+		var fams []string
+		for _, f := range sh.families[sh.table] {
+			fams = append(fams, f+":")
+		}
+		return fams
+	case completeDecoding:
+		var ds []string
+		for _, d := range cellfmt.Decodings() {
+			ds = append(ds, string(d))
+		}
+		return ds
+	case completeFilter:
+		var fns []string
+		for _, f := range filterexpr.Functions() {
+			fns = append(fns, f+"(")
+		}
+		return append(fns, "off", "help")
+	}
+	return nil
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+var errUsage = errors.New("wrong arguments, see help <command>")
+
+// cmdLine is a split command line that remembers where each argument
+// started so that filter expressions can be taken verbatim.
+type cmdLine struct {
+	raw   string
+	args  []string
+	start []int
+}
+
+func (l *cmdLine) shift() {
+	l.args, l.start = l.args[1:], l.start[1:]
+}
+
+// rest returns the raw text from argument i to the end of the line.
+func (l *cmdLine) rest(i int) string {
+	if i >= len(l.args) {
+		return ""
+	}
+	return strings.TrimSpace(l.raw[l.start[i]:])
+}
+
+// splitLine splits a line on whitespace, single and double quotes group and
+// backslash escapes the next character.
+func splitLine(line string) (*cmdLine, error) {
+	l := &cmdLine{raw: line}
+	var (
+		cur     strings.Builder
+		inWord  bool
+		quote   rune
+		escaped bool
+	)
+	for i, r := range line {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+		case r == ' ' || r == '\t':
+			if inWord {
+				l.args = append(l.args, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+			continue
+		default:
+			cur.WriteRune(r)
+		}
+		if !inWord {
+			inWord = true
+			l.start = append(l.start, i)
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c", quote)
+	}
+	if inWord {
+		l.args = append(l.args, cur.String())
+	}
+	return l, nil
+}
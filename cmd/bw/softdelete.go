@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"bigworkshop/btenv"
+	"bigworkshop/softdelete"
+	"cloud.google.com/go/bigtable"
+)
+
+var softdeleteCmd = &command{
+	name:  "softdelete",
+	usage: "-table t [-family f] [-prefix p] [-retention d] [-dry-run] (delete key... | undelete key... | list | reap)",
+	help:  "deletes rows with tombstones that reads skip, restores them and hard deletes those past the retention",
+}
+
+func init() {
+	softdeleteCmd.run = runSoftdelete
+	register(softdeleteCmd)
+}
+
+func runSoftdelete(ctx context.Context, cfg btenv.Config, args []string) error {
+	fs := newFlagSet(softdeleteCmd)
+	tableName := fs.String("table", "", "table")
+	family := fs.String("family", "deleted", "tombstone family, created by delete if missing")
+	qualifier := fs.String("qualifier", "at", "tombstone qualifier")
+	prefix := fs.String("prefix", "", "list and reap only rows with this prefix")
+	retention := fs.Duration("retention", 30*24*time.Hour, "reap rows deleted longer ago than this")
+	dryRun := fs.Bool("dry-run", false, "reap only counts the rows")
+	fs.Parse(args)
+
+	if *tableName == "" || fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+	clients, err := cfg.Dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer clients.Close()
+	tbl := softdelete.Wrap(clients.Data.Open(*tableName), softdelete.Options{Family: *family, Qualifier: *qualifier})
+	keys := fs.Args()[1:]
+
+	switch fs.Arg(0) {
+	case "delete":
+		if err := ensureFamily(ctx, clients.Admin, *tableName, *family); err != nil {
+			return err
+		}
+		for _, k := range keys {
+			if err := tbl.Delete(ctx, k); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("deleted %d rows, undelete restores them\n", len(keys))
+		return nil
+	case "undelete":
+		for _, k := range keys {
+			if err := tbl.Undelete(ctx, k); err != nil {
+				return err
+			}
+		}
+		fmt.Printf("restored %d rows\n", len(keys))
+		return nil
+	case "list":
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ROW\tDELETED")
+		rr := bigtable.RowRange(bigtable.InfiniteRange(""))
+		if *prefix != "" {
+			rr = bigtable.PrefixRange(*prefix)
+		}
+		err := tbl.ReadDeleted(ctx, rr, func(r bigtable.Row) bool {
+			at, _ := tbl.DeletedAt(r)
+			fmt.Fprintf(tw, "%s\t%s\n", r.Key(), at.Local().Format("2006-01-02 15:04:05"))
+			return true
+		}, bigtable.RowFilter(bigtable.StripValueFilter()))
+		if err != nil {
+			return err
+		}
+		return tw.Flush()
+	case "reap":
+		n, err := tbl.Reap(ctx, *retention, softdelete.ReapOptions{Prefix: *prefix, DryRun: *dryRun})
+		if *dryRun {
+			fmt.Printf("would hard delete %d rows deleted before %v\n", n, time.Now().Add(-*retention).Format("2006-01-02 15:04:05"))
+		} else {
+			fmt.Printf("hard deleted %d rows\n", n)
+		}
+		return err
+	}
+	return fmt.Errorf("unknown softdelete command %q, use delete, undelete, list or reap", fs.Arg(0))
+}
+
+// ensureFamily creates a column family unless the table has it.
+func ensureFamily(ctx context.Context, admin *bigtable.AdminClient, tbl, family string) error {
+	info, err := admin.TableInfo(ctx, tbl)
+	if err != nil {
+		return err
+	}
+	for _, f := range info.Families {
+		if f == family {
+			return nil
+		}
+	}
+	return admin.CreateColumnFamily(ctx, tbl, family)
+}
@@ -0,0 +1,329 @@
+// Package datagen populates tables with synthetic rows described by a
+// schema file, instead of the handful of cbt set commands the exercises
+// start with.
+//
+// The schema is json, every key part and column names a Generator:
+//
+//	{
+//	  "table": "users",
+//	  "rows": 1000,
+//	  "seed": 42,
+//	  "timestamps": {"from": "2023-01-01T00:00:00Z", "to": "2023-02-01T00:00:00Z"},
+//	  "key": [{"type": "const", "value": "user#"}, {"type": "sequence", "pad": 6}],
+//	  "families": [
+//	    {"name": "profile", "gcPolicy": "maxversions=3", "columns": [
+//	      {"qualifier": "name", "type": "name"},
+//	      {"qualifier": "email", "type": "email"},
+//	      {"qualifier": "city", "type": "city", "versions": 3}
+//	    ]},
+//	    {"name": "stats", "columns": [
+//	      {"qualifier": "visits", "type": "int", "min": 0, "max": 500, "encoding": "int64", "probability": 0.5}
+//	    ]}
+//	  ]
+//	}
+//
+// Row i only depends on the seed and i, so the same schema and seed always
+// give the same rows, also when they are written concurrently or only a
+// part of them is generated. Cell timestamps are random within Timestamps,
+// which is a fixed window rather than the current time for that reason.
+package datagen
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"sync"
+
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+)
+
+// Schema describes the rows of a table.
+type Schema struct {
+	// Table is the table the rows are written to.
+	Table string `json:"table"`
+	// Rows is the number of rows.
+	Rows int64 `json:"rows"`
+	// Seed makes the rows reproducible.
+	Seed int64 `json:"seed"`
+	// Timestamps is the window of cell timestamps and timestamp values,
+	// January 2023 if not set.
+	Timestamps *Window `json:"timestamps,omitempty"`
+	// Key parts are generated as text and concatenated to the row key.
+	Key      []Generator `json:"key"`
+	Families []Family    `json:"families"`
+
+	win     window
+	keyGens []genFunc
+	colGens [][]genFunc
+}
+
+// Window is a time range in RFC 3339.
+type Window struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Family is a column family and its columns.
+type Family struct {
+	Name string `json:"name"`
+	// GCPolicy is created with the family, in the syntax of cbt
+	// setgcpolicy, e.g. maxversions=3 or maxage=7d.
+	GCPolicy string   `json:"gcPolicy,omitempty"`
+	Columns  []Column `json:"columns"`
+}
+
+// Column is a column and the generator of its values.
+type Column struct {
+	Qualifier string `json:"qualifier"`
+	Generator
+	// Versions is the number of cells with different timestamps, 1 if zero.
+	Versions int `json:"versions,omitempty"`
+	// Probability is the chance that a row has the column, 1 if zero.
+	Probability float64 `json:"probability,omitempty"`
+}
+
+// Load reads and compiles a schema file.
+func Load(path string) (*Schema, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s, err := Parse(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return s, nil
+}
+
+// Parse parses and compiles a json schema.
+func Parse(data []byte) (*Schema, error) {
+	var s Schema
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, err
+	}
+	if err := s.Compile(); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// Compile checks the schema and prepares its generators, it has to be
+// called again after the schema was changed.
+func (s *Schema) Compile() error {
+	w := Window{From: "2023-01-01T00:00:00Z", To: "2023-02-01T00:00:00Z"}
+	if s.Timestamps != nil {
+		w = *s.Timestamps
+	}
+	var err error
+	if s.win, err = parseWindow(w.From, w.To); err != nil {
+		return fmt.Errorf("timestamps: %w", err)
+	}
+	if len(s.Key) == 0 {
+		return fmt.Errorf("schema has no key")
+	}
+	s.keyGens = make([]genFunc, len(s.Key))
+	for i, g := range s.Key {
+		if g.Encoding != "" && g.Encoding != "text" {
+			return fmt.Errorf("key part %d: keys are text", i)
+		}
+		if s.keyGens[i], err = g.compile(s.win); err != nil {
+			return fmt.Errorf("key part %d: %w", i, err)
+		}
+	}
+	s.colGens = make([][]genFunc, len(s.Families))
+	seen := map[string]bool{}
+	for fi, f := range s.Families {
+		if f.Name == "" {
+			return fmt.Errorf("family %d has no name", fi)
+		}
+		if seen[f.Name] {
+			return fmt.Errorf("family %s is listed twice", f.Name)
+		}
+		seen[f.Name] = true
+		s.colGens[fi] = make([]genFunc, len(f.Columns))
+		for ci, c := range f.Columns {
+			if c.Versions < 0 || c.Probability < 0 || c.Probability > 1 {
+				return fmt.Errorf("%s:%s: bad versions or probability", f.Name, c.Qualifier)
+			}
+			if int64(c.Versions) > s.win.to.Sub(s.win.from).Milliseconds() {
+				return fmt.Errorf("%s:%s: more versions than milliseconds in the window", f.Name, c.Qualifier)
+			}
+			if s.colGens[fi][ci], err = c.compile(s.win); err != nil {
+				return fmt.Errorf("%s:%s: %w", f.Name, c.Qualifier, err)
+			}
+		}
+	}
+	return nil
+}
+
+// rand returns the source of row i, seeded from the seed and i alone.
+func (s *Schema) rand(i int64) *rand.Rand {
+	// splitmix64, so that neighbouring rows get unrelated sources
+	z := uint64(s.Seed) + uint64(i+1)*0x9e3779b97f4a7c15
+	z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+	z = (z ^ z>>27) * 0x94d049bb133111eb
+	return rand.New(rand.NewSource(int64(z ^ z>>31)))
+}
+
+// Row returns the key and the cells of row i, the cells ordered like a
+// read returns them. A row whose columns all missed their probability has
+// no cells.
+func (s *Schema) Row(i int64) (string, bigtable.Row) {
+	rnd := s.rand(i)
+	key := ""
+	for _, g := range s.keyGens {
+		key += string(g(rnd, i))
+	}
+	row := bigtable.Row{}
+	for fi, f := range s.Families {
+		for ci, c := range f.Columns {
+			if c.Probability > 0 && c.Probability < 1 && rnd.Float64() >= c.Probability {
+				continue
+			}
+			versions := c.Versions
+			if versions == 0 {
+				versions = 1
+			}
+			// distinct timestamps, newest first
+			stamps := map[bigtable.Timestamp]bool{}
+			for len(stamps) < versions {
+				stamps[bigtable.Time(s.win.random(rnd))] = true
+			}
+			ordered := make([]bigtable.Timestamp, 0, versions)
+			for ts := range stamps {
+				ordered = append(ordered, ts)
+			}
+			sort.Slice(ordered, func(a, b int) bool { return ordered[a] > ordered[b] })
+			for _, ts := range ordered {
+				row[f.Name] = append(row[f.Name], bigtable.ReadItem{
+					Row:       key,
+					Column:    f.Name + ":" + c.Qualifier,
+					Timestamp: ts,
+					Value:     s.colGens[fi][ci](rnd, i),
+				})
+			}
+		}
+	}
+	for _, items := range row {
+		sort.SliceStable(items, func(a, b int) bool { return items[a].Column < items[b].Column })
+	}
+	return key, row
+}
+
+// Mutation returns the key and the mutation writing row i, nil if the row
+// has no cells.
+func (s *Schema) Mutation(i int64) (string, *bigtable.Mutation) {
+	key, row := s.Row(i)
+	if len(row) == 0 {
+		return key, nil
+	}
+	m := bigtable.NewMutation()
+	for fam, items := range row {
+		for _, it := range items {
+			m.Set(fam, it.Column[len(fam)+1:], it.Timestamp, it.Value)
+		}
+	}
+	return key, m
+}
+
+// Options configure Populate.
+type Options struct {
+	// First is the index of the first row, to generate a part of the rows.
+	First int64
+	// Batch is the number of rows per ApplyBulk, 500 if zero.
+	Batch int
+	// Concurrency is the number of concurrent ApplyBulk calls, 4 if zero.
+	Concurrency int
+	// Progress is called with the number of rows written so far.
+	Progress func(rows int64)
+}
+
+// Populate writes rows First to Rows-1 of the schema to tbl and returns how
+// many were written. Rows without cells are skipped, bigtable has no empty
+// rows.
+func Populate(ctx context.Context, tbl table.Table, s *Schema, opts Options) (int64, error) {
+	if opts.Batch <= 0 {
+		opts.Batch = 500
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 4
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	batches := make(chan int64)
+	var mu sync.Mutex
+	var written int64
+	var firstErr error
+	fail := func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < opts.Concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for first := range batches {
+				var keys []string
+				var muts []*bigtable.Mutation
+				for i := first; i < first+int64(opts.Batch) && i < s.Rows; i++ {
+					key, m := s.Mutation(i)
+					if m == nil {
+						continue
+					}
+					keys = append(keys, key)
+					muts = append(muts, m)
+				}
+				if len(keys) == 0 {
+					continue
+				}
+				errs, err := tbl.ApplyBulk(ctx, keys, muts)
+				if err != nil {
+					fail(err)
+					return
+				}
+				for i, e := range errs {
+					if e != nil {
+						fail(fmt.Errorf("row %q: %w", keys[i], e))
+						return
+					}
+				}
+				mu.Lock()
+				written += int64(len(keys))
+				n := written
+				mu.Unlock()
+				if opts.Progress != nil {
+					opts.Progress(n)
+				}
+			}
+		}()
+	}
+
+feed:
+	for first := opts.First; first < s.Rows; first += int64(opts.Batch) {
+		select {
+		case batches <- first:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(batches)
+	wg.Wait()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return written, firstErr
+}
@@ -0,0 +1,309 @@
+package datagen
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Generator describes how a key part or cell value is generated. Which
+// fields apply depends on Type:
+//
+//	const      Value
+//	sequence   Start, Step (1 if zero), Pad digits, Desc counts down from Max like ex5.2
+//	int        Min to Max inclusive
+//	float      Min to Max, Decimals
+//	choice     one of Values, Weights optional
+//	uuid       random version 4 uuid
+//	name       first and last name, first and last on their own
+//	email      first.last@ an example domain
+//	city       a city name
+//	words      Min to Max (1 to 5 if zero) lorem ipsum words
+//	bytes      Min to Max (16 if zero) random bytes
+//	timestamp  between From and To (RFC 3339, the schema's Timestamps if
+//	           empty) printed with Format: rfc3339 (default), unix,
+//	           unixmilli or a go time layout
+//
+// Encoding is text (default), int64 for 8 byte big endian values like
+// those ReadModifyWrite increments, for sequence, int and timestamp with a
+// unix format, or raw for bytes.
+type Generator struct {
+	Type     string    `json:"type"`
+	Value    string    `json:"value,omitempty"`
+	Start    int64     `json:"start,omitempty"`
+	Step     int64     `json:"step,omitempty"`
+	Pad      int       `json:"pad,omitempty"`
+	Desc     bool      `json:"desc,omitempty"`
+	Min      float64   `json:"min,omitempty"`
+	Max      float64   `json:"max,omitempty"`
+	Decimals int       `json:"decimals,omitempty"`
+	Values   []string  `json:"values,omitempty"`
+	Weights  []float64 `json:"weights,omitempty"`
+	From     string    `json:"from,omitempty"`
+	To       string    `json:"to,omitempty"`
+	Format   string    `json:"format,omitempty"`
+	Encoding string    `json:"encoding,omitempty"`
+}
+
+// genFunc returns the value of row i, drawing randomness from rnd only, so
+// that the same seed gives the same rows.
+type genFunc func(rnd *rand.Rand, i int64) []byte
+
+// compile checks g and returns its generator, win is the window of
+// timestamps without From and To.
+func (g Generator) compile(win window) (genFunc, error) {
+	enc := g.Encoding
+	if enc == "" {
+		enc = "text"
+		if g.Type == "bytes" {
+			enc = "raw"
+		}
+	}
+	switch enc {
+	case "text", "int64", "raw":
+	default:
+		return nil, fmt.Errorf("unknown encoding %q, use text, int64 or raw", enc)
+	}
+	if (enc == "raw") != (g.Type == "bytes") {
+		return nil, fmt.Errorf("encoding raw is only for bytes")
+	}
+
+	// number generators support int64, the others only text
+	number := func(f func(rnd *rand.Rand, i int64) int64) genFunc {
+		if enc == "int64" {
+			return func(rnd *rand.Rand, i int64) []byte {
+				v := make([]byte, 8)
+				binary.BigEndian.PutUint64(v, uint64(f(rnd, i)))
+				return v
+			}
+		}
+		return func(rnd *rand.Rand, i int64) []byte {
+			return []byte(strconv.FormatInt(f(rnd, i), 10))
+		}
+	}
+	text := func(f func(rnd *rand.Rand, i int64) string) (genFunc, error) {
+		if enc != "text" {
+			return nil, fmt.Errorf("%s values can only be encoded as text", g.Type)
+		}
+		return func(rnd *rand.Rand, i int64) []byte { return []byte(f(rnd, i)) }, nil
+	}
+
+	switch g.Type {
+	case "const":
+		return text(func(*rand.Rand, int64) string { return g.Value })
+
+	case "sequence":
+		step := g.Step
+		if step == 0 {
+			step = 1
+		}
+		if g.Desc && g.Max == 0 {
+			return nil, fmt.Errorf("a descending sequence needs max")
+		}
+		seq := func(_ *rand.Rand, i int64) int64 {
+			n := g.Start + i*step
+			if g.Desc {
+				n = int64(g.Max) - n
+			}
+			return n
+		}
+		if g.Pad > 0 {
+			if enc != "text" {
+				return nil, fmt.Errorf("pad only applies to text")
+			}
+			return func(rnd *rand.Rand, i int64) []byte {
+				return []byte(fmt.Sprintf("%0*d", g.Pad, seq(rnd, i)))
+			}, nil
+		}
+		return number(seq), nil
+
+	case "int":
+		lo, hi := int64(g.Min), int64(g.Max)
+		if hi < lo {
+			return nil, fmt.Errorf("max %v is below min %v", g.Max, g.Min)
+		}
+		return number(func(rnd *rand.Rand, _ int64) int64 {
+			return lo + rnd.Int63n(hi-lo+1)
+		}), nil
+
+	case "float":
+		if g.Max < g.Min {
+			return nil, fmt.Errorf("max %v is below min %v", g.Max, g.Min)
+		}
+		return text(func(rnd *rand.Rand, _ int64) string {
+			return strconv.FormatFloat(g.Min+rnd.Float64()*(g.Max-g.Min), 'f', g.Decimals, 64)
+		})
+
+	case "choice":
+		if len(g.Values) == 0 {
+			return nil, fmt.Errorf("choice needs values")
+		}
+		if len(g.Weights) > 0 && len(g.Weights) != len(g.Values) {
+			return nil, fmt.Errorf("choice has %d values but %d weights", len(g.Values), len(g.Weights))
+		}
+		total := 0.0
+		for _, w := range g.Weights {
+			if w < 0 {
+				return nil, fmt.Errorf("negative weight %v", w)
+			}
+			total += w
+		}
+		return text(func(rnd *rand.Rand, _ int64) string {
+			if total == 0 {
+				return g.Values[rnd.Intn(len(g.Values))]
+			}
+			x := rnd.Float64() * total
+			for i, w := range g.Weights {
+				if x < w {
+					return g.Values[i]
+				}
+				x -= w
+			}
+			return g.Values[len(g.Values)-1]
+		})
+
+	case "uuid":
+		return text(func(rnd *rand.Rand, _ int64) string {
+			var b [16]byte
+			rnd.Read(b[:])
+			b[6] = b[6]&0x0f | 0x40
+			b[8] = b[8]&0x3f | 0x80
+			return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+		})
+
+	case "name":
+		return text(func(rnd *rand.Rand, _ int64) string {
+			return pick(rnd, firstNames) + " " + pick(rnd, lastNames)
+		})
+	case "first":
+		return text(func(rnd *rand.Rand, _ int64) string { return pick(rnd, firstNames) })
+	case "last":
+		return text(func(rnd *rand.Rand, _ int64) string { return pick(rnd, lastNames) })
+	case "email":
+		return text(func(rnd *rand.Rand, _ int64) string {
+			return strings.ToLower(pick(rnd, firstNames)+"."+pick(rnd, lastNames)) + "@" + pick(rnd, domains)
+		})
+	case "city":
+		return text(func(rnd *rand.Rand, _ int64) string { return pick(rnd, cities) })
+
+	case "words":
+		lo, hi := int(g.Min), int(g.Max)
+		if lo <= 0 && hi <= 0 {
+			lo, hi = 1, 5
+		}
+		if hi < lo {
+			return nil, fmt.Errorf("max %v is below min %v", g.Max, g.Min)
+		}
+		return text(func(rnd *rand.Rand, _ int64) string {
+			n := lo + rnd.Intn(hi-lo+1)
+			w := make([]string, n)
+			for i := range w {
+				w[i] = pick(rnd, lorem)
+			}
+			return strings.Join(w, " ")
+		})
+
+	case "bytes":
+		lo, hi := int(g.Min), int(g.Max)
+		if lo <= 0 && hi <= 0 {
+			lo, hi = 16, 16
+		}
+		if hi < lo {
+			return nil, fmt.Errorf("max %v is below min %v", g.Max, g.Min)
+		}
+		return func(rnd *rand.Rand, _ int64) []byte {
+			v := make([]byte, lo+rnd.Intn(hi-lo+1))
+			rnd.Read(v)
+			return v
+		}, nil
+
+	case "timestamp":
+		w, err := win.override(g.From, g.To)
+		if err != nil {
+			return nil, err
+		}
+		switch g.Format {
+		case "unix":
+			return number(func(rnd *rand.Rand, _ int64) int64 { return w.random(rnd).Unix() }), nil
+		case "unixmilli":
+			return number(func(rnd *rand.Rand, _ int64) int64 { return w.random(rnd).UnixNano() / 1e6 }), nil
+		}
+		layout := g.Format
+		if layout == "" || layout == "rfc3339" {
+			layout = time.RFC3339
+		}
+		return text(func(rnd *rand.Rand, _ int64) string { return w.random(rnd).Format(layout) })
+	}
+	return nil, fmt.Errorf("unknown generator type %q", g.Type)
+}
+
+func pick(rnd *rand.Rand, list []string) string {
+	return list[rnd.Intn(len(list))]
+}
+
+// window is a time range generated times fall into.
+type window struct {
+	from, to time.Time
+}
+
+func parseWindow(from, to string) (window, error) {
+	var w window
+	var err error
+	if w.from, err = time.Parse(time.RFC3339, from); err != nil {
+		return w, fmt.Errorf("from: %w", err)
+	}
+	if w.to, err = time.Parse(time.RFC3339, to); err != nil {
+		return w, fmt.Errorf("to: %w", err)
+	}
+	if !w.to.After(w.from) {
+		return w, fmt.Errorf("window %s to %s is empty", from, to)
+	}
+	return w, nil
+}
+
+// override replaces the bounds that are set.
+func (w window) override(from, to string) (window, error) {
+	if from == "" {
+		from = w.from.Format(time.RFC3339)
+	}
+	if to == "" {
+		to = w.to.Format(time.RFC3339)
+	}
+	return parseWindow(from, to)
+}
+
+// random returns a time in the window with millisecond precision, the
+// precision of bigtable timestamps.
+func (w window) random(rnd *rand.Rand) time.Time {
+	ms := w.to.Sub(w.from).Milliseconds()
+	return w.from.Add(time.Duration(rnd.Int63n(ms)) * time.Millisecond).UTC()
+}
+
+var firstNames = []string{
+	"Ada", "Alan", "Amara", "Ben", "Chen", "Clara", "Dario", "Elena", "Emil", "Fatima",
+	"Grace", "Hana", "Ines", "Ivan", "Jonas", "Kai", "Lena", "Linus", "Maya", "Mateo",
+	"Nina", "Noah", "Olga", "Omar", "Priya", "Quinn", "Rosa", "Sam", "Sofia", "Tariq",
+	"Uma", "Victor", "Wen", "Yara", "Yusuf", "Zoe",
+}
+
+var lastNames = []string{
+	"Adams", "Bauer", "Costa", "Dubois", "Eriksson", "Fischer", "Garcia", "Hoffmann", "Ito", "Jansen",
+	"Kim", "Lopez", "Meyer", "Nakamura", "Novak", "Okafor", "Petrov", "Quispe", "Rossi", "Schmidt",
+	"Silva", "Tanaka", "Usman", "Vogel", "Wagner", "Weber", "Xu", "Yilmaz", "Zhang", "Zimmermann",
+}
+
+var domains = []string{"example.com", "example.org", "example.net"}
+
+var cities = []string{
+	"Amsterdam", "Berlin", "Bogota", "Cairo", "Dublin", "Hamburg", "Helsinki", "Lagos", "Lima", "Lisbon",
+	"Madrid", "Montreal", "Mumbai", "Nairobi", "Osaka", "Oslo", "Prague", "Seoul", "Sydney", "Vienna",
+}
+
+var lorem = []string{
+	"lorem", "ipsum", "dolor", "sit", "amet", "consectetur", "adipiscing", "elit", "sed", "do",
+	"eiusmod", "tempor", "incididunt", "ut", "labore", "et", "dolore", "magna", "aliqua", "enim",
+	"ad", "minim", "veniam", "quis", "nostrud", "exercitation", "ullamco", "laboris", "nisi", "aliquip",
+}
@@ -0,0 +1,233 @@
+// Package entity implements the TokenService of entitypb on top of a
+// bigtable table, tokens are mapped to rows with protorow.
+package entity
+
+import (
+	"context"
+	"encoding/base64"
+
+	"bigworkshop/entitypb"
+	"bigworkshop/pager"
+	"bigworkshop/protorow"
+	"cloud.google.com/go/bigtable"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/emptypb"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+)
+
+const (
+	// KeyPrefix is the prefix of the row key of every token.
+	KeyPrefix = "token#"
+
+	defaultPageSize = 50
+	maxPageSize     = 1000
+	maxBatchSize    = 1000
+)
+
+var mapper *protorow.Mapper
+
+func init() {
+	var err error
+	if mapper, err = protorow.New(&entitypb.Token{}, "id", KeyPrefix); err != nil {
+		panic(err)
+	}
+}
+
+// Families returns the column families a token table needs.
+func Families() []string {
+	return mapper.Families()
+}
+
+// CreateTable creates the table and its families if they are missing.
+func CreateTable(ctx context.Context, admin *bigtable.AdminClient, table string) error {
+	tables, err := admin.Tables(ctx)
+	if err != nil {
+		return err
+	}
+	exists := false
+	for _, t := range tables {
+		exists = exists || t == table
+	}
+	if !exists {
+		if err := admin.CreateTable(ctx, table); err != nil {
+			return err
+		}
+	}
+	info, err := admin.TableInfo(ctx, table)
+	if err != nil {
+		return err
+	}
+	have := map[string]bool{}
+	for _, f := range info.Families {
+		have[f] = true
+	}
+	for _, f := range Families() {
+		if have[f] {
+			continue
+		}
+		if err := admin.CreateColumnFamily(ctx, table, f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Server serves tokens stored in one table.
+type Server struct {
+	entitypb.UnimplementedTokenServiceServer
+	tbl *bigtable.Table
+}
+
+// NewServer returns a server for the tokens in tbl.
+func NewServer(tbl *bigtable.Table) *Server {
+	return &Server{tbl: tbl}
+}
+
+// families turns a field mask into the families to read or write.
+func families(mask *fieldmaskpb.FieldMask) ([]string, error) {
+	fams, err := mapper.SelectFamilies(mask.GetPaths())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return fams, nil
+}
+
+func (s *Server) GetToken(ctx context.Context, req *entitypb.GetTokenRequest) (*entitypb.Token, error) {
+	if req.GetId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+	fams, err := families(req.GetReadMask())
+	if err != nil {
+		return nil, err
+	}
+	row, err := s.tbl.ReadRow(ctx, mapper.RowKey(req.GetId()), bigtable.RowFilter(mapper.Filter(fams)))
+	if err != nil {
+		return nil, err
+	}
+	if len(row) == 0 {
+		return nil, status.Errorf(codes.NotFound, "token %q not found", req.GetId())
+	}
+	return unmarshal(row)
+}
+
+func (s *Server) BatchGetTokens(ctx context.Context, req *entitypb.BatchGetTokensRequest) (*entitypb.BatchGetTokensResponse, error) {
+	if len(req.GetIds()) > maxBatchSize {
+		return nil, status.Errorf(codes.InvalidArgument, "at most %d ids per batch, got %d", maxBatchSize, len(req.GetIds()))
+	}
+	fams, err := families(req.GetReadMask())
+	if err != nil {
+		return nil, err
+	}
+	keys := make(bigtable.RowList, 0, len(req.GetIds()))
+	for _, id := range req.GetIds() {
+		if id == "" {
+			return nil, status.Error(codes.InvalidArgument, "ids must not be empty")
+		}
+		keys = append(keys, mapper.RowKey(id))
+	}
+
+	found := map[string]*entitypb.Token{}
+	var uerr error
+	err = s.tbl.ReadRows(ctx, keys, func(row bigtable.Row) bool {
+		var t *entitypb.Token
+		if t, uerr = unmarshal(row); uerr != nil {
+			return false
+		}
+		found[t.GetId()] = t
+		return true
+	}, bigtable.RowFilter(mapper.Filter(fams)))
+	if err != nil {
+		return nil, err
+	}
+	if uerr != nil {
+		return nil, uerr
+	}
+
+	resp := &entitypb.BatchGetTokensResponse{}
+	for _, id := range req.GetIds() {
+		if t, ok := found[id]; ok {
+			resp.Tokens = append(resp.Tokens, t)
+		} else {
+			resp.MissingIds = append(resp.MissingIds, id)
+		}
+	}
+	return resp, nil
+}
+
+func (s *Server) PutToken(ctx context.Context, req *entitypb.PutTokenRequest) (*entitypb.Token, error) {
+	token := req.GetToken()
+	if token.GetId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "token.id is required")
+	}
+	fams, err := families(req.GetUpdateMask())
+	if err != nil {
+		return nil, err
+	}
+	mut, err := mapper.Mutation(token, fams, bigtable.Now())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	if err := s.tbl.Apply(ctx, mapper.Key(token), mut); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+func (s *Server) DeleteToken(ctx context.Context, req *entitypb.DeleteTokenRequest) (*emptypb.Empty, error) {
+	if req.GetId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "id is required")
+	}
+	mut := bigtable.NewMutation()
+	mut.DeleteRow()
+	if err := s.tbl.Apply(ctx, mapper.RowKey(req.GetId()), mut); err != nil {
+		return nil, err
+	}
+	return &emptypb.Empty{}, nil
+}
+
+func (s *Server) ListTokens(ctx context.Context, req *entitypb.ListTokensRequest) (*entitypb.ListTokensResponse, error) {
+	size := int(req.GetPageSize())
+	switch {
+	case size < 0:
+		return nil, status.Error(codes.InvalidArgument, "page_size must not be negative")
+	case size == 0:
+		size = defaultPageSize
+	case size > maxPageSize:
+		size = maxPageSize
+	}
+	fams, err := families(req.GetReadMask())
+	if err != nil {
+		return nil, err
+	}
+	after, err := base64.RawURLEncoding.DecodeString(req.GetPageToken())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "bad page_token %q", req.GetPageToken())
+	}
+
+	r := pager.PrefixRange(mapper.RowKey(req.GetIdPrefix()))
+	rows, next, err := pager.Page(ctx, s.tbl, r, string(after), size, bigtable.RowFilter(mapper.Filter(fams)))
+	if err != nil {
+		return nil, err
+	}
+	resp := &entitypb.ListTokensResponse{}
+	for _, row := range rows {
+		t, err := unmarshal(row)
+		if err != nil {
+			return nil, err
+		}
+		resp.Tokens = append(resp.Tokens, t)
+	}
+	if next != "" {
+		resp.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(next))
+	}
+	return resp, nil
+}
+
+func unmarshal(row bigtable.Row) (*entitypb.Token, error) {
+	t := &entitypb.Token{}
+	if err := mapper.Unmarshal(row, t); err != nil {
+		return nil, status.Errorf(codes.DataLoss, "row %q: %v", row.Key(), err)
+	}
+	return t, nil
+}
@@ -0,0 +1,195 @@
+package entity_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"bigworkshop/entity/harness"
+	"bigworkshop/entitypb"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/fieldmaskpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func start(t *testing.T) *harness.Harness {
+	t.Helper()
+	h, err := harness.Start(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func token(id string) *entitypb.Token {
+	return &entitypb.Token{
+		Id:      id,
+		Profile: &entitypb.Profile{Name: "Token " + id, Symbol: id, Decimals: 8, Tags: []string{"a", "b"}},
+		Market:  &entitypb.Market{Price: 1.5, Volume: 42, Listed: true, Updated: timestamppb.New(time.Unix(1700000000, 0))},
+	}
+}
+
+func mask(paths ...string) *fieldmaskpb.FieldMask {
+	return &fieldmaskpb.FieldMask{Paths: paths}
+}
+
+func put(t *testing.T, h *harness.Harness, tok *entitypb.Token) {
+	t.Helper()
+	if _, err := h.Client.PutToken(context.Background(), &entitypb.PutTokenRequest{Token: tok}); err != nil {
+		t.Fatalf("put %s: %v", tok.Id, err)
+	}
+}
+
+func wantCode(t *testing.T, err error, code codes.Code) {
+	t.Helper()
+	if status.Code(err) != code {
+		t.Errorf("got %v, want %v", err, code)
+	}
+}
+
+func TestPutGet(t *testing.T) {
+	h := start(t)
+	ctx := context.Background()
+	tok := token("btc")
+	put(t, h, tok)
+
+	got, err := h.Client.GetToken(ctx, &entitypb.GetTokenRequest{Id: "btc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !proto.Equal(got, tok) {
+		t.Errorf("get = %v, want %v", got, tok)
+	}
+
+	got, err = h.Client.GetToken(ctx, &entitypb.GetTokenRequest{Id: "btc", ReadMask: mask("profile")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (&entitypb.Token{Id: "btc", Profile: tok.Profile}); !proto.Equal(got, want) {
+		t.Errorf("get with profile mask = %v, want %v", got, want)
+	}
+
+	_, err = h.Client.GetToken(ctx, &entitypb.GetTokenRequest{Id: "eth"})
+	wantCode(t, err, codes.NotFound)
+	_, err = h.Client.GetToken(ctx, &entitypb.GetTokenRequest{})
+	wantCode(t, err, codes.InvalidArgument)
+	_, err = h.Client.GetToken(ctx, &entitypb.GetTokenRequest{Id: "btc", ReadMask: mask("nope")})
+	wantCode(t, err, codes.InvalidArgument)
+}
+
+func TestPutUpdateMask(t *testing.T) {
+	h := start(t)
+	ctx := context.Background()
+	tok := token("btc")
+	put(t, h, tok)
+
+	update := &entitypb.Token{Id: "btc", Profile: &entitypb.Profile{Name: "Bitcoin"}, Market: &entitypb.Market{Price: 99}}
+	if _, err := h.Client.PutToken(ctx, &entitypb.PutTokenRequest{Token: update, UpdateMask: mask("profile")}); err != nil {
+		t.Fatal(err)
+	}
+	got, err := h.Client.GetToken(ctx, &entitypb.GetTokenRequest{Id: "btc"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the profile is replaced as a whole, the market is left alone
+	if want := (&entitypb.Token{Id: "btc", Profile: update.Profile, Market: tok.Market}); !proto.Equal(got, want) {
+		t.Errorf("get = %v, want %v", got, want)
+	}
+
+	_, err = h.Client.PutToken(ctx, &entitypb.PutTokenRequest{Token: &entitypb.Token{Profile: tok.Profile}})
+	wantCode(t, err, codes.InvalidArgument)
+	_, err = h.Client.PutToken(ctx, &entitypb.PutTokenRequest{Token: &entitypb.Token{Id: "eth"}})
+	wantCode(t, err, codes.InvalidArgument)
+}
+
+func TestDelete(t *testing.T) {
+	h := start(t)
+	ctx := context.Background()
+	put(t, h, token("btc"))
+	if _, err := h.Client.DeleteToken(ctx, &entitypb.DeleteTokenRequest{Id: "btc"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err := h.Client.GetToken(ctx, &entitypb.GetTokenRequest{Id: "btc"})
+	wantCode(t, err, codes.NotFound)
+	// deleting a missing token succeeds
+	if _, err := h.Client.DeleteToken(ctx, &entitypb.DeleteTokenRequest{Id: "btc"}); err != nil {
+		t.Fatal(err)
+	}
+	_, err = h.Client.DeleteToken(ctx, &entitypb.DeleteTokenRequest{})
+	wantCode(t, err, codes.InvalidArgument)
+}
+
+func TestBatchGet(t *testing.T) {
+	h := start(t)
+	ctx := context.Background()
+	put(t, h, token("btc"))
+	put(t, h, token("eth"))
+
+	resp, err := h.Client.BatchGetTokens(ctx, &entitypb.BatchGetTokensRequest{Ids: []string{"eth", "doge", "btc"}, ReadMask: mask("market")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, tok := range resp.Tokens {
+		ids = append(ids, tok.Id)
+		if tok.Profile != nil || tok.Market == nil {
+			t.Errorf("%s: read mask market returned %v", tok.Id, tok)
+		}
+	}
+	if fmt.Sprint(ids) != "[eth btc]" || fmt.Sprint(resp.MissingIds) != "[doge]" {
+		t.Errorf("tokens %v and missing %v, want [eth btc] and [doge]", ids, resp.MissingIds)
+	}
+
+	_, err = h.Client.BatchGetTokens(ctx, &entitypb.BatchGetTokensRequest{Ids: []string{"btc", ""}})
+	wantCode(t, err, codes.InvalidArgument)
+}
+
+func TestList(t *testing.T) {
+	h := start(t)
+	ctx := context.Background()
+	for i := 0; i < 7; i++ {
+		put(t, h, token(fmt.Sprintf("a%d", i)))
+	}
+	put(t, h, token("b0"))
+
+	var ids []string
+	var pages int
+	req := &entitypb.ListTokensRequest{PageSize: 3, IdPrefix: "a", ReadMask: mask("profile")}
+	for {
+		resp, err := h.Client.ListTokens(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages++
+		for _, tok := range resp.Tokens {
+			ids = append(ids, tok.Id)
+			if tok.Market != nil || tok.Profile.GetSymbol() != tok.Id {
+				t.Errorf("%s: read mask profile returned %v", tok.Id, tok)
+			}
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		req.PageToken = resp.NextPageToken
+	}
+	if fmt.Sprint(ids) != "[a0 a1 a2 a3 a4 a5 a6]" || pages != 3 {
+		t.Errorf("listed %v in %d pages, want a0 to a6 in 3", ids, pages)
+	}
+
+	resp, err := h.Client.ListTokens(ctx, &entitypb.ListTokensRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(resp.Tokens) != 8 || resp.NextPageToken != "" {
+		t.Errorf("listed %d tokens with next page %q, want 8 and none", len(resp.Tokens), resp.NextPageToken)
+	}
+
+	_, err = h.Client.ListTokens(ctx, &entitypb.ListTokensRequest{PageToken: "!"})
+	wantCode(t, err, codes.InvalidArgument)
+	_, err = h.Client.ListTokens(ctx, &entitypb.ListTokensRequest{PageSize: -1})
+	wantCode(t, err, codes.InvalidArgument)
+}
@@ -0,0 +1,106 @@
+// Package harness runs the token service in process, backed by a bttest
+// server and reached over bufconn, so tests need neither an emulator nor a
+// free port for the service:
+//
+//	h, err := harness.Start(ctx)
+//	if err != nil { ... }
+//	defer h.Close()
+//	h.Client.PutToken(ctx, &entitypb.PutTokenRequest{Token: token})
+package harness
+
+import (
+	"context"
+	"net"
+
+	"bigworkshop/entity"
+	"bigworkshop/entitypb"
+	"cloud.google.com/go/bigtable"
+	"cloud.google.com/go/bigtable/bttest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Table is the name of the token table created by Start.
+const Table = "tokens"
+
+// Harness is a running token service.
+type Harness struct {
+	// Client talks to the service.
+	Client entitypb.TokenServiceClient
+	// Data and Admin talk to the bttest server behind it, to look at or
+	// prepare rows directly.
+	Data  *bigtable.Client
+	Admin *bigtable.AdminClient
+
+	bt      *bttest.Server
+	btConn  *grpc.ClientConn
+	srv     *grpc.Server
+	svcConn *grpc.ClientConn
+}
+
+// Start starts bttest, creates the token table and serves the service.
+func Start(ctx context.Context) (h *Harness, err error) {
+	h = &Harness{}
+	defer func() {
+		if err != nil {
+			h.Close()
+		}
+	}()
+
+	if h.bt, err = bttest.NewServer("localhost:0"); err != nil {
+		return nil, err
+	}
+	if h.btConn, err = grpc.Dial(h.bt.Addr, grpc.WithInsecure()); err != nil {
+		return nil, err
+	}
+	if h.Data, err = bigtable.NewClient(ctx, "test", "test", option.WithGRPCConn(h.btConn)); err != nil {
+		return nil, err
+	}
+	if h.Admin, err = bigtable.NewAdminClient(ctx, "test", "test", option.WithGRPCConn(h.btConn)); err != nil {
+		return nil, err
+	}
+	if err = entity.CreateTable(ctx, h.Admin, Table); err != nil {
+		return nil, err
+	}
+
+	lis := bufconn.Listen(1 << 20)
+	h.srv = grpc.NewServer()
+	entitypb.RegisterTokenServiceServer(h.srv, entity.NewServer(h.Data.Open(Table)))
+	go h.srv.Serve(lis)
+
+	h.svcConn, err = grpc.DialContext(ctx, "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return lis.DialContext(ctx)
+		}),
+		grpc.WithInsecure(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	h.Client = entitypb.NewTokenServiceClient(h.svcConn)
+	return h, nil
+}
+
+// Close stops the service and the bttest server.
+func (h *Harness) Close() error {
+	if h.svcConn != nil {
+		h.svcConn.Close()
+	}
+	if h.srv != nil {
+		h.srv.Stop()
+	}
+	if h.Data != nil {
+		h.Data.Close()
+	}
+	if h.Admin != nil {
+		h.Admin.Close()
+	}
+	if h.btConn != nil {
+		h.btConn.Close()
+	}
+	if h.bt != nil {
+		h.bt.Close()
+	}
+	return nil
+}
@@ -0,0 +1,4 @@
+// Package entitypb contains the generated code for entity.proto.
+package entitypb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative entity.proto
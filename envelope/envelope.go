@@ -0,0 +1,434 @@
+// Package envelope wraps a table.Table so that the values of sensitive
+// columns are stored encrypted, instead of plain bytes like ex1's world.
+//
+// Values are encrypted with AES-GCM under a data key. The data key is
+// wrapped by a master key of a KeyProvider, a KMS or the FileKeys stand-in,
+// and stored with the id of the master key in front of every value:
+//
+//	keys, err := envelope.LoadFileKeys("keys.json")
+//	tbl := envelope.Wrap(client.Open("tbl"), envelope.Options{
+//		Columns: []string{"fam:qualifier", "pii:*"},
+//		Keys:    keys,
+//	})
+//
+// Reads decrypt the values, values written before the column was
+// encrypted are returned as they are. Rotating the master key only changes
+// the key of new values, Reencrypt rewrites existing ones. The ciphertext
+// is bound to its column but not to its row, so that rekey and copy can
+// move encrypted rows.
+//
+// Filters on values and ReadModifyWrite do not work on encrypted columns,
+// and conditional mutations are refused since their values cannot be
+// reached.
+package envelope
+
+import (
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"bigworkshop/pager"
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// magic starts every encrypted value.
+const magic = "\x00bwe1"
+
+// Options configure the encryption.
+type Options struct {
+	// Columns are encrypted, family:qualifier or family:* for all columns
+	// of a family.
+	Columns []string
+	Keys    KeyProvider
+}
+
+// ParseColumns splits a comma separated list of columns.
+func ParseColumns(s string) ([]string, error) {
+	var cols []string
+	for _, c := range strings.Split(s, ",") {
+		c = strings.TrimSpace(c)
+		if c == "" {
+			continue
+		}
+		if fam, qual, ok := strings.Cut(c, ":"); !ok || fam == "" || qual == "" {
+			return nil, fmt.Errorf("bad column %q, want family:qualifier or family:*", c)
+		}
+		cols = append(cols, c)
+	}
+	return cols, nil
+}
+
+// dataKey is a data key with its wrapped form.
+type dataKey struct {
+	keyID   string
+	wrapped []byte
+	aead    cipher.AEAD
+}
+
+// Table encrypts and decrypts the columns of the table it wraps.
+type Table struct {
+	tbl  table.Table
+	keys KeyProvider
+	cols map[string]bool
+	fams map[string]bool
+
+	mu        sync.Mutex
+	current   *dataKey
+	unwrapped map[string]cipher.AEAD
+}
+
+var _ table.Table = (*Table)(nil)
+
+// Wrap returns tbl encrypting the columns of opts.
+func Wrap(tbl table.Table, opts Options) *Table {
+	t := &Table{tbl: tbl, keys: opts.Keys, cols: map[string]bool{}, fams: map[string]bool{}, unwrapped: map[string]cipher.AEAD{}}
+	for _, c := range opts.Columns {
+		if fam, qual, _ := strings.Cut(c, ":"); qual == "*" {
+			t.fams[fam] = true
+		} else {
+			t.cols[c] = true
+		}
+	}
+	return t
+}
+
+// Encrypted reports whether values of column, family:qualifier, are
+// encrypted.
+func (t *Table) Encrypted(column string) bool {
+	fam, _, _ := strings.Cut(column, ":")
+	return t.cols[column] || t.fams[fam]
+}
+
+// dataKey returns the data key of new values, a new one after the primary
+// master key changed.
+func (t *Table) dataKey() (*dataKey, error) {
+	primary := t.keys.PrimaryKey()
+	if len(primary) > MaxKeyIDLen {
+		return nil, fmt.Errorf("envelope: master key id %.20q... is longer than %d bytes", primary, MaxKeyIDLen)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.current != nil && t.current.keyID == primary {
+		return t.current, nil
+	}
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return nil, err
+	}
+	wrapped, err := t.keys.Wrap(primary, dek)
+	if err != nil {
+		return nil, fmt.Errorf("envelope: wrapping data key: %w", err)
+	}
+	if len(wrapped) > 0xffff {
+		return nil, fmt.Errorf("envelope: wrapped data key of %d bytes, at most %d fit", len(wrapped), 0xffff)
+	}
+	a, err := newAEAD(dek)
+	if err != nil {
+		return nil, err
+	}
+	t.current = &dataKey{keyID: primary, wrapped: wrapped, aead: a}
+	t.unwrapped[primary+"\x00"+string(wrapped)] = a
+	return t.current, nil
+}
+
+// Encrypt returns the stored form of a value of column:
+//
+//	magic | id length | master key id | wrapped length (2) | wrapped data key | nonce | ciphertext
+func (t *Table) Encrypt(column string, v []byte) ([]byte, error) {
+	dk, err := t.dataKey()
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := seal(dk.aead, v, []byte(column))
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, 0, len(magic)+3+len(dk.keyID)+len(dk.wrapped)+len(sealed))
+	out = append(out, magic...)
+	out = append(out, byte(len(dk.keyID)))
+	out = append(out, dk.keyID...)
+	out = append(out, byte(len(dk.wrapped)>>8), byte(len(dk.wrapped)))
+	out = append(out, dk.wrapped...)
+	return append(out, sealed...), nil
+}
+
+// KeyID returns the master key id of a stored value, false if it is not
+// encrypted.
+func KeyID(v []byte) (string, bool) {
+	id, _, _, err := parse(v)
+	return id, err == nil
+}
+
+func parse(v []byte) (keyID string, wrapped, sealed []byte, err error) {
+	if !strings.HasPrefix(string(v), magic) {
+		return "", nil, nil, fmt.Errorf("envelope: value is not encrypted")
+	}
+	rest := v[len(magic):]
+	if len(rest) < 1 || len(rest) < 1+int(rest[0])+2 {
+		return "", nil, nil, fmt.Errorf("envelope: truncated value")
+	}
+	keyID, rest = string(rest[1:1+rest[0]]), rest[1+rest[0]:]
+	n := int(binary.BigEndian.Uint16(rest))
+	if len(rest) < 2+n {
+		return "", nil, nil, fmt.Errorf("envelope: truncated value")
+	}
+	return keyID, rest[2 : 2+n], rest[2+n:], nil
+}
+
+// Decrypt returns the value of a stored value of column, values that are
+// not encrypted as they are.
+func (t *Table) Decrypt(column string, v []byte) ([]byte, error) {
+	if !strings.HasPrefix(string(v), magic) {
+		return v, nil
+	}
+	keyID, wrapped, sealed, err := parse(v)
+	if err != nil {
+		return nil, err
+	}
+	cacheKey := keyID + "\x00" + string(wrapped)
+	t.mu.Lock()
+	a, ok := t.unwrapped[cacheKey]
+	t.mu.Unlock()
+	if !ok {
+		dek, err := t.keys.Unwrap(keyID, wrapped)
+		if err != nil {
+			return nil, fmt.Errorf("envelope: unwrapping data key of %s: %w", keyID, err)
+		}
+		if a, err = newAEAD(dek); err != nil {
+			return nil, err
+		}
+		t.mu.Lock()
+		t.unwrapped[cacheKey] = a
+		t.mu.Unlock()
+	}
+	plain, err := open(a, sealed, []byte(column))
+	if err != nil {
+		return nil, fmt.Errorf("envelope: decrypting %s: %w", column, err)
+	}
+	return plain, nil
+}
+
+// encryptMutation returns m with the values of encrypted columns encrypted.
+func (t *Table) encryptMutation(m *bigtable.Mutation) (*bigtable.Mutation, error) {
+	if table.IsConditional(m) {
+		return nil, status.Error(codes.Unimplemented, "envelope: conditional mutations cannot be encrypted")
+	}
+	ops := table.Ops(m)
+	var out []*btpb.Mutation
+	for i, op := range ops {
+		set := op.GetSetCell()
+		if set == nil || !t.Encrypted(set.FamilyName+":"+string(set.ColumnQualifier)) {
+			if out != nil {
+				out = append(out, op)
+			}
+			continue
+		}
+		if out == nil {
+			out = append([]*btpb.Mutation(nil), ops[:i]...)
+		}
+		v, err := t.Encrypt(set.FamilyName+":"+string(set.ColumnQualifier), set.Value)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, &btpb.Mutation{Mutation: &btpb.Mutation_SetCell_{SetCell: &btpb.Mutation_SetCell{
+			FamilyName:      set.FamilyName,
+			ColumnQualifier: set.ColumnQualifier,
+			TimestampMicros: set.TimestampMicros,
+			Value:           v,
+		}}})
+	}
+	if out == nil {
+		return m, nil
+	}
+	return table.NewMutation(out), nil
+}
+
+// decryptRow decrypts the encrypted columns of r in place.
+func (t *Table) decryptRow(r bigtable.Row) error {
+	for fam, items := range r {
+		for i, it := range items {
+			if !t.Encrypted(it.Column) {
+				continue
+			}
+			v, err := t.Decrypt(it.Column, it.Value)
+			if err != nil {
+				return fmt.Errorf("row %q: %w", it.Row, err)
+			}
+			r[fam][i].Value = v
+		}
+	}
+	return nil
+}
+
+func (t *Table) ReadRows(ctx context.Context, arg bigtable.RowSet, f func(bigtable.Row) bool, opts ...bigtable.ReadOption) error {
+	var derr error
+	err := t.tbl.ReadRows(ctx, arg, func(r bigtable.Row) bool {
+		if derr = t.decryptRow(r); derr != nil {
+			return false
+		}
+		return f(r)
+	}, opts...)
+	if err == nil {
+		err = derr
+	}
+	return err
+}
+
+func (t *Table) ReadRow(ctx context.Context, row string, opts ...bigtable.ReadOption) (bigtable.Row, error) {
+	r, err := t.tbl.ReadRow(ctx, row, opts...)
+	if err != nil {
+		return r, err
+	}
+	return r, t.decryptRow(r)
+}
+
+func (t *Table) Apply(ctx context.Context, row string, m *bigtable.Mutation, opts ...bigtable.ApplyOption) error {
+	enc, err := t.encryptMutation(m)
+	if err != nil {
+		return err
+	}
+	return t.tbl.Apply(ctx, row, enc, opts...)
+}
+
+func (t *Table) ApplyBulk(ctx context.Context, rowKeys []string, muts []*bigtable.Mutation, opts ...bigtable.ApplyOption) ([]error, error) {
+	enc := make([]*bigtable.Mutation, len(muts))
+	for i, m := range muts {
+		var err error
+		if enc[i], err = t.encryptMutation(m); err != nil {
+			return nil, err
+		}
+	}
+	return t.tbl.ApplyBulk(ctx, rowKeys, enc, opts...)
+}
+
+// ApplyReadModifyWrite is passed through, appending to or incrementing an
+// encrypted value corrupts it.
+func (t *Table) ApplyReadModifyWrite(ctx context.Context, row string, m *bigtable.ReadModifyWrite) (bigtable.Row, error) {
+	r, err := t.tbl.ApplyReadModifyWrite(ctx, row, m)
+	if err != nil {
+		return r, err
+	}
+	return r, t.decryptRow(r)
+}
+
+func (t *Table) SampleRowKeys(ctx context.Context) ([]string, error) {
+	return t.tbl.SampleRowKeys(ctx)
+}
+
+// ReencryptOptions limit a re-encryption.
+type ReencryptOptions struct {
+	// Prefix, or Start and End, limit the scan, the whole table if empty.
+	Prefix     string
+	Start, End string
+	// Batch is the number of rows per ApplyBulk, 500 if zero.
+	Batch int
+	// DryRun only counts the values that would be rewritten.
+	DryRun bool
+}
+
+// ReencryptReport counts the values of a re-encryption.
+type ReencryptReport struct {
+	Rows, Values int64
+	// Rewritten values were plain or under an old master key.
+	Rewritten int64
+}
+
+// columnFilter reads the encrypted columns.
+func (t *Table) columnFilter() bigtable.Filter {
+	var fs []bigtable.Filter
+	for fam := range t.fams {
+		fs = append(fs, bigtable.FamilyFilter("^"+regexp.QuoteMeta(fam)+"$"))
+	}
+	for col := range t.cols {
+		fam, qual, _ := strings.Cut(col, ":")
+		fs = append(fs, bigtable.ChainFilters(
+			bigtable.FamilyFilter("^"+regexp.QuoteMeta(fam)+"$"),
+			bigtable.ColumnFilter("^"+regexp.QuoteMeta(qual)+"$"),
+		))
+	}
+	if len(fs) == 1 {
+		return fs[0]
+	}
+	return bigtable.InterleaveFilters(fs...)
+}
+
+// Reencrypt rewrites every version of the encrypted columns that is not
+// encrypted under the primary master key, with its timestamp, e.g. after
+// a rotation or after encryption was turned on for a column.
+func (t *Table) Reencrypt(ctx context.Context, opts ReencryptOptions) (ReencryptReport, error) {
+	var rep ReencryptReport
+	if len(t.cols)+len(t.fams) == 0 {
+		return rep, nil
+	}
+	if opts.Batch <= 0 {
+		opts.Batch = 500
+	}
+	primary := t.keys.PrimaryKey()
+	after := ""
+	for {
+		var keys []string
+		var muts []*bigtable.Mutation
+		var rerr error
+		n := 0
+		err := t.tbl.ReadRows(ctx, pager.ResumeRange(opts.Prefix, opts.Start, opts.End, after), func(r bigtable.Row) bool {
+			n++
+			after = r.Key()
+			rep.Rows++
+			m := bigtable.NewMutation()
+			changed := false
+			for fam, items := range r {
+				for _, it := range items {
+					rep.Values++
+					if id, ok := KeyID(it.Value); ok && id == primary {
+						continue
+					}
+					rep.Rewritten++
+					plain, err := t.Decrypt(it.Column, it.Value)
+					if err == nil && !opts.DryRun {
+						var enc []byte
+						enc, err = t.Encrypt(it.Column, plain)
+						m.Set(fam, strings.TrimPrefix(it.Column, fam+":"), it.Timestamp, enc)
+					}
+					if err != nil {
+						rerr = fmt.Errorf("row %q: %w", r.Key(), err)
+						return false
+					}
+					changed = true
+				}
+			}
+			if changed && !opts.DryRun {
+				keys, muts = append(keys, r.Key()), append(muts, m)
+			}
+			return true
+		}, bigtable.RowFilter(t.columnFilter()), bigtable.LimitRows(int64(opts.Batch)))
+		if err == nil {
+			err = rerr
+		}
+		if err != nil {
+			return rep, err
+		}
+		if len(keys) > 0 {
+			errs, err := t.tbl.ApplyBulk(ctx, keys, muts)
+			if err != nil {
+				return rep, err
+			}
+			for i, e := range errs {
+				if e != nil {
+					return rep, fmt.Errorf("rewriting %q: %w", keys[i], e)
+				}
+			}
+		}
+		if n < opts.Batch {
+			return rep, nil
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package envelope
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// MaxKeyIDLen is the longest master key id, stored values keep its length
+// in a byte.
+const MaxKeyIDLen = 255
+
+// KeyProvider wraps data keys with master keys it never hands out, the
+// interface of a KMS.
+type KeyProvider interface {
+	// PrimaryKey returns the id of the master key new data keys are
+	// wrapped with, at most MaxKeyIDLen bytes.
+	PrimaryKey() string
+	// Wrap encrypts a data key with a master key.
+	Wrap(keyID string, dek []byte) ([]byte, error)
+	// Unwrap decrypts a data key wrapped by Wrap.
+	Unwrap(keyID string, wrapped []byte) ([]byte, error)
+}
+
+// FileKeys is a KeyProvider keeping its master keys in a json file, a
+// stand-in for a KMS on the emulator. The file holds the keys in the clear
+// and has to be protected like one.
+type FileKeys struct {
+	path string
+
+	mu   sync.Mutex
+	file keyFile
+}
+
+type keyFile struct {
+	Primary string            `json:"primary"`
+	Keys    map[string][]byte `json:"keys"`
+}
+
+// CreateFileKeys writes a new key file with one master key, it fails if
+// the file exists.
+func CreateFileKeys(path string) (*FileKeys, error) {
+	k := &FileKeys{path: path, file: keyFile{Keys: map[string][]byte{}}}
+	if _, err := k.add(); err != nil {
+		return nil, err
+	}
+	if err := k.save(true); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// LoadFileKeys reads a key file.
+func LoadFileKeys(path string) (*FileKeys, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	k := &FileKeys{path: path}
+	if err := json.Unmarshal(data, &k.file); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	if _, ok := k.file.Keys[k.file.Primary]; !ok {
+		return nil, fmt.Errorf("%s: primary key %q is missing", path, k.file.Primary)
+	}
+	for id := range k.file.Keys {
+		if len(id) > MaxKeyIDLen {
+			return nil, fmt.Errorf("%s: key id %.20q... is longer than %d bytes", path, id, MaxKeyIDLen)
+		}
+	}
+	return k, nil
+}
+
+// add creates a master key k1, k2, ... and makes it the primary one.
+func (k *FileKeys) add() (string, error) {
+	n := 0
+	for id := range k.file.Keys {
+		if i, err := strconv.Atoi(strings.TrimPrefix(id, "k")); err == nil && i > n {
+			n = i
+		}
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	id := fmt.Sprintf("k%d", n+1)
+	if len(id) > MaxKeyIDLen {
+		return "", fmt.Errorf("envelope: key id %.20q... is longer than %d bytes", id, MaxKeyIDLen)
+	}
+	k.file.Keys[id] = key
+	k.file.Primary = id
+	return id, nil
+}
+
+// save writes the file to a temporary one next to it and renames that over
+// the key file, a crash leaves either the old or the new keys. With create
+// the key file must not exist yet.
+func (k *FileKeys) save(create bool) error {
+	data, err := json.MarshalIndent(k.file, "", "  ")
+	if err != nil {
+		return err
+	}
+	dir, base := filepath.Split(k.path)
+	if dir == "" {
+		dir = "."
+	}
+	f, err := os.CreateTemp(dir, "."+base+".tmp*")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	defer os.Remove(tmp)
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if create {
+		// Link fails if the key file exists, unlike Rename.
+		if err = os.Link(tmp, k.path); os.IsExist(err) {
+			err = fmt.Errorf("%s: %w", k.path, os.ErrExist)
+		}
+	} else {
+		err = os.Rename(tmp, k.path)
+	}
+	if err != nil {
+		return err
+	}
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// Rotate adds a master key, makes it the primary one and saves the file.
+// Old keys are kept to unwrap the data keys of existing values until they
+// are re-encrypted.
+func (k *FileKeys) Rotate() (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	id, err := k.add()
+	if err != nil {
+		return "", err
+	}
+	return id, k.save(false)
+}
+
+// IDs returns the ids of all master keys.
+func (k *FileKeys) IDs() []string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	ids := make([]string, 0, len(k.file.Keys))
+	for id := range k.file.Keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (k *FileKeys) PrimaryKey() string {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.file.Primary
+}
+
+// aead returns the cipher of a master key. Unknown keys are looked up in
+// the file again, they may have been added by a rotation in another
+// process.
+func (k *FileKeys) aead(keyID string) (cipher.AEAD, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	key, ok := k.file.Keys[keyID]
+	if !ok {
+		if fresh, err := LoadFileKeys(k.path); err == nil {
+			k.file = fresh.file
+			key, ok = k.file.Keys[keyID]
+		}
+	}
+	if !ok {
+		return nil, fmt.Errorf("envelope: unknown master key %q", keyID)
+	}
+	return newAEAD(key)
+}
+
+func (k *FileKeys) Wrap(keyID string, dek []byte) ([]byte, error) {
+	a, err := k.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return seal(a, dek, []byte(keyID))
+}
+
+func (k *FileKeys) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	a, err := k.aead(keyID)
+	if err != nil {
+		return nil, err
+	}
+	return open(a, wrapped, []byte(keyID))
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts with a random nonce in front of the ciphertext.
+func seal(a cipher.AEAD, plain, aad []byte) ([]byte, error) {
+	nonce := make([]byte, a.NonceSize(), a.NonceSize()+len(plain)+a.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return a.Seal(nonce, nonce, plain, aad), nil
+}
+
+func open(a cipher.AEAD, sealed, aad []byte) ([]byte, error) {
+	if len(sealed) < a.NonceSize() {
+		return nil, fmt.Errorf("envelope: ciphertext too short")
+	}
+	return a.Open(nil, sealed[:a.NonceSize()], sealed[a.NonceSize():], aad)
+}
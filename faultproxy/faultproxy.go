@@ -0,0 +1,388 @@
+// Package faultproxy is a grpc proxy that sits between a bigtable client and
+// the emulator and injects faults, to check retry and resume logic offline.
+//
+// Every call is forwarded as raw bytes, so data and admin methods work the
+// same. A Fault matching the method can add latency, fail the call before it
+// reaches the emulator, abort a response stream after some messages (a
+// ReadRows broken mid-stream) or fail some entries of a MutateRows without
+// applying them.
+//
+//	p, err := faultproxy.New(emulatorAddr, faultproxy.Fault{Method: "ReadRows", AbortAfter: 2, AbortRate: 1})
+//	lis, _ := net.Listen("tcp", "localhost:0")
+//	go p.Serve(lis)
+//	defer p.Close()
+//	// point BIGTABLE_EMULATOR_HOST at lis.Addr()
+package faultproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bigworkshop/rawgrpc"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+	rpcstatus "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+const mutateRows = "/google.bigtable.v2.Bigtable/MutateRows"
+
+// Fault describes what to inject into the calls of a method.
+type Fault struct {
+	// Method is a full method like /google.bigtable.v2.Bigtable/ReadRows,
+	// just its name like ReadRows, or * for every method.
+	Method string
+	// Latency is added before the call is forwarded, plus up to Jitter.
+	Latency time.Duration
+	Jitter  time.Duration
+	// ErrorRate is the probability that the call fails with Code without
+	// being forwarded.
+	ErrorRate float64
+	// AbortAfter and AbortRate break the response stream with Code after
+	// AbortAfter messages, with probability AbortRate per call.
+	AbortAfter int
+	AbortRate  float64
+	// PartialRate is the probability that an entry of a MutateRows fails
+	// with Code. Failed entries are not forwarded, so they are not applied.
+	PartialRate float64
+	// Code of injected errors, Unavailable if zero.
+	Code codes.Code
+}
+
+func (f Fault) matches(method string) bool {
+	return f.Method == "*" || f.Method == method || strings.HasSuffix(method, "/"+f.Method)
+}
+
+func (f Fault) code() codes.Code {
+	if f.Code == codes.OK {
+		return codes.Unavailable
+	}
+	return f.Code
+}
+
+// ParseFault parses the -fault flag of the faultproxy command:
+//
+//	ReadRows:abort-after=2,abort=0.5
+//	*:latency=20ms,jitter=10ms,error=0.05,code=aborted
+//	MutateRows:partial=0.3
+func ParseFault(s string) (Fault, error) {
+	method, opts, _ := strings.Cut(s, ":")
+	f := Fault{Method: strings.TrimSpace(method)}
+	if f.Method == "" {
+		return f, fmt.Errorf("faultproxy: missing method in %q", s)
+	}
+	for _, opt := range strings.Split(opts, ",") {
+		if opt = strings.TrimSpace(opt); opt == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(opt, "=")
+		if !ok {
+			return f, fmt.Errorf("faultproxy: expected key=value, got %q", opt)
+		}
+		var err error
+		switch k {
+		case "latency":
+			f.Latency, err = time.ParseDuration(v)
+		case "jitter":
+			f.Jitter, err = time.ParseDuration(v)
+		case "error":
+			f.ErrorRate, err = strconv.ParseFloat(v, 64)
+		case "abort-after":
+			f.AbortAfter, err = strconv.Atoi(v)
+			if f.AbortRate == 0 {
+				f.AbortRate = 1
+			}
+		case "abort":
+			f.AbortRate, err = strconv.ParseFloat(v, 64)
+		case "partial":
+			f.PartialRate, err = strconv.ParseFloat(v, 64)
+		case "code":
+			f.Code, err = parseCode(v)
+		default:
+			return f, fmt.Errorf("faultproxy: unknown option %q, use latency, jitter, error, abort-after, abort, partial or code", k)
+		}
+		if err != nil {
+			return f, fmt.Errorf("faultproxy: %s: %w", k, err)
+		}
+	}
+	return f, nil
+}
+
+func parseCode(s string) (codes.Code, error) {
+	name := strings.ReplaceAll(strings.ToLower(s), "_", "")
+	for c := codes.OK; c <= codes.Unauthenticated; c++ {
+		if strings.ToLower(c.String()) == name {
+			return c, nil
+		}
+	}
+	return codes.OK, fmt.Errorf("unknown code %q", s)
+}
+
+// Stats counts the calls and injected faults.
+type Stats struct {
+	Calls    int
+	Errors   int
+	Aborts   int
+	Partials int
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d calls, %d errors, %d aborted streams, %d failed mutations", s.Calls, s.Errors, s.Aborts, s.Partials)
+}
+
+// Proxy forwards calls to a backend and injects faults.
+type Proxy struct {
+	backend *grpc.ClientConn
+	server  *grpc.Server
+
+	mu     sync.Mutex
+	faults []Fault
+	rand   *rand.Rand
+	stats  Stats
+}
+
+// New returns a proxy to the grpc server at backend with the given faults.
+func New(backend string, faults ...Fault) (*Proxy, error) {
+	conn, err := grpc.Dial(backend, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	p := &Proxy{backend: conn, faults: faults, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+	p.server = grpc.NewServer(grpc.ForceServerCodec(rawgrpc.Codec{}), grpc.UnknownServiceHandler(p.handle))
+	return p, nil
+}
+
+// SetFaults replaces the faults, calls already running keep theirs.
+func (p *Proxy) SetFaults(faults ...Fault) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.faults = faults
+}
+
+// Stats returns the counters since the proxy started.
+func (p *Proxy) Stats() Stats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats
+}
+
+// Serve accepts connections on lis until Close.
+func (p *Proxy) Serve(lis net.Listener) error {
+	return p.server.Serve(lis)
+}
+
+// Close stops the proxy and closes the backend connection.
+func (p *Proxy) Close() error {
+	p.server.Stop()
+	return p.backend.Close()
+}
+
+// fault returns the first fault for method, the zero Fault if none matches.
+func (p *Proxy) fault(method string) Fault {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stats.Calls++
+	for _, f := range p.faults {
+		if f.matches(method) {
+			return f
+		}
+	}
+	return Fault{}
+}
+
+// roll returns true with probability rate and counts it.
+func (p *Proxy) roll(rate float64, counter *int) bool {
+	if rate <= 0 {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.rand.Float64() >= rate {
+		return false
+	}
+	*counter++
+	return true
+}
+
+func (p *Proxy) handle(_ interface{}, ss grpc.ServerStream) error {
+	method, ok := grpc.MethodFromServerStream(ss)
+	if !ok {
+		return status.Error(codes.Internal, "faultproxy: no method")
+	}
+	ctx, cancel := context.WithCancel(ss.Context())
+	defer cancel()
+	f := p.fault(method)
+
+	if f.Latency > 0 || f.Jitter > 0 {
+		wait := f.Latency
+		if f.Jitter > 0 {
+			p.mu.Lock()
+			wait += time.Duration(p.rand.Int63n(int64(f.Jitter)))
+			p.mu.Unlock()
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	if p.roll(f.ErrorRate, &p.stats.Errors) {
+		return status.Errorf(f.code(), "faultproxy: injected %s on %s", f.code(), method)
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	ctx = metadata.NewOutgoingContext(ctx, md.Copy())
+
+	var partial *partialMutate
+	if method == mutateRows && f.PartialRate > 0 {
+		var err error
+		if partial, err = p.splitMutateRows(ss, f); err != nil {
+			return err
+		}
+		if len(partial.kept) == 0 {
+			return ss.SendMsg(partial.response())
+		}
+	}
+
+	cs, err := p.backend.NewStream(ctx, rawgrpc.StreamDesc, method, grpc.ForceCodec(rawgrpc.Codec{}))
+	if err != nil {
+		return err
+	}
+
+	// requests
+	go func() {
+		if partial != nil {
+			if err := cs.SendMsg(partial.request); err != nil {
+				cancel()
+				return
+			}
+		}
+		for {
+			req := &rawgrpc.Frame{}
+			if err := ss.RecvMsg(req); err == io.EOF {
+				cs.CloseSend()
+				return
+			} else if err != nil {
+				cancel()
+				return
+			}
+			if err := cs.SendMsg(req); err != nil {
+				cancel()
+				return
+			}
+		}
+	}()
+
+	// responses
+	abort := f.AbortRate > 0 && p.roll(f.AbortRate, &p.stats.Aborts)
+	for n := 0; ; n++ {
+		if abort && n >= f.AbortAfter {
+			return status.Errorf(f.code(), "faultproxy: aborted %s after %d messages", method, n)
+		}
+		resp := &rawgrpc.Frame{}
+		if err := cs.RecvMsg(resp); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		if n == 0 {
+			if hdr, err := cs.Header(); err == nil {
+				ss.SendHeader(hdr)
+			}
+		}
+		if partial != nil {
+			if err := partial.add(resp); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := ss.SendMsg(resp); err != nil {
+			return err
+		}
+	}
+	ss.SetTrailer(cs.Trailer())
+	if partial != nil {
+		return ss.SendMsg(partial.response())
+	}
+	return nil
+}
+
+// partialMutate is a MutateRows with some entries taken out. The responses
+// of the forwarded entries are merged with the failures into one response
+// ordered by index, the v1.16 client matches entries by position.
+type partialMutate struct {
+	request *rawgrpc.Frame
+	// kept maps the index in the forwarded request to the original index
+	kept    []int64
+	failed  []int64
+	code    codes.Code
+	entries []*btpb.MutateRowsResponse_Entry
+}
+
+func (p *Proxy) splitMutateRows(ss grpc.ServerStream, f Fault) (*partialMutate, error) {
+	in := &rawgrpc.Frame{}
+	if err := ss.RecvMsg(in); err != nil {
+		return nil, err
+	}
+	var req btpb.MutateRowsRequest
+	if err := proto.Unmarshal(in.Payload, &req); err != nil {
+		return nil, status.Errorf(codes.Internal, "faultproxy: %v", err)
+	}
+	pm := &partialMutate{code: f.code()}
+	var entries []*btpb.MutateRowsRequest_Entry
+	for i, e := range req.Entries {
+		if p.roll(f.PartialRate, &p.stats.Partials) {
+			pm.failed = append(pm.failed, int64(i))
+			continue
+		}
+		pm.kept = append(pm.kept, int64(i))
+		entries = append(entries, e)
+	}
+	req.Entries = entries
+	payload, err := proto.Marshal(&req)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "faultproxy: %v", err)
+	}
+	pm.request = &rawgrpc.Frame{Payload: payload}
+	return pm, nil
+}
+
+// add collects the entries of a backend response with their original index.
+func (pm *partialMutate) add(in *rawgrpc.Frame) error {
+	var resp btpb.MutateRowsResponse
+	if err := proto.Unmarshal(in.Payload, &resp); err != nil {
+		return status.Errorf(codes.Internal, "faultproxy: %v", err)
+	}
+	for _, e := range resp.Entries {
+		if e.Index >= 0 && e.Index < int64(len(pm.kept)) {
+			e.Index = pm.kept[e.Index]
+		}
+		pm.entries = append(pm.entries, e)
+	}
+	return nil
+}
+
+// response merges the collected entries with the injected failures.
+func (pm *partialMutate) response() *rawgrpc.Frame {
+	resp := btpb.MutateRowsResponse{Entries: pm.entries}
+	for _, i := range pm.failed {
+		resp.Entries = append(resp.Entries, &btpb.MutateRowsResponse_Entry{
+			Index:  i,
+			Status: &rpcstatus.Status{Code: int32(pm.code), Message: "faultproxy: injected partial failure"},
+		})
+	}
+	sort.Slice(resp.Entries, func(i, j int) bool { return resp.Entries[i].Index < resp.Entries[j].Index })
+	payload, _ := proto.Marshal(&resp)
+	return &rawgrpc.Frame{Payload: payload}
+}
@@ -0,0 +1,484 @@
+// Package filterexpr parses a small text syntax into bigtable filters so that
+// the tools can take filters on the command line.
+//
+// An expression is a call like latest(1) or family(fam). Calls are combined
+// with && (chain, every filter is applied in sequence) and || (interleave,
+// the results of both filters are merged), && binds tighter than || and
+// parentheses group:
+//
+//	family(fam) && latest(2)
+//	col(fam:qualifier) || (family(meme) && strip())
+//	if(value(pepe.*), label(meme), block())
+//
+// Arguments are bare words, numbers or quoted strings. Regular expressions
+// containing ( ) , | & or spaces have to be quoted: row("token:(1|2).*").
+package filterexpr
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+)
+
+type function struct {
+	args  string
+	help  string
+	build func(args []*node) (bigtable.Filter, error)
+}
+
+var functions map[string]function
+
+// functions refers to itself through chain, interleave and if, so it has to
+// be set up in init.
+func init() {
+	functions = map[string]function{
+		"row":        {"regex", "rows whose key matches", stringFilter(bigtable.RowKeyFilter)},
+		"family":     {"regex", "cells in matching column families", stringFilter(bigtable.FamilyFilter)},
+		"qualifier":  {"regex", "cells in matching column qualifiers", stringFilter(bigtable.ColumnFilter)},
+		"col":        {"family:qualifier", "cells in exactly this column", buildCol},
+		"cols":       {"family, start, end", "cells in the qualifier range [start, end)", buildCols},
+		"value":      {"regex", "cells whose value matches", stringFilter(bigtable.ValueFilter)},
+		"values":     {"start, end", "cells whose value is in [start, end)", buildValues},
+		"latest":     {"n", "the n most recent versions of each column", intFilter(bigtable.LatestNFilter)},
+		"limit":      {"n", "the first n cells of each row", intFilter(bigtable.CellsPerRowLimitFilter)},
+		"offset":     {"n", "skips the first n cells of each row", intFilter(bigtable.CellsPerRowOffsetFilter)},
+		"ts":         {"start, end", "cells written in [start, end), RFC3339 or -duration relative to now", buildTimestamps},
+		"sample":     {"p", "a random sample of rows with probability p", buildSample},
+		"label":      {"name", "labels every cell", stringFilter(bigtable.LabelFilter)},
+		"strip":      {"", "replaces every value with an empty value", noArgFilter(bigtable.StripValueFilter)},
+		"pass":       {"", "matches everything", noArgFilter(bigtable.PassAllFilter)},
+		"block":      {"", "matches nothing", noArgFilter(bigtable.BlockAllFilter)},
+		"chain":      {"f, ...", "applies every filter in sequence, same as &&", buildChain},
+		"interleave": {"f, ...", "merges the results of every filter, same as ||", buildInterleave},
+		"if":         {"predicate, true[, false]", "applies true to rows matching predicate, false to the others", buildIf},
+	}
+}
+
+// Functions returns the names of all functions, sorted.
+func Functions() []string {
+	names := make([]string, 0, len(functions))
+	for name := range functions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Help returns a one line description per function.
+func Help() []string {
+	var lines []string
+	for _, name := range Functions() {
+		f := functions[name]
+		lines = append(lines, fmt.Sprintf("%s(%s): %s", name, f.args, f.help))
+	}
+	return lines
+}
+
+// Parse parses an expression into a bigtable filter.
+func Parse(expr string) (bigtable.Filter, error) {
+	toks, err := lex(expr)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{toks: toks}
+	n, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != tokEOF {
+		return nil, p.errorf("unexpected %q", p.peek().text)
+	}
+	return n.filter()
+}
+
+// node is either a literal (name only) or a call with arguments.
+type node struct {
+	name string
+	call bool
+	args []*node
+	pos  int
+}
+
+func (n *node) filter() (bigtable.Filter, error) {
+	if !n.call {
+		return nil, fmt.Errorf("filterexpr: expected a filter at %d, got %q", n.pos, n.name)
+	}
+	f, ok := functions[n.name]
+	if !ok {
+		return nil, fmt.Errorf("filterexpr: unknown function %q at %d", n.name, n.pos)
+	}
+	filter, err := f.build(n.args)
+	if err != nil {
+		return nil, fmt.Errorf("filterexpr: %s(%s): %w", n.name, f.args, err)
+	}
+	return filter, nil
+}
+
+func (n *node) literal() (string, error) {
+	if n.call {
+		return "", fmt.Errorf("expected a value at %d, got a filter", n.pos)
+	}
+	return n.name, nil
+}
+
+func literals(args []*node, want int) ([]string, error) {
+	if len(args) != want {
+		return nil, fmt.Errorf("expected %d arguments, got %d", want, len(args))
+	}
+	vals := make([]string, len(args))
+	for i, a := range args {
+		v, err := a.literal()
+		if err != nil {
+			return nil, err
+		}
+		vals[i] = v
+	}
+	return vals, nil
+}
+
+func filters(args []*node) ([]bigtable.Filter, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("expected at least one filter")
+	}
+	fs := make([]bigtable.Filter, len(args))
+	for i, a := range args {
+		f, err := a.filter()
+		if err != nil {
+			return nil, err
+		}
+		fs[i] = f
+	}
+	return fs, nil
+}
+
+func stringFilter(fn func(string) bigtable.Filter) func([]*node) (bigtable.Filter, error) {
+	return func(args []*node) (bigtable.Filter, error) {
+		vals, err := literals(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		return fn(vals[0]), nil
+	}
+}
+
+func intFilter(fn func(int) bigtable.Filter) func([]*node) (bigtable.Filter, error) {
+	return func(args []*node) (bigtable.Filter, error) {
+		vals, err := literals(args, 1)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(vals[0])
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, fmt.Errorf("%d must not be negative", n)
+		}
+		return fn(n), nil
+	}
+}
+
+func noArgFilter(fn func() bigtable.Filter) func([]*node) (bigtable.Filter, error) {
+	return func(args []*node) (bigtable.Filter, error) {
+		if _, err := literals(args, 0); err != nil {
+			return nil, err
+		}
+		return fn(), nil
+	}
+}
+
+func buildCol(args []*node) (bigtable.Filter, error) {
+	vals, err := literals(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	fam, qual, ok := strings.Cut(vals[0], ":")
+	if !ok {
+		return nil, fmt.Errorf("%q is not family:qualifier", vals[0])
+	}
+	return ColumnFilter(fam, qual), nil
+}
+
+// ColumnFilter matches exactly one column, the family and qualifier are not regular expressions.
+func ColumnFilter(family, qualifier string) bigtable.Filter {
+	return bigtable.ChainFilters(
+		bigtable.FamilyFilter("^"+regexp.QuoteMeta(family)+"$"),
+		bigtable.ColumnFilter("^"+regexp.QuoteMeta(qualifier)+"$"),
+	)
+}
+
+func buildCols(args []*node) (bigtable.Filter, error) {
+	vals, err := literals(args, 3)
+	if err != nil {
+		return nil, err
+	}
+	return bigtable.ColumnRangeFilter(vals[0], vals[1], vals[2]), nil
+}
+
+func buildValues(args []*node) (bigtable.Filter, error) {
+	vals, err := literals(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	var start, end []byte
+	if vals[0] != "" {
+		start = []byte(vals[0])
+	}
+	if vals[1] != "" {
+		end = []byte(vals[1])
+	}
+	return bigtable.ValueRangeFilter(start, end), nil
+}
+
+func buildTimestamps(args []*node) (bigtable.Filter, error) {
+	vals, err := literals(args, 2)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	var bounds [2]time.Time
+	for i, v := range vals {
+		if bounds[i], err = ParseTime(v, now); err != nil {
+			return nil, err
+		}
+	}
+	return bigtable.TimestampRangeFilter(bounds[0], bounds[1]), nil
+}
+
+// ParseTime parses an RFC3339 time or a duration relative to now such as -1h.
+// An empty string is the zero time, which bigtable treats as unbounded.
+func ParseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(d), nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%q is neither RFC3339 nor a duration", s)
+	}
+	return t, nil
+}
+
+func buildSample(args []*node) (bigtable.Filter, error) {
+	vals, err := literals(args, 1)
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseFloat(vals[0], 64)
+	if err != nil {
+		return nil, err
+	}
+	if p <= 0 || p >= 1 {
+		return nil, fmt.Errorf("%v must be between 0 and 1", p)
+	}
+	return bigtable.RowSampleFilter(p), nil
+}
+
+func buildChain(args []*node) (bigtable.Filter, error) {
+	fs, err := filters(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(fs) == 1 {
+		return fs[0], nil
+	}
+	return bigtable.ChainFilters(fs...), nil
+}
+
+func buildInterleave(args []*node) (bigtable.Filter, error) {
+	fs, err := filters(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(fs) == 1 {
+		return fs[0], nil
+	}
+	return bigtable.InterleaveFilters(fs...), nil
+}
+
+func buildIf(args []*node) (bigtable.Filter, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, fmt.Errorf("expected 2 or 3 arguments, got %d", len(args))
+	}
+	fs, err := filters(args)
+	if err != nil {
+		return nil, err
+	}
+	if len(fs) == 2 {
+		return bigtable.ConditionFilter(fs[0], fs[1], nil), nil
+	}
+	return bigtable.ConditionFilter(fs[0], fs[1], fs[2]), nil
+}
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokWord
+	tokString
+	tokLParen
+	tokRParen
+	tokComma
+	tokAnd
+	tokOr
+)
+
+type token struct {
+	kind tokKind
+	text string
+	pos  int
+}
+
+func lex(s string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(':
+			toks = append(toks, token{tokLParen, "(", i})
+			i++
+		case c == ')':
+			toks = append(toks, token{tokRParen, ")", i})
+			i++
+		case c == ',':
+			toks = append(toks, token{tokComma, ",", i})
+			i++
+		case strings.HasPrefix(s[i:], "&&"):
+			toks = append(toks, token{tokAnd, "&&", i})
+			i += 2
+		case strings.HasPrefix(s[i:], "||"):
+			toks = append(toks, token{tokOr, "||", i})
+			i += 2
+		case c == '"' || c == '\'':
+			end := i + 1
+			for end < len(s) && s[end] != c {
+				if s[end] == '\\' && c == '"' {
+					end++
+				}
+				end++
+			}
+			if end >= len(s) {
+				return nil, fmt.Errorf("filterexpr: unterminated string at %d", i)
+			}
+			text := s[i+1 : end]
+			if c == '"' {
+				var err error
+				if text, err = strconv.Unquote(s[i : end+1]); err != nil {
+					return nil, fmt.Errorf("filterexpr: bad string at %d: %w", i, err)
+				}
+			}
+			toks = append(toks, token{tokString, text, i})
+			i = end + 1
+		default:
+			end := i
+			for end < len(s) && !strings.ContainsRune(" \t\n(),\"'", rune(s[end])) &&
+				!strings.HasPrefix(s[end:], "&&") && !strings.HasPrefix(s[end:], "||") {
+				end++
+			}
+			toks = append(toks, token{tokWord, s[i:end], i})
+			i = end
+		}
+	}
+	return append(toks, token{tokEOF, "end of expression", len(s)}), nil
+}
+
+type parser struct {
+	toks []token
+	pos  int
+}
+
+func (p *parser) peek() token { return p.toks[p.pos] }
+
+func (p *parser) next() token {
+	t := p.toks[p.pos]
+	if t.kind != tokEOF {
+		p.pos++
+	}
+	return t
+}
+
+func (p *parser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("filterexpr: at %d: %s", p.peek().pos, fmt.Sprintf(format, args...))
+}
+
+func (p *parser) parseOr() (*node, error) {
+	return p.parseBinary(tokOr, "interleave", p.parseAnd)
+}
+
+func (p *parser) parseAnd() (*node, error) {
+	return p.parseBinary(tokAnd, "chain", p.parseUnary)
+}
+
+func (p *parser) parseBinary(op tokKind, name string, operand func() (*node, error)) (*node, error) {
+	first, err := operand()
+	if err != nil {
+		return nil, err
+	}
+	if p.peek().kind != op {
+		return first, nil
+	}
+	n := &node{name: name, call: true, args: []*node{first}, pos: first.pos}
+	for p.peek().kind == op {
+		p.next()
+		arg, err := operand()
+		if err != nil {
+			return nil, err
+		}
+		n.args = append(n.args, arg)
+	}
+	return n, nil
+}
+
+func (p *parser) parseUnary() (*node, error) {
+	t := p.next()
+	switch t.kind {
+	case tokLParen:
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek().kind != tokRParen {
+			return nil, p.errorf("expected ) got %q", p.peek().text)
+		}
+		p.next()
+		return n, nil
+	case tokString:
+		return &node{name: t.text, pos: t.pos}, nil
+	case tokWord:
+		if p.peek().kind != tokLParen {
+			return &node{name: t.text, pos: t.pos}, nil
+		}
+		p.next()
+		n := &node{name: t.text, call: true, pos: t.pos}
+		if p.peek().kind == tokRParen {
+			p.next()
+			return n, nil
+		}
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			n.args = append(n.args, arg)
+			switch p.peek().kind {
+			case tokComma:
+				p.next()
+			case tokRParen:
+				p.next()
+				return n, nil
+			default:
+				return nil, p.errorf("expected , or ) got %q", p.peek().text)
+			}
+		}
+	}
+	return nil, fmt.Errorf("filterexpr: at %d: unexpected %q", t.pos, t.text)
+}
@@ -0,0 +1,514 @@
+// Package gateway exposes the data operations of exercises 1 to 4 as a
+// REST/JSON api:
+//
+//	GET  /v1/tables/{table}/rows/{key}?filter=expr                read a row (ex1, ex3)
+//	POST /v1/tables/{table}/rows/{key}:mutate                     set and delete cells, delete the row (ex1, ex4)
+//	POST /v1/tables/{table}/rows/{key}:readModifyWrite            append and increment (ex2)
+//	GET  /v1/tables/{table}/rows?prefix=p&start=k&end=k&limit=n&cursor=c&filter=expr
+//	                                                              scan a range as NDJSON (ex5)
+//
+// Row keys are path escaped, values are base64 like every []byte in
+// encoding/json. Families are validated against the table schema before a
+// mutation is sent and bigtable errors are mapped to http status codes, see
+// HTTPStatus. The handler only needs a data and an admin client, so it works
+// against the emulator as well as against an in-process bttest server.
+package gateway
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"bigworkshop/cellfmt"
+	"bigworkshop/filterexpr"
+	"bigworkshop/pager"
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Options configure the gateway.
+type Options struct {
+	// DefaultLimit is the page size of scans without a limit, MaxLimit caps it.
+	DefaultLimit int
+	MaxLimit     int
+	// SchemaTTL is how long the families of a table are cached for validation.
+	SchemaTTL time.Duration
+	// Timeout bounds single row requests, scans are only bound by the client.
+	Timeout time.Duration
+	// Open returns the table for a request, e.g. wrapped with retries or
+	// telemetry. It defaults to opening the table with the data client.
+	Open func(name string) table.Table
+}
+
+// Gateway is the http.Handler serving the api.
+type Gateway struct {
+	admin *bigtable.AdminClient
+	opts  Options
+
+	mu      sync.Mutex
+	schemas map[string]schema
+}
+
+type schema struct {
+	families map[string]bool
+	loaded   time.Time
+}
+
+// New returns a gateway using the given clients.
+func New(data *bigtable.Client, admin *bigtable.AdminClient, opts Options) *Gateway {
+	if opts.DefaultLimit <= 0 {
+		opts.DefaultLimit = 100
+	}
+	if opts.MaxLimit <= 0 {
+		opts.MaxLimit = 10000
+	}
+	if opts.SchemaTTL <= 0 {
+		opts.SchemaTTL = time.Second * 30
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = time.Second * 30
+	}
+	if opts.Open == nil {
+		opts.Open = func(name string) table.Table { return data.Open(name) }
+	}
+	return &Gateway{admin: admin, opts: opts, schemas: map[string]schema{}}
+}
+
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// use the escaped path so that keys may contain slashes as %2F
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	if len(parts) < 4 || parts[0] != "v1" || parts[1] != "tables" || parts[3] != "rows" || len(parts) > 5 {
+		writeError(w, status.Errorf(codes.NotFound, "no route for %s", r.URL.Path))
+		return
+	}
+	table, err := url.PathUnescape(parts[2])
+	if err != nil || table == "" {
+		writeError(w, status.Errorf(codes.InvalidArgument, "bad table %q", parts[2]))
+		return
+	}
+
+	if len(parts) == 4 {
+		if !allow(w, r, http.MethodGet) {
+			return
+		}
+		g.scan(w, r, table)
+		return
+	}
+
+	key, method := parts[4], ""
+	if i := strings.LastIndex(key, ":"); i >= 0 && r.Method == http.MethodPost {
+		key, method = key[:i], key[i+1:]
+	}
+	if key, err = url.PathUnescape(key); err != nil || key == "" {
+		writeError(w, status.Errorf(codes.InvalidArgument, "bad row key %q", parts[4]))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), g.opts.Timeout)
+	defer cancel()
+	switch method {
+	case "":
+		if allow(w, r, http.MethodGet) {
+			g.readRow(ctx, w, r, table, key)
+		}
+	case "mutate":
+		g.mutate(ctx, w, r, table, key)
+	case "readModifyWrite":
+		g.readModifyWrite(ctx, w, r, table, key)
+	default:
+		writeError(w, status.Errorf(codes.NotFound, "unknown method %q, use mutate or readModifyWrite", method))
+	}
+}
+
+func allow(w http.ResponseWriter, r *http.Request, method string) bool {
+	if r.Method == method {
+		return true
+	}
+	w.Header().Set("Allow", method)
+	writeJSON(w, http.StatusMethodNotAllowed, map[string]interface{}{"error": map[string]interface{}{
+		"code": http.StatusMethodNotAllowed, "status": "METHOD_NOT_ALLOWED", "message": "use " + method,
+	}})
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.WithError(err).Warn("could not write response")
+	}
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	body := newErrorBody(err)
+	if body.Error.Code >= 500 {
+		logrus.WithError(err).Warn("gateway request failed")
+	}
+	writeJSON(w, body.Error.Code, body)
+}
+
+// Cell is a single cell version.
+type Cell struct {
+	Family    string   `json:"family"`
+	Qualifier string   `json:"qualifier"`
+	Timestamp int64    `json:"timestamp"`
+	Value     []byte   `json:"value"`
+	Labels    []string `json:"labels,omitempty"`
+}
+
+// Row is the json form of a bigtable row.
+type Row struct {
+	Key   string `json:"key"`
+	Cells []Cell `json:"cells"`
+}
+
+func toRow(r bigtable.Row) Row {
+	out := Row{Key: r.Key(), Cells: []Cell{}}
+	for _, c := range cellfmt.Cells(r) {
+		out.Cells = append(out.Cells, Cell{
+			Family:    c.Family,
+			Qualifier: c.Qualifier,
+			Timestamp: int64(c.Timestamp),
+			Value:     c.Value,
+			Labels:    c.Labels,
+		})
+	}
+	return out
+}
+
+func readOpts(r *http.Request) ([]bigtable.ReadOption, error) {
+	expr := r.URL.Query().Get("filter")
+	if expr == "" {
+		return nil, nil
+	}
+	f, err := filterexpr.Parse(expr)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+	return []bigtable.ReadOption{bigtable.RowFilter(f)}, nil
+}
+
+func (g *Gateway) readRow(ctx context.Context, w http.ResponseWriter, r *http.Request, table, key string) {
+	opts, err := readOpts(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	row, err := g.opts.Open(table).ReadRow(ctx, key, opts...)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(row) == 0 {
+		writeError(w, status.Errorf(codes.NotFound, "row %q not found", key))
+		return
+	}
+	writeJSON(w, http.StatusOK, toRow(row))
+}
+
+// MutateRequest is the body of :mutate, the mutations are applied atomically in order.
+type MutateRequest struct {
+	Mutations []Mutation `json:"mutations"`
+}
+
+// Mutation sets exactly one of its fields.
+type Mutation struct {
+	Set          *SetCell      `json:"set,omitempty"`
+	DeleteCells  *DeleteCells  `json:"deleteCells,omitempty"`
+	DeleteFamily *DeleteFamily `json:"deleteFamily,omitempty"`
+	DeleteRow    *struct{}     `json:"deleteRow,omitempty"`
+}
+
+// SetCell writes a cell. Timestamp is in microseconds, 0 means now and -1
+// lets the server pick the time. Text can be used instead of Value.
+type SetCell struct {
+	Family    string `json:"family"`
+	Qualifier string `json:"qualifier"`
+	Timestamp int64  `json:"timestamp"`
+	Value     []byte `json:"value"`
+	Text      string `json:"text"`
+}
+
+// DeleteCells deletes the versions of a column in [Start, End), 0 is unbounded.
+type DeleteCells struct {
+	Family    string `json:"family"`
+	Qualifier string `json:"qualifier"`
+	Start     int64  `json:"start"`
+	End       int64  `json:"end"`
+}
+
+// DeleteFamily deletes all cells of a family.
+type DeleteFamily struct {
+	Family string `json:"family"`
+}
+
+func (g *Gateway) mutate(ctx context.Context, w http.ResponseWriter, r *http.Request, table, key string) {
+	var req MutateRequest
+	if err := decode(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(req.Mutations) == 0 {
+		writeError(w, status.Error(codes.InvalidArgument, "no mutations"))
+		return
+	}
+
+	var families []string
+	mut := bigtable.NewMutation()
+	for i, m := range req.Mutations {
+		switch {
+		case m.Set != nil && m.DeleteCells == nil && m.DeleteFamily == nil && m.DeleteRow == nil:
+			ts := bigtable.Timestamp(m.Set.Timestamp)
+			if ts == 0 {
+				ts = bigtable.Now()
+			}
+			value := m.Set.Value
+			if value == nil {
+				value = []byte(m.Set.Text)
+			}
+			mut.Set(m.Set.Family, m.Set.Qualifier, ts, value)
+			families = append(families, m.Set.Family)
+		case m.DeleteCells != nil && m.Set == nil && m.DeleteFamily == nil && m.DeleteRow == nil:
+			d := m.DeleteCells
+			if d.Start == 0 && d.End == 0 {
+				mut.DeleteCellsInColumn(d.Family, d.Qualifier)
+			} else {
+				mut.DeleteTimestampRange(d.Family, d.Qualifier, bigtable.Timestamp(d.Start), bigtable.Timestamp(d.End))
+			}
+			families = append(families, d.Family)
+		case m.DeleteFamily != nil && m.Set == nil && m.DeleteCells == nil && m.DeleteRow == nil:
+			mut.DeleteCellsInFamily(m.DeleteFamily.Family)
+			families = append(families, m.DeleteFamily.Family)
+		case m.DeleteRow != nil && m.Set == nil && m.DeleteCells == nil && m.DeleteFamily == nil:
+			mut.DeleteRow()
+		default:
+			writeError(w, status.Errorf(codes.InvalidArgument, "mutation %d must set exactly one of set, deleteCells, deleteFamily or deleteRow", i))
+			return
+		}
+	}
+	if err := g.validateFamilies(ctx, table, families); err != nil {
+		writeError(w, err)
+		return
+	}
+	if err := g.opts.Open(table).Apply(ctx, key, mut); err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]int{"applied": len(req.Mutations)})
+}
+
+// ReadModifyWriteRequest is the body of :readModifyWrite.
+type ReadModifyWriteRequest struct {
+	Rules []Rule `json:"rules"`
+}
+
+// Rule appends to or increments a cell, Increment works on 8 byte big-endian values.
+type Rule struct {
+	Family     string `json:"family"`
+	Qualifier  string `json:"qualifier"`
+	Append     []byte `json:"append,omitempty"`
+	AppendText string `json:"appendText,omitempty"`
+	Increment  int64  `json:"increment,omitempty"`
+}
+
+func (g *Gateway) readModifyWrite(ctx context.Context, w http.ResponseWriter, r *http.Request, table, key string) {
+	var req ReadModifyWriteRequest
+	if err := decode(r, &req); err != nil {
+		writeError(w, err)
+		return
+	}
+	if len(req.Rules) == 0 {
+		writeError(w, status.Error(codes.InvalidArgument, "no rules"))
+		return
+	}
+
+	var families []string
+	rmw := bigtable.NewReadModifyWrite()
+	for i, rule := range req.Rules {
+		appends := rule.Append != nil || rule.AppendText != ""
+		switch {
+		case appends && rule.Increment == 0:
+			value := rule.Append
+			if value == nil {
+				value = []byte(rule.AppendText)
+			}
+			rmw.AppendValue(rule.Family, rule.Qualifier, value)
+		case !appends && rule.Increment != 0:
+			rmw.Increment(rule.Family, rule.Qualifier, rule.Increment)
+		default:
+			writeError(w, status.Errorf(codes.InvalidArgument, "rule %d must either append or increment", i))
+			return
+		}
+		families = append(families, rule.Family)
+	}
+	if err := g.validateFamilies(ctx, table, families); err != nil {
+		writeError(w, err)
+		return
+	}
+	row, err := g.opts.Open(table).ApplyReadModifyWrite(ctx, key, rmw)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, toRow(row))
+}
+
+func decode(r *http.Request, v interface{}) error {
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return status.Errorf(codes.InvalidArgument, "bad request body: %v", err)
+	}
+	return nil
+}
+
+// validateFamilies checks that every family exists in the table, the
+// schema is cached for Options.SchemaTTL and reloaded once on a miss.
+func (g *Gateway) validateFamilies(ctx context.Context, table string, families []string) error {
+	for reloaded := false; ; reloaded = true {
+		known, err := g.families(ctx, table, reloaded)
+		if err != nil {
+			return err
+		}
+		missing := ""
+		for _, f := range families {
+			if f == "" {
+				return status.Error(codes.InvalidArgument, "missing family")
+			}
+			if !known[f] {
+				missing = f
+				break
+			}
+		}
+		if missing == "" {
+			return nil
+		}
+		if reloaded {
+			return status.Errorf(codes.InvalidArgument, "table %s has no column family %q", table, missing)
+		}
+	}
+}
+
+func (g *Gateway) families(ctx context.Context, table string, reload bool) (map[string]bool, error) {
+	g.mu.Lock()
+	s, ok := g.schemas[table]
+	g.mu.Unlock()
+	if ok && !reload && time.Since(s.loaded) < g.opts.SchemaTTL {
+		return s.families, nil
+	}
+
+	info, err := g.admin.TableInfo(ctx, table)
+	if err != nil {
+		return nil, err
+	}
+	s = schema{families: map[string]bool{}, loaded: time.Now()}
+	for _, f := range info.Families {
+		s.families[f] = true
+	}
+	g.mu.Lock()
+	g.schemas[table] = s
+	g.mu.Unlock()
+	return s.families, nil
+}
+
+// ScanLine is one line of a scan response: either a row or, as the last
+// line, the cursor for the next page or an error that ended the stream.
+type ScanLine struct {
+	Row    *Row       `json:"row,omitempty"`
+	Cursor string     `json:"cursor,omitempty"`
+	Error  *errorBody `json:"error,omitempty"`
+}
+
+// EncodeCursor turns the last row key of a page into an opaque cursor.
+func EncodeCursor(key string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// DecodeCursor is the reverse of EncodeCursor.
+func DecodeCursor(cursor string) (string, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return "", status.Errorf(codes.InvalidArgument, "bad cursor %q", cursor)
+	}
+	return string(key), nil
+}
+
+// scan streams rows as NDJSON while they are read. When the page is full the
+// last line carries the cursor to continue after the last row, like exercise 5.4.
+func (g *Gateway) scan(w http.ResponseWriter, r *http.Request, table string) {
+	q := r.URL.Query()
+	rng := pager.Range{Start: q.Get("start"), Limit: q.Get("end")}
+	if prefix := q.Get("prefix"); prefix != "" {
+		if rng.Start != "" || rng.Limit != "" {
+			writeError(w, status.Error(codes.InvalidArgument, "prefix cannot be combined with start or end"))
+			return
+		}
+		rng = pager.PrefixRange(prefix)
+	}
+	limit := g.opts.DefaultLimit
+	if l := q.Get("limit"); l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n <= 0 || n > g.opts.MaxLimit {
+			writeError(w, status.Errorf(codes.InvalidArgument, "limit must be between 1 and %d", g.opts.MaxLimit))
+			return
+		}
+		limit = n
+	}
+	after := ""
+	if c := q.Get("cursor"); c != "" {
+		var err error
+		if after, err = DecodeCursor(c); err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+	opts, err := readOpts(r)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	rng = rng.After(after)
+	if rng.Limit != "" && rng.Start >= rng.Limit {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	count, last := 0, ""
+	err = g.opts.Open(table).ReadRows(r.Context(), rng.RowRange(), func(row bigtable.Row) bool {
+		out := toRow(row)
+		if err := enc.Encode(ScanLine{Row: &out}); err != nil {
+			return false // client went away
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		count++
+		last = row.Key()
+		return true
+	}, append(opts, bigtable.LimitRows(int64(limit)))...)
+
+	switch {
+	case err != nil && count == 0:
+		// nothing was written yet, so a proper status code can still be sent
+		w.Header().Del("Content-Type")
+		writeError(w, err)
+	case err != nil:
+		body := newErrorBody(err)
+		logrus.WithError(err).Warn("scan ended early")
+		enc.Encode(ScanLine{Error: &body, Cursor: EncodeCursor(last)})
+	case count == limit:
+		enc.Encode(ScanLine{Cursor: EncodeCursor(last)})
+	}
+}
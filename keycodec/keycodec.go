@@ -0,0 +1,259 @@
+// Package keycodec turns numeric ids into row keys, with the key schemes of
+// exercise 5 and a salted one that spreads sequential ids over the table.
+//
+//	plain          token:42
+//	padded         token:0000000042
+//	padded-desc    token:9999999957, newest first
+//	padded-desc:5:10000  token:09958, the keys of ex5.2
+//	salted:16      0a#token:42, 16 buckets in front of plain keys
+//	salted:16:padded-desc
+//
+// Padded keys sort like their ids, plain keys do not. Sequential ids end up
+// next to each other with both, so all writes of a time ordered workload hit
+// the same tablet; a salt prefix spreads them at the price of scans having
+// to read every bucket.
+package keycodec
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Codec encodes ids as row keys.
+type Codec interface {
+	// Encode returns the row key of id, which has to pass Check.
+	Encode(id uint64) string
+	// Check returns an error for ids Encode has no key for, e.g. ids
+	// wider than a padded key.
+	Check(id uint64) error
+	// Decode returns the id of a row key written by Encode.
+	Decode(key string) (uint64, error)
+	// String returns the scheme as accepted by Parse.
+	String() string
+}
+
+// Plain keys are the prefix followed by the decimal id.
+type Plain struct {
+	Prefix string
+}
+
+func (c Plain) Encode(id uint64) string {
+	return c.Prefix + strconv.FormatUint(id, 10)
+}
+
+func (c Plain) Check(id uint64) error {
+	return nil
+}
+
+func (c Plain) Decode(key string) (uint64, error) {
+	if !strings.HasPrefix(key, c.Prefix) {
+		return 0, fmt.Errorf("keycodec: key %q does not start with %q", key, c.Prefix)
+	}
+	return strconv.ParseUint(key[len(c.Prefix):], 10, 64)
+}
+
+func (c Plain) String() string {
+	return "plain"
+}
+
+// Padded keys are the prefix followed by the id padded with zeros to Width
+// digits. Descending keys store Max-id, so that higher ids sort first.
+type Padded struct {
+	Prefix     string
+	Width      int
+	Descending bool
+	// Max is the highest id of descending keys, 10^Width-1 if zero.
+	Max uint64
+}
+
+// widest returns the highest number of Width digits.
+func (c Padded) widest() uint64 {
+	if c.Width >= 20 {
+		return math.MaxUint64
+	}
+	m := uint64(1)
+	for i := 0; i < c.Width; i++ {
+		m *= 10
+	}
+	return m - 1
+}
+
+func (c Padded) max() uint64 {
+	if c.Max > 0 {
+		return c.Max
+	}
+	return c.widest()
+}
+
+// Check rejects ids above the max of descending keys and ids whose keys
+// would have more than Width digits, they would not sort with the others.
+func (c Padded) Check(id uint64) error {
+	n := id
+	if c.Descending {
+		if id > c.max() {
+			return fmt.Errorf("keycodec: id %d is above the max %d of %v", id, c.max(), c)
+		}
+		n = c.max() - id
+	}
+	if n > c.widest() {
+		return fmt.Errorf("keycodec: id %d does not fit in the %d digits of %v", id, c.Width, c)
+	}
+	return nil
+}
+
+func (c Padded) Encode(id uint64) string {
+	if c.Descending {
+		id = c.max() - id
+	}
+	return fmt.Sprintf("%s%0*d", c.Prefix, c.Width, id)
+}
+
+func (c Padded) Decode(key string) (uint64, error) {
+	n, err := Plain{Prefix: c.Prefix}.Decode(key)
+	if err != nil {
+		return 0, err
+	}
+	if n > c.widest() || (c.Descending && n > c.max()) {
+		return 0, fmt.Errorf("keycodec: key %q is out of the range of %v", key, c)
+	}
+	if c.Descending {
+		return c.max() - n, nil
+	}
+	return n, nil
+}
+
+func (c Padded) String() string {
+	name := "padded"
+	if c.Descending {
+		name = "padded-desc"
+	}
+	switch {
+	case c.Max > 0:
+		return fmt.Sprintf("%s:%d:%d", name, c.Width, c.Max)
+	case c.Width != 10:
+		return fmt.Sprintf("%s:%d", name, c.Width)
+	}
+	return name
+}
+
+// Salted keys put a bucket derived from the id in front of the keys of
+// Inner, e.g. 0a#token:42.
+type Salted struct {
+	Buckets int
+	Inner   Codec
+}
+
+// Bucket returns the salt bucket of id.
+func (c Salted) Bucket(id uint64) int {
+	h := fnv.New32a()
+	var b [8]byte
+	for i := range b {
+		b[i] = byte(id >> (8 * i))
+	}
+	h.Write(b[:])
+	return int(h.Sum32() % uint32(c.Buckets))
+}
+
+// Prefixes returns the key prefix of every bucket, scans of the whole key
+// space have to read all of them.
+func (c Salted) Prefixes() []string {
+	p := make([]string, c.Buckets)
+	for i := range p {
+		p[i] = c.salt(i)
+	}
+	return p
+}
+
+func (c Salted) salt(bucket int) string {
+	width := len(strconv.FormatInt(int64(c.Buckets-1), 16))
+	return fmt.Sprintf("%0*x#", width, bucket)
+}
+
+func (c Salted) Encode(id uint64) string {
+	return c.salt(c.Bucket(id)) + c.Inner.Encode(id)
+}
+
+func (c Salted) Check(id uint64) error {
+	return c.Inner.Check(id)
+}
+
+func (c Salted) Decode(key string) (uint64, error) {
+	_, rest, ok := strings.Cut(key, "#")
+	if !ok {
+		return 0, fmt.Errorf("keycodec: key %q has no salt", key)
+	}
+	return c.Inner.Decode(rest)
+}
+
+func (c Salted) String() string {
+	if _, plain := c.Inner.(Plain); plain {
+		return fmt.Sprintf("salted:%d", c.Buckets)
+	}
+	return fmt.Sprintf("salted:%d:%v", c.Buckets, c.Inner)
+}
+
+// Parse returns the codec of a scheme listed in the package doc, the keys
+// start with prefix. Padded ids have 10 digits unless the scheme says
+// otherwise, padded:width or padded-desc:width[:max].
+func Parse(scheme, prefix string) (Codec, error) {
+	if scheme == "plain" {
+		return Plain{Prefix: prefix}, nil
+	}
+	if name, params, _ := strings.Cut(scheme, ":"); name == "padded" || name == "padded-desc" {
+		c := Padded{Prefix: prefix, Width: 10, Descending: name == "padded-desc"}
+		if params == "" {
+			return c, nil
+		}
+		width, max, hasMax := strings.Cut(params, ":")
+		var err error
+		if c.Width, err = strconv.Atoi(width); err != nil || c.Width < 1 || c.Width > 19 {
+			return nil, fmt.Errorf("keycodec: bad width in %q", scheme)
+		}
+		if hasMax {
+			if !c.Descending {
+				return nil, fmt.Errorf("keycodec: only padded-desc has a max, got %q", scheme)
+			}
+			if c.Max, err = strconv.ParseUint(max, 10, 64); err != nil || c.Max == 0 || c.Max > c.widest() {
+				return nil, fmt.Errorf("keycodec: bad max in %q, it has to fit in the width", scheme)
+			}
+		}
+		return c, nil
+	}
+	if rest, ok := cutPrefix(scheme, "salted:"); ok {
+		n, inner, _ := strings.Cut(rest, ":")
+		buckets, err := strconv.Atoi(n)
+		if err != nil || buckets < 1 {
+			return nil, fmt.Errorf("keycodec: bad bucket count in %q", scheme)
+		}
+		if inner == "" {
+			inner = "plain"
+		}
+		c, err := Parse(inner, prefix)
+		if err != nil {
+			return nil, err
+		}
+		if _, nested := c.(Salted); nested {
+			return nil, fmt.Errorf("keycodec: %q salts twice", scheme)
+		}
+		return Salted{Buckets: buckets, Inner: c}, nil
+	}
+	return nil, fmt.Errorf("keycodec: unknown scheme %q, use plain, padded[:width], padded-desc[:width[:max]] or salted:n[:scheme]", scheme)
+}
+
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+// Matches reports whether key is written by c, i.e. decodes to an id c
+// can encode and encodes back to itself. Plain keys with leading zeros and
+// padded keys without them do not match.
+func Matches(c Codec, key string) bool {
+	id, err := c.Decode(key)
+	return err == nil && c.Check(id) == nil && c.Encode(id) == key
+}
@@ -0,0 +1,104 @@
+package keycodec
+
+import (
+	"sort"
+	"testing"
+)
+
+func mustParse(t *testing.T, scheme, prefix string) Codec {
+	t.Helper()
+	c, err := Parse(scheme, prefix)
+	if err != nil {
+		t.Fatalf("parse %q: %v", scheme, err)
+	}
+	return c
+}
+
+func TestRoundTrip(t *testing.T) {
+	ids := []uint64{0, 1, 42, 999, 1000, 99999}
+	for _, scheme := range []string{"plain", "padded", "padded:5", "padded-desc:5", "padded-desc:6:100000", "salted:4", "salted:4:padded:6"} {
+		c := mustParse(t, scheme, "doc:")
+		for _, id := range ids {
+			if err := c.Check(id); err != nil {
+				t.Errorf("%s: check %d: %v", scheme, id, err)
+				continue
+			}
+			key := c.Encode(id)
+			got, err := c.Decode(key)
+			if err != nil || got != id {
+				t.Errorf("%s: decode %q = %d, %v, want %d", scheme, key, got, err, id)
+			}
+			if !Matches(c, key) {
+				t.Errorf("%s: %q does not match", scheme, key)
+			}
+		}
+	}
+}
+
+func TestSortOrder(t *testing.T) {
+	ids := []uint64{0, 7, 10, 99, 100, 12345, 99999}
+	for _, scheme := range []string{"padded:5", "padded-desc:5"} {
+		c := mustParse(t, scheme, "doc:")
+		keys := make([]string, len(ids))
+		for i, id := range ids {
+			keys[i] = c.Encode(id)
+		}
+		desc := c.(Padded).Descending
+		if !sort.SliceIsSorted(keys, func(i, j int) bool { return keys[i] < keys[j] != desc }) {
+			t.Errorf("%s: keys %q do not sort in id order", scheme, keys)
+		}
+	}
+}
+
+func TestOutOfRange(t *testing.T) {
+	for _, tc := range []struct {
+		scheme string
+		id     uint64
+	}{
+		{"padded:5", 100000},
+		{"padded-desc:5", 100000},
+		{"padded-desc:5:500", 501},
+		{"salted:4:padded:3", 1000},
+	} {
+		c := mustParse(t, tc.scheme, "doc:")
+		if err := c.Check(tc.id); err == nil {
+			t.Errorf("%s: id %d passes check", tc.scheme, tc.id)
+		}
+		if key := c.Encode(tc.id); Matches(c, key) {
+			t.Errorf("%s: %q of id %d matches", tc.scheme, key, tc.id)
+		}
+	}
+
+	for _, tc := range []struct{ scheme, key string }{
+		{"padded:5", "doc:123456"},
+		{"padded-desc:5:500", "doc:00501"},
+	} {
+		c := mustParse(t, tc.scheme, "doc:")
+		if id, err := c.Decode(tc.key); err == nil {
+			t.Errorf("%s: %q decodes to %d", tc.scheme, tc.key, id)
+		}
+	}
+
+	if _, err := Parse("padded-desc:3:1000", ""); err == nil {
+		t.Error("max wider than the width parses")
+	}
+}
+
+func TestMatchesRejectsOtherSchemes(t *testing.T) {
+	plain, padded := mustParse(t, "plain", "doc:"), mustParse(t, "padded:5", "doc:")
+	for _, tc := range []struct {
+		c    Codec
+		key  string
+		want bool
+	}{
+		{plain, "doc:42", true},
+		{plain, "doc:00042", false},
+		{padded, "doc:00042", true},
+		{padded, "doc:42", false},
+		{padded, "user:00042", false},
+	} {
+		if got := Matches(tc.c, tc.key); got != tc.want {
+			t.Errorf("Matches(%v, %q) = %v, want %v", tc.c, tc.key, got, tc.want)
+		}
+	}
+}
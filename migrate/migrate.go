@@ -0,0 +1,450 @@
+// Package migrate applies versioned schema and data migrations and records
+// them in a metadata table, so every copy of a table, the emulator of each
+// developer included, can be brought to the same state.
+//
+// A migration is a list of steps: tables and families to create or delete,
+// gc policies, go functions and Rewrites, data migrations that rewrite rows
+// in batches, e.g. to move ex5's keys to padded ones:
+//
+//	m, err := migrate.New(admin, data, migrate.Options{},
+//		migrate.Migration{Version: 1, Name: "create tokens", Up: []migrate.Step{
+//			migrate.CreateTable{Table: "tokens"},
+//			migrate.CreateFamily{Table: "tokens", Family: "fam", GCPolicy: bigtable.MaxVersionsPolicy(1)},
+//		}},
+//	)
+//	err = m.Up(ctx, 0)
+//
+// Every step records its progress, Rewrites after every batch, and a
+// migration that failed continues where it stopped on the next Up. A lock
+// row keeps two runs from migrating at the same time.
+package migrate
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+	"github.com/sirupsen/logrus"
+)
+
+// Migration is a version of the schema and the steps to reach it from the
+// previous version.
+type Migration struct {
+	Version int
+	Name    string
+	Up      []Step
+	// Down undoes Up, the reverses of the Up steps in reverse order if
+	// nil.
+	Down []Step
+}
+
+// downSteps returns the steps undoing m. The reverses of CreateTable and
+// CreateFamily steps only run if the step created its table or family,
+// created holds the indexes of those steps.
+func (m Migration) downSteps(created map[int]bool) ([]Step, error) {
+	if m.Down != nil {
+		return m.Down, nil
+	}
+	steps := make([]Step, len(m.Up))
+	for i, s := range m.Up {
+		r, ok := s.(Reverser)
+		if !ok {
+			return nil, fmt.Errorf("migration %d: %v cannot be undone, the migration needs Down steps", m.Version, s)
+		}
+		rev := r.Reverse()
+		switch s.(type) {
+		case CreateTable, CreateFamily:
+			if !created[i] {
+				rev = keep{s}
+			}
+		}
+		steps[len(m.Up)-1-i] = rev
+	}
+	return steps, nil
+}
+
+// Options configure a Migrator.
+type Options struct {
+	// MetaTable records the migrations, schema_migrations if empty. It is
+	// created on the first Up.
+	MetaTable string
+	// Open returns the data api of a table, the data client's Open if nil.
+	Open func(name string) table.Table
+	// DryRun only logs the steps and counts the rows Rewrites would
+	// change, nothing is written, not even to the metadata table.
+	DryRun bool
+	// Log receives the progress, logrus.StandardLogger() if nil.
+	Log logrus.FieldLogger
+}
+
+// Migrator applies migrations.
+type Migrator struct {
+	admin      *bigtable.AdminClient
+	opts       Options
+	meta       table.Table
+	migrations []Migration
+}
+
+const (
+	metaFamily = "m"
+	lockRow    = "lock"
+
+	// createdPrefix and the index of a step name the column recording that
+	// it created its table or family
+	createdPrefix = "created_"
+
+	stateRunning   = "running"
+	stateApplied   = "applied"
+	stateReverting = "reverting"
+)
+
+// New returns a migrator for the migrations, their versions have to be
+// positive and unique.
+func New(admin *bigtable.AdminClient, data *bigtable.Client, opts Options, migrations ...Migration) (*Migrator, error) {
+	if opts.MetaTable == "" {
+		opts.MetaTable = "schema_migrations"
+	}
+	if opts.Open == nil {
+		opts.Open = func(name string) table.Table { return data.Open(name) }
+	}
+	if opts.Log == nil {
+		opts.Log = logrus.StandardLogger()
+	}
+	ms := append([]Migration(nil), migrations...)
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	for i, m := range ms {
+		if m.Version <= 0 {
+			return nil, fmt.Errorf("migration %q: version %d is not positive", m.Name, m.Version)
+		}
+		if i > 0 && ms[i-1].Version == m.Version {
+			return nil, fmt.Errorf("migrations %q and %q both have version %d", ms[i-1].Name, m.Name, m.Version)
+		}
+	}
+	return &Migrator{admin: admin, opts: opts, meta: opts.Open(opts.MetaTable), migrations: ms}, nil
+}
+
+// Status is the state of a migration.
+type Status struct {
+	Version int
+	Name    string
+	// State is applied, running or reverting for a migration that was
+	// interrupted, empty if it is pending.
+	State     string
+	AppliedAt time.Time
+	// Step is the index of the step that runs next while State is running
+	// or reverting, Checkpoint the last row its Rewrite finished and Rows
+	// the rows it scanned.
+	Step       int
+	Checkpoint string
+	Rows       int64
+	// Unknown is set for a migration that is recorded but not registered,
+	// applied by a newer version of the program.
+	Unknown bool
+
+	// created holds the steps that created their table or family
+	created map[int]bool
+}
+
+func versionKey(v int) string {
+	return fmt.Sprintf("%010d", v)
+}
+
+// recorded reads the metadata table, nil if it does not exist yet.
+func (m *Migrator) recorded(ctx context.Context) (map[int]Status, error) {
+	tables, err := m.admin.Tables(ctx)
+	if err != nil {
+		return nil, err
+	}
+	exists := false
+	for _, t := range tables {
+		exists = exists || t == m.opts.MetaTable
+	}
+	if !exists {
+		return nil, nil
+	}
+	recs := map[int]Status{}
+	err = m.meta.ReadRows(ctx, bigtable.InfiniteRange(""), func(r bigtable.Row) bool {
+		v, err := strconv.Atoi(r.Key())
+		if err != nil {
+			return true // the lock
+		}
+		s := Status{Version: v}
+		for _, it := range r[metaFamily] {
+			val := string(it.Value)
+			switch it.Column[len(metaFamily)+1:] {
+			case "name":
+				s.Name = val
+			case "state":
+				s.State = val
+			case "applied_at":
+				s.AppliedAt, _ = time.Parse(time.RFC3339, val)
+			case "step":
+				s.Step, _ = strconv.Atoi(val)
+			case "checkpoint":
+				s.Checkpoint = val
+			case "rows":
+				s.Rows, _ = strconv.ParseInt(val, 10, 64)
+			default:
+				if i, err := strconv.Atoi(strings.TrimPrefix(it.Column[len(metaFamily)+1:], createdPrefix)); err == nil && val == "1" {
+					if s.created == nil {
+						s.created = map[int]bool{}
+					}
+					s.created[i] = true
+				}
+			}
+		}
+		recs[v] = s
+		return true
+	}, bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	return recs, err
+}
+
+// Status returns the registered migrations and those only recorded, by
+// version.
+func (m *Migrator) Status(ctx context.Context) ([]Status, error) {
+	recs, err := m.recorded(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var out []Status
+	for _, mig := range m.migrations {
+		s, ok := recs[mig.Version]
+		if !ok {
+			s = Status{Version: mig.Version}
+		}
+		s.Name = mig.Name
+		out = append(out, s)
+		delete(recs, mig.Version)
+	}
+	for _, s := range recs {
+		s.Unknown = true
+		out = append(out, s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Version < out[j].Version })
+	return out, nil
+}
+
+// record sets columns of the row of version v.
+func (m *Migrator) record(ctx context.Context, v int, cols map[string]string) error {
+	mut := bigtable.NewMutation()
+	ts := bigtable.Now()
+	for c, val := range cols {
+		mut.Set(metaFamily, c, ts, []byte(val))
+	}
+	return m.meta.Apply(ctx, versionKey(v), mut)
+}
+
+func (m *Migrator) ensureMeta(ctx context.Context) error {
+	env := &Env{Admin: m.admin}
+	if err := (CreateTable{Table: m.opts.MetaTable}).Run(ctx, env); err != nil {
+		return err
+	}
+	return CreateFamily{Table: m.opts.MetaTable, Family: metaFamily, GCPolicy: bigtable.MaxVersionsPolicy(1)}.Run(ctx, env)
+}
+
+// lock takes the lock row, or fails if another run holds it.
+func (m *Migrator) lock(ctx context.Context) error {
+	host, _ := os.Hostname()
+	owner := fmt.Sprintf("%s pid %d since %s", host, os.Getpid(), time.Now().UTC().Format(time.RFC3339))
+	set := bigtable.NewMutation()
+	set.Set(metaFamily, "owner", bigtable.Now(), []byte(owner))
+	held := false
+	cond := bigtable.NewCondMutation(bigtable.ColumnFilter("owner"), nil, set)
+	if err := m.meta.Apply(ctx, lockRow, cond, bigtable.GetCondMutationResult(&held)); err != nil {
+		return err
+	}
+	if held {
+		r, err := m.meta.ReadRow(ctx, lockRow)
+		if err != nil {
+			return err
+		}
+		by := "another run"
+		if items := r[metaFamily]; len(items) > 0 {
+			by = string(items[0].Value)
+		}
+		return fmt.Errorf("migrations are locked by %s, run unlock if it is gone", by)
+	}
+	return nil
+}
+
+// Unlock removes the lock of a run that died without releasing it.
+func (m *Migrator) Unlock(ctx context.Context) error {
+	mut := bigtable.NewMutation()
+	mut.DeleteRow()
+	return m.meta.Apply(ctx, lockRow, mut)
+}
+
+// begin prepares the metadata table and takes the lock, the returned
+// function releases it.
+func (m *Migrator) begin(ctx context.Context) (map[int]Status, func(), error) {
+	if m.opts.DryRun {
+		recs, err := m.recorded(ctx)
+		return recs, func() {}, err
+	}
+	if err := m.ensureMeta(ctx); err != nil {
+		return nil, nil, err
+	}
+	if err := m.lock(ctx); err != nil {
+		return nil, nil, err
+	}
+	unlock := func() {
+		// the run may have been cancelled, the lock is released anyway
+		if err := m.Unlock(context.Background()); err != nil {
+			m.opts.Log.WithError(err).Warn("could not release the migration lock")
+		}
+	}
+	recs, err := m.recorded(ctx)
+	if err != nil {
+		unlock()
+		return nil, nil, err
+	}
+	return recs, unlock, nil
+}
+
+// Up applies the pending migrations up to version target, all if target is
+// zero, and continues interrupted ones.
+func (m *Migrator) Up(ctx context.Context, target int) error {
+	recs, unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	for _, mig := range m.migrations {
+		if target > 0 && mig.Version > target {
+			break
+		}
+		rec := recs[mig.Version]
+		switch rec.State {
+		case stateApplied:
+			continue
+		case stateReverting:
+			return fmt.Errorf("migration %d was interrupted while being undone, run down first", mig.Version)
+		}
+		if err := m.run(ctx, mig, mig.Up, stateRunning, rec); err != nil {
+			return err
+		}
+		if m.opts.DryRun {
+			continue
+		}
+		err := m.record(ctx, mig.Version, map[string]string{
+			"state":      stateApplied,
+			"applied_at": time.Now().UTC().Format(time.RFC3339),
+			"step":       "",
+			"checkpoint": "",
+			"rows":       "",
+		})
+		if err != nil {
+			return err
+		}
+		m.opts.Log.Infof("migration %d %s applied", mig.Version, mig.Name)
+	}
+	return nil
+}
+
+// Down undoes the applied migrations above version target, newest first.
+// A target of -1 undoes only the newest one.
+func (m *Migrator) Down(ctx context.Context, target int) error {
+	recs, unlock, err := m.begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	newest := 0
+	for v := range recs {
+		if v > newest {
+			newest = v
+		}
+	}
+	for v := range recs {
+		if !m.find(v) && (v > target && target >= 0 || target < 0 && v == newest) {
+			return fmt.Errorf("migration %d is applied but unknown, it cannot be undone by this program", v)
+		}
+	}
+	undone := 0
+	for i := len(m.migrations) - 1; i >= 0; i-- {
+		mig := m.migrations[i]
+		rec, ok := recs[mig.Version]
+		if !ok || (target >= 0 && mig.Version <= target) {
+			continue
+		}
+		if target < 0 && undone == 1 {
+			break
+		}
+		steps, err := mig.downSteps(rec.created)
+		if err != nil {
+			return err
+		}
+		if rec.State != stateReverting {
+			rec.Step, rec.Checkpoint, rec.Rows = 0, "", 0
+		}
+		if err := m.run(ctx, mig, steps, stateReverting, rec); err != nil {
+			return err
+		}
+		undone++
+		if m.opts.DryRun {
+			continue
+		}
+		del := bigtable.NewMutation()
+		del.DeleteRow()
+		if err := m.meta.Apply(ctx, versionKey(mig.Version), del); err != nil {
+			return err
+		}
+		m.opts.Log.Infof("migration %d %s undone", mig.Version, mig.Name)
+	}
+	return nil
+}
+
+func (m *Migrator) find(v int) bool {
+	for _, mig := range m.migrations {
+		if mig.Version == v {
+			return true
+		}
+	}
+	return false
+}
+
+// run runs the steps of mig from rec.Step on, recording the progress in
+// state.
+func (m *Migrator) run(ctx context.Context, mig Migration, steps []Step, state string, rec Status) error {
+	log := m.opts.Log.WithField("migration", mig.Version)
+	env := &Env{Admin: m.admin, Open: m.opts.Open, DryRun: m.opts.DryRun, Log: log}
+	for i := rec.Step; i < len(steps); i++ {
+		step := steps[i]
+		if m.opts.DryRun {
+			log.Infof("would %v", step)
+		} else {
+			log.Infof("%v", step)
+			err := m.record(ctx, mig.Version, map[string]string{"name": mig.Name, "state": state, "step": strconv.Itoa(i)})
+			if err != nil {
+				return err
+			}
+		}
+		env.saved, env.savedRows, env.created = "", 0, false
+		if i == rec.Step {
+			env.saved, env.savedRows = rec.Checkpoint, rec.Rows
+		}
+		env.checkpoint = func(ctx context.Context, key string, rows int64) error {
+			return m.record(ctx, mig.Version, map[string]string{"checkpoint": key, "rows": strconv.FormatInt(rows, 10)})
+		}
+		if err := step.Run(ctx, env); err != nil {
+			return fmt.Errorf("migration %d %s, step %d %v: %w", mig.Version, mig.Name, i+1, step, err)
+		}
+		if !m.opts.DryRun {
+			cols := map[string]string{"step": strconv.Itoa(i + 1), "checkpoint": "", "rows": "0"}
+			if env.created {
+				cols[createdPrefix+strconv.Itoa(i)] = "1"
+			}
+			err := m.record(ctx, mig.Version, cols)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
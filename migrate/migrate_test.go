@@ -0,0 +1,247 @@
+package migrate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"bigworkshop/keycodec"
+	"bigworkshop/table/tabletest"
+	"cloud.google.com/go/bigtable"
+	"github.com/sirupsen/logrus"
+)
+
+func quiet() logrus.FieldLogger {
+	log := logrus.New()
+	log.SetOutput(io.Discard)
+	return log
+}
+
+func newMigrator(t *testing.T, srv *tabletest.Server, opts Options, migrations ...Migration) *Migrator {
+	t.Helper()
+	opts.Log = quiet()
+	m, err := New(srv.Admin, srv.Data, opts, migrations...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func families(t *testing.T, srv *tabletest.Server, tbl string) []string {
+	t.Helper()
+	info, err := srv.Admin.TableInfo(context.Background(), tbl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(info.Families)
+	return info.Families
+}
+
+func tables(t *testing.T, srv *tabletest.Server) []string {
+	t.Helper()
+	tbls, err := srv.Admin.Tables(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(tbls)
+	return tbls
+}
+
+func states(t *testing.T, m *Migrator) string {
+	t.Helper()
+	st, err := m.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out []string
+	for _, s := range st {
+		out = append(out, fmt.Sprintf("%d:%s", s.Version, s.State))
+	}
+	return strings.Join(out, " ")
+}
+
+var schema = []Migration{
+	{Version: 1, Name: "tokens", Up: []Step{
+		CreateTable{Table: "tokens"},
+		CreateFamily{Table: "tokens", Family: "f", GCPolicy: bigtable.MaxVersionsPolicy(1)},
+	}},
+	{Version: 2, Name: "market", Up: []Step{
+		CreateFamily{Table: "tokens", Family: "market"},
+	}},
+}
+
+func TestUpDown(t *testing.T) {
+	ctx := context.Background()
+	srv := tabletest.Start(t)
+	m := newMigrator(t, srv, Options{}, schema...)
+
+	if err := m.Up(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+	if got := states(t, m); got != "1:applied 2:" {
+		t.Errorf("after up 1: %s", got)
+	}
+	if err := m.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := families(t, srv, "tokens"); !reflect.DeepEqual(got, []string{"f", "market"}) {
+		t.Errorf("families %q", got)
+	}
+
+	if err := m.Down(ctx, -1); err != nil {
+		t.Fatal(err)
+	}
+	if got := families(t, srv, "tokens"); !reflect.DeepEqual(got, []string{"f"}) {
+		t.Errorf("families after down -1 %q", got)
+	}
+	if err := m.Down(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := tables(t, srv); !reflect.DeepEqual(got, []string{"schema_migrations"}) {
+		t.Errorf("tables after down 0 %q", got)
+	}
+	if got := states(t, m); got != "1: 2:" {
+		t.Errorf("after down 0: %s", got)
+	}
+}
+
+func TestDownKeepsWhatExisted(t *testing.T) {
+	ctx := context.Background()
+	srv := tabletest.Start(t)
+	srv.Table(t, "tokens", "market")
+	m := newMigrator(t, srv, Options{}, schema...)
+
+	if err := m.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Down(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	// the table and market existed, only f was created by the migrations
+	if got := families(t, srv, "tokens"); !reflect.DeepEqual(got, []string{"market"}) {
+		t.Errorf("families after down %q, want market", got)
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	ctx := context.Background()
+	srv := tabletest.Start(t)
+	migs := append(schema, Migration{Version: 3, Name: "rekey", Up: []Step{
+		Rekey{Table: "tokens", Prefix: "t:", From: keycodec.Plain{Prefix: "t:"}, To: keycodec.Padded{Prefix: "t:", Width: 5}},
+	}})
+	m := newMigrator(t, srv, Options{DryRun: true}, migs...)
+	if err := m.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := tables(t, srv); len(got) != 0 {
+		t.Errorf("dry run created %q", got)
+	}
+}
+
+func TestRewriteContinues(t *testing.T) {
+	ctx := context.Background()
+	srv := tabletest.Start(t)
+	tbl := srv.Table(t, "tokens", "f")
+	for i := 0; i < 5; i++ {
+		m := bigtable.NewMutation()
+		m.Set("f", "name", 1000, []byte(fmt.Sprint("token ", i)))
+		if err := tbl.Apply(ctx, fmt.Sprint("t:", i), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var seen []string
+	fail := errors.New("fail")
+	failing := true
+	mig := Migration{Version: 1, Name: "upper", Up: []Step{
+		Rewrite{Table: "tokens", Prefix: "t:", Batch: 2, Fn: func(r bigtable.Row) ([]Write, error) {
+			seen = append(seen, r.Key())
+			if r.Key() == "t:3" && failing {
+				return nil, fail
+			}
+			m := bigtable.NewMutation()
+			m.Set("f", "name", 2000, []byte(strings.ToUpper(string(r["f"][0].Value))))
+			return []Write{{Row: r.Key(), Mutation: m}}, nil
+		}},
+	}}
+	m := newMigrator(t, srv, Options{}, mig)
+	if err := m.Up(ctx, 0); !errors.Is(err, fail) {
+		t.Fatalf("up returned %v, want the failure of t:3", err)
+	}
+	st, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st[0].State != stateRunning || st[0].Checkpoint != "t:1" || st[0].Rows != 2 {
+		t.Errorf("status %+v, want running after t:1", st[0])
+	}
+
+	failing, seen = false, nil
+	if err := m.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(seen, []string{"t:2", "t:3", "t:4"}) {
+		t.Errorf("continued with %q, want t:2 to t:4", seen)
+	}
+	r, err := tbl.ReadRow(ctx, "t:4", bigtable.RowFilter(bigtable.LatestNFilter(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(r["f"][0].Value); got != "TOKEN 4" {
+		t.Errorf("t:4 is %q", got)
+	}
+}
+
+func TestRekeyStep(t *testing.T) {
+	ctx := context.Background()
+	srv := tabletest.Start(t)
+	tbl := srv.Table(t, "tokens", "f")
+	for _, id := range []int{1, 22, 333} {
+		m := bigtable.NewMutation()
+		m.Set("f", "v", 1000, []byte("x"))
+		if err := tbl.Apply(ctx, fmt.Sprint("t:", id), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	step := Rekey{Table: "tokens", Prefix: "t:", From: keycodec.Plain{Prefix: "t:"}, To: keycodec.Padded{Prefix: "t:", Width: 4}}
+	m := newMigrator(t, srv, Options{}, Migration{Version: 1, Name: "pad", Up: []Step{step}})
+
+	if err := m.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tabletest.Keys(t, tbl), []string{"t:0001", "t:0022", "t:0333"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys after up %q, want %q", got, want)
+	}
+	if err := m.Down(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tabletest.Keys(t, tbl), []string{"t:1", "t:22", "t:333"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("keys after down %q, want %q", got, want)
+	}
+}
+
+func TestLock(t *testing.T) {
+	ctx := context.Background()
+	srv := tabletest.Start(t)
+	m := newMigrator(t, srv, Options{}, schema...)
+	if err := m.ensureMeta(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.lock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(ctx, 0); err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Errorf("up while locked returned %v", err)
+	}
+	if err := m.Unlock(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Up(ctx, 0); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,427 @@
+package migrate
+
+import (
+	"context"
+	"fmt"
+
+	"bigworkshop/keycodec"
+	"bigworkshop/pager"
+	"bigworkshop/rekey"
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+	"github.com/sirupsen/logrus"
+)
+
+// Step is one change of a migration. Steps should be safe to run again: a
+// migration that failed halfway continues with the step that failed.
+type Step interface {
+	Run(ctx context.Context, env *Env) error
+	String() string
+}
+
+// Reverser is implemented by steps that can be undone without being told
+// how, migrations without Down steps are undone with the reverses of their
+// Up steps.
+type Reverser interface {
+	Reverse() Step
+}
+
+// Env is what steps run against.
+type Env struct {
+	Admin *bigtable.AdminClient
+	// Open returns the data api of a table.
+	Open func(name string) table.Table
+	// DryRun steps only log and count what they would do.
+	DryRun bool
+	Log    logrus.FieldLogger
+
+	// checkpoint and saved persist the progress of the running step
+	checkpoint func(ctx context.Context, key string, rows int64) error
+	saved      string
+	savedRows  int64
+	// created is set by steps that created their table or family
+	created bool
+}
+
+func (e *Env) tables(ctx context.Context) (map[string]bool, error) {
+	tables, err := e.Admin.Tables(ctx)
+	if err != nil {
+		return nil, err
+	}
+	m := map[string]bool{}
+	for _, t := range tables {
+		m[t] = true
+	}
+	return m, nil
+}
+
+// dryRunMissing reports whether a dry run finds no table tbl because an
+// earlier step that did not run would have created it.
+func (e *Env) dryRunMissing(ctx context.Context, tbl string) (bool, error) {
+	if !e.DryRun {
+		return false, nil
+	}
+	tables, err := e.tables(ctx)
+	if err != nil {
+		return false, err
+	}
+	return !tables[tbl], nil
+}
+
+func (e *Env) hasFamily(ctx context.Context, tbl, family string) (bool, error) {
+	info, err := e.Admin.TableInfo(ctx, tbl)
+	if err != nil {
+		return false, err
+	}
+	for _, f := range info.Families {
+		if f == family {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// CreateTable creates a table unless it exists. Its reverse only deletes
+// the table if the step created it.
+type CreateTable struct {
+	Table string
+}
+
+func (s CreateTable) String() string { return "create table " + s.Table }
+func (s CreateTable) Reverse() Step  { return DeleteTable(s) }
+
+func (s CreateTable) Run(ctx context.Context, env *Env) error {
+	tables, err := env.tables(ctx)
+	if err != nil || tables[s.Table] || env.DryRun {
+		return err
+	}
+	if err := env.Admin.CreateTable(ctx, s.Table); err != nil {
+		return err
+	}
+	env.created = true
+	return nil
+}
+
+// DeleteTable deletes a table with all its data, if it exists.
+type DeleteTable struct {
+	Table string
+}
+
+func (s DeleteTable) String() string { return "delete table " + s.Table }
+
+func (s DeleteTable) Run(ctx context.Context, env *Env) error {
+	tables, err := env.tables(ctx)
+	if err != nil || !tables[s.Table] || env.DryRun {
+		return err
+	}
+	return env.Admin.DeleteTable(ctx, s.Table)
+}
+
+// CreateFamily creates a column family unless it exists and sets its gc
+// policy if one is given. Its reverse only deletes the family if the step
+// created it.
+type CreateFamily struct {
+	Table, Family string
+	GCPolicy      bigtable.GCPolicy
+}
+
+func (s CreateFamily) String() string {
+	if s.GCPolicy != nil {
+		return fmt.Sprintf("create family %s:%s with gc policy %v", s.Table, s.Family, s.GCPolicy)
+	}
+	return fmt.Sprintf("create family %s:%s", s.Table, s.Family)
+}
+
+func (s CreateFamily) Reverse() Step { return DeleteFamily{Table: s.Table, Family: s.Family} }
+
+func (s CreateFamily) Run(ctx context.Context, env *Env) error {
+	if missing, err := env.dryRunMissing(ctx, s.Table); err != nil || missing {
+		return err
+	}
+	exists, err := env.hasFamily(ctx, s.Table, s.Family)
+	if err != nil || env.DryRun {
+		return err
+	}
+	if !exists {
+		if err := env.Admin.CreateColumnFamily(ctx, s.Table, s.Family); err != nil {
+			return err
+		}
+		env.created = true
+	}
+	if s.GCPolicy == nil {
+		return nil
+	}
+	return env.Admin.SetGCPolicy(ctx, s.Table, s.Family, s.GCPolicy)
+}
+
+// DeleteFamily deletes a column family with its data, if it exists.
+type DeleteFamily struct {
+	Table, Family string
+}
+
+func (s DeleteFamily) String() string { return fmt.Sprintf("delete family %s:%s", s.Table, s.Family) }
+
+func (s DeleteFamily) Run(ctx context.Context, env *Env) error {
+	exists, err := env.hasFamily(ctx, s.Table, s.Family)
+	if err != nil || !exists || env.DryRun {
+		return err
+	}
+	return env.Admin.DeleteColumnFamily(ctx, s.Table, s.Family)
+}
+
+// SetGCPolicy changes the gc policy of a family. It cannot be reversed
+// without knowing the old policy, give it as a Down step.
+type SetGCPolicy struct {
+	Table, Family string
+	Policy        bigtable.GCPolicy
+}
+
+func (s SetGCPolicy) String() string {
+	return fmt.Sprintf("set gc policy of %s:%s to %v", s.Table, s.Family, s.Policy)
+}
+
+func (s SetGCPolicy) Run(ctx context.Context, env *Env) error {
+	if env.DryRun {
+		return nil
+	}
+	return env.Admin.SetGCPolicy(ctx, s.Table, s.Family, s.Policy)
+}
+
+// keep stands in for the reverse of a step that found its table or family
+// and left it alone.
+type keep struct {
+	Step
+}
+
+func (s keep) String() string { return fmt.Sprintf("skip undoing %v, it existed before", s.Step) }
+
+func (s keep) Run(ctx context.Context, env *Env) error { return nil }
+
+// Func is a step written in go, it has to check env.DryRun itself.
+type Func struct {
+	Name string
+	Fn   func(ctx context.Context, env *Env) error
+}
+
+func (s Func) String() string { return s.Name }
+
+func (s Func) Run(ctx context.Context, env *Env) error {
+	return s.Fn(ctx, env)
+}
+
+// Write is a mutation of one row.
+type Write struct {
+	Row      string
+	Mutation *bigtable.Mutation
+}
+
+// Rewrite is a data migration: it scans a table in batches and applies the
+// writes Fn returns for every row. The last key of every batch is recorded,
+// a migration that was interrupted continues after it.
+//
+// Writes to other rows are applied before the writes to the row that was
+// read, so that a key change, written as a copy to the new key and a
+// DeleteRow of the old one, never loses the row if a batch fails.
+type Rewrite struct {
+	Name  string
+	Table string
+	// Prefix, or Start and End, limit the scan, the whole table if empty.
+	Prefix     string
+	Start, End string
+	// Filter of the scan, every cell version if nil.
+	Filter bigtable.Filter
+	// Batch is the number of rows per ApplyBulk, 500 if zero.
+	Batch int
+	// Fn returns the writes for a row, none to leave it alone.
+	Fn func(row bigtable.Row) ([]Write, error)
+}
+
+func (s Rewrite) String() string {
+	where := "all rows"
+	switch {
+	case s.Prefix != "":
+		where = "rows with prefix " + s.Prefix
+	case s.Start != "" || s.End != "":
+		where = fmt.Sprintf("rows [%s, %s)", s.Start, s.End)
+	}
+	name := s.Name
+	if name == "" {
+		name = "rewrite"
+	}
+	return fmt.Sprintf("%s %s of %s", name, where, s.Table)
+}
+
+func (s Rewrite) Run(ctx context.Context, env *Env) error {
+	if missing, err := env.dryRunMissing(ctx, s.Table); err != nil || missing {
+		if missing {
+			env.Log.Infof("%v: would change no rows of a new table", s)
+		}
+		return err
+	}
+	batch := s.Batch
+	if batch <= 0 {
+		batch = 500
+	}
+	tbl := env.Open(s.Table)
+	var opts []bigtable.ReadOption
+	if s.Filter != nil {
+		opts = append(opts, bigtable.RowFilter(s.Filter))
+	}
+
+	after, scanned, changed := env.saved, env.savedRows, int64(0)
+	if after != "" {
+		env.Log.Infof("%v: continuing after %q, %d rows done", s, after, scanned)
+	}
+	for {
+		var rows []bigtable.Row
+		err := tbl.ReadRows(ctx, pager.ResumeRange(s.Prefix, s.Start, s.End, after), func(r bigtable.Row) bool {
+			rows = append(rows, r)
+			return true
+		}, append(opts, bigtable.LimitRows(int64(batch)))...)
+		if err != nil {
+			return err
+		}
+		if len(rows) == 0 {
+			break
+		}
+
+		var others, own []Write
+		for _, r := range rows {
+			writes, err := s.Fn(r)
+			if err != nil {
+				return fmt.Errorf("row %q: %w", r.Key(), err)
+			}
+			if len(writes) > 0 {
+				changed++
+			}
+			for _, w := range writes {
+				if w.Row == r.Key() {
+					own = append(own, w)
+				} else {
+					others = append(others, w)
+				}
+			}
+		}
+		if !env.DryRun {
+			for _, ws := range [][]Write{others, own} {
+				if err := applyWrites(ctx, tbl, ws); err != nil {
+					return err
+				}
+			}
+		}
+		after = rows[len(rows)-1].Key()
+		scanned += int64(len(rows))
+		if !env.DryRun {
+			if err := env.checkpoint(ctx, after, scanned); err != nil {
+				return err
+			}
+		}
+		if len(rows) < batch {
+			break
+		}
+	}
+	if env.DryRun {
+		env.Log.Infof("%v: would change %d of %d rows", s, changed, scanned)
+	} else {
+		env.Log.Infof("%v: changed %d of %d rows", s, changed, scanned)
+	}
+	return nil
+}
+
+func applyWrites(ctx context.Context, tbl table.Table, ws []Write) error {
+	if len(ws) == 0 {
+		return nil
+	}
+	keys := make([]string, len(ws))
+	muts := make([]*bigtable.Mutation, len(ws))
+	for i, w := range ws {
+		keys[i], muts[i] = w.Row, w.Mutation
+	}
+	errs, err := tbl.ApplyBulk(ctx, keys, muts)
+	if err != nil {
+		return err
+	}
+	for i, e := range errs {
+		if e != nil {
+			return fmt.Errorf("writing %q: %w", keys[i], e)
+		}
+	}
+	return nil
+}
+
+// Rekey moves the rows whose keys are written by From to the keys To
+// writes for the same id, with every cell version, e.g. from ex5's
+// token:101 to token:09899. It runs rekey.Run: copies are verified by
+// checksum before the old rows are deleted, old rows written to during the
+// step keep their key and are logged. Rows matching both or neither are
+// left alone, so that a Rekey within one prefix does not move the rows it
+// wrote again.
+type Rekey struct {
+	Table  string
+	Prefix string
+	From   keycodec.Codec
+	To     keycodec.Codec
+	// KeepOld keeps the rows under their old keys.
+	KeepOld bool
+}
+
+func (s Rekey) String() string {
+	return fmt.Sprintf("rekey %s%s from %v to %v", s.Table, prefixNote(s.Prefix), s.From, s.To)
+}
+
+func prefixNote(prefix string) string {
+	if prefix == "" {
+		return ""
+	}
+	return " rows with prefix " + prefix
+}
+
+// Reverse moves the rows back. Rows the rekey left alone because their key
+// already matched To are moved as well.
+func (s Rekey) Reverse() Step {
+	return Rekey{Table: s.Table, Prefix: s.Prefix, From: s.To, To: s.From, KeepOld: s.KeepOld}
+}
+
+func (s Rekey) Run(ctx context.Context, env *Env) error {
+	if missing, err := env.dryRunMissing(ctx, s.Table); err != nil || missing {
+		if missing {
+			env.Log.Infof("%v: would move no rows of a new table", s)
+		}
+		return err
+	}
+	tbl := env.Open(s.Table)
+	done := env.savedRows
+	if env.saved != "" {
+		env.Log.Infof("%v: continuing after %q, %d rows done", s, env.saved, done)
+	}
+	rep, err := rekey.Run(ctx, tbl, tbl, rekey.Codec(s.From, s.To), rekey.Options{
+		Prefix:    s.Prefix,
+		After:     env.saved,
+		DeleteOld: !s.KeepOld,
+		DryRun:    env.DryRun,
+		Checkpoint: func(after string, rep rekey.Report) error {
+			if env.DryRun {
+				return nil
+			}
+			return env.checkpoint(ctx, after, done+rep.Scanned)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	if env.DryRun {
+		env.Log.Infof("%v: would move %d of %d rows", s, rep.Moved, rep.Scanned)
+		return nil
+	}
+	env.Log.Infof("%v: %v", s, rep)
+	if rep.Changed > 0 {
+		env.Log.Warnf("%v: %d rows were written to during the step and kept their old keys, rekey them with the rekey command", s, rep.Changed)
+	}
+	if rep.Rejected > 0 {
+		env.Log.Warnf("%v: %d rows have no key in %v and kept their old keys: %q", s, rep.Rejected, s.To, rep.Rejections)
+	}
+	if !rep.Verified() {
+		return fmt.Errorf("%v: %d copies do not match their source rows, their old rows were kept", s, rep.Mismatched)
+	}
+	return nil
+}
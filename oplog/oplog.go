@@ -0,0 +1,352 @@
+// Package oplog logs table operations as structured logrus entries with the
+// fields table, method, key, key_prefix, latency, cells and status.
+//
+// Keys are hashed by default, with the same hash telemetry puts into spans,
+// so log lines and traces of one row can be matched without the key. Values
+// are only logged when asked for, and Rules redact or hash the values of
+// families holding personal data:
+//
+//	tbl = oplog.Wrap(tbl, "users", oplog.Options{
+//		Values: oplog.Show,
+//		Rules:  []oplog.Rule{{Family: "pii", Mode: oplog.Redact}},
+//		Slow:   100 * time.Millisecond,
+//	})
+//
+// Failed and slow operations are always logged, others are sampled.
+package oplog
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+
+	"bigworkshop/cellfmt"
+	"bigworkshop/table"
+	"bigworkshop/telemetry"
+	"cloud.google.com/go/bigtable"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/status"
+)
+
+// Mode is how a key or value appears in the log.
+type Mode int
+
+const (
+	// Omit leaves it out, the default for values.
+	Omit Mode = iota
+	// Hash logs a hash of it, the default for keys.
+	Hash
+	// Redact logs a placeholder, so it is visible that there was one.
+	Redact
+	// Show logs it as is, values decoded like cellfmt.Auto.
+	Show
+)
+
+// ParseMode parses omit, hash, redact or show.
+func ParseMode(s string) (Mode, error) {
+	for m, name := range modeNames {
+		if name == s {
+			return Mode(m), nil
+		}
+	}
+	return Omit, fmt.Errorf("oplog: unknown mode %q, use omit, hash, redact or show", s)
+}
+
+var modeNames = []string{"omit", "hash", "redact", "show"}
+
+func (m Mode) String() string {
+	if int(m) < len(modeNames) {
+		return modeNames[m]
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
+
+// Rule overrides the value mode for a family, or a single column of it.
+type Rule struct {
+	Family    string
+	Qualifier string
+	Mode      Mode
+}
+
+// Options configure the logging.
+type Options struct {
+	// Logger receives the entries, logrus.StandardLogger() if nil.
+	Logger logrus.FieldLogger
+	// Level of successful operations, Debug if zero. Slow ones are logged
+	// at Warn, failed ones at Error.
+	Level logrus.Level
+	// Keys is how row keys are logged, Hash if zero.
+	Keys Mode
+	// KeySeparators end the key_prefix field, "#:/" if empty. The prefix
+	// names the kind of row without identifying it, token# for token#42.
+	// It is logged like the keys, hashed by default and left out if they
+	// are redacted.
+	KeySeparators string
+	// Values is how cell values are logged unless a rule matches.
+	Values Mode
+	// Rules for families holding personal data, the first match wins.
+	Rules []Rule
+	// Sample is the fraction of successful operations that are logged,
+	// all if zero, none if negative.
+	Sample float64
+	// Slow logs operations taking longer at Warn even if not sampled.
+	Slow time.Duration
+}
+
+// Table is a table.Table logging its operations.
+type Table struct {
+	tbl  table.Table
+	name string
+	opts Options
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+var _ table.Table = (*Table)(nil)
+
+// Wrap logs the operations on tbl, name is logged as the table.
+func Wrap(tbl table.Table, name string, opts Options) *Table {
+	if opts.Logger == nil {
+		opts.Logger = logrus.StandardLogger()
+	}
+	if opts.Level == logrus.PanicLevel {
+		opts.Level = logrus.DebugLevel
+	}
+	if opts.Keys == Omit {
+		opts.Keys = Hash
+	}
+	if opts.KeySeparators == "" {
+		opts.KeySeparators = "#:/"
+	}
+	return &Table{tbl: tbl, name: name, opts: opts, rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+func (t *Table) render(m Mode, v string) (string, bool) {
+	switch m {
+	case Hash:
+		return telemetry.HashKey(v), true
+	case Redact:
+		return "[redacted]", true
+	case Show:
+		return v, true
+	}
+	return "", false
+}
+
+func (t *Table) keyFields(key string) logrus.Fields {
+	f := logrus.Fields{}
+	if v, ok := t.render(t.opts.Keys, key); ok {
+		f["key"] = v
+	}
+	if p := t.keyPrefix(key); p != "" {
+		f["key_prefix"] = p
+	}
+	return f
+}
+
+// keyPrefix returns the key_prefix field of key, rendered like the keys:
+// hashed it still groups the rows of one kind. Redacted keys have none.
+func (t *Table) keyPrefix(key string) string {
+	i := strings.IndexAny(key, t.opts.KeySeparators)
+	if i < 0 || t.opts.Keys == Redact {
+		return ""
+	}
+	p, _ := t.render(t.opts.Keys, key[:i+1])
+	return p
+}
+
+func (t *Table) valueMode(family, qualifier string) Mode {
+	for _, r := range t.opts.Rules {
+		if r.Family == family && (r.Qualifier == "" || r.Qualifier == qualifier) {
+			return r.Mode
+		}
+	}
+	return t.opts.Values
+}
+
+func (t *Table) value(family, qualifier string, v []byte) (string, bool) {
+	m := t.valueMode(family, qualifier)
+	if m == Show {
+		return cellfmt.Decode(cellfmt.Auto, v), true
+	}
+	return t.render(m, string(v))
+}
+
+// rowValues returns the logged values of a row by column, nil if none are.
+func (t *Table) rowValues(r bigtable.Row) map[string]string {
+	var vals map[string]string
+	for _, c := range cellfmt.Cells(r) {
+		if v, ok := t.value(c.Family, c.Qualifier, c.Value); ok {
+			if vals == nil {
+				vals = map[string]string{}
+			}
+			if _, seen := vals[c.Column()]; !seen {
+				vals[c.Column()] = v // newest version only
+			}
+		}
+	}
+	return vals
+}
+
+func (t *Table) mutationValues(m *bigtable.Mutation) (cells int, vals map[string]string) {
+	for _, op := range table.Ops(m) {
+		set := op.GetSetCell()
+		if set == nil {
+			continue
+		}
+		cells++
+		if v, ok := t.value(set.FamilyName, string(set.ColumnQualifier), set.Value); ok {
+			if vals == nil {
+				vals = map[string]string{}
+			}
+			vals[set.FamilyName+":"+string(set.ColumnQualifier)] = v
+		}
+	}
+	return cells, vals
+}
+
+func (t *Table) sampled() bool {
+	switch {
+	case t.opts.Sample < 0:
+		return false
+	case t.opts.Sample == 0 || t.opts.Sample >= 1:
+		return true
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.rand.Float64() < t.opts.Sample
+}
+
+// log writes the entry of an operation that started at start.
+func (t *Table) log(method string, start time.Time, fields logrus.Fields, err error) {
+	latency := time.Since(start)
+	slow := t.opts.Slow > 0 && latency > t.opts.Slow
+	if err == nil && !slow && !t.sampled() {
+		return
+	}
+	fields["table"] = t.name
+	fields["method"] = method
+	fields["latency"] = latency
+	fields["status"] = code(err)
+	entry := t.opts.Logger.WithFields(fields)
+	switch {
+	case err != nil:
+		entry.WithError(err).Error(method + " failed")
+	case slow:
+		entry.Warn(method + " slow")
+	default:
+		entry.Log(t.opts.Level, method)
+	}
+}
+
+// code is the grpc code of err, context errors of the caller count as
+// Canceled and DeadlineExceeded.
+func code(err error) string {
+	if s, ok := status.FromError(err); ok {
+		return s.Code().String()
+	}
+	return status.FromContextError(err).Code().String()
+}
+
+func (t *Table) ReadRows(ctx context.Context, arg bigtable.RowSet, f func(bigtable.Row) bool, opts ...bigtable.ReadOption) error {
+	start := time.Now()
+	rows, cells := 0, 0
+	var prefix string
+	err := t.tbl.ReadRows(ctx, arg, func(r bigtable.Row) bool {
+		if rows == 0 {
+			prefix = t.keyPrefix(r.Key())
+		}
+		rows++
+		for _, items := range r {
+			cells += len(items)
+		}
+		return f(r)
+	}, opts...)
+	fields := logrus.Fields{"rows": rows, "cells": cells}
+	if prefix != "" {
+		fields["key_prefix"] = prefix
+	}
+	t.log("ReadRows", start, fields, err)
+	return err
+}
+
+func (t *Table) ReadRow(ctx context.Context, row string, opts ...bigtable.ReadOption) (bigtable.Row, error) {
+	start := time.Now()
+	r, err := t.tbl.ReadRow(ctx, row, opts...)
+	fields := t.keyFields(row)
+	cells := 0
+	for _, items := range r {
+		cells += len(items)
+	}
+	fields["cells"] = cells
+	if vals := t.rowValues(r); vals != nil {
+		fields["values"] = vals
+	}
+	t.log("ReadRow", start, fields, err)
+	return r, err
+}
+
+func (t *Table) Apply(ctx context.Context, row string, m *bigtable.Mutation, opts ...bigtable.ApplyOption) error {
+	start := time.Now()
+	err := t.tbl.Apply(ctx, row, m, opts...)
+	fields := t.keyFields(row)
+	cells, vals := t.mutationValues(m)
+	fields["cells"] = cells
+	if vals != nil {
+		fields["values"] = vals
+	}
+	if table.IsConditional(m) {
+		fields["conditional"] = true
+	}
+	t.log("Apply", start, fields, err)
+	return err
+}
+
+func (t *Table) ApplyBulk(ctx context.Context, rowKeys []string, muts []*bigtable.Mutation, opts ...bigtable.ApplyOption) ([]error, error) {
+	start := time.Now()
+	errs, err := t.tbl.ApplyBulk(ctx, rowKeys, muts, opts...)
+	cells, failed := 0, 0
+	for _, m := range muts {
+		n, _ := t.mutationValues(m)
+		cells += n
+	}
+	for i, e := range errs {
+		if e == nil {
+			continue
+		}
+		failed++
+		if err == nil && i < len(rowKeys) {
+			// log the failed entries on their own, with their key
+			t.log("ApplyBulk.entry", start, t.keyFields(rowKeys[i]), e)
+		}
+	}
+	t.log("ApplyBulk", start, logrus.Fields{"mutations": len(muts), "cells": cells, "failed": failed}, err)
+	return errs, err
+}
+
+func (t *Table) ApplyReadModifyWrite(ctx context.Context, row string, m *bigtable.ReadModifyWrite) (bigtable.Row, error) {
+	start := time.Now()
+	r, err := t.tbl.ApplyReadModifyWrite(ctx, row, m)
+	fields := t.keyFields(row)
+	cells := 0
+	for _, items := range r {
+		cells += len(items)
+	}
+	fields["cells"] = cells
+	if vals := t.rowValues(r); vals != nil {
+		fields["values"] = vals
+	}
+	t.log("ApplyReadModifyWrite", start, fields, err)
+	return r, err
+}
+
+func (t *Table) SampleRowKeys(ctx context.Context) ([]string, error) {
+	start := time.Now()
+	keys, err := t.tbl.SampleRowKeys(ctx)
+	t.log("SampleRowKeys", start, logrus.Fields{"keys": len(keys)}, err)
+	return keys, err
+}
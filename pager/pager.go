@@ -0,0 +1,157 @@
+// Package pager pages through a row range the way exercise 5.4 does: the
+// next page starts right after the last row key of the previous page, found
+// by appending a zero byte to the key (exercise 5.3).
+package pager
+
+import (
+	"context"
+
+	"cloud.google.com/go/bigtable"
+)
+
+// Reader is the part of *bigtable.Table the pager needs.
+type Reader interface {
+	ReadRows(ctx context.Context, arg bigtable.RowSet, f func(bigtable.Row) bool, opts ...bigtable.ReadOption) error
+}
+
+// Range is a row range [Start, Limit), an empty Limit is unbounded.
+type Range struct {
+	Start string
+	Limit string
+}
+
+// PrefixRange returns the range of all keys starting with prefix.
+func PrefixRange(prefix string) Range {
+	return Range{Start: prefix, Limit: PrefixEnd(prefix)}
+}
+
+// PrefixEnd returns the smallest key that is larger than every key starting
+// with prefix, "" if there is none.
+func PrefixEnd(prefix string) string {
+	n := len(prefix)
+	for n > 0 && prefix[n-1] == 0xff {
+		n--
+	}
+	if n == 0 {
+		return ""
+	}
+	return prefix[:n-1] + string([]byte{prefix[n-1] + 1})
+}
+
+// IncrementKey returns the smallest key that is larger than key.
+func IncrementKey(key string) string {
+	return key + "\x00"
+}
+
+// After returns the part of r that comes after key, key itself is excluded.
+// An empty key returns r unchanged.
+func (r Range) After(key string) Range {
+	if key == "" || IncrementKey(key) <= r.Start {
+		return r
+	}
+	return Range{Start: IncrementKey(key), Limit: r.Limit}
+}
+
+// ResumeRange returns the rows with prefix, or in [start, end) without
+// one, that come after the key after: the rest of a scan that stopped at a
+// checkpoint. An empty after returns the whole range.
+func ResumeRange(prefix, start, end, after string) bigtable.RowRange {
+	r := Range{Start: start, Limit: end}
+	if prefix != "" {
+		r = PrefixRange(prefix)
+	}
+	return r.After(after).RowRange()
+}
+
+// RowRange converts r for use with ReadRows.
+func (r Range) RowRange() bigtable.RowRange {
+	return bigtable.NewRange(r.Start, r.Limit)
+}
+
+// Page reads up to size rows of r that come after the key after. next is
+// the key to pass as after for the following page, it is empty once the
+// range is exhausted.
+func Page(ctx context.Context, tbl Reader, r Range, after string, size int, opts ...bigtable.ReadOption) (rows []bigtable.Row, next string, err error) {
+	rr := r.After(after)
+	if rr.Limit != "" && rr.Start >= rr.Limit {
+		return nil, "", nil
+	}
+	opts = append(opts[:len(opts):len(opts)], bigtable.LimitRows(int64(size)))
+	err = tbl.ReadRows(ctx, rr.RowRange(), func(row bigtable.Row) bool {
+		rows = append(rows, row)
+		return true
+	}, opts...)
+	if err != nil {
+		return nil, "", err
+	}
+	if len(rows) == size {
+		next = rows[len(rows)-1].Key()
+	}
+	return rows, next, nil
+}
+
+// Pager keeps track of the pages already read so that it can go back.
+type Pager struct {
+	tbl  Reader
+	r    Range
+	size int
+	opts []bigtable.ReadOption
+
+	// afters[i] is the key page i starts after
+	afters []string
+	next   string
+}
+
+// New returns a pager over r with size rows per page.
+func New(tbl Reader, r Range, size int, opts ...bigtable.ReadOption) *Pager {
+	return &Pager{tbl: tbl, r: r, size: size, opts: opts}
+}
+
+// Page returns the number of the current page starting at 1, 0 before the first read.
+func (p *Pager) Page() int {
+	return len(p.afters)
+}
+
+// HasNext reports whether there may be another page.
+func (p *Pager) HasNext() bool {
+	return len(p.afters) == 0 || p.next != ""
+}
+
+// HasPrev reports whether there is a page before the current one.
+func (p *Pager) HasPrev() bool {
+	return len(p.afters) > 1
+}
+
+// Next reads the next page, it returns no rows once the range is exhausted.
+func (p *Pager) Next(ctx context.Context) ([]bigtable.Row, error) {
+	if !p.HasNext() {
+		return nil, nil
+	}
+	return p.read(ctx, p.next, len(p.afters))
+}
+
+// Prev reads the previous page again.
+func (p *Pager) Prev(ctx context.Context) ([]bigtable.Row, error) {
+	if len(p.afters) < 2 {
+		return p.Reload(ctx)
+	}
+	return p.read(ctx, p.afters[len(p.afters)-2], len(p.afters)-2)
+}
+
+// Reload reads the current page again, e.g. after rows were changed.
+func (p *Pager) Reload(ctx context.Context) ([]bigtable.Row, error) {
+	if len(p.afters) == 0 {
+		return p.Next(ctx)
+	}
+	return p.read(ctx, p.afters[len(p.afters)-1], len(p.afters)-1)
+}
+
+func (p *Pager) read(ctx context.Context, after string, page int) ([]bigtable.Row, error) {
+	rows, next, err := Page(ctx, p.tbl, p.r, after, p.size, p.opts...)
+	if err != nil {
+		return nil, err
+	}
+	p.afters = append(p.afters[:page], after)
+	p.next = next
+	return rows, nil
+}
@@ -0,0 +1,308 @@
+// Package protorow maps proto messages onto bigtable rows.
+//
+// The message has one string field holding the id, which becomes the row key
+// after a fixed prefix. Every other top level field has to be a message, it
+// becomes a column family of the same name and each of its fields becomes a
+// column qualifier:
+//
+//	message Token {            row key   token#<id>
+//	  string id = 1;
+//	  Profile profile = 2;     family    profile
+//	}
+//	message Profile {
+//	  string name = 1;         column    profile:name
+//	  int64 decimals = 3;      column    profile:decimals
+//	}
+//
+// Scalars are stored so that other tools can read them: strings and bytes as
+// is, integers as 8 byte big-endian (the format of ReadModifyWrite
+// Increment), floats as their 8 byte IEEE bits and bools as a single byte.
+// Messages, lists and maps are stored as the proto encoding of the family
+// message with only that field set.
+package protorow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/bigtable"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// existsLabel marks the stripped cell Filter adds to find rows whose
+// selected families are empty.
+const existsLabel = "protorow-exists"
+
+// Mapper converts one message type to rows and back.
+type Mapper struct {
+	desc     protoreflect.MessageDescriptor
+	idField  protoreflect.FieldDescriptor
+	prefix   string
+	families map[string]protoreflect.FieldDescriptor
+}
+
+// New returns a mapper for messages like msg. idField is the name of the
+// string field used as the row key, prefix is prepended to it.
+func New(msg proto.Message, idField, prefix string) (*Mapper, error) {
+	desc := msg.ProtoReflect().Descriptor()
+	m := &Mapper{desc: desc, prefix: prefix, families: map[string]protoreflect.FieldDescriptor{}}
+	fields := desc.Fields()
+	for i := 0; i < fields.Len(); i++ {
+		fd := fields.Get(i)
+		switch {
+		case string(fd.Name()) == idField:
+			if fd.Kind() != protoreflect.StringKind || fd.IsList() {
+				return nil, fmt.Errorf("protorow: id field %s must be a string", fd.FullName())
+			}
+			m.idField = fd
+		case fd.Kind() == protoreflect.MessageKind && !fd.IsList() && !fd.IsMap():
+			m.families[string(fd.Name())] = fd
+		default:
+			return nil, fmt.Errorf("protorow: field %s must be a message to become a column family", fd.FullName())
+		}
+	}
+	if m.idField == nil {
+		return nil, fmt.Errorf("protorow: %s has no field %q", desc.FullName(), idField)
+	}
+	return m, nil
+}
+
+// Families returns the column families of the message, sorted.
+func (m *Mapper) Families() []string {
+	fams := make([]string, 0, len(m.families))
+	for f := range m.families {
+		fams = append(fams, f)
+	}
+	sort.Strings(fams)
+	return fams
+}
+
+// RowKey returns the row key of an id.
+func (m *Mapper) RowKey(id string) string {
+	return m.prefix + id
+}
+
+// ID returns the id of a row key.
+func (m *Mapper) ID(rowKey string) string {
+	return strings.TrimPrefix(rowKey, m.prefix)
+}
+
+// Prefix returns the prefix of all row keys.
+func (m *Mapper) Prefix() string {
+	return m.prefix
+}
+
+// Key returns the row key of msg.
+func (m *Mapper) Key(msg proto.Message) string {
+	return m.RowKey(msg.ProtoReflect().Get(m.idField).String())
+}
+
+// SelectFamilies validates field mask paths, only whole families and the id
+// can be selected. No paths select every family.
+func (m *Mapper) SelectFamilies(paths []string) ([]string, error) {
+	if len(paths) == 0 {
+		return m.Families(), nil
+	}
+	var fams []string
+	for _, p := range paths {
+		if p == string(m.idField.Name()) {
+			continue
+		}
+		if _, ok := m.families[p]; !ok {
+			return nil, fmt.Errorf("protorow: %q is not a family of %s, use one of %v", p, m.desc.Name(), m.Families())
+		}
+		fams = append(fams, p)
+	}
+	return fams, nil
+}
+
+// Mutation replaces the given families of the row with the fields of msg,
+// fields with their zero value are not stored. A message that sets no cells
+// in the families is an error: bigtable has no empty rows, the mutation
+// would only delete.
+func (m *Mapper) Mutation(msg proto.Message, families []string, ts bigtable.Timestamp) (*bigtable.Mutation, error) {
+	r := msg.ProtoReflect()
+	if r.Descriptor() != m.desc {
+		return nil, fmt.Errorf("protorow: got %s, want %s", r.Descriptor().FullName(), m.desc.FullName())
+	}
+	mut := bigtable.NewMutation()
+	cells := 0
+	for _, fam := range families {
+		fd, ok := m.families[fam]
+		if !ok {
+			return nil, fmt.Errorf("protorow: unknown family %q", fam)
+		}
+		mut.DeleteCellsInFamily(fam)
+		if !r.Has(fd) {
+			continue
+		}
+		famMsg := r.Get(fd).Message()
+		var err error
+		famMsg.Range(func(qd protoreflect.FieldDescriptor, v protoreflect.Value) bool {
+			var value []byte
+			if value, err = encode(famMsg, qd, v); err != nil {
+				return false
+			}
+			mut.Set(fam, string(qd.Name()), ts, value)
+			cells++
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cells == 0 {
+		return nil, fmt.Errorf("protorow: %s sets no field of %v, the row would not be stored", m.desc.Name(), families)
+	}
+	return mut, nil
+}
+
+// Filter reads the latest version of the given families. It also returns a
+// single stripped cell of any other family so that a row whose selected
+// families are empty is still found.
+func (m *Mapper) Filter(families []string) bigtable.Filter {
+	exists := bigtable.ChainFilters(
+		bigtable.CellsPerRowLimitFilter(1),
+		bigtable.StripValueFilter(),
+		bigtable.LabelFilter(existsLabel),
+	)
+	if len(families) == 0 {
+		return exists
+	}
+	quoted := make([]string, len(families))
+	for i, f := range families {
+		quoted[i] = regexp.QuoteMeta(f)
+	}
+	selected := bigtable.ChainFilters(
+		bigtable.FamilyFilter("^("+strings.Join(quoted, "|")+")$"),
+		bigtable.LatestNFilter(1),
+	)
+	return bigtable.InterleaveFilters(selected, exists)
+}
+
+// Unmarshal fills msg from a row read with Filter. Unknown qualifiers are ignored.
+func (m *Mapper) Unmarshal(row bigtable.Row, msg proto.Message) error {
+	r := msg.ProtoReflect()
+	if r.Descriptor() != m.desc {
+		return fmt.Errorf("protorow: got %s, want %s", r.Descriptor().FullName(), m.desc.FullName())
+	}
+	proto.Reset(msg)
+	r.Set(m.idField, protoreflect.ValueOfString(m.ID(row.Key())))
+
+	for fam, items := range row {
+		fd, ok := m.families[fam]
+		if !ok {
+			continue
+		}
+		seen := map[string]bool{}
+		for _, item := range items {
+			if hasLabel(item.Labels, existsLabel) {
+				continue
+			}
+			qual := strings.TrimPrefix(item.Column, fam+":")
+			if seen[qual] {
+				continue // older version
+			}
+			seen[qual] = true
+
+			famMsg := r.Mutable(fd).Message()
+			qd := famMsg.Descriptor().Fields().ByName(protoreflect.Name(qual))
+			if qd == nil {
+				continue
+			}
+			if err := decode(famMsg, qd, item.Value); err != nil {
+				return fmt.Errorf("protorow: %s: %w", item.Column, err)
+			}
+		}
+	}
+	return nil
+}
+
+func hasLabel(labels []string, label string) bool {
+	for _, l := range labels {
+		if l == label {
+			return true
+		}
+	}
+	return false
+}
+
+func encode(parent protoreflect.Message, fd protoreflect.FieldDescriptor, v protoreflect.Value) ([]byte, error) {
+	if fd.IsList() || fd.IsMap() || fd.Kind() == protoreflect.MessageKind || fd.Kind() == protoreflect.GroupKind {
+		// store the field on its own, decode merges it back
+		single := parent.New()
+		single.Set(fd, v)
+		return proto.Marshal(single.Interface())
+	}
+
+	buf := make([]byte, 8)
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		return []byte(v.String()), nil
+	case protoreflect.BytesKind:
+		return v.Bytes(), nil
+	case protoreflect.BoolKind:
+		if v.Bool() {
+			return []byte{1}, nil
+		}
+		return []byte{0}, nil
+	case protoreflect.EnumKind:
+		binary.BigEndian.PutUint64(buf, uint64(v.Enum()))
+	case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind,
+		protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+		binary.BigEndian.PutUint64(buf, uint64(v.Int()))
+	case protoreflect.Uint32Kind, protoreflect.Fixed32Kind, protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		binary.BigEndian.PutUint64(buf, v.Uint())
+	case protoreflect.FloatKind, protoreflect.DoubleKind:
+		binary.BigEndian.PutUint64(buf, math.Float64bits(v.Float()))
+	default:
+		return nil, fmt.Errorf("unsupported kind %s of %s", fd.Kind(), fd.FullName())
+	}
+	return buf, nil
+}
+
+func decode(parent protoreflect.Message, fd protoreflect.FieldDescriptor, b []byte) error {
+	if fd.IsList() || fd.IsMap() || fd.Kind() == protoreflect.MessageKind || fd.Kind() == protoreflect.GroupKind {
+		return proto.UnmarshalOptions{Merge: true}.Unmarshal(b, parent.Interface())
+	}
+
+	var v protoreflect.Value
+	switch fd.Kind() {
+	case protoreflect.StringKind:
+		v = protoreflect.ValueOfString(string(b))
+	case protoreflect.BytesKind:
+		v = protoreflect.ValueOfBytes(b)
+	case protoreflect.BoolKind:
+		v = protoreflect.ValueOfBool(len(b) > 0 && b[0] != 0)
+	default:
+		if len(b) != 8 {
+			return fmt.Errorf("expected 8 bytes for %s, got %d", fd.Kind(), len(b))
+		}
+		n := binary.BigEndian.Uint64(b)
+		switch fd.Kind() {
+		case protoreflect.EnumKind:
+			v = protoreflect.ValueOfEnum(protoreflect.EnumNumber(int64(n)))
+		case protoreflect.Int32Kind, protoreflect.Sint32Kind, protoreflect.Sfixed32Kind:
+			v = protoreflect.ValueOfInt32(int32(int64(n)))
+		case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind:
+			v = protoreflect.ValueOfInt64(int64(n))
+		case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+			v = protoreflect.ValueOfUint32(uint32(n))
+		case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+			v = protoreflect.ValueOfUint64(n)
+		case protoreflect.FloatKind:
+			v = protoreflect.ValueOfFloat32(float32(math.Float64frombits(n)))
+		case protoreflect.DoubleKind:
+			v = protoreflect.ValueOfFloat64(math.Float64frombits(n))
+		default:
+			return fmt.Errorf("unsupported kind %s of %s", fd.Kind(), fd.FullName())
+		}
+	}
+	parent.Set(fd, v)
+	return nil
+}
@@ -0,0 +1,274 @@
+// Package purge deletes all rows with a prefix or within a key range,
+// instead of ex4's DeleteRow per row.
+//
+// Prefixes are dropped with AdminClient.DropRowRange, which deletes on the
+// server without reading the rows. Key ranges, and prefixes where the admin
+// api is not available, are scanned and deleted in batches:
+//
+//	p, err := purge.Count(ctx, tbl, purge.Options{Prefix: "token:"})
+//	rep, err := purge.Run(ctx, admin, "tbl", tbl, purge.Options{Prefix: "token:", Audit: f})
+//
+// With Audit set every deleted key is recorded as a json line, a drop
+// scans the keys first for that. Rows written between that scan and the
+// drop are deleted without being recorded.
+package purge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"bigworkshop/pager"
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Options select the rows to delete.
+type Options struct {
+	// Prefix, or Start and End, are the rows to delete. One of them has to
+	// be set, purging a whole table takes Start "" and End "" with All.
+	Prefix     string
+	Start, End string
+	All        bool
+	// Scan deletes a prefix by scanning it even if DropRowRange works.
+	Scan bool
+	// Batch is the number of rows per ApplyBulk, 500 if zero.
+	Batch int
+	// Audit receives an Entry per deleted row and per run as json lines.
+	Audit io.Writer
+	// User is recorded in the audit log.
+	User string
+	// Progress is called after every batch with the rows deleted so far.
+	Progress func(rows int64)
+}
+
+func (o Options) String() string {
+	switch {
+	case o.Prefix != "":
+		return fmt.Sprintf("rows with prefix %q", o.Prefix)
+	case o.Start != "" || o.End != "":
+		return fmt.Sprintf("rows [%q, %q)", o.Start, o.End)
+	}
+	return "all rows"
+}
+
+func (o Options) check() error {
+	if o.Prefix == "" && o.Start == "" && o.End == "" && !o.All {
+		return fmt.Errorf("purge: no prefix or range, set All to purge the whole table")
+	}
+	if o.Prefix != "" && (o.Start != "" || o.End != "") {
+		return fmt.Errorf("purge: prefix and range given")
+	}
+	return nil
+}
+
+// keysOnly reads every cell without its value, enough to count them.
+var keysOnly = bigtable.RowFilter(bigtable.StripValueFilter())
+
+// Preview is what a purge would delete.
+type Preview struct {
+	Rows  int64
+	Cells int64
+	// Sample holds the first keys, First and Last the range.
+	Sample      []string
+	First, Last string
+}
+
+// Count scans the rows selected by opts without their values.
+func Count(ctx context.Context, tbl table.Table, opts Options) (Preview, error) {
+	var p Preview
+	if err := opts.check(); err != nil {
+		return p, err
+	}
+	err := tbl.ReadRows(ctx, pager.ResumeRange(opts.Prefix, opts.Start, opts.End, ""), func(r bigtable.Row) bool {
+		if p.Rows == 0 {
+			p.First = r.Key()
+		}
+		p.Last = r.Key()
+		p.Rows++
+		p.Cells += cells(r)
+		if len(p.Sample) < 10 {
+			p.Sample = append(p.Sample, r.Key())
+		}
+		return true
+	}, keysOnly)
+	return p, err
+}
+
+// Entry is a line of the audit log. A run writes a start entry, a row entry
+// per deleted row and a done or failed entry.
+type Entry struct {
+	Time   time.Time `json:"time"`
+	Table  string    `json:"table"`
+	Event  string    `json:"event"`
+	Method string    `json:"method,omitempty"`
+	Prefix string    `json:"prefix,omitempty"`
+	Start  string    `json:"start,omitempty"`
+	End    string    `json:"end,omitempty"`
+	User   string    `json:"user,omitempty"`
+	Key    string    `json:"key,omitempty"`
+	Cells  int64     `json:"cells,omitempty"`
+	Rows   int64     `json:"rows,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// Methods of a Report, how the rows were deleted.
+const (
+	Drop = "DropRowRange"
+	Scan = "scan"
+)
+
+// Report is what a run deleted. Rows is only known for scans and for drops
+// with an audit log.
+type Report struct {
+	Method string
+	Rows   int64
+	Cells  int64
+}
+
+type audit struct {
+	mu    sync.Mutex
+	enc   *json.Encoder
+	entry Entry
+	err   error
+}
+
+func (a *audit) log(event string, e Entry) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	base := a.entry
+	base.Time, base.Event = time.Now().UTC(), event
+	base.Method, base.Key, base.Cells, base.Rows, base.Error = e.Method, e.Key, e.Cells, e.Rows, e.Error
+	if err := a.enc.Encode(base); err != nil && a.err == nil {
+		a.err = err
+	}
+}
+
+// Run deletes the rows selected by opts from tbl, the table called name. A
+// prefix is dropped through admin unless admin is nil, opts.Scan is set or
+// the drop is refused as unimplemented or not permitted.
+func Run(ctx context.Context, admin *bigtable.AdminClient, name string, tbl table.Table, opts Options) (Report, error) {
+	if err := opts.check(); err != nil {
+		return Report{}, err
+	}
+	if opts.Batch <= 0 {
+		opts.Batch = 500
+	}
+	var a *audit
+	if opts.Audit != nil {
+		a = &audit{enc: json.NewEncoder(opts.Audit), entry: Entry{
+			Table: name, Prefix: opts.Prefix, Start: opts.Start, End: opts.End, User: opts.User,
+		}}
+	}
+
+	method := Scan
+	if admin != nil && !opts.Scan && (opts.Prefix != "" || opts.All && opts.Start == "" && opts.End == "") {
+		method = Drop
+	}
+	a.log("start", Entry{Method: method})
+	rep, err := run(ctx, admin, name, tbl, opts, method, a)
+	if err != nil {
+		a.log("failed", Entry{Method: rep.Method, Rows: rep.Rows, Error: err.Error()})
+		return rep, err
+	}
+	a.log("done", Entry{Method: rep.Method, Rows: rep.Rows, Cells: rep.Cells})
+	if a != nil && a.err != nil {
+		return rep, fmt.Errorf("writing audit log: %w", a.err)
+	}
+	return rep, nil
+}
+
+func run(ctx context.Context, admin *bigtable.AdminClient, name string, tbl table.Table, opts Options, method string, a *audit) (Report, error) {
+	if method == Drop {
+		rep := Report{Method: Drop}
+		if a != nil {
+			// record the keys, the drop does not return them
+			err := tbl.ReadRows(ctx, pager.ResumeRange(opts.Prefix, opts.Start, opts.End, ""), func(r bigtable.Row) bool {
+				rep.Rows++
+				rep.Cells += cells(r)
+				a.log("row", Entry{Key: r.Key(), Cells: cells(r)})
+				return true
+			}, keysOnly)
+			if err != nil {
+				return rep, err
+			}
+		}
+		var err error
+		if opts.Prefix != "" {
+			err = admin.DropRowRange(ctx, name, opts.Prefix)
+		} else {
+			err = admin.DropAllRows(ctx, name)
+		}
+		switch status.Code(err) {
+		case codes.OK:
+			if opts.Progress != nil {
+				opts.Progress(rep.Rows)
+			}
+			return rep, nil
+		case codes.Unimplemented, codes.PermissionDenied:
+			// scan below, the keys are already in the audit log
+			a = nil
+		default:
+			return rep, err
+		}
+	}
+	return scan(ctx, tbl, opts, a)
+}
+
+// scan deletes the rows a batch at a time, every batch is audited before
+// it is deleted.
+func scan(ctx context.Context, tbl table.Table, opts Options, a *audit) (Report, error) {
+	rep := Report{Method: Scan}
+	after := ""
+	for {
+		var keys []string
+		var muts []*bigtable.Mutation
+		err := tbl.ReadRows(ctx, pager.ResumeRange(opts.Prefix, opts.Start, opts.End, after), func(r bigtable.Row) bool {
+			after = r.Key()
+			keys = append(keys, r.Key())
+			m := bigtable.NewMutation()
+			m.DeleteRow()
+			muts = append(muts, m)
+			rep.Cells += cells(r)
+			a.log("row", Entry{Key: r.Key(), Cells: cells(r)})
+			return true
+		}, keysOnly, bigtable.LimitRows(int64(opts.Batch)))
+		if err != nil {
+			return rep, err
+		}
+		if len(keys) > 0 {
+			errs, err := tbl.ApplyBulk(ctx, keys, muts)
+			if err != nil {
+				return rep, err
+			}
+			for i, e := range errs {
+				if e != nil {
+					return rep, fmt.Errorf("deleting %q: %w", keys[i], e)
+				}
+			}
+			rep.Rows += int64(len(keys))
+			if opts.Progress != nil {
+				opts.Progress(rep.Rows)
+			}
+		}
+		if len(keys) < opts.Batch {
+			return rep, nil
+		}
+	}
+}
+
+func cells(r bigtable.Row) int64 {
+	n := 0
+	for _, items := range r {
+		n += len(items)
+	}
+	return int64(n)
+}
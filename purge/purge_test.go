@@ -0,0 +1,122 @@
+package purge
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"bigworkshop/table/tabletest"
+	"cloud.google.com/go/bigtable"
+)
+
+var keys = []string{"a:1", "a:2", "a:3", "b:1", "b:2", "c:1"}
+
+func fill(t *testing.T, srv *tabletest.Server) *bigtable.Table {
+	t.Helper()
+	tbl := srv.Table(t, "tbl", "f")
+	for _, k := range keys {
+		m := bigtable.NewMutation()
+		m.Set("f", "x", 1000, []byte("v"))
+		m.Set("f", "y", 1000, []byte("v"))
+		if err := tbl.Apply(context.Background(), k, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return tbl
+}
+
+func audited(t *testing.T, b *bytes.Buffer) (events, rows []string) {
+	t.Helper()
+	dec := json.NewDecoder(b)
+	for dec.More() {
+		var e Entry
+		if err := dec.Decode(&e); err != nil {
+			t.Fatal(err)
+		}
+		events = append(events, e.Event)
+		if e.Event == "row" {
+			rows = append(rows, e.Key)
+		}
+	}
+	return events, rows
+}
+
+func TestCount(t *testing.T) {
+	srv := tabletest.Start(t)
+	tbl := fill(t, srv)
+	p, err := Count(context.Background(), tbl, Options{Prefix: "a:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Rows != 3 || p.Cells != 6 || p.First != "a:1" || p.Last != "a:3" || len(p.Sample) != 3 {
+		t.Errorf("preview %+v", p)
+	}
+	if _, err := Count(context.Background(), tbl, Options{}); err == nil {
+		t.Error("count without prefix or range succeeded")
+	}
+}
+
+func TestRunDrop(t *testing.T) {
+	srv := tabletest.Start(t)
+	tbl := fill(t, srv)
+	var log bytes.Buffer
+	rep, err := Run(context.Background(), srv.Admin, "tbl", tbl, Options{Prefix: "a:", Audit: &log, User: "me"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Method != Drop || rep.Rows != 3 || rep.Cells != 6 {
+		t.Errorf("report %+v, want 3 rows dropped", rep)
+	}
+	if got := tabletest.Keys(t, tbl); !reflect.DeepEqual(got, keys[3:]) {
+		t.Errorf("left %q", got)
+	}
+	events, rows := audited(t, &log)
+	if !reflect.DeepEqual(rows, keys[:3]) || events[0] != "start" || events[len(events)-1] != "done" {
+		t.Errorf("audit log %q with rows %q", events, rows)
+	}
+}
+
+func TestRunScan(t *testing.T) {
+	srv := tabletest.Start(t)
+	tbl := fill(t, srv)
+	var log bytes.Buffer
+	var progress []int64
+	rep, err := Run(context.Background(), nil, "tbl", tbl, Options{
+		Start: "a:2", End: "b:2", Batch: 2, Audit: &log,
+		Progress: func(rows int64) { progress = append(progress, rows) },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Method != Scan || rep.Rows != 3 || rep.Cells != 6 {
+		t.Errorf("report %+v, want 3 rows scanned", rep)
+	}
+	if got, want := tabletest.Keys(t, tbl), []string{"a:1", "b:2", "c:1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("left %q, want %q", got, want)
+	}
+	if _, rows := audited(t, &log); !reflect.DeepEqual(rows, []string{"a:2", "a:3", "b:1"}) {
+		t.Errorf("audited %q", rows)
+	}
+	if !reflect.DeepEqual(progress, []int64{2, 3}) {
+		t.Errorf("progress %v", progress)
+	}
+}
+
+func TestRunAll(t *testing.T) {
+	srv := tabletest.Start(t)
+	tbl := fill(t, srv)
+	if _, err := Run(context.Background(), srv.Admin, "tbl", tbl, Options{}); err == nil {
+		t.Fatal("run without prefix or range succeeded")
+	}
+	for _, opts := range []Options{{All: true, Scan: true, Batch: 4}, {All: true}} {
+		rep, err := Run(context.Background(), srv.Admin, "tbl", tbl, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := tabletest.Keys(t, tbl); len(got) != 0 {
+			t.Errorf("%s left %q", rep.Method, got)
+		}
+	}
+}
@@ -0,0 +1,363 @@
+// Package queue is a durable work queue in Bigtable rows, for background
+// jobs of services that already have a table. Messages are rows keyed
+//
+//	queue#priority#enqueue-time#id
+//
+// so that a scan of the queue's prefix returns them by priority, 0 first,
+// and then oldest first:
+//
+//	q := queue.New(client.Open("jobs"), "mail", queue.Options{})
+//	_, err := q.Enqueue(ctx, body, queue.EnqueueOptions{Priority: 1})
+//	msgs, err := q.Claim(ctx, 10)
+//	for _, m := range msgs {
+//		err := send(m.Body)
+//		if err != nil {
+//			q.Nack(ctx, m, time.Minute)
+//			continue
+//		}
+//		q.Ack(ctx, m)
+//	}
+//
+// Claiming a message writes a lease cell whose timestamp is the time it
+// expires, with a CondMutation that only applies if the message has no
+// unexpired lease, so a message is held by one worker at a time. If the
+// worker neither acks nor nacks it before the lease expires, the message
+// becomes visible again. Messages claimed more than MaxAttempts times are
+// moved to a dead letter queue.
+//
+// Acked messages are deleted. Deleted rows are skipped by scans until a
+// compaction removes them, queues with a high throughput pay for that at
+// their head.
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+)
+
+// Columns of a message.
+const (
+	colBody     = "body"
+	colLease    = "lease"
+	colAttempts = "attempts"
+)
+
+// MaxPriority is the lowest priority, 0 is the highest.
+const MaxPriority = 9
+
+// ErrLeaseLost is returned when acking, nacking or extending a message
+// that has been claimed by another worker or deleted since.
+var ErrLeaseLost = errors.New("queue: lease lost")
+
+// Options configure a queue.
+type Options struct {
+	// Family holds the messages, q if empty.
+	Family string
+	// Lease is the visibility timeout of claimed messages, 30s if zero.
+	Lease time.Duration
+	// MaxAttempts is the number of claims after which a message is dead
+	// lettered, 5 if zero.
+	MaxAttempts int
+	// DeadLetter is the queue dead messages are moved to, the queue's name
+	// with -dead if empty.
+	DeadLetter string
+}
+
+// Queue is a queue in a table.
+type Queue struct {
+	tbl  table.Table
+	name string
+	opts Options
+}
+
+// New returns the queue name of tbl. Names must not contain #.
+func New(tbl table.Table, name string, opts Options) *Queue {
+	if opts.Family == "" {
+		opts.Family = "q"
+	}
+	if opts.Lease <= 0 {
+		opts.Lease = 30 * time.Second
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 5
+	}
+	if opts.DeadLetter == "" {
+		opts.DeadLetter = name + "-dead"
+	}
+	return &Queue{tbl: tbl, name: name, opts: opts}
+}
+
+// DeadLetter returns the dead letter queue. Its messages are never dead
+// lettered again.
+func (q *Queue) DeadLetter() *Queue {
+	opts := q.opts
+	opts.MaxAttempts = int(^uint(0) >> 1)
+	return &Queue{tbl: q.tbl, name: q.opts.DeadLetter, opts: opts}
+}
+
+// Message is a message of a queue.
+type Message struct {
+	// Key is the row key of the message.
+	Key      string
+	ID       string
+	Priority int
+	Enqueued time.Time
+	Body     []byte
+	// Attempts is the number of claims, including the current one.
+	Attempts int
+	// Token identifies the lease of a claimed message, LeaseExpiry is when
+	// it ends.
+	Token       string
+	LeaseExpiry time.Time
+}
+
+func (q *Queue) key(priority int, enqueued time.Time, id string) string {
+	return fmt.Sprintf("%s#%d#%016d#%s", q.name, priority, enqueued.UnixMicro(), id)
+}
+
+func parseKey(key string) (*Message, error) {
+	parts := strings.Split(key, "#")
+	if len(parts) != 4 {
+		return nil, fmt.Errorf("queue: bad message key %q", key)
+	}
+	p, err := strconv.Atoi(parts[1])
+	if err != nil || p < 0 || p > MaxPriority {
+		return nil, fmt.Errorf("queue: bad message key %q", key)
+	}
+	us, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("queue: bad message key %q", key)
+	}
+	return &Message{Key: key, ID: parts[3], Priority: p, Enqueued: time.UnixMicro(us)}, nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// EnqueueOptions configure a message.
+type EnqueueOptions struct {
+	// Priority is 0, the highest, to MaxPriority.
+	Priority int
+	// Delay hides the message until it has passed.
+	Delay time.Duration
+}
+
+// Enqueue adds a message and returns its key.
+func (q *Queue) Enqueue(ctx context.Context, body []byte, opts EnqueueOptions) (string, error) {
+	if opts.Priority < 0 || opts.Priority > MaxPriority {
+		return "", fmt.Errorf("queue: priority %d is not between 0 and %d", opts.Priority, MaxPriority)
+	}
+	id, err := randomHex(8)
+	if err != nil {
+		return "", err
+	}
+	key := q.key(opts.Priority, time.Now(), id)
+	return key, q.put(ctx, key, body, 0, opts.Delay)
+}
+
+func (q *Queue) put(ctx context.Context, key string, body []byte, attempts int, delay time.Duration) error {
+	m := bigtable.NewMutation()
+	m.Set(q.opts.Family, colBody, bigtable.Now(), body)
+	m.Set(q.opts.Family, colAttempts, bigtable.Now(), []byte(strconv.Itoa(attempts)))
+	if delay > 0 {
+		// a lease nobody holds
+		m.Set(q.opts.Family, colLease, bigtable.Time(time.Now().Add(delay)), nil)
+	}
+	return q.tbl.Apply(ctx, key, m)
+}
+
+func (q *Queue) column(name string) bigtable.Filter {
+	return bigtable.ChainFilters(
+		bigtable.FamilyFilter("^"+regexp.QuoteMeta(q.opts.Family)+"$"),
+		bigtable.ColumnFilter("^"+name+"$"),
+	)
+}
+
+// leased matches a lease that has not expired at now.
+func (q *Queue) leased(now time.Time) bigtable.Filter {
+	return bigtable.ChainFilters(q.column(colLease), bigtable.TimestampRangeFilterMicros(bigtable.Time(now), 0))
+}
+
+// visible passes the cells of messages without an unexpired lease.
+func (q *Queue) visible(now time.Time) bigtable.Filter {
+	return bigtable.ChainFilters(
+		bigtable.FamilyFilter("^"+regexp.QuoteMeta(q.opts.Family)+"$"),
+		bigtable.ConditionFilter(q.leased(now), bigtable.BlockAllFilter(), bigtable.LatestNFilter(1)),
+	)
+}
+
+// held matches the lease with token.
+func (q *Queue) held(token string) bigtable.Filter {
+	return bigtable.ChainFilters(q.column(colLease), bigtable.LatestNFilter(1), bigtable.ValueFilter("^"+regexp.QuoteMeta(token)+"$"))
+}
+
+func (q *Queue) parseRow(r bigtable.Row) (*Message, error) {
+	m, err := parseKey(r.Key())
+	if err != nil {
+		return nil, err
+	}
+	for _, it := range r[q.opts.Family] {
+		switch strings.TrimPrefix(it.Column, q.opts.Family+":") {
+		case colBody:
+			m.Body = it.Value
+		case colAttempts:
+			m.Attempts, _ = strconv.Atoi(string(it.Value))
+		case colLease:
+			m.LeaseExpiry = it.Timestamp.Time()
+		}
+	}
+	return m, nil
+}
+
+// Claim leases up to n visible messages from the head of the queue. It
+// returns fewer if other workers claim the same ones first, messages past
+// MaxAttempts are dead lettered instead of returned.
+func (q *Queue) Claim(ctx context.Context, n int) ([]*Message, error) {
+	now := time.Now()
+	var candidates []*Message
+	var perr error
+	// some candidates are lost to other workers, read more than n
+	err := q.tbl.ReadRows(ctx, bigtable.PrefixRange(q.name+"#"), func(r bigtable.Row) bool {
+		m, err := q.parseRow(r)
+		if err != nil {
+			perr = err
+			return false
+		}
+		candidates = append(candidates, m)
+		return true
+	}, bigtable.RowFilter(q.visible(now)), bigtable.LimitRows(int64(2*n+8)))
+	if err == nil {
+		err = perr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var claimed []*Message
+	for _, m := range candidates {
+		if len(claimed) == n {
+			break
+		}
+		ok, err := q.claim(ctx, m, now)
+		if err != nil {
+			return claimed, err
+		}
+		if !ok {
+			continue
+		}
+		if m.Attempts > q.opts.MaxAttempts {
+			if err := q.deadLetter(ctx, m); err != nil {
+				return claimed, err
+			}
+			continue
+		}
+		claimed = append(claimed, m)
+	}
+	return claimed, nil
+}
+
+// claim leases m if it still exists, nobody holds a lease on it and its
+// attempts are the ones read, so that two workers racing for it cannot
+// both count the same attempt.
+func (q *Queue) claim(ctx context.Context, m *Message, now time.Time) (bool, error) {
+	token, err := randomHex(8)
+	if err != nil {
+		return false, err
+	}
+	expiry := now.Add(q.opts.Lease)
+	mut := bigtable.NewMutation()
+	mut.DeleteCellsInColumn(q.opts.Family, colLease)
+	mut.Set(q.opts.Family, colLease, bigtable.Time(expiry), []byte(token))
+	mut.Set(q.opts.Family, colAttempts, bigtable.Now(), []byte(strconv.Itoa(m.Attempts+1)))
+	// matches messages without a lease whose attempts did not change
+	attempts := bigtable.ChainFilters(
+		bigtable.ColumnFilter("^"+colAttempts+"$"),
+		bigtable.LatestNFilter(1),
+		bigtable.ValueFilter("^"+strconv.Itoa(m.Attempts)+"$"),
+	)
+	pred := bigtable.ChainFilters(
+		bigtable.FamilyFilter("^"+regexp.QuoteMeta(q.opts.Family)+"$"),
+		bigtable.ConditionFilter(q.leased(now), bigtable.BlockAllFilter(), attempts),
+	)
+	var matched bool
+	if err := q.tbl.Apply(ctx, m.Key, bigtable.NewCondMutation(pred, mut, nil), bigtable.GetCondMutationResult(&matched)); err != nil {
+		return false, err
+	}
+	if matched {
+		m.Attempts++
+		m.Token, m.LeaseExpiry = token, expiry.Truncate(time.Millisecond)
+	}
+	return matched, nil
+}
+
+// whileHeld applies mut to a message if its lease is still the one of the
+// claim.
+func (q *Queue) whileHeld(ctx context.Context, m *Message, mut *bigtable.Mutation) error {
+	var matched bool
+	if err := q.tbl.Apply(ctx, m.Key, bigtable.NewCondMutation(q.held(m.Token), mut, nil), bigtable.GetCondMutationResult(&matched)); err != nil {
+		return err
+	}
+	if !matched {
+		return ErrLeaseLost
+	}
+	return nil
+}
+
+// Ack deletes a claimed message.
+func (q *Queue) Ack(ctx context.Context, m *Message) error {
+	mut := bigtable.NewMutation()
+	mut.DeleteRow()
+	return q.whileHeld(ctx, m, mut)
+}
+
+// Nack releases a claimed message, it becomes visible again after delay.
+func (q *Queue) Nack(ctx context.Context, m *Message, delay time.Duration) error {
+	mut := bigtable.NewMutation()
+	mut.DeleteCellsInColumn(q.opts.Family, colLease)
+	if delay > 0 {
+		mut.Set(q.opts.Family, colLease, bigtable.Time(time.Now().Add(delay)), nil)
+	}
+	return q.whileHeld(ctx, m, mut)
+}
+
+// Extend moves the end of the lease of a claimed message to d from now,
+// for work that takes longer than the lease.
+func (q *Queue) Extend(ctx context.Context, m *Message, d time.Duration) error {
+	expiry := time.Now().Add(d)
+	mut := bigtable.NewMutation()
+	mut.DeleteCellsInColumn(q.opts.Family, colLease)
+	mut.Set(q.opts.Family, colLease, bigtable.Time(expiry), []byte(m.Token))
+	if err := q.whileHeld(ctx, m, mut); err != nil {
+		return err
+	}
+	m.LeaseExpiry = expiry.Truncate(time.Millisecond)
+	return nil
+}
+
+// deadLetter moves a claimed message to the dead letter queue with its id,
+// priority, enqueue time and attempts.
+func (q *Queue) deadLetter(ctx context.Context, m *Message) error {
+	dead := q.DeadLetter()
+	if err := dead.put(ctx, dead.key(m.Priority, m.Enqueued, m.ID), m.Body, m.Attempts-1, 0); err != nil {
+		return err
+	}
+	if err := q.Ack(ctx, m); err != nil && err != ErrLeaseLost {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"bigworkshop/table/tabletest"
+)
+
+func newQueue(t *testing.T, opts Options) *Queue {
+	t.Helper()
+	srv := tabletest.Start(t)
+	return New(srv.Table(t, "jobs", "q"), "mail", opts)
+}
+
+func enqueue(t *testing.T, q *Queue, body string, priority int) {
+	t.Helper()
+	if _, err := q.Enqueue(context.Background(), []byte(body), EnqueueOptions{Priority: priority}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func claim(t *testing.T, q *Queue, n int) []string {
+	t.Helper()
+	msgs, err := q.Claim(context.Background(), n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bodies []string
+	for _, m := range msgs {
+		bodies = append(bodies, string(m.Body))
+	}
+	return bodies
+}
+
+func TestClaimAck(t *testing.T) {
+	ctx := context.Background()
+	q := newQueue(t, Options{})
+	enqueue(t, q, "low", 5)
+	enqueue(t, q, "first", 0)
+	enqueue(t, q, "second", 0)
+
+	msgs, err := q.Claim(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msgs) != 2 || string(msgs[0].Body) != "first" || string(msgs[1].Body) != "second" {
+		t.Fatalf("claimed %v, want first and second", msgs)
+	}
+	if m := msgs[0]; m.Attempts != 1 || m.Token == "" || m.LeaseExpiry.Before(time.Now()) {
+		t.Errorf("claimed %+v, want a lease of the first attempt", m)
+	}
+	// claimed messages are invisible to other claims
+	if got := claim(t, q, 5); len(got) != 1 || got[0] != "low" {
+		t.Errorf("second claim %q, want low", got)
+	}
+
+	if err := q.Ack(ctx, msgs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Ack(ctx, msgs[0]); err != ErrLeaseLost {
+		t.Errorf("second ack returned %v, want ErrLeaseLost", err)
+	}
+	st, err := q.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Total() != 2 {
+		t.Errorf("stats %+v, want 2 messages left", st)
+	}
+}
+
+func TestNack(t *testing.T) {
+	ctx := context.Background()
+	q := newQueue(t, Options{})
+	enqueue(t, q, "job", 0)
+	msgs, err := q.Claim(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Nack(ctx, msgs[0], 0); err != nil {
+		t.Fatal(err)
+	}
+	again, err := q.Claim(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != 1 || again[0].Attempts != 2 {
+		t.Fatalf("claimed %v after nack, want the second attempt", again)
+	}
+	if err := q.Nack(ctx, again[0], time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if got := claim(t, q, 1); len(got) != 0 {
+		t.Errorf("claimed %q during the nack delay", got)
+	}
+}
+
+func TestLeaseExpires(t *testing.T) {
+	ctx := context.Background()
+	q := newQueue(t, Options{Lease: 20 * time.Millisecond})
+	enqueue(t, q, "job", 0)
+	msgs, err := q.Claim(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(40 * time.Millisecond)
+	again, err := q.Claim(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again) != 1 || again[0].Attempts != 2 {
+		t.Fatalf("claimed %v after the lease expired, want the second attempt", again)
+	}
+	if err := q.Ack(ctx, msgs[0]); err != ErrLeaseLost {
+		t.Errorf("ack of the expired lease returned %v, want ErrLeaseLost", err)
+	}
+	if err := q.Extend(ctx, again[0], time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(40 * time.Millisecond)
+	if got := claim(t, q, 1); len(got) != 0 {
+		t.Errorf("claimed %q during the extended lease", got)
+	}
+	if err := q.Ack(ctx, again[0]); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	q := newQueue(t, Options{})
+	if _, err := q.Enqueue(context.Background(), []byte("later"), EnqueueOptions{Delay: time.Hour}); err != nil {
+		t.Fatal(err)
+	}
+	if got := claim(t, q, 1); len(got) != 0 {
+		t.Errorf("claimed delayed %q", got)
+	}
+	if _, err := q.Enqueue(context.Background(), nil, EnqueueOptions{Priority: MaxPriority + 1}); err == nil {
+		t.Error("enqueued with a priority above MaxPriority")
+	}
+}
+
+func TestDeadLetter(t *testing.T) {
+	ctx := context.Background()
+	q := newQueue(t, Options{Lease: 10 * time.Millisecond, MaxAttempts: 1})
+	enqueue(t, q, "poison", 3)
+	if got := claim(t, q, 1); len(got) != 1 {
+		t.Fatalf("claimed %q, want poison", got)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if got := claim(t, q, 1); len(got) != 0 {
+		t.Errorf("claimed %q past MaxAttempts", got)
+	}
+	dead, err := q.DeadLetter().Claim(ctx, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dead) != 1 || string(dead[0].Body) != "poison" || dead[0].Priority != 3 || dead[0].Attempts != 2 {
+		t.Errorf("dead letters %+v, want poison with its priority and attempts", dead)
+	}
+}
@@ -0,0 +1,75 @@
+package queue
+
+import (
+	"context"
+	"regexp"
+	"time"
+
+	"cloud.google.com/go/bigtable"
+)
+
+// Stats count the messages of a queue.
+type Stats struct {
+	// Ready messages are visible, by priority.
+	Ready [MaxPriority + 1]int64
+	// Leased messages are claimed or delayed.
+	Leased int64
+	// Oldest is the enqueue time of the oldest ready message.
+	Oldest time.Time
+}
+
+// Total returns the number of messages.
+func (s Stats) Total() int64 {
+	n := s.Leased
+	for _, r := range s.Ready {
+		n += r
+	}
+	return n
+}
+
+// Stats scans the queue without the bodies.
+func (q *Queue) Stats(ctx context.Context) (Stats, error) {
+	var s Stats
+	now := time.Now()
+	var perr error
+	err := q.tbl.ReadRows(ctx, bigtable.PrefixRange(q.name+"#"), func(r bigtable.Row) bool {
+		m, err := q.parseRow(r)
+		if err != nil {
+			perr = err
+			return false
+		}
+		if m.LeaseExpiry.After(now) {
+			s.Leased++
+			return true
+		}
+		s.Ready[m.Priority]++
+		if s.Oldest.IsZero() || m.Enqueued.Before(s.Oldest) {
+			s.Oldest = m.Enqueued
+		}
+		return true
+	}, bigtable.RowFilter(bigtable.ChainFilters(q.column("("+colLease+"|"+colAttempts+")"), bigtable.LatestNFilter(1), bigtable.StripValueFilter())))
+	if err == nil {
+		err = perr
+	}
+	return s, err
+}
+
+// Peek returns up to n messages from the head of the queue without
+// claiming them, leased ones included.
+func (q *Queue) Peek(ctx context.Context, n int) ([]*Message, error) {
+	var msgs []*Message
+	var perr error
+	err := q.tbl.ReadRows(ctx, bigtable.PrefixRange(q.name+"#"), func(r bigtable.Row) bool {
+		m, err := q.parseRow(r)
+		if err != nil {
+			perr = err
+			return false
+		}
+		msgs = append(msgs, m)
+		return true
+	}, bigtable.RowFilter(bigtable.ChainFilters(bigtable.FamilyFilter("^"+regexp.QuoteMeta(q.opts.Family)+"$"), bigtable.LatestNFilter(1))), bigtable.LimitRows(int64(n)))
+	if err == nil {
+		err = perr
+	}
+	return msgs, err
+}
@@ -0,0 +1,184 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Priority orders waiting callers, lower values go first.
+type Priority int
+
+const (
+	// Interactive is the default, for requests someone is waiting for.
+	Interactive Priority = iota
+	// Batch is for jobs that may wait, they only get tokens while no
+	// interactive caller waits.
+	Batch
+
+	numPriorities
+)
+
+type priorityKey struct{}
+
+// WithPriority marks the operations started with ctx.
+func WithPriority(ctx context.Context, p Priority) context.Context {
+	return context.WithValue(ctx, priorityKey{}, p)
+}
+
+// PriorityFrom returns the priority of ctx, Interactive if none is set.
+func PriorityFrom(ctx context.Context) Priority {
+	if p, ok := ctx.Value(priorityKey{}).(Priority); ok && p >= 0 && p < numPriorities {
+		return p
+	}
+	return Interactive
+}
+
+// Rate is a token bucket size, the zero Rate is unlimited.
+type Rate struct {
+	// PerSecond is the refill rate.
+	PerSecond float64
+	// Burst is the bucket size, PerSecond if zero.
+	Burst float64
+}
+
+func (r Rate) String() string {
+	if r.PerSecond <= 0 {
+		return "unlimited"
+	}
+	if r.Burst <= 0 {
+		return strconv.FormatFloat(r.PerSecond, 'g', -1, 64)
+	}
+	return strconv.FormatFloat(r.PerSecond, 'g', -1, 64) + ":" + strconv.FormatFloat(r.Burst, 'g', -1, 64)
+}
+
+// ParseRate parses rate[:burst], e.g. 100 or 100:500.
+func ParseRate(s string) (Rate, error) {
+	rate, burst, hasBurst := strings.Cut(s, ":")
+	var r Rate
+	var err error
+	if r.PerSecond, err = strconv.ParseFloat(rate, 64); err != nil || r.PerSecond < 0 {
+		return r, fmt.Errorf("ratelimit: bad rate %q", s)
+	}
+	if hasBurst {
+		if r.Burst, err = strconv.ParseFloat(burst, 64); err != nil || r.Burst < 0 {
+			return r, fmt.Errorf("ratelimit: bad burst %q", s)
+		}
+	}
+	return r, nil
+}
+
+// bucket is a token bucket whose rate is scaled by the adaptive factor.
+// Tokens may go negative when more is taken than the burst allows, later
+// callers then wait for the debt to be paid off.
+type bucket struct {
+	mu      sync.Mutex
+	rate    Rate
+	factor  float64
+	tokens  float64
+	last    time.Time
+	waiting [numPriorities]int
+}
+
+func newBucket(r Rate) *bucket {
+	if r.Burst <= 0 {
+		r.Burst = r.PerSecond
+	}
+	return &bucket{rate: r, factor: 1, tokens: r.Burst, last: time.Now()}
+}
+
+func (b *bucket) unlimited() bool {
+	return b == nil || b.rate.PerSecond <= 0
+}
+
+// refill adds the tokens earned since the last call, b.mu must be held.
+func (b *bucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate.PerSecond * b.factor
+	if b.tokens > b.rate.Burst {
+		b.tokens = b.rate.Burst
+	}
+	b.last = now
+}
+
+// wait blocks until n tokens can be taken by a caller of priority p. It
+// fails right away with ResourceExhausted if that would take longer than
+// maxWait, zero waits as long as ctx allows.
+func (b *bucket) wait(ctx context.Context, n float64, p Priority, maxWait time.Duration) error {
+	if b.unlimited() || n <= 0 {
+		return nil
+	}
+	// more than the burst can never be available, take it once the
+	// bucket is full and leave the rest as debt
+	need := math.Min(n, b.rate.Burst)
+	queued := false
+	defer func() {
+		if queued {
+			b.mu.Lock()
+			b.waiting[p]--
+			b.mu.Unlock()
+		}
+	}()
+	start := time.Now()
+	for {
+		b.mu.Lock()
+		now := time.Now()
+		b.refill(now)
+		ahead := 0
+		for q := Priority(0); q < p; q++ {
+			ahead += b.waiting[q]
+		}
+		if ahead == 0 && b.tokens >= need {
+			b.tokens -= n
+			b.mu.Unlock()
+			return nil
+		}
+		d := time.Duration((need - b.tokens) / (b.rate.PerSecond * b.factor) * float64(time.Second))
+		if ahead > 0 || d < time.Millisecond {
+			d = time.Millisecond
+		}
+		if !queued {
+			b.waiting[p]++
+			queued = true
+		}
+		b.mu.Unlock()
+
+		if maxWait > 0 && now.Add(d).Sub(start) > maxWait {
+			return status.Errorf(codes.ResourceExhausted, "ratelimit: would wait more than %v", maxWait)
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// take removes n tokens without waiting, for costs known only afterwards.
+func (b *bucket) take(n float64) {
+	if b.unlimited() || n <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.tokens -= n
+}
+
+func (b *bucket) setFactor(f float64) {
+	if b.unlimited() {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill(time.Now())
+	b.factor = f
+}
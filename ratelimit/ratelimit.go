@@ -0,0 +1,323 @@
+// Package ratelimit throttles table operations on the client, so bulk jobs
+// like the write loop of ex5.2 do not overwhelm a small cluster.
+//
+// Every wrapped table has token buckets for read operations, mutations and
+// bytes. Reads take a token per row, mutations one per mutation and bytes
+// are charged for what is written and read. Callers marked Batch with
+// WithPriority only get tokens while no Interactive caller is waiting. With
+// Adaptive set the rates shrink when latency rises or the server answers
+// RESOURCE_EXHAUSTED and grow back once it recovers.
+//
+//	lim := ratelimit.New(ratelimit.Config{
+//		Default:  ratelimit.Limits{Mutations: ratelimit.Rate{PerSecond: 1000}},
+//		Adaptive: &ratelimit.Adaptive{TargetLatency: 50 * time.Millisecond},
+//	})
+//	tbl := lim.Wrap(client.Open("tokens"), "tokens")
+//	err := tbl.ApplyBulk(ratelimit.WithPriority(ctx, ratelimit.Batch), keys, muts)
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Limits are the rates of one table.
+type Limits struct {
+	// Reads limits rows read, ReadRow and SampleRowKeys count as one.
+	Reads Rate
+	// Mutations limits mutations, each entry of ApplyBulk is one.
+	Mutations Rate
+	// Bytes limits bytes written and read.
+	Bytes Rate
+}
+
+// ParseLimits parses reads=rate,mutations=rate,bytes=rate where rate is
+// rate[:burst] per second, e.g. mutations=1000:5000,bytes=1048576.
+func ParseLimits(s string) (Limits, error) {
+	var l Limits
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(part, "=")
+		if !ok {
+			return l, fmt.Errorf("ratelimit: expected kind=rate, got %q", part)
+		}
+		r, err := ParseRate(v)
+		if err != nil {
+			return l, err
+		}
+		switch k {
+		case "reads":
+			l.Reads = r
+		case "mutations":
+			l.Mutations = r
+		case "bytes":
+			l.Bytes = r
+		default:
+			return l, fmt.Errorf("ratelimit: unknown kind %q, use reads, mutations or bytes", k)
+		}
+	}
+	return l, nil
+}
+
+// Adaptive scales the rates between Min and 1: down by Decrease when the
+// average latency exceeds TargetLatency or the server answers
+// RESOURCE_EXHAUSTED, at most once per Cooldown, and up by Increase for
+// every operation that was fine.
+type Adaptive struct {
+	// TargetLatency is the highest acceptable average latency, latency is
+	// ignored if zero. The latency of ReadRows is the time to the first row.
+	TargetLatency time.Duration
+	// Min is the lowest factor, 0.05 if zero.
+	Min float64
+	// Decrease multiplies the factor, 0.5 if zero.
+	Decrease float64
+	// Increase is added to the factor, 0.01 if zero.
+	Increase float64
+	// Cooldown is the minimum time between decreases, a second if zero.
+	Cooldown time.Duration
+}
+
+func (a Adaptive) withDefaults() Adaptive {
+	if a.Min <= 0 {
+		a.Min = 0.05
+	}
+	if a.Decrease <= 0 || a.Decrease >= 1 {
+		a.Decrease = 0.5
+	}
+	if a.Increase <= 0 {
+		a.Increase = 0.01
+	}
+	if a.Cooldown <= 0 {
+		a.Cooldown = time.Second
+	}
+	return a
+}
+
+// Config configures a Limiter.
+type Config struct {
+	// Default are the limits of tables not in Tables.
+	Default Limits
+	// Tables overrides the limits per table.
+	Tables map[string]Limits
+	// Adaptive enables adaptive throttling.
+	Adaptive *Adaptive
+	// MaxWait rejects operations that would wait longer with
+	// RESOURCE_EXHAUSTED instead of queueing them, zero waits as long as
+	// the context allows.
+	MaxWait time.Duration
+}
+
+// Limiter hands out the limits of Config to the tables it wraps.
+type Limiter struct {
+	cfg Config
+}
+
+// New returns a limiter for cfg.
+func New(cfg Config) *Limiter {
+	if cfg.Adaptive != nil {
+		a := cfg.Adaptive.withDefaults()
+		cfg.Adaptive = &a
+	}
+	return &Limiter{cfg: cfg}
+}
+
+// Wrap limits the operations on tbl with the limits of the table name.
+// Tables wrapped twice do not share their buckets.
+func (l *Limiter) Wrap(tbl table.Table, name string) *Table {
+	lim, ok := l.cfg.Tables[name]
+	if !ok {
+		lim = l.cfg.Default
+	}
+	return &Table{
+		tbl:       tbl,
+		reads:     newBucket(lim.Reads),
+		mutations: newBucket(lim.Mutations),
+		bytes:     newBucket(lim.Bytes),
+		adaptive:  l.cfg.Adaptive,
+		maxWait:   l.cfg.MaxWait,
+		factor:    1,
+	}
+}
+
+// Table is a rate limited table.Table.
+type Table struct {
+	tbl                     table.Table
+	reads, mutations, bytes *bucket
+	adaptive                *Adaptive
+	maxWait                 time.Duration
+
+	mu           sync.Mutex
+	factor       float64
+	latency      float64 // moving average in seconds
+	lastDecrease time.Time
+}
+
+var _ table.Table = (*Table)(nil)
+
+// Factor returns the current adaptive factor, 1 without adaptive throttling.
+func (t *Table) Factor() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.factor
+}
+
+// observe feeds the result of an operation that started at start into
+// adaptive throttling.
+func (t *Table) observe(start time.Time, err error) {
+	t.adapt(time.Since(start), err)
+}
+
+// adapt feeds the latency and result of an operation into adaptive
+// throttling.
+func (t *Table) adapt(latency time.Duration, err error) {
+	a := t.adaptive
+	if a == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	d := latency.Seconds()
+	if t.latency == 0 {
+		t.latency = d
+	} else {
+		t.latency = 0.8*t.latency + 0.2*d
+	}
+	overloaded := status.Code(err) == codes.ResourceExhausted ||
+		(a.TargetLatency > 0 && t.latency > a.TargetLatency.Seconds())
+
+	f := t.factor
+	switch {
+	case overloaded && time.Since(t.lastDecrease) >= a.Cooldown:
+		f *= a.Decrease
+		t.lastDecrease = time.Now()
+	case !overloaded && err == nil:
+		f += a.Increase
+	}
+	if f < a.Min {
+		f = a.Min
+	}
+	if f > 1 {
+		f = 1
+	}
+	if f != t.factor {
+		t.factor = f
+		t.reads.setFactor(f)
+		t.mutations.setFactor(f)
+		t.bytes.setFactor(f)
+	}
+}
+
+func (t *Table) ReadRows(ctx context.Context, arg bigtable.RowSet, f func(bigtable.Row) bool, opts ...bigtable.ReadOption) error {
+	p := PriorityFrom(ctx)
+	if err := t.reads.wait(ctx, 1, p, t.maxWait); err != nil {
+		return err
+	}
+	// The latency of a scan is the time to its first row, the rest depends
+	// on its length, the waits below and the callback.
+	start := time.Now()
+	latency := time.Duration(-1)
+	var werr error
+	err := t.tbl.ReadRows(ctx, arg, func(r bigtable.Row) bool {
+		// the first row used the token taken above
+		if latency < 0 {
+			latency = time.Since(start)
+		} else if werr = t.reads.wait(ctx, 1, p, 0); werr != nil {
+			return false
+		}
+		t.bytes.take(float64(table.RowSize(r)))
+		return f(r)
+	}, opts...)
+	if latency < 0 {
+		latency = time.Since(start)
+	}
+	t.adapt(latency, err)
+	if err == nil {
+		err = werr
+	}
+	return err
+}
+
+func (t *Table) ReadRow(ctx context.Context, row string, opts ...bigtable.ReadOption) (bigtable.Row, error) {
+	if err := t.reads.wait(ctx, 1, PriorityFrom(ctx), t.maxWait); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	r, err := t.tbl.ReadRow(ctx, row, opts...)
+	t.bytes.take(float64(table.RowSize(r)))
+	t.observe(start, err)
+	return r, err
+}
+
+// admitWrite waits for n mutations of size bytes.
+func (t *Table) admitWrite(ctx context.Context, n, size int) error {
+	p := PriorityFrom(ctx)
+	if err := t.mutations.wait(ctx, float64(n), p, t.maxWait); err != nil {
+		return err
+	}
+	return t.bytes.wait(ctx, float64(size), p, t.maxWait)
+}
+
+func (t *Table) Apply(ctx context.Context, row string, m *bigtable.Mutation, opts ...bigtable.ApplyOption) error {
+	if err := t.admitWrite(ctx, 1, table.MutationSize(m)); err != nil {
+		return err
+	}
+	start := time.Now()
+	err := t.tbl.Apply(ctx, row, m, opts...)
+	t.observe(start, err)
+	return err
+}
+
+func (t *Table) ApplyBulk(ctx context.Context, rowKeys []string, muts []*bigtable.Mutation, opts ...bigtable.ApplyOption) ([]error, error) {
+	size := 0
+	for _, m := range muts {
+		size += table.MutationSize(m)
+	}
+	if err := t.admitWrite(ctx, len(muts), size); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	errs, err := t.tbl.ApplyBulk(ctx, rowKeys, muts, opts...)
+	if err == nil {
+		for _, e := range errs {
+			if status.Code(e) == codes.ResourceExhausted {
+				err = e
+				break
+			}
+		}
+		t.observe(start, err)
+		return errs, nil
+	}
+	t.observe(start, err)
+	return errs, err
+}
+
+func (t *Table) ApplyReadModifyWrite(ctx context.Context, row string, m *bigtable.ReadModifyWrite) (bigtable.Row, error) {
+	if err := t.admitWrite(ctx, 1, 0); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	r, err := t.tbl.ApplyReadModifyWrite(ctx, row, m)
+	t.bytes.take(float64(table.RowSize(r)))
+	t.observe(start, err)
+	return r, err
+}
+
+func (t *Table) SampleRowKeys(ctx context.Context) ([]string, error) {
+	if err := t.reads.wait(ctx, 1, PriorityFrom(ctx), t.maxWait); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	keys, err := t.tbl.SampleRowKeys(ctx)
+	t.observe(start, err)
+	return keys, err
+}
@@ -0,0 +1,46 @@
+// Package rawgrpc passes grpc messages through as bytes, for proxies and
+// fakes that handle any method without generated code.
+//
+//	srv := grpc.NewServer(grpc.ForceServerCodec(rawgrpc.Codec{}), grpc.UnknownServiceHandler(h))
+//	stream, err := conn.NewStream(ctx, rawgrpc.StreamDesc, method, grpc.ForceCodec(rawgrpc.Codec{}))
+package rawgrpc
+
+import (
+	"fmt"
+
+	"google.golang.org/grpc"
+)
+
+// Frame is one message in its wire encoding.
+type Frame struct {
+	Payload []byte
+}
+
+// Codec sends and receives *Frame. It registers as "proto" so that the
+// content type matches what proto clients and servers expect.
+type Codec struct{}
+
+func (Codec) Marshal(v interface{}) ([]byte, error) {
+	f, ok := v.(*Frame)
+	if !ok {
+		return nil, fmt.Errorf("rawgrpc: cannot marshal %T", v)
+	}
+	return f.Payload, nil
+}
+
+func (Codec) Unmarshal(data []byte, v interface{}) error {
+	f, ok := v.(*Frame)
+	if !ok {
+		return fmt.Errorf("rawgrpc: cannot unmarshal into %T", v)
+	}
+	f.Payload = append(f.Payload[:0], data...)
+	return nil
+}
+
+func (Codec) Name() string {
+	return "proto"
+}
+
+// StreamDesc describes a call of unknown shape, every call can be treated
+// as a bidirectional stream.
+var StreamDesc = &grpc.StreamDesc{ServerStreams: true, ClientStreams: true}
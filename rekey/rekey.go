@@ -0,0 +1,339 @@
+// Package rekey moves rows to new keys while the table stays in use, for
+// key design changes like ex5.2's move from token:101 to token:09899.
+//
+// Rows are copied in batches with every cell version and its original
+// timestamp. Each batch is read back and compared with the source by
+// checksum before the old rows are deleted. An old row is only deleted if
+// it has no cell from a later millisecond than the copied ones and no more
+// cells than were copied; a write that replaces a copied cell under its
+// own timestamp, or adds one while others expire, is not noticed:
+//
+//	from, _ := keycodec.Parse("plain", "token:")
+//	to, _ := keycodec.Parse("padded-desc:5:10000", "token:")
+//	rep, err := rekey.Run(ctx, tbl, tbl, rekey.Codec(from, to), rekey.Options{Prefix: "token:", DeleteOld: true})
+//
+// Rows written to the old keys during the run keep their old key and are
+// counted as Changed, running again moves them.
+package rekey
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+	"sync"
+
+	"bigworkshop/keycodec"
+	"bigworkshop/pager"
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+)
+
+// Transform returns the new key of a row, false to leave the row alone. An
+// error also leaves it alone, the row is counted as Rejected.
+type Transform func(key string) (string, bool, error)
+
+// Codec moves keys written by from to the keys to writes for the same id.
+// Keys matching both or neither are left alone, so that rows moved within
+// one prefix are not moved again when the scan reaches them. Ids to has no
+// key for are rejected.
+func Codec(from, to keycodec.Codec) Transform {
+	return func(key string) (string, bool, error) {
+		if !keycodec.Matches(from, key) || keycodec.Matches(to, key) {
+			return "", false, nil
+		}
+		id, err := from.Decode(key)
+		if err != nil {
+			return "", false, nil
+		}
+		if err := to.Check(id); err != nil {
+			return "", false, err
+		}
+		return to.Encode(id), true, nil
+	}
+}
+
+// Prefix replaces the prefix old with new. Keys already starting with new
+// are left alone.
+func Prefix(old, new string) Transform {
+	return func(key string) (string, bool, error) {
+		if !strings.HasPrefix(key, old) || strings.HasPrefix(key, new) {
+			return "", false, nil
+		}
+		return new + key[len(old):], true, nil
+	}
+}
+
+// Options configure a run.
+type Options struct {
+	// Prefix, or Start and End, limit the scan, the whole table if empty.
+	Prefix     string
+	Start, End string
+	// DeleteOld deletes the old rows once their copies are verified.
+	DeleteOld bool
+	// Batch is the number of rows copied per ApplyBulk, 500 if zero.
+	Batch int
+	// Concurrency of the conditional deletes, 8 if zero.
+	Concurrency int
+	// DryRun only counts the rows that would be moved.
+	DryRun bool
+	// Progress is called after every batch with the report so far.
+	Progress func(Report)
+	// After continues a run that stopped, the scan starts after this key.
+	After string
+	// Checkpoint is called after every batch with its last key, to pass
+	// as After when the run is continued. An error stops the run.
+	Checkpoint func(after string, rep Report) error
+}
+
+// Report counts what a run did. The sums are order independent checksums
+// of the cells, without the keys, of all moved rows in the source and of
+// their copies.
+type Report struct {
+	Scanned int64
+	Moved   int64
+	Skipped int64
+	Cells   int64
+	Deleted int64
+	// Changed rows were written to during the run and kept their old key.
+	Changed int64
+	// Mismatched rows differ from their copy, e.g. because the new key
+	// already had cells, and kept their old key.
+	Mismatched int64
+	Mismatches []string // the first few old keys
+	// Rejected rows have no new key, e.g. ids too wide for the new key
+	// scheme, and kept their old key.
+	Rejected   int64
+	Rejections []string // the first few errors
+
+	SourceSum, TargetSum uint64
+}
+
+// Verified reports whether every copy matched its source. Rejected rows
+// are not copied and do not count.
+func (r Report) Verified() bool {
+	return r.Mismatched == 0 && r.SourceSum == r.TargetSum
+}
+
+func (r Report) String() string {
+	s := fmt.Sprintf("%d rows scanned, %d moved with %d cells, %d skipped, %d old rows deleted",
+		r.Scanned, r.Moved, r.Cells, r.Skipped, r.Deleted)
+	if r.Changed > 0 {
+		s += fmt.Sprintf(", %d changed during the run", r.Changed)
+	}
+	if r.Mismatched > 0 {
+		s += fmt.Sprintf(", %d mismatched %q", r.Mismatched, r.Mismatches)
+	}
+	if r.Rejected > 0 {
+		s += fmt.Sprintf(", %d rejected %q", r.Rejected, r.Rejections)
+	}
+	return s + fmt.Sprintf(", checksums %016x/%016x", r.SourceSum, r.TargetSum)
+}
+
+// Checksum hashes the cells of a row, their families, qualifiers,
+// timestamps and values, but not the key.
+func Checksum(r bigtable.Row) uint64 {
+	var cells []bigtable.ReadItem
+	for _, items := range r {
+		cells = append(cells, items...)
+	}
+	sort.Slice(cells, func(i, j int) bool {
+		if cells[i].Column != cells[j].Column {
+			return cells[i].Column < cells[j].Column
+		}
+		return cells[i].Timestamp > cells[j].Timestamp
+	})
+	h := fnv.New64a()
+	var buf [8]byte
+	for _, c := range cells {
+		binary.BigEndian.PutUint64(buf[:], uint64(len(c.Column)))
+		h.Write(buf[:])
+		h.Write([]byte(c.Column))
+		binary.BigEndian.PutUint64(buf[:], uint64(c.Timestamp))
+		h.Write(buf[:])
+		binary.BigEndian.PutUint64(buf[:], uint64(len(c.Value)))
+		h.Write(buf[:])
+		h.Write(c.Value)
+	}
+	return h.Sum64()
+}
+
+// move is a row being moved.
+type move struct {
+	row    bigtable.Row
+	newKey string
+	sum    uint64
+	cells  int
+	newest bigtable.Timestamp
+}
+
+// Run moves the rows of src selected by opts and t to dst, which may be
+// src. It stops at the first failed write, the rows moved so far stay
+// moved and running again continues with the rest.
+func Run(ctx context.Context, src, dst table.Table, t Transform, opts Options) (Report, error) {
+	if opts.Batch <= 0 {
+		opts.Batch = 500
+	}
+	if opts.Concurrency <= 0 {
+		opts.Concurrency = 8
+	}
+	var rep Report
+	after := opts.After
+	for {
+		var moves []move
+		n := 0
+		err := src.ReadRows(ctx, pager.ResumeRange(opts.Prefix, opts.Start, opts.End, after), func(r bigtable.Row) bool {
+			n++
+			after = r.Key()
+			newKey, ok, err := t(r.Key())
+			if err != nil {
+				rep.Rejected++
+				if len(rep.Rejections) < 10 {
+					rep.Rejections = append(rep.Rejections, fmt.Sprintf("%q: %v", r.Key(), err))
+				}
+				return true
+			}
+			if !ok || newKey == r.Key() {
+				rep.Skipped++
+				return true
+			}
+			m := move{row: r, newKey: newKey, sum: Checksum(r)}
+			for _, items := range r {
+				m.cells += len(items)
+				for _, it := range items {
+					if it.Timestamp > m.newest {
+						m.newest = it.Timestamp
+					}
+				}
+			}
+			moves = append(moves, m)
+			return true
+		}, bigtable.LimitRows(int64(opts.Batch)))
+		if err != nil {
+			return rep, err
+		}
+		rep.Scanned += int64(n)
+		if len(moves) > 0 {
+			if err := moveBatch(ctx, src, dst, moves, opts, &rep); err != nil {
+				return rep, err
+			}
+		}
+		if opts.Progress != nil {
+			opts.Progress(rep)
+		}
+		if opts.Checkpoint != nil && n > 0 {
+			if err := opts.Checkpoint(after, rep); err != nil {
+				return rep, err
+			}
+		}
+		if n < opts.Batch {
+			return rep, nil
+		}
+	}
+}
+
+func moveBatch(ctx context.Context, src, dst table.Table, moves []move, opts Options, rep *Report) error {
+	if opts.DryRun {
+		for _, m := range moves {
+			rep.Moved++
+			rep.Cells += cells(m.row)
+		}
+		return nil
+	}
+
+	keys := make([]string, len(moves))
+	muts := make([]*bigtable.Mutation, len(moves))
+	for i, m := range moves {
+		keys[i], muts[i] = m.newKey, table.CopyMutation(m.row)
+	}
+	errs, err := dst.ApplyBulk(ctx, keys, muts)
+	if err != nil {
+		return err
+	}
+	for i, e := range errs {
+		if e != nil {
+			return fmt.Errorf("copying %q to %q: %w", moves[i].row.Key(), keys[i], e)
+		}
+	}
+
+	// read the copies back and compare
+	copies := map[string]uint64{}
+	err = dst.ReadRows(ctx, bigtable.RowList(keys), func(r bigtable.Row) bool {
+		copies[r.Key()] = Checksum(r)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	var verified []move
+	for _, m := range moves {
+		rep.SourceSum += m.sum
+		rep.TargetSum += copies[m.newKey]
+		if copies[m.newKey] != m.sum {
+			rep.Mismatched++
+			if len(rep.Mismatches) < 10 {
+				rep.Mismatches = append(rep.Mismatches, m.row.Key())
+			}
+			continue
+		}
+		rep.Moved++
+		rep.Cells += cells(m.row)
+		verified = append(verified, m)
+	}
+	if !opts.DeleteOld {
+		return nil
+	}
+	return deleteOld(ctx, src, verified, opts.Concurrency, rep)
+}
+
+// deleteOld deletes the moved rows unless they have cells newer than the
+// ones that were copied or more cells.
+func deleteOld(ctx context.Context, src table.Table, moves []move, concurrency int, rep *Report) error {
+	var mu sync.Mutex
+	var firstErr error
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for _, m := range moves {
+		m := m
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			del := bigtable.NewMutation()
+			del.DeleteRow()
+			written := false
+			// timestamps have millisecond granularity, newer cells start at
+			// the next millisecond; cells written with older timestamps
+			// show up in the count
+			changed := bigtable.InterleaveFilters(
+				bigtable.TimestampRangeFilterMicros(m.newest.TruncateToMilliseconds()+1000, 0),
+				bigtable.ChainFilters(bigtable.CellsPerRowOffsetFilter(m.cells), bigtable.StripValueFilter()),
+			)
+			cond := bigtable.NewCondMutation(changed, nil, del)
+			err := src.Apply(ctx, m.row.Key(), cond, bigtable.GetCondMutationResult(&written))
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case err != nil && firstErr == nil:
+				firstErr = fmt.Errorf("deleting %q: %w", m.row.Key(), err)
+			case err != nil:
+			case written:
+				rep.Changed++
+			default:
+				rep.Deleted++
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+func cells(r bigtable.Row) int64 {
+	n := 0
+	for _, items := range r {
+		n += len(items)
+	}
+	return int64(n)
+}
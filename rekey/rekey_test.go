@@ -0,0 +1,151 @@
+package rekey
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"bigworkshop/keycodec"
+	"bigworkshop/table/tabletest"
+	"cloud.google.com/go/bigtable"
+)
+
+func codec(t *testing.T, from, to string) Transform {
+	t.Helper()
+	f, err := keycodec.Parse(from, "token:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := keycodec.Parse(to, "token:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return Codec(f, c)
+}
+
+// tokens writes the rows token:id with two versions of a cell each.
+func tokens(t *testing.T, tbl *bigtable.Table, ids ...int) {
+	t.Helper()
+	for _, id := range ids {
+		m := bigtable.NewMutation()
+		m.Set("f", "v", 1000, []byte(fmt.Sprint("old ", id)))
+		m.Set("f", "v", 2000, []byte(fmt.Sprint("new ", id)))
+		if err := tbl.Apply(context.Background(), fmt.Sprint("token:", id), m); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	srv := tabletest.Start(t)
+	tbl := srv.Table(t, "tokens", "f")
+	tokens(t, tbl, 1, 2, 30, 400, 20000)
+	move := codec(t, "plain", "padded-desc:5:10000")
+
+	rep, err := Run(ctx, tbl, tbl, move, Options{Prefix: "token:", DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Moved != 4 || rep.Rejected != 1 || len(tabletest.Keys(t, tbl)) != 5 {
+		t.Errorf("dry run %v, want 4 moved and 1 rejected and no change", rep)
+	}
+
+	rep, err = Run(ctx, tbl, tbl, move, Options{Prefix: "token:", DeleteOld: true, Batch: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Verified() || rep.Moved != 4 || rep.Deleted != 4 || rep.Cells != 8 || rep.Rejected != 1 {
+		t.Errorf("run %v, want 4 rows with 8 cells moved and 1 rejected", rep)
+	}
+	want := []string{"token:09600", "token:09970", "token:09998", "token:09999", "token:20000"}
+	if got := tabletest.Keys(t, tbl); !reflect.DeepEqual(got, want) {
+		t.Errorf("keys %q, want %q", got, want)
+	}
+	r, err := tbl.ReadRow(ctx, "token:09970")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items := r["f"]; len(items) != 2 || string(items[0].Value) != "new 30" || items[1].Timestamp != 1000 {
+		t.Errorf("token:09970 has %v, want both versions of token:30", items)
+	}
+
+	rep, err = Run(ctx, tbl, tbl, move, Options{Prefix: "token:", DeleteOld: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Moved != 0 || rep.Skipped != 4 {
+		t.Errorf("second run %v, want nothing moved", rep)
+	}
+}
+
+func TestRunKeepsOldRows(t *testing.T) {
+	ctx := context.Background()
+	srv := tabletest.Start(t)
+	src, dst := srv.Table(t, "src", "f"), srv.Table(t, "dst", "f")
+	tokens(t, src, 1, 2)
+
+	rep, err := Run(ctx, src, dst, Prefix("token:", "t:"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rep.Verified() || rep.Moved != 2 || rep.Deleted != 0 {
+		t.Errorf("run %v, want 2 copied and none deleted", rep)
+	}
+	if got := tabletest.Keys(t, dst); !reflect.DeepEqual(got, []string{"t:1", "t:2"}) {
+		t.Errorf("copied %q", got)
+	}
+	if got := tabletest.Keys(t, src); len(got) != 2 {
+		t.Errorf("source has %q left, want both rows", got)
+	}
+}
+
+func TestRunContinues(t *testing.T) {
+	ctx := context.Background()
+	srv := tabletest.Start(t)
+	tbl := srv.Table(t, "tokens", "f")
+	tokens(t, tbl, 1, 2, 3, 4, 5)
+	move := codec(t, "plain", "padded:3")
+
+	stop := errors.New("stop")
+	var after string
+	_, err := Run(ctx, tbl, tbl, move, Options{Prefix: "token:", DeleteOld: true, Batch: 2, Checkpoint: func(a string, _ Report) error {
+		after = a
+		return stop
+	}})
+	if err != stop || after != "token:2" {
+		t.Fatalf("first batch stopped with %v after %q", err, after)
+	}
+	rep, err := Run(ctx, tbl, tbl, move, Options{Prefix: "token:", DeleteOld: true, Batch: 2, After: after})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Moved != 3 {
+		t.Errorf("continued run %v, want the other 3 moved", rep)
+	}
+	want := []string{"token:001", "token:002", "token:003", "token:004", "token:005"}
+	if got := tabletest.Keys(t, tbl); !reflect.DeepEqual(got, want) {
+		t.Errorf("keys %q, want %q", got, want)
+	}
+}
+
+func TestCodecRejects(t *testing.T) {
+	move := codec(t, "plain", "padded:3")
+	for _, tc := range []struct {
+		key, want string
+		ok, err   bool
+	}{
+		{"token:7", "token:007", true, false},
+		{"token:007", "", false, false},
+		{"token:07", "", false, false},
+		{"token:1000", "", false, true},
+		{"user:7", "", false, false},
+	} {
+		got, ok, err := move(tc.key)
+		if got != tc.want || ok != tc.ok || (err != nil) != tc.err {
+			t.Errorf("%q: %q, %v, %v", tc.key, got, ok, err)
+		}
+	}
+}
@@ -0,0 +1,215 @@
+// Package replay records bigtable rpcs to a file and serves them back, so
+// tests written against the emulator can run in CI without one and failing
+// sessions can be reproduced exactly.
+//
+// Record by adding the interceptors to the connection:
+//
+//	rec, err := replay.Create("testdata/session.jsonl")
+//	cfg.DialOptions = rec.DialOptions()
+//	... run the test against the emulator ...
+//	rec.Close()
+//
+// Replay by pointing the client at a Server instead of the emulator:
+//
+//	srv, err := replay.Load("testdata/session.jsonl")
+//	lis, _ := net.Listen("tcp", "localhost:0")
+//	go srv.Serve(lis)
+//	cfg.Emulator = lis.Addr().String()
+//
+// The file has one json Call per line, in the order the calls finished.
+package replay
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Call is one recorded rpc. Messages are kept in their proto encoding.
+type Call struct {
+	Method    string     `json:"method"`
+	Requests  [][]byte   `json:"requests"`
+	Responses [][]byte   `json:"responses,omitempty"`
+	Code      codes.Code `json:"code"`
+	Message   string     `json:"message,omitempty"`
+}
+
+// Recorder writes calls made through its interceptors.
+type Recorder struct {
+	mu     sync.Mutex
+	w      *bufio.Writer
+	enc    *json.Encoder
+	closer io.Closer
+	err    error
+	// open streams, finished when the recorder is closed
+	pending map[*recordedStream]bool
+}
+
+// NewRecorder records to w.
+func NewRecorder(w io.Writer) *Recorder {
+	bw := bufio.NewWriter(w)
+	return &Recorder{w: bw, enc: json.NewEncoder(bw), pending: map[*recordedStream]bool{}}
+}
+
+// Create records to a new file at path.
+func Create(path string) (*Recorder, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	r := NewRecorder(f)
+	r.closer = f
+	return r, nil
+}
+
+// DialOptions add the interceptors, for btenv.Config.DialOptions.
+func (r *Recorder) DialOptions() []grpc.DialOption {
+	return []grpc.DialOption{
+		grpc.WithChainUnaryInterceptor(r.UnaryInterceptor),
+		grpc.WithChainStreamInterceptor(r.StreamInterceptor),
+	}
+}
+
+// Close finishes open streams as canceled and flushes the file. It returns
+// the first error writing the file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	var open []*recordedStream
+	for s := range r.pending {
+		open = append(open, s)
+	}
+	r.mu.Unlock()
+	for _, s := range open {
+		s.finish(status.Error(codes.Canceled, "replay: recorder closed"))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.w.Flush(); err != nil && r.err == nil {
+		r.err = err
+	}
+	if r.closer != nil {
+		if err := r.closer.Close(); err != nil && r.err == nil {
+			r.err = err
+		}
+	}
+	return r.err
+}
+
+func (r *Recorder) write(c *Call) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.enc.Encode(c); err != nil && r.err == nil {
+		r.err = err
+	}
+}
+
+func marshal(m interface{}) []byte {
+	pm, ok := m.(proto.Message)
+	if !ok {
+		return nil
+	}
+	b, _ := proto.MarshalOptions{Deterministic: true}.Marshal(pm)
+	return b
+}
+
+func (c *Call) setStatus(err error) {
+	s := status.Convert(err)
+	c.Code, c.Message = s.Code(), s.Message()
+}
+
+// UnaryInterceptor records unary calls.
+func (r *Recorder) UnaryInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	c := &Call{Method: method, Requests: [][]byte{marshal(req)}}
+	if err == nil {
+		c.Responses = [][]byte{marshal(reply)}
+	}
+	c.setStatus(err)
+	r.write(c)
+	return err
+}
+
+// StreamInterceptor records streaming calls, ReadRows and MutateRows among
+// them. A stream is written once it ends, fails or its context is done.
+func (r *Recorder) StreamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	cs, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		c := &Call{Method: method}
+		c.setStatus(err)
+		r.write(c)
+		return nil, err
+	}
+	s := &recordedStream{ClientStream: cs, r: r, call: &Call{Method: method}, done: make(chan struct{})}
+	r.mu.Lock()
+	r.pending[s] = true
+	r.mu.Unlock()
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.finish(ctx.Err())
+		case <-s.done:
+		}
+	}()
+	return s, nil
+}
+
+type recordedStream struct {
+	grpc.ClientStream
+	r    *Recorder
+	once sync.Once
+	done chan struct{}
+
+	mu       sync.Mutex
+	call     *Call
+	finished bool
+}
+
+func (s *recordedStream) SendMsg(m interface{}) error {
+	s.mu.Lock()
+	if !s.finished {
+		s.call.Requests = append(s.call.Requests, marshal(m))
+	}
+	s.mu.Unlock()
+	return s.ClientStream.SendMsg(m)
+}
+
+func (s *recordedStream) RecvMsg(m interface{}) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err == nil {
+		s.mu.Lock()
+		if !s.finished {
+			s.call.Responses = append(s.call.Responses, marshal(m))
+		}
+		s.mu.Unlock()
+		return nil
+	}
+	if err == io.EOF {
+		s.finish(nil)
+	} else {
+		s.finish(err)
+	}
+	return err
+}
+
+func (s *recordedStream) finish(err error) {
+	s.once.Do(func() {
+		close(s.done)
+		s.mu.Lock()
+		s.finished = true
+		s.call.setStatus(err)
+		s.r.write(s.call)
+		s.mu.Unlock()
+		s.r.mu.Lock()
+		delete(s.r.pending, s)
+		s.r.mu.Unlock()
+	})
+}
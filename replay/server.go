@@ -0,0 +1,145 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"bigworkshop/rawgrpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// ReadCalls reads a recording.
+func ReadCalls(r io.Reader) ([]Call, error) {
+	var calls []Call
+	sc := bufio.NewScanner(r)
+	sc.Buffer(nil, 64<<20)
+	for line := 1; sc.Scan(); line++ {
+		if len(bytes.TrimSpace(sc.Bytes())) == 0 {
+			continue
+		}
+		var c Call
+		if err := json.Unmarshal(sc.Bytes(), &c); err != nil {
+			return nil, fmt.Errorf("replay: line %d: %w", line, err)
+		}
+		calls = append(calls, c)
+	}
+	return calls, sc.Err()
+}
+
+// Server serves recorded calls back. An incoming call gets the responses and
+// status of the first unused recorded call with the same method and the
+// same first request. Unless Strict is set, a call without such a match
+// gets the first unused call of the same method, so requests that differ in
+// e.g. a timestamp still replay in recorded order.
+type Server struct {
+	// Strict only replays calls whose request matches exactly.
+	Strict bool
+
+	server *grpc.Server
+
+	mu    sync.Mutex
+	calls []Call
+	used  []bool
+}
+
+// NewServer returns a server for calls.
+func NewServer(calls []Call) *Server {
+	s := &Server{calls: calls, used: make([]bool, len(calls))}
+	s.server = grpc.NewServer(grpc.ForceServerCodec(rawgrpc.Codec{}), grpc.UnknownServiceHandler(s.handle))
+	return s
+}
+
+// Load returns a server for the recording at path.
+func Load(path string) (*Server, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	calls, err := ReadCalls(f)
+	if err != nil {
+		return nil, err
+	}
+	return NewServer(calls), nil
+}
+
+// Serve accepts connections on lis until Close.
+func (s *Server) Serve(lis net.Listener) error {
+	return s.server.Serve(lis)
+}
+
+// Close stops the server.
+func (s *Server) Close() {
+	s.server.Stop()
+}
+
+// Unused returns the recorded calls that were not replayed, a test can check
+// that it made all the calls of the recording.
+func (s *Server) Unused() []Call {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var unused []Call
+	for i, c := range s.calls {
+		if !s.used[i] {
+			unused = append(unused, c)
+		}
+	}
+	return unused
+}
+
+// take marks and returns the recorded call for method and req.
+func (s *Server) take(method string, req []byte) (Call, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fallback := -1
+	for i, c := range s.calls {
+		if s.used[i] || c.Method != method {
+			continue
+		}
+		if len(c.Requests) > 0 && bytes.Equal(c.Requests[0], req) {
+			s.used[i] = true
+			return c, true
+		}
+		if fallback < 0 {
+			fallback = i
+		}
+	}
+	if fallback < 0 || s.Strict {
+		return Call{}, false
+	}
+	s.used[fallback] = true
+	return s.calls[fallback], true
+}
+
+func (s *Server) handle(_ interface{}, ss grpc.ServerStream) error {
+	method, ok := grpc.MethodFromServerStream(ss)
+	if !ok {
+		return status.Error(codes.Internal, "replay: no method")
+	}
+	// bigtable calls send a single request, it identifies the call
+	req := &rawgrpc.Frame{}
+	if err := ss.RecvMsg(req); err != nil && err != io.EOF {
+		return err
+	}
+	c, ok := s.take(method, req.Payload)
+	if !ok {
+		return status.Errorf(codes.FailedPrecondition, "replay: no recorded call left for %s", method)
+	}
+	for _, resp := range c.Responses {
+		if err := ss.SendMsg(&rawgrpc.Frame{Payload: resp}); err != nil {
+			return err
+		}
+	}
+	if c.Code == codes.OK {
+		return nil
+	}
+	return status.Error(c.Code, c.Message)
+}
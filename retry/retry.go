@@ -0,0 +1,336 @@
+// Package retry wraps a table.Table so that transient errors are retried
+// with exponential backoff instead of ending up in a log.Fatalf.
+//
+// Errors are classified by their grpc code: Unavailable, DeadlineExceeded
+// and Aborted are retryable by default, everything else is permanent. Only
+// idempotent operations are retried. Reads are, and so are mutations whose
+// cells carry explicit timestamps. Mutations using bigtable.ServerTime,
+// conditional mutations and ReadModifyWrite would be applied twice if the
+// first attempt reached the server, so they get exactly one attempt.
+package retry
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Class is the classification of an error.
+type Class int
+
+const (
+	// Permanent errors fail the same way when retried.
+	Permanent Class = iota
+	// Retryable errors are transient and may succeed on another attempt.
+	Retryable
+)
+
+func (c Class) String() string {
+	if c == Retryable {
+		return "retryable"
+	}
+	return "permanent"
+}
+
+// DefaultRetryable are the codes retried when Policy.Retryable is empty.
+var DefaultRetryable = []codes.Code{codes.Unavailable, codes.DeadlineExceeded, codes.Aborted}
+
+// Policy configures retries, the zero value is usable.
+type Policy struct {
+	// MaxAttempts is the number of attempts including the first, 5 if zero.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, 50ms if zero.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the wait between attempts, 5s if zero.
+	MaxBackoff time.Duration
+	// Multiplier grows the wait after every attempt, 2 if zero.
+	Multiplier float64
+	// Jitter is the fraction of the wait that is randomized, 0.2 waits
+	// between 80% and 100% of the backoff. 0.5 if zero, negative disables it.
+	Jitter float64
+	// Retryable are the retried codes, DefaultRetryable if empty.
+	Retryable []codes.Code
+	// Budget limits retries across all calls, unlimited if nil.
+	Budget *Budget
+	// OnRetry is called before waiting for a retry.
+	OnRetry func(op string, attempt int, err error, wait time.Duration)
+}
+
+func (p Policy) withDefaults() Policy {
+	if p.MaxAttempts <= 0 {
+		p.MaxAttempts = 5
+	}
+	if p.InitialBackoff <= 0 {
+		p.InitialBackoff = 50 * time.Millisecond
+	}
+	if p.MaxBackoff <= 0 {
+		p.MaxBackoff = 5 * time.Second
+	}
+	if p.Multiplier < 1 {
+		p.Multiplier = 2
+	}
+	switch {
+	case p.Jitter == 0:
+		p.Jitter = 0.5
+	case p.Jitter < 0:
+		p.Jitter = 0
+	case p.Jitter > 1:
+		p.Jitter = 1
+	}
+	if len(p.Retryable) == 0 {
+		p.Retryable = DefaultRetryable
+	}
+	return p
+}
+
+// Classify returns whether err is worth retrying under p. Context errors of
+// the caller are permanent, there is no time left to retry.
+func (p Policy) Classify(err error) Class {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return Permanent
+	}
+	code := codes.Unknown
+	var se interface{ GRPCStatus() *status.Status }
+	if errors.As(err, &se) {
+		code = se.GRPCStatus().Code()
+	}
+	retryable := p.Retryable
+	if len(retryable) == 0 {
+		retryable = DefaultRetryable
+	}
+	for _, c := range retryable {
+		if c == code {
+			return Retryable
+		}
+	}
+	return Permanent
+}
+
+// Classify classifies err with the default policy.
+func Classify(err error) Class {
+	return Policy{}.Classify(err)
+}
+
+// Budget caps retries to a fraction of the calls, so that an outage does not
+// multiply the load on the server by MaxAttempts. Every call earns Ratio
+// tokens, every retry spends one, at most Max tokens are kept.
+type Budget struct {
+	mu     sync.Mutex
+	tokens float64
+	ratio  float64
+	max    float64
+}
+
+// NewBudget returns a full budget, NewBudget(0.1, 10) allows bursts of 10
+// retries and one retry per 10 calls after that.
+func NewBudget(ratio, max float64) *Budget {
+	return &Budget{tokens: max, ratio: ratio, max: max}
+}
+
+func (b *Budget) earn() {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens += b.ratio; b.tokens > b.max {
+		b.tokens = b.max
+	}
+}
+
+func (b *Budget) spend() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Table is a table.Table with retries.
+type Table struct {
+	tbl    table.Table
+	policy Policy
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+var _ table.Table = (*Table)(nil)
+
+// Wrap returns tbl with retries according to p.
+func Wrap(tbl table.Table, p Policy) *Table {
+	return &Table{tbl: tbl, policy: p.withDefaults(), rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+}
+
+// backoff returns the wait before retry number n, starting at 1.
+func (t *Table) backoff(n int) time.Duration {
+	d := float64(t.policy.InitialBackoff)
+	for i := 1; i < n && d < float64(t.policy.MaxBackoff); i++ {
+		d *= t.policy.Multiplier
+	}
+	if d > float64(t.policy.MaxBackoff) {
+		d = float64(t.policy.MaxBackoff)
+	}
+	t.mu.Lock()
+	r := t.rand.Float64()
+	t.mu.Unlock()
+	return time.Duration(d * (1 - t.policy.Jitter*r))
+}
+
+// permanent stops do from retrying an error it would otherwise retry.
+type permanent struct{ err error }
+
+func (p permanent) Error() string { return p.err.Error() }
+
+// do runs f until it succeeds, fails permanently or runs out of attempts.
+// A non idempotent f is run once.
+func (t *Table) do(ctx context.Context, op string, idempotent bool, f func() error) error {
+	t.policy.Budget.earn()
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if p, ok := err.(permanent); ok {
+			return p.err
+		}
+		if err == nil || !idempotent || attempt >= t.policy.MaxAttempts || t.policy.Classify(err) != Retryable {
+			return err
+		}
+		if ctx.Err() != nil || !t.policy.Budget.spend() {
+			return err
+		}
+		wait := t.backoff(attempt)
+		if t.policy.OnRetry != nil {
+			t.policy.OnRetry(op, attempt, err, wait)
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// ReadRows retries until the first row was passed to f. After that a retry
+// would hand rows to f twice, the client already resumes broken streams
+// on its own.
+func (t *Table) ReadRows(ctx context.Context, arg bigtable.RowSet, f func(bigtable.Row) bool, opts ...bigtable.ReadOption) error {
+	delivered := false
+	return t.do(ctx, "ReadRows", true, func() error {
+		err := t.tbl.ReadRows(ctx, arg, func(r bigtable.Row) bool {
+			delivered = true
+			return f(r)
+		}, opts...)
+		if err != nil && delivered {
+			return permanent{err}
+		}
+		return err
+	})
+}
+
+func (t *Table) ReadRow(ctx context.Context, row string, opts ...bigtable.ReadOption) (r bigtable.Row, err error) {
+	err = t.do(ctx, "ReadRow", true, func() error {
+		r, err = t.tbl.ReadRow(ctx, row, opts...)
+		return err
+	})
+	return r, err
+}
+
+func (t *Table) Apply(ctx context.Context, row string, m *bigtable.Mutation, opts ...bigtable.ApplyOption) error {
+	return t.do(ctx, "Apply", table.Idempotent(m), func() error {
+		return t.tbl.Apply(ctx, row, m, opts...)
+	})
+}
+
+// ApplyBulk retries the entries that failed with a retryable error and are
+// idempotent. The returned errors line up with rowKeys like those of
+// *bigtable.Table.
+func (t *Table) ApplyBulk(ctx context.Context, rowKeys []string, muts []*bigtable.Mutation, opts ...bigtable.ApplyOption) ([]error, error) {
+	if len(rowKeys) != len(muts) {
+		return t.tbl.ApplyBulk(ctx, rowKeys, muts, opts...)
+	}
+	idempotent := true
+	for _, m := range muts {
+		idempotent = idempotent && table.Idempotent(m)
+	}
+
+	errs := make([]error, len(muts))
+	pending := make([]int, len(muts))
+	for i := range pending {
+		pending[i] = i
+	}
+	// callErr is set while the last call failed as a whole, got once any
+	// call returned per entry results
+	var callErr error
+	got := false
+	t.do(ctx, "ApplyBulk", true, func() error {
+		keys := make([]string, len(pending))
+		batch := make([]*bigtable.Mutation, len(pending))
+		for j, i := range pending {
+			keys[j], batch[j] = rowKeys[i], muts[i]
+		}
+		berrs, err := t.tbl.ApplyBulk(ctx, keys, batch, opts...)
+		if callErr = err; err != nil {
+			if !idempotent {
+				// nothing is known about which entries were applied
+				return permanent{err}
+			}
+			return err
+		}
+		got = true
+		var retry []int
+		var last error
+		for j, i := range pending {
+			errs[i] = nil
+			if berrs != nil {
+				errs[i] = berrs[j]
+			}
+			if errs[i] != nil && table.Idempotent(muts[i]) && t.policy.Classify(errs[i]) == Retryable {
+				retry = append(retry, i)
+				last = errs[i]
+			}
+		}
+		pending = retry
+		return last
+	})
+	if callErr != nil {
+		if !got {
+			return nil, callErr
+		}
+		for _, i := range pending {
+			errs[i] = callErr
+		}
+	}
+	for _, e := range errs {
+		if e != nil {
+			return errs, nil
+		}
+	}
+	return nil, nil
+}
+
+// ApplyReadModifyWrite is never retried, the rules are not idempotent.
+func (t *Table) ApplyReadModifyWrite(ctx context.Context, row string, m *bigtable.ReadModifyWrite) (bigtable.Row, error) {
+	t.policy.Budget.earn()
+	return t.tbl.ApplyReadModifyWrite(ctx, row, m)
+}
+
+func (t *Table) SampleRowKeys(ctx context.Context) (keys []string, err error) {
+	err = t.do(ctx, "SampleRowKeys", true, func() error {
+		keys, err = t.tbl.SampleRowKeys(ctx)
+		return err
+	})
+	return keys, err
+}
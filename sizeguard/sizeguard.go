@@ -0,0 +1,151 @@
+// Package sizeguard estimates the sizes of mutations and rows and checks
+// them against Bigtable's limits: cells should stay below 10 MB, rows
+// below 100 MB, and a mutation may have at most 100,000 entries.
+//
+//	tbl := sizeguard.Wrap(client.Open("tbl"), "tbl", sizeguard.Options{Reject: true})
+//
+// Wrapped tables log a warning for every mutation and row read over a
+// limit, with Reject mutations over a limit fail with InvalidArgument
+// before they are sent.
+package sizeguard
+
+import (
+	"fmt"
+
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// Bigtable's limits.
+const (
+	MaxCellBytes = 10 << 20
+	MaxRowBytes  = 100 << 20
+	MaxEntries   = 100000
+)
+
+// cellOverhead is what Bigtable stores per cell besides its key, column
+// and value: the timestamp and some framing.
+const cellOverhead = 16
+
+// Estimate is the estimated size of a mutation or row.
+type Estimate struct {
+	// Entries are the operations of a mutation, the cells of a row.
+	Entries int
+	// Cells and Columns are the cells set, or read, and their distinct
+	// columns.
+	Cells, Columns int
+	// Wire is the size of the request or of the read response.
+	Wire int64
+	// Stored is the size the cells take in storage before compression, the
+	// row key is stored with every cell.
+	Stored int64
+	// LargestCell is the size of the largest value, in LargestColumn.
+	LargestCell   int64
+	LargestColumn string
+	// Conditional mutations cannot be looked into, their estimate is
+	// empty.
+	Conditional bool
+}
+
+// Mutation estimates m applied to row.
+func Mutation(row string, m *bigtable.Mutation) Estimate {
+	e := Estimate{Conditional: table.IsConditional(m)}
+	ops := table.Ops(m)
+	e.Entries = len(ops)
+	e.Wire = int64(proto.Size(&btpb.MutateRowRequest{RowKey: []byte(row), Mutations: ops}))
+	cols := map[string]bool{}
+	for _, op := range ops {
+		set := op.GetSetCell()
+		if set == nil {
+			continue
+		}
+		col := set.FamilyName + ":" + string(set.ColumnQualifier)
+		e.add(col, len(row)+len(col)+cellOverhead, len(set.Value))
+		cols[col] = true
+	}
+	e.Columns = len(cols)
+	return e
+}
+
+// Row estimates r.
+func Row(r bigtable.Row) Estimate {
+	var e Estimate
+	for _, items := range r {
+		col := ""
+		for _, it := range items {
+			if it.Column != col {
+				col = it.Column
+				e.Columns++
+			}
+			e.add(it.Column, len(it.Row)+len(it.Column)+cellOverhead, len(it.Value))
+			// a chunk of a ReadRowsResponse per cell, the key is only
+			// sent with the first
+			e.Wire += int64(len(it.Column) + len(it.Value) + len(it.Labels)*8 + cellOverhead)
+		}
+	}
+	e.Entries = e.Cells
+	e.Wire += int64(len(r.Key()))
+	return e
+}
+
+func (e *Estimate) add(col string, overhead, value int) {
+	e.Cells++
+	e.Stored += int64(overhead + value)
+	if int64(value) > e.LargestCell {
+		e.LargestCell, e.LargestColumn = int64(value), col
+	}
+}
+
+// Limits are the sizes Check allows, Bigtable's if zero.
+type Limits struct {
+	CellBytes, RowBytes int64
+	Entries             int
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.CellBytes <= 0 {
+		l.CellBytes = MaxCellBytes
+	}
+	if l.RowBytes <= 0 {
+		l.RowBytes = MaxRowBytes
+	}
+	if l.Entries <= 0 {
+		l.Entries = MaxEntries
+	}
+	return l
+}
+
+// LimitError is returned by Check for an estimate over a limit.
+type LimitError struct {
+	// Limit is cell, row or entries.
+	Limit       string
+	Size, Max   int64
+	Row, Column string
+}
+
+func (e *LimitError) Error() string {
+	if e.Limit == "cell" {
+		return fmt.Sprintf("sizeguard: row %q: cell %s has %d bytes, more than %d", e.Row, e.Column, e.Size, e.Max)
+	}
+	if e.Limit == "entries" {
+		return fmt.Sprintf("sizeguard: row %q: mutation has %d entries, more than %d", e.Row, e.Size, e.Max)
+	}
+	return fmt.Sprintf("sizeguard: row %q has %d bytes, more than %d", e.Row, e.Size, e.Max)
+}
+
+// Check returns a *LimitError if e of row exceeds a limit. A mutation's
+// row size is only what it sets, the cells it adds to are not known.
+func (l Limits) Check(row string, e Estimate) error {
+	l = l.withDefaults()
+	switch {
+	case e.Entries > l.Entries:
+		return &LimitError{Limit: "entries", Size: int64(e.Entries), Max: int64(l.Entries), Row: row}
+	case e.LargestCell > l.CellBytes:
+		return &LimitError{Limit: "cell", Size: e.LargestCell, Max: l.CellBytes, Row: row, Column: e.LargestColumn}
+	case e.Stored > l.RowBytes:
+		return &LimitError{Limit: "row", Size: e.Stored, Max: l.RowBytes, Row: row}
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package sizeguard
+
+import (
+	"context"
+	"sort"
+
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+)
+
+// RowStat is the estimate of a row.
+type RowStat struct {
+	Key string
+	Estimate
+}
+
+// Report summarizes the rows of a scan.
+type Report struct {
+	Rows, Cells int64
+	Bytes       int64
+	// OverLimit are the rows that exceed a limit.
+	OverLimit []RowStat
+	// Largest are the rows with the most bytes, Widest those with the most
+	// columns, most first.
+	Largest, Widest []RowStat
+}
+
+// ScanOptions configure a scan.
+type ScanOptions struct {
+	Limits Limits
+	// Top is the number of largest and widest rows, 10 if zero.
+	Top int
+	// Limit is the number of rows scanned, all if zero.
+	Limit int64
+}
+
+// insert adds s to top, sorted by less, if it is among the first n.
+func insert(top []RowStat, s RowStat, n int, less func(a, b RowStat) bool) []RowStat {
+	if len(top) == n && !less(s, top[n-1]) {
+		return top
+	}
+	i := sort.Search(len(top), func(i int) bool { return less(s, top[i]) })
+	if len(top) < n {
+		top = append(top, RowStat{})
+	}
+	copy(top[i+1:], top[i:])
+	top[i] = s
+	return top
+}
+
+// Scan estimates the rows of rs.
+func Scan(ctx context.Context, tbl table.Table, rs bigtable.RowSet, opts ScanOptions) (Report, error) {
+	var rep Report
+	if opts.Top <= 0 {
+		opts.Top = 10
+	}
+	larger := func(a, b RowStat) bool { return a.Stored > b.Stored }
+	wider := func(a, b RowStat) bool { return a.Columns > b.Columns }
+	var ropts []bigtable.ReadOption
+	if opts.Limit > 0 {
+		ropts = append(ropts, bigtable.LimitRows(opts.Limit))
+	}
+	err := tbl.ReadRows(ctx, rs, func(r bigtable.Row) bool {
+		s := RowStat{Key: r.Key(), Estimate: Row(r)}
+		rep.Rows++
+		rep.Cells += int64(s.Cells)
+		rep.Bytes += s.Stored
+		if opts.Limits.Check(s.Key, s.Estimate) != nil {
+			rep.OverLimit = append(rep.OverLimit, s)
+		}
+		rep.Largest = insert(rep.Largest, s, opts.Top, larger)
+		rep.Widest = insert(rep.Widest, s, opts.Top, wider)
+		return true
+	}, ropts...)
+	return rep, err
+}
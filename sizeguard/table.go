@@ -0,0 +1,143 @@
+package sizeguard
+
+import (
+	"context"
+
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Options configure a guarded table.
+type Options struct {
+	Limits Limits
+	// Reject fails mutations over a limit instead of only warning.
+	Reject bool
+	// Logger receives the warnings, logrus.StandardLogger() if nil.
+	Logger logrus.FieldLogger
+}
+
+// Table checks the mutations and rows of the table it wraps.
+type Table struct {
+	tbl  table.Table
+	name string
+	opts Options
+}
+
+var _ table.Table = (*Table)(nil)
+
+// Wrap returns tbl, named name in the warnings, checked by opts.
+func Wrap(tbl table.Table, name string, opts Options) *Table {
+	if opts.Logger == nil {
+		opts.Logger = logrus.StandardLogger()
+	}
+	return &Table{tbl: tbl, name: name, opts: opts}
+}
+
+func (t *Table) warn(op string, err error, e Estimate) {
+	t.opts.Logger.WithFields(logrus.Fields{
+		"table":   t.name,
+		"op":      op,
+		"entries": e.Entries,
+		"bytes":   e.Stored,
+		"wire":    e.Wire,
+	}).Warn(err.Error())
+}
+
+// checkMutation returns the error of a mutation over a limit if it is
+// rejected.
+func (t *Table) checkMutation(op, row string, m *bigtable.Mutation) error {
+	e := Mutation(row, m)
+	err := t.opts.Limits.Check(row, e)
+	if err == nil {
+		return nil
+	}
+	t.warn(op, err, e)
+	if t.opts.Reject {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	return nil
+}
+
+func (t *Table) checkRow(op string, r bigtable.Row) {
+	if r == nil {
+		return
+	}
+	e := Row(r)
+	if err := t.opts.Limits.Check(r.Key(), e); err != nil {
+		t.warn(op, err, e)
+	}
+}
+
+func (t *Table) ReadRows(ctx context.Context, arg bigtable.RowSet, f func(bigtable.Row) bool, opts ...bigtable.ReadOption) error {
+	return t.tbl.ReadRows(ctx, arg, func(r bigtable.Row) bool {
+		t.checkRow("ReadRows", r)
+		return f(r)
+	}, opts...)
+}
+
+func (t *Table) ReadRow(ctx context.Context, row string, opts ...bigtable.ReadOption) (bigtable.Row, error) {
+	r, err := t.tbl.ReadRow(ctx, row, opts...)
+	if err == nil {
+		t.checkRow("ReadRow", r)
+	}
+	return r, err
+}
+
+func (t *Table) Apply(ctx context.Context, row string, m *bigtable.Mutation, opts ...bigtable.ApplyOption) error {
+	if err := t.checkMutation("Apply", row, m); err != nil {
+		return err
+	}
+	return t.tbl.Apply(ctx, row, m, opts...)
+}
+
+// ApplyBulk fails rejected entries and applies the others.
+func (t *Table) ApplyBulk(ctx context.Context, rowKeys []string, muts []*bigtable.Mutation, opts ...bigtable.ApplyOption) ([]error, error) {
+	var rejected []error
+	var keys []string
+	var pass []*bigtable.Mutation
+	for i, m := range muts {
+		if err := t.checkMutation("ApplyBulk", rowKeys[i], m); err != nil {
+			if rejected == nil {
+				rejected = make([]error, len(muts))
+			}
+			rejected[i] = err
+			continue
+		}
+		keys, pass = append(keys, rowKeys[i]), append(pass, m)
+	}
+	if rejected == nil {
+		return t.tbl.ApplyBulk(ctx, rowKeys, muts, opts...)
+	}
+	if len(keys) == 0 {
+		return rejected, nil
+	}
+	errs, err := t.tbl.ApplyBulk(ctx, keys, pass, opts...)
+	if err != nil {
+		return nil, err
+	}
+	j := 0
+	for i := range rejected {
+		if rejected[i] == nil {
+			if errs != nil {
+				rejected[i] = errs[j]
+			}
+			j++
+		}
+	}
+	return rejected, nil
+}
+
+func (t *Table) ApplyReadModifyWrite(ctx context.Context, row string, m *bigtable.ReadModifyWrite) (bigtable.Row, error) {
+	r, err := t.tbl.ApplyReadModifyWrite(ctx, row, m)
+	if err == nil {
+		t.checkRow("ApplyReadModifyWrite", r)
+	}
+	return r, err
+}
+
+func (t *Table) SampleRowKeys(ctx context.Context) ([]string, error) {
+	return t.tbl.SampleRowKeys(ctx)
+}
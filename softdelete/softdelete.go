@@ -0,0 +1,222 @@
+// Package softdelete wraps a table.Table so that deleted rows can be
+// restored: DeleteRow writes a tombstone cell instead of removing the row,
+// and reads skip rows with a tombstone.
+//
+//	tbl := softdelete.Wrap(client.Open("tbl"), softdelete.Options{})
+//	m := bigtable.NewMutation()
+//	m.DeleteRow()
+//	tbl.Apply(ctx, "token:101", m)      // writes deleted:at
+//	tbl.ReadRow(ctx, "token:101")       // nil row
+//	tbl.Undelete(ctx, "token:101")      // the row is back
+//	n, err := tbl.Reap(ctx, 30*24*time.Hour, softdelete.ReapOptions{})
+//
+// The tombstone family has to exist in the table. Tombstoned rows are
+// filtered on the server with a condition filter, so row limits still
+// count visible rows. Writes to a deleted row are kept but stay hidden
+// until it is undeleted. A DeleteRow followed by writes in one mutation
+// replaces the row and is applied as it is, and conditional mutations are
+// passed through unchanged, their operations cannot be rewritten.
+package softdelete
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"time"
+
+	"bigworkshop/pager"
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+)
+
+// Options name the tombstone column.
+type Options struct {
+	// Family of the tombstone, "deleted" if empty.
+	Family string
+	// Qualifier of the tombstone, "at" if empty.
+	Qualifier string
+}
+
+func (o Options) withDefaults() Options {
+	if o.Family == "" {
+		o.Family = "deleted"
+	}
+	if o.Qualifier == "" {
+		o.Qualifier = "at"
+	}
+	return o
+}
+
+// Table hides soft deleted rows of the table it wraps.
+type Table struct {
+	tbl  table.Table
+	opts Options
+}
+
+var _ table.Table = (*Table)(nil)
+
+// Wrap returns tbl with soft deletes.
+func Wrap(tbl table.Table, opts Options) *Table {
+	return &Table{tbl: tbl, opts: opts.withDefaults()}
+}
+
+// tombstone matches the tombstone cells.
+func (t *Table) tombstone() bigtable.Filter {
+	return bigtable.ChainFilters(
+		bigtable.FamilyFilter("^"+regexp.QuoteMeta(t.opts.Family)+"$"),
+		bigtable.ColumnFilter("^"+regexp.QuoteMeta(t.opts.Qualifier)+"$"),
+	)
+}
+
+// live returns opts with their filter applied to rows without tombstone.
+func (t *Table) live(opts []bigtable.ReadOption) []bigtable.ReadOption {
+	f, rest := table.SplitFilter(opts)
+	if f == nil {
+		f = bigtable.PassAllFilter()
+	}
+	return append(rest, bigtable.RowFilter(bigtable.ConditionFilter(t.tombstone(), bigtable.BlockAllFilter(), f)))
+}
+
+func (t *Table) ReadRows(ctx context.Context, arg bigtable.RowSet, f func(bigtable.Row) bool, opts ...bigtable.ReadOption) error {
+	return t.tbl.ReadRows(ctx, arg, f, t.live(opts)...)
+}
+
+func (t *Table) ReadRow(ctx context.Context, row string, opts ...bigtable.ReadOption) (bigtable.Row, error) {
+	return t.tbl.ReadRow(ctx, row, t.live(opts)...)
+}
+
+// ReadDeleted reads the soft deleted rows of arg, with their tombstones.
+func (t *Table) ReadDeleted(ctx context.Context, arg bigtable.RowSet, f func(bigtable.Row) bool, opts ...bigtable.ReadOption) error {
+	filter, rest := table.SplitFilter(opts)
+	if filter == nil {
+		filter = bigtable.PassAllFilter()
+	}
+	rest = append(rest, bigtable.RowFilter(bigtable.ConditionFilter(t.tombstone(), filter, bigtable.BlockAllFilter())))
+	return t.tbl.ReadRows(ctx, arg, f, rest...)
+}
+
+// DeletedAt returns when a row read by ReadDeleted was deleted.
+func (t *Table) DeletedAt(r bigtable.Row) (time.Time, bool) {
+	col := t.opts.Family + ":" + t.opts.Qualifier
+	for _, it := range r[t.opts.Family] {
+		if it.Column == col {
+			return it.Timestamp.Time(), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// deletion returns the mutation writing a tombstone, the only version of
+// the tombstone column.
+func (t *Table) deletion() *bigtable.Mutation {
+	m := bigtable.NewMutation()
+	m.DeleteCellsInColumn(t.opts.Family, t.opts.Qualifier)
+	m.Set(t.opts.Family, t.opts.Qualifier, bigtable.Now(), nil)
+	return m
+}
+
+// rewrite turns a mutation ending in DeleteRow into a tombstone.
+func (t *Table) rewrite(m *bigtable.Mutation) *bigtable.Mutation {
+	if table.IsConditional(m) {
+		return m
+	}
+	ops := table.Ops(m)
+	if len(ops) == 0 {
+		return m
+	}
+	if _, del := ops[len(ops)-1].Mutation.(*btpb.Mutation_DeleteFromRow_); !del {
+		return m
+	}
+	return t.deletion()
+}
+
+func (t *Table) Apply(ctx context.Context, row string, m *bigtable.Mutation, opts ...bigtable.ApplyOption) error {
+	return t.tbl.Apply(ctx, row, t.rewrite(m), opts...)
+}
+
+func (t *Table) ApplyBulk(ctx context.Context, rowKeys []string, muts []*bigtable.Mutation, opts ...bigtable.ApplyOption) ([]error, error) {
+	rewritten := make([]*bigtable.Mutation, len(muts))
+	for i, m := range muts {
+		rewritten[i] = t.rewrite(m)
+	}
+	return t.tbl.ApplyBulk(ctx, rowKeys, rewritten, opts...)
+}
+
+func (t *Table) ApplyReadModifyWrite(ctx context.Context, row string, m *bigtable.ReadModifyWrite) (bigtable.Row, error) {
+	return t.tbl.ApplyReadModifyWrite(ctx, row, m)
+}
+
+func (t *Table) SampleRowKeys(ctx context.Context) ([]string, error) {
+	return t.tbl.SampleRowKeys(ctx)
+}
+
+// Delete soft deletes a row.
+func (t *Table) Delete(ctx context.Context, row string) error {
+	return t.tbl.Apply(ctx, row, t.deletion())
+}
+
+// Undelete removes the tombstone of a row, its cells are visible again.
+func (t *Table) Undelete(ctx context.Context, row string) error {
+	m := bigtable.NewMutation()
+	m.DeleteCellsInColumn(t.opts.Family, t.opts.Qualifier)
+	return t.tbl.Apply(ctx, row, m)
+}
+
+// ReapOptions limit a reap.
+type ReapOptions struct {
+	// Prefix, or Start and End, limit the scan, the whole table if empty.
+	Prefix     string
+	Start, End string
+	// DryRun only counts the rows that would be deleted.
+	DryRun bool
+	// Batch is the number of rows read at a time, 500 if zero.
+	Batch int
+}
+
+// Reap hard deletes the rows deleted more than retention ago and returns
+// how many. Every row is deleted with a condition on its tombstone, rows
+// undeleted or deleted again since the scan are kept.
+func (t *Table) Reap(ctx context.Context, retention time.Duration, opts ReapOptions) (int64, error) {
+	if opts.Batch <= 0 {
+		opts.Batch = 500
+	}
+	cutoff := bigtable.Time(time.Now().Add(-retention)).TruncateToMilliseconds()
+	if cutoff <= 0 {
+		return 0, fmt.Errorf("softdelete: retention %v reaches before 1970", retention)
+	}
+	expired := bigtable.ChainFilters(t.tombstone(), bigtable.TimestampRangeFilterMicros(0, cutoff))
+
+	var reaped int64
+	after := ""
+	for {
+		var keys []string
+		err := t.tbl.ReadRows(ctx, pager.ResumeRange(opts.Prefix, opts.Start, opts.End, after), func(r bigtable.Row) bool {
+			keys = append(keys, r.Key())
+			return true
+		}, bigtable.RowFilter(bigtable.ChainFilters(expired, bigtable.StripValueFilter())), bigtable.LimitRows(int64(opts.Batch)))
+		if err != nil {
+			return reaped, err
+		}
+		for _, key := range keys {
+			if opts.DryRun {
+				reaped++
+				continue
+			}
+			del := bigtable.NewMutation()
+			del.DeleteRow()
+			matched := false
+			err := t.tbl.Apply(ctx, key, bigtable.NewCondMutation(expired, del, nil), bigtable.GetCondMutationResult(&matched))
+			if err != nil {
+				return reaped, fmt.Errorf("deleting %q: %w", key, err)
+			}
+			if matched {
+				reaped++
+			}
+		}
+		if len(keys) < opts.Batch {
+			return reaped, nil
+		}
+		after = keys[len(keys)-1]
+	}
+}
@@ -0,0 +1,116 @@
+package table
+
+import (
+	"reflect"
+
+	"cloud.google.com/go/bigtable"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+)
+
+var filterPkg = reflect.TypeOf(bigtable.PassAllFilter()).PkgPath()
+
+// FilterProto returns the request proto of f, false for filters it does
+// not know. The client builds it with an unexported method, so it is
+// rebuilt here from the filter's fields like the client does.
+func FilterProto(f bigtable.Filter) (*btpb.RowFilter, bool) {
+	if f == nil {
+		return nil, false
+	}
+	return filterProto(reflect.ValueOf(f))
+}
+
+func filterProto(v reflect.Value) (*btpb.RowFilter, bool) {
+	if v.Kind() == reflect.Interface {
+		v = v.Elem()
+	}
+	if !v.IsValid() || v.Type().PkgPath() != filterPkg {
+		return nil, false
+	}
+	field := func(name string) reflect.Value { return v.FieldByName(name) }
+	subs := func() ([]*btpb.RowFilter, bool) {
+		sub := field("sub")
+		out := make([]*btpb.RowFilter, sub.Len())
+		for i := range out {
+			p, ok := filterProto(sub.Index(i))
+			if !ok {
+				return nil, false
+			}
+			out[i] = p
+		}
+		return out, true
+	}
+
+	switch v.Type().Name() {
+	case "chainFilter":
+		fs, ok := subs()
+		return &btpb.RowFilter{Filter: &btpb.RowFilter_Chain_{Chain: &btpb.RowFilter_Chain{Filters: fs}}}, ok
+	case "interleaveFilter":
+		fs, ok := subs()
+		return &btpb.RowFilter{Filter: &btpb.RowFilter_Interleave_{Interleave: &btpb.RowFilter_Interleave{Filters: fs}}}, ok
+	case "rowKeyFilter":
+		return &btpb.RowFilter{Filter: &btpb.RowFilter_RowKeyRegexFilter{RowKeyRegexFilter: []byte(v.String())}}, true
+	case "familyFilter":
+		return &btpb.RowFilter{Filter: &btpb.RowFilter_FamilyNameRegexFilter{FamilyNameRegexFilter: v.String()}}, true
+	case "columnFilter":
+		return &btpb.RowFilter{Filter: &btpb.RowFilter_ColumnQualifierRegexFilter{ColumnQualifierRegexFilter: []byte(v.String())}}, true
+	case "valueFilter":
+		return &btpb.RowFilter{Filter: &btpb.RowFilter_ValueRegexFilter{ValueRegexFilter: []byte(v.String())}}, true
+	case "latestNFilter":
+		return &btpb.RowFilter{Filter: &btpb.RowFilter_CellsPerColumnLimitFilter{CellsPerColumnLimitFilter: int32(v.Int())}}, true
+	case "labelFilter":
+		return &btpb.RowFilter{Filter: &btpb.RowFilter_ApplyLabelTransformer{ApplyLabelTransformer: v.String()}}, true
+	case "stripValueFilter":
+		return &btpb.RowFilter{Filter: &btpb.RowFilter_StripValueTransformer{StripValueTransformer: true}}, true
+	case "timestampRangeFilter":
+		return &btpb.RowFilter{Filter: &btpb.RowFilter_TimestampRangeFilter{TimestampRangeFilter: &btpb.TimestampRange{
+			StartTimestampMicros: int64(bigtable.Timestamp(field("startTime").Int()).TruncateToMilliseconds()),
+			EndTimestampMicros:   int64(bigtable.Timestamp(field("endTime").Int()).TruncateToMilliseconds()),
+		}}}, true
+	case "columnRangeFilter":
+		r := &btpb.ColumnRange{FamilyName: field("family").String()}
+		if s := field("start").String(); s != "" {
+			r.StartQualifier = &btpb.ColumnRange_StartQualifierClosed{StartQualifierClosed: []byte(s)}
+		}
+		if e := field("end").String(); e != "" {
+			r.EndQualifier = &btpb.ColumnRange_EndQualifierOpen{EndQualifierOpen: []byte(e)}
+		}
+		return &btpb.RowFilter{Filter: &btpb.RowFilter_ColumnRangeFilter{ColumnRangeFilter: r}}, true
+	case "valueRangeFilter":
+		r := &btpb.ValueRange{}
+		if s := field("start"); !s.IsNil() {
+			r.StartValue = &btpb.ValueRange_StartValueClosed{StartValueClosed: append([]byte(nil), s.Bytes()...)}
+		}
+		if e := field("end"); !e.IsNil() {
+			r.EndValue = &btpb.ValueRange_EndValueOpen{EndValueOpen: append([]byte(nil), e.Bytes()...)}
+		}
+		return &btpb.RowFilter{Filter: &btpb.RowFilter_ValueRangeFilter{ValueRangeFilter: r}}, true
+	case "conditionFilter":
+		c := &btpb.RowFilter_Condition{}
+		var ok bool
+		if c.PredicateFilter, ok = filterProto(field("predicateFilter")); !ok {
+			return nil, false
+		}
+		for _, b := range []struct {
+			name string
+			dst  **btpb.RowFilter
+		}{{"trueFilter", &c.TrueFilter}, {"falseFilter", &c.FalseFilter}} {
+			if f := field(b.name); !f.IsNil() {
+				if *b.dst, ok = filterProto(f); !ok {
+					return nil, false
+				}
+			}
+		}
+		return &btpb.RowFilter{Filter: &btpb.RowFilter_Condition_{Condition: c}}, true
+	case "cellsPerRowOffsetFilter":
+		return &btpb.RowFilter{Filter: &btpb.RowFilter_CellsPerRowOffsetFilter{CellsPerRowOffsetFilter: int32(v.Int())}}, true
+	case "cellsPerRowLimitFilter":
+		return &btpb.RowFilter{Filter: &btpb.RowFilter_CellsPerRowLimitFilter{CellsPerRowLimitFilter: int32(v.Int())}}, true
+	case "rowSampleFilter":
+		return &btpb.RowFilter{Filter: &btpb.RowFilter_RowSampleFilter{RowSampleFilter: v.Float()}}, true
+	case "passAllFilter":
+		return &btpb.RowFilter{Filter: &btpb.RowFilter_PassAllFilter{PassAllFilter: true}}, true
+	case "blockAllFilter":
+		return &btpb.RowFilter{Filter: &btpb.RowFilter_BlockAllFilter{BlockAllFilter: true}}, true
+	}
+	return nil, false
+}
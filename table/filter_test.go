@@ -0,0 +1,60 @@
+package table
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestFilterProto(t *testing.T) {
+	w := newWire(t)
+	ctx := context.Background()
+	filters := map[string]bigtable.Filter{
+		"chain":        bigtable.ChainFilters(bigtable.FamilyFilter("f"), bigtable.LatestNFilter(2)),
+		"interleave":   bigtable.InterleaveFilters(bigtable.ColumnFilter("a"), bigtable.ValueFilter("v")),
+		"row key":      bigtable.RowKeyFilter("r.*"),
+		"label":        bigtable.LabelFilter("l"),
+		"strip value":  bigtable.StripValueFilter(),
+		"timestamps":   bigtable.TimestampRangeFilterMicros(1234, 5678000),
+		"columns":      bigtable.ColumnRangeFilter("f", "a", "c"),
+		"open columns": bigtable.ColumnRangeFilter("f", "", ""),
+		"values":       bigtable.ValueRangeFilter([]byte("a"), []byte("c")),
+		"open values":  bigtable.ValueRangeFilter(nil, nil),
+		"condition":    bigtable.ConditionFilter(bigtable.ColumnFilter("a"), bigtable.PassAllFilter(), bigtable.BlockAllFilter()),
+		"no else":      bigtable.ConditionFilter(bigtable.ColumnFilter("a"), bigtable.StripValueFilter(), nil),
+		"offset":       bigtable.CellsPerRowOffsetFilter(2),
+		"limit":        bigtable.CellsPerRowLimitFilter(3),
+		"sample":       bigtable.RowSampleFilter(0.5),
+		"pass all":     bigtable.PassAllFilter(),
+		"block all":    bigtable.BlockAllFilter(),
+	}
+	for name, f := range filters {
+		// the request is recorded whether or not bttest supports the filter
+		w.tbl.ReadRows(ctx, bigtable.InfiniteRange(""), func(bigtable.Row) bool { return true }, bigtable.RowFilter(f))
+		req, ok := w.last(t).(*btpb.ReadRowsRequest)
+		if !ok {
+			t.Fatalf("%s: sent %T", name, w.last(t))
+		}
+		p, ok := FilterProto(f)
+		if !ok {
+			t.Errorf("%s: FilterProto does not know %T", name, f)
+			continue
+		}
+		if !proto.Equal(p, req.Filter) {
+			t.Errorf("%s: FilterProto = %v, sent %v", name, p, req.Filter)
+		}
+	}
+}
+
+type unknownFilter struct{ bigtable.Filter }
+
+func TestFilterProtoUnknown(t *testing.T) {
+	for _, f := range []bigtable.Filter{nil, unknownFilter{}, bigtable.ChainFilters(bigtable.PassAllFilter(), unknownFilter{})} {
+		if p, ok := FilterProto(f); ok {
+			t.Errorf("FilterProto(%v) = %v, want false", f, p)
+		}
+	}
+}
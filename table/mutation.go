@@ -0,0 +1,132 @@
+package table
+
+import (
+	"reflect"
+	"strings"
+	"unsafe"
+
+	"cloud.google.com/go/bigtable"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+)
+
+// bigtable.Mutation keeps its operations unexported. The wrappers need to
+// look at them, so they are read with reflect. The field names are checked
+// once here so that a client upgrade that renames them fails loudly, and
+// go.mod pins the client version; the tests compare the accessors with the
+// requests the client sends, run them before moving the pin.
+var (
+	mutationOps  = field(reflect.TypeOf(bigtable.Mutation{}), "ops", reflect.TypeOf([]*btpb.Mutation(nil)))
+	mutationCond = field(reflect.TypeOf(bigtable.Mutation{}), "cond", reflect.TypeOf((*bigtable.Filter)(nil)).Elem())
+	mutationTrue = field(reflect.TypeOf(bigtable.Mutation{}), "mtrue", reflect.TypeOf((*bigtable.Mutation)(nil)))
+	mutationElse = field(reflect.TypeOf(bigtable.Mutation{}), "mfalse", reflect.TypeOf((*bigtable.Mutation)(nil)))
+)
+
+func field(t reflect.Type, name string, want reflect.Type) uintptr {
+	f, ok := t.FieldByName(name)
+	if !ok || f.Type != want {
+		panic("table: unsupported bigtable client, " + t.String() + "." + name + " changed")
+	}
+	return f.Offset
+}
+
+// Ops returns the operations of m. They must not be modified. A conditional
+// mutation has no operations of its own.
+func Ops(m *bigtable.Mutation) []*btpb.Mutation {
+	if m == nil {
+		return nil
+	}
+	return *(*[]*btpb.Mutation)(unsafe.Pointer(uintptr(unsafe.Pointer(m)) + mutationOps))
+}
+
+// IsConditional reports whether m was created with bigtable.NewCondMutation.
+func IsConditional(m *bigtable.Mutation) bool {
+	if m == nil {
+		return false
+	}
+	return *(*bigtable.Filter)(unsafe.Pointer(uintptr(unsafe.Pointer(m)) + mutationCond)) != nil
+}
+
+// Cond returns the condition and the mutations of a conditional mutation,
+// to rebuild it with bigtable.NewCondMutation. The mutations may be nil.
+func Cond(m *bigtable.Mutation) (cond bigtable.Filter, mtrue, mfalse *bigtable.Mutation) {
+	return *(*bigtable.Filter)(unsafe.Pointer(uintptr(unsafe.Pointer(m)) + mutationCond)),
+		*(**bigtable.Mutation)(unsafe.Pointer(uintptr(unsafe.Pointer(m)) + mutationTrue)),
+		*(**bigtable.Mutation)(unsafe.Pointer(uintptr(unsafe.Pointer(m)) + mutationElse))
+}
+
+// Idempotent reports whether applying m twice has the same effect as
+// applying it once. That is not the case for conditional mutations, whose
+// condition may change in between, and for cells set with
+// bigtable.ServerTime, which get a new version on every attempt.
+func Idempotent(m *bigtable.Mutation) bool {
+	if IsConditional(m) {
+		return false
+	}
+	for _, op := range Ops(m) {
+		if set := op.GetSetCell(); set != nil && set.TimestampMicros == int64(bigtable.ServerTime) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewMutation builds a mutation from operations, e.g. ones returned by Ops
+// and then rewritten.
+func NewMutation(ops []*btpb.Mutation) *bigtable.Mutation {
+	m := bigtable.NewMutation()
+	for _, op := range ops {
+		switch o := op.Mutation.(type) {
+		case *btpb.Mutation_SetCell_:
+			c := o.SetCell
+			m.Set(c.FamilyName, string(c.ColumnQualifier), bigtable.Timestamp(c.TimestampMicros), c.Value)
+		case *btpb.Mutation_DeleteFromColumn_:
+			c := o.DeleteFromColumn
+			if r := c.TimeRange; r != nil {
+				m.DeleteTimestampRange(c.FamilyName, string(c.ColumnQualifier),
+					bigtable.Timestamp(r.StartTimestampMicros), bigtable.Timestamp(r.EndTimestampMicros))
+			} else {
+				m.DeleteCellsInColumn(c.FamilyName, string(c.ColumnQualifier))
+			}
+		case *btpb.Mutation_DeleteFromFamily_:
+			m.DeleteCellsInFamily(o.DeleteFromFamily.FamilyName)
+		case *btpb.Mutation_DeleteFromRow_:
+			m.DeleteRow()
+		}
+	}
+	return m
+}
+
+// MutationSize is the number of bytes m sets: families, qualifiers and values.
+func MutationSize(m *bigtable.Mutation) int {
+	n := 0
+	for _, op := range Ops(m) {
+		if set := op.GetSetCell(); set != nil {
+			n += len(set.FamilyName) + len(set.ColumnQualifier) + len(set.Value)
+		}
+	}
+	return n
+}
+
+// RowSize is the number of bytes of r: its key, columns and values.
+func RowSize(r bigtable.Row) int {
+	n := len(r.Key())
+	for _, items := range r {
+		for _, it := range items {
+			n += len(it.Column) + len(it.Value)
+		}
+	}
+	return n
+}
+
+// CopyMutation returns a mutation that writes every cell of r with its
+// timestamp, to copy the row to another key or table. Labels of filtered
+// reads are not copied.
+func CopyMutation(r bigtable.Row) *bigtable.Mutation {
+	m := bigtable.NewMutation()
+	for fam, items := range r {
+		for _, it := range items {
+			m.Set(fam, strings.TrimPrefix(it.Column, fam+":"), it.Timestamp, it.Value)
+		}
+	}
+	return m
+}
@@ -0,0 +1,183 @@
+package table
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"cloud.google.com/go/bigtable/bttest"
+	"google.golang.org/api/option"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+	"google.golang.org/grpc"
+	"google.golang.org/protobuf/proto"
+)
+
+// wire is a bttest server whose client records the requests it sends, to
+// compare the accessors with what the client puts on the wire.
+type wire struct {
+	tbl *bigtable.Table
+
+	mu   sync.Mutex
+	sent []proto.Message
+}
+
+func newWire(t *testing.T) *wire {
+	t.Helper()
+	ctx := context.Background()
+	srv, err := bttest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(srv.Close)
+	w := &wire{}
+	conn, err := grpc.Dial(srv.Addr, grpc.WithInsecure(),
+		grpc.WithUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+			w.record(req)
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}),
+		grpc.WithStreamInterceptor(func(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+			s, err := streamer(ctx, desc, cc, method, opts...)
+			return recordStream{s, w}, err
+		}),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	admin, err := bigtable.NewAdminClient(ctx, "test", "test", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.CreateTable(ctx, "t"); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.CreateColumnFamily(ctx, "t", "f"); err != nil {
+		t.Fatal(err)
+	}
+	client, err := bigtable.NewClient(ctx, "test", "test", option.WithGRPCConn(conn))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.tbl = client.Open("t")
+	return w
+}
+
+type recordStream struct {
+	grpc.ClientStream
+	w *wire
+}
+
+func (s recordStream) SendMsg(m interface{}) error {
+	s.w.record(m)
+	return s.ClientStream.SendMsg(m)
+}
+
+func (w *wire) record(req interface{}) {
+	if m, ok := req.(proto.Message); ok {
+		w.mu.Lock()
+		w.sent = append(w.sent, proto.Clone(m))
+		w.mu.Unlock()
+	}
+}
+
+// last returns the last request sent.
+func (w *wire) last(t *testing.T) proto.Message {
+	t.Helper()
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if len(w.sent) == 0 {
+		t.Fatal("no request sent")
+	}
+	return w.sent[len(w.sent)-1]
+}
+
+func equalOps(a, b []*btpb.Mutation) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !proto.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func testMutations() map[string]*bigtable.Mutation {
+	set := bigtable.NewMutation()
+	set.Set("f", "a", 1000, []byte("v"))
+	set.Set("f", "b", 2000, nil)
+	deletes := bigtable.NewMutation()
+	deletes.DeleteCellsInColumn("f", "a")
+	deletes.DeleteTimestampRange("f", "b", 1000, 3000)
+	deletes.DeleteCellsInFamily("f")
+	deletes.DeleteRow()
+	serverTime := bigtable.NewMutation()
+	serverTime.Set("f", "a", bigtable.ServerTime, []byte("v"))
+	return map[string]*bigtable.Mutation{"set": set, "deletes": deletes, "server time": serverTime}
+}
+
+func TestOps(t *testing.T) {
+	w := newWire(t)
+	ctx := context.Background()
+	for name, m := range testMutations() {
+		if err := w.tbl.Apply(ctx, "r", m); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		req, ok := w.last(t).(*btpb.MutateRowRequest)
+		if !ok {
+			t.Fatalf("%s: sent %T", name, w.last(t))
+		}
+		if !equalOps(Ops(m), req.Mutations) {
+			t.Errorf("%s: Ops = %v, sent %v", name, Ops(m), req.Mutations)
+		}
+		if rebuilt := NewMutation(Ops(m)); !equalOps(Ops(rebuilt), req.Mutations) {
+			t.Errorf("%s: NewMutation(Ops) = %v, sent %v", name, Ops(rebuilt), req.Mutations)
+		}
+		if IsConditional(m) {
+			t.Errorf("%s is conditional", name)
+		}
+		if got, want := Idempotent(m), name != "server time"; got != want {
+			t.Errorf("Idempotent(%s) = %v, want %v", name, got, want)
+		}
+	}
+}
+
+func TestCond(t *testing.T) {
+	w := newWire(t)
+	ctx := context.Background()
+	muts := testMutations()
+	for name, m := range map[string]*bigtable.Mutation{
+		"true and false": bigtable.NewCondMutation(bigtable.ColumnFilter("a"), muts["set"], muts["deletes"]),
+		"true only":      bigtable.NewCondMutation(bigtable.ValueFilter("v"), muts["set"], nil),
+		"false only":     bigtable.NewCondMutation(bigtable.LatestNFilter(1), nil, muts["deletes"]),
+	} {
+		if err := w.tbl.Apply(ctx, "r", m); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		req, ok := w.last(t).(*btpb.CheckAndMutateRowRequest)
+		if !ok {
+			t.Fatalf("%s: sent %T", name, w.last(t))
+		}
+		if !IsConditional(m) || Idempotent(m) {
+			t.Errorf("%s: conditional %v, idempotent %v", name, IsConditional(m), Idempotent(m))
+		}
+		if len(Ops(m)) != 0 {
+			t.Errorf("%s: Ops = %v, want none", name, Ops(m))
+		}
+		cond, mtrue, mfalse := Cond(m)
+		if p, ok := FilterProto(cond); !ok || !proto.Equal(p, req.PredicateFilter) {
+			t.Errorf("%s: condition %v, sent %v", name, p, req.PredicateFilter)
+		}
+		if !equalOps(Ops(mtrue), req.TrueMutations) || !equalOps(Ops(mfalse), req.FalseMutations) {
+			t.Errorf("%s: mutations %v and %v, sent %v and %v", name, Ops(mtrue), Ops(mfalse), req.TrueMutations, req.FalseMutations)
+		}
+	}
+}
+
+func TestNilMutation(t *testing.T) {
+	if Ops(nil) != nil || IsConditional(nil) || !Idempotent(nil) {
+		t.Error("nil mutation has operations or is conditional")
+	}
+}
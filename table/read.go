@@ -0,0 +1,32 @@
+package table
+
+import (
+	"reflect"
+	"unsafe"
+
+	"cloud.google.com/go/bigtable"
+)
+
+// The filter of bigtable.RowFilter is unexported as well.
+var (
+	rowFilterType   = reflect.TypeOf(bigtable.RowFilter(bigtable.PassAllFilter()))
+	rowFilterFilter = field(rowFilterType, "f", reflect.TypeOf((*bigtable.Filter)(nil)).Elem())
+)
+
+// SplitFilter returns the filter set by a bigtable.RowFilter option, nil if
+// there is none, and the other options. Like the client, it takes the last
+// filter if there are several.
+func SplitFilter(opts []bigtable.ReadOption) (bigtable.Filter, []bigtable.ReadOption) {
+	var f bigtable.Filter
+	var rest []bigtable.ReadOption
+	for _, o := range opts {
+		if reflect.TypeOf(o) != rowFilterType {
+			rest = append(rest, o)
+			continue
+		}
+		v := reflect.New(rowFilterType).Elem()
+		v.Set(reflect.ValueOf(o))
+		f = *(*bigtable.Filter)(unsafe.Pointer(uintptr(v.Addr().UnsafePointer()) + rowFilterFilter))
+	}
+	return f, rest
+}
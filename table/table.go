@@ -0,0 +1,24 @@
+// Package table defines the Table interface shared by the wrappers in this
+// module. *bigtable.Table implements it, so wrappers can be stacked:
+//
+//	var tbl table.Table = client.Open("tokens")
+//	tbl = retry.Wrap(tbl, retry.Policy{})
+package table
+
+import (
+	"context"
+
+	"cloud.google.com/go/bigtable"
+)
+
+// Table is the data api of *bigtable.Table.
+type Table interface {
+	ReadRows(ctx context.Context, arg bigtable.RowSet, f func(bigtable.Row) bool, opts ...bigtable.ReadOption) error
+	ReadRow(ctx context.Context, row string, opts ...bigtable.ReadOption) (bigtable.Row, error)
+	Apply(ctx context.Context, row string, m *bigtable.Mutation, opts ...bigtable.ApplyOption) error
+	ApplyBulk(ctx context.Context, rowKeys []string, muts []*bigtable.Mutation, opts ...bigtable.ApplyOption) ([]error, error)
+	ApplyReadModifyWrite(ctx context.Context, row string, m *bigtable.ReadModifyWrite) (bigtable.Row, error)
+	SampleRowKeys(ctx context.Context) ([]string, error)
+}
+
+var _ Table = (*bigtable.Table)(nil)
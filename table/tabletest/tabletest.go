@@ -0,0 +1,80 @@
+// Package tabletest starts a bttest server for the tests of the packages
+// built on table.Table, so they need no emulator:
+//
+//	srv := tabletest.Start(t)
+//	tbl := srv.Table(t, "docs", "blob")
+//	store := blob.New(tbl, blob.Options{})
+//
+// The server and its clients are closed when the test ends.
+package tabletest
+
+import (
+	"context"
+	"testing"
+
+	"cloud.google.com/go/bigtable"
+	"cloud.google.com/go/bigtable/bttest"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+)
+
+// Server is a bttest server with clients.
+type Server struct {
+	Data  *bigtable.Client
+	Admin *bigtable.AdminClient
+}
+
+// Start starts a bttest server, stopped with its clients at the end of t.
+func Start(t testing.TB) *Server {
+	t.Helper()
+	ctx := context.Background()
+	bt, err := bttest.NewServer("localhost:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(bt.Close)
+	conn, err := grpc.Dial(bt.Addr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	s := &Server{}
+	if s.Data, err = bigtable.NewClient(ctx, "test", "test", option.WithGRPCConn(conn)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Data.Close() })
+	if s.Admin, err = bigtable.NewAdminClient(ctx, "test", "test", option.WithGRPCConn(conn)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Admin.Close() })
+	return s
+}
+
+// Table creates a table with families and opens it.
+func (s *Server) Table(t testing.TB, name string, families ...string) *bigtable.Table {
+	t.Helper()
+	ctx := context.Background()
+	if err := s.Admin.CreateTable(ctx, name); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range families {
+		if err := s.Admin.CreateColumnFamily(ctx, name, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s.Data.Open(name)
+}
+
+// Keys returns the row keys of tbl.
+func Keys(t testing.TB, tbl *bigtable.Table) []string {
+	t.Helper()
+	var keys []string
+	err := tbl.ReadRows(context.Background(), bigtable.InfiniteRange(""), func(r bigtable.Row) bool {
+		keys = append(keys, r.Key())
+		return true
+	}, bigtable.RowFilter(bigtable.StripValueFilter()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys
+}
@@ -0,0 +1,265 @@
+// Package tablecopy copies tables between instances or within one, e.g. a
+// slice of production into the emulator or tbl into tbl_backup.
+//
+// Schema creates the destination with the families and gc policies of the
+// source, Run copies the rows with every cell version and its timestamp.
+// Run splits the key range into shards at keys SampleRowKeys returns and
+// copies them in parallel; wrap the destination with ratelimit to keep the
+// writes from overwhelming it:
+//
+//	splits, err := tablecopy.SampleKeys(ctx, src, opts)
+//	err = tablecopy.Schema(ctx, srcAdmin, "tbl", dstAdmin, "tbl_backup", splits)
+//	dst := lim.Wrap(dstClient.Open("tbl_backup"), "tbl_backup")
+//	rep, err := tablecopy.Run(ctx, src, dst, opts)
+package tablecopy
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"bigworkshop/pager"
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+)
+
+// Schema creates dstTable, split at splits, unless it exists and adds the
+// families of srcTable it lacks, with their gc policies.
+func Schema(ctx context.Context, src *bigtable.AdminClient, srcTable string, dst *bigtable.AdminClient, dstTable string, splits []string) error {
+	info, err := src.TableInfo(ctx, srcTable)
+	if err != nil {
+		return fmt.Errorf("reading schema of %s: %w", srcTable, err)
+	}
+	tables, err := dst.Tables(ctx)
+	if err != nil {
+		return err
+	}
+	exists := false
+	for _, t := range tables {
+		exists = exists || t == dstTable
+	}
+	if !exists {
+		conf := &bigtable.TableConf{TableID: dstTable, SplitKeys: splits, Families: map[string]bigtable.GCPolicy{}}
+		for _, f := range info.FamilyInfos {
+			conf.Families[f.Name] = f.FullGCPolicy
+		}
+		return dst.CreateTableFromConf(ctx, conf)
+	}
+
+	have, err := dst.TableInfo(ctx, dstTable)
+	if err != nil {
+		return err
+	}
+	seen := map[string]bool{}
+	for _, f := range have.FamilyInfos {
+		seen[f.Name] = true
+	}
+	for _, f := range info.FamilyInfos {
+		if seen[f.Name] {
+			continue
+		}
+		if err := dst.CreateColumnFamily(ctx, dstTable, f.Name); err != nil {
+			return err
+		}
+		if err := dst.SetGCPolicy(ctx, dstTable, f.Name, f.FullGCPolicy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Options configure a copy.
+type Options struct {
+	// Prefix, or Start and End, limit the copy, the whole table if empty.
+	Prefix     string
+	Start, End string
+	// Filter of the reads, every cell version if nil.
+	Filter bigtable.Filter
+	// Transform is called for every row read and returns the key and cells
+	// to write, an empty row to skip it. Rows are copied as they are if nil.
+	Transform func(r bigtable.Row) (string, bigtable.Row, error)
+	// Shards is the number of key ranges copied in parallel, 8 if zero.
+	Shards int
+	// Batch is the number of rows per ApplyBulk, 500 if zero.
+	Batch int
+	// Progress is called after every batch with the report so far.
+	Progress func(Report)
+}
+
+func (o Options) bounds() (start, end string) {
+	if o.Prefix != "" {
+		return o.Prefix, pager.PrefixEnd(o.Prefix)
+	}
+	return o.Start, o.End
+}
+
+// Report counts what a copy did.
+type Report struct {
+	Shards  int
+	Rows    int64
+	Skipped int64
+	Cells   int64
+	Bytes   int64
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("%d rows with %d cells and %d bytes copied in %d shards, %d skipped",
+		r.Rows, r.Cells, r.Bytes, r.Shards, r.Skipped)
+}
+
+// SampleKeys returns the keys SampleRowKeys returns for tbl that lie within
+// the range of opts, in order. They are the tablet boundaries of the
+// source, good split keys for the destination and for shards.
+func SampleKeys(ctx context.Context, tbl table.Table, opts Options) ([]string, error) {
+	keys, err := tbl.SampleRowKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	start, end := opts.bounds()
+	var in []string
+	for _, k := range keys {
+		if k > start && (end == "" || k < end) && (len(in) == 0 || k > in[len(in)-1]) {
+			in = append(in, k)
+		}
+	}
+	return in, nil
+}
+
+// shards splits the range of opts into up to n ranges at sampled keys,
+// spread evenly over the samples.
+func shards(opts Options, samples []string, n int) []pager.Range {
+	start, end := opts.bounds()
+	var cuts []string
+	if len(samples) < n {
+		cuts = samples
+	} else {
+		for i := 1; i < n; i++ {
+			cuts = append(cuts, samples[i*len(samples)/n])
+		}
+	}
+	var out []pager.Range
+	for _, c := range cuts {
+		if c == start {
+			continue
+		}
+		out = append(out, pager.Range{Start: start, Limit: c})
+		start = c
+	}
+	return append(out, pager.Range{Start: start, Limit: end})
+}
+
+// Run copies the rows of src selected by opts to dst. The first failure
+// stops all shards; rows keep their timestamps, so running the copy again
+// writes the same cells.
+func Run(ctx context.Context, src, dst table.Table, opts Options) (Report, error) {
+	if opts.Shards <= 0 {
+		opts.Shards = 8
+	}
+	if opts.Batch <= 0 {
+		opts.Batch = 500
+	}
+	samples, err := SampleKeys(ctx, src, opts)
+	if err != nil {
+		return Report{}, fmt.Errorf("sampling row keys: %w", err)
+	}
+	ranges := shards(opts, samples, opts.Shards)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var mu sync.Mutex
+	rep := Report{Shards: len(ranges)}
+	var firstErr error
+	add := func(d Report, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		rep.Rows += d.Rows
+		rep.Skipped += d.Skipped
+		rep.Cells += d.Cells
+		rep.Bytes += d.Bytes
+		if err != nil && firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+		if opts.Progress != nil {
+			opts.Progress(rep)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for _, r := range ranges {
+		r := r
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			copyShard(ctx, src, dst, r, opts, add)
+		}()
+	}
+	wg.Wait()
+	return rep, firstErr
+}
+
+// copyShard copies one range a batch at a time and reports every batch.
+func copyShard(ctx context.Context, src, dst table.Table, r pager.Range, opts Options, add func(Report, error)) {
+	readOpts := []bigtable.ReadOption{bigtable.LimitRows(int64(opts.Batch))}
+	if opts.Filter != nil {
+		readOpts = append(readOpts, bigtable.RowFilter(opts.Filter))
+	}
+	after := ""
+	for {
+		var d Report
+		var keys []string
+		var muts []*bigtable.Mutation
+		var terr error
+		n := 0
+		err := src.ReadRows(ctx, r.After(after).RowRange(), func(row bigtable.Row) bool {
+			n++
+			after = row.Key()
+			key := row.Key()
+			if opts.Transform != nil {
+				if key, row, terr = opts.Transform(row); terr != nil {
+					terr = fmt.Errorf("row %q: %w", after, terr)
+					return false
+				}
+			}
+			if key == "" || len(row) == 0 {
+				d.Skipped++
+				return true
+			}
+			for _, items := range row {
+				d.Cells += int64(len(items))
+			}
+			d.Rows++
+			d.Bytes += int64(table.RowSize(row))
+			keys = append(keys, key)
+			muts = append(muts, table.CopyMutation(row))
+			return true
+		}, readOpts...)
+		if err == nil {
+			err = terr
+		}
+		if err == nil && len(keys) > 0 {
+			err = applyBulk(ctx, dst, keys, muts)
+		}
+		if err != nil {
+			add(Report{}, err)
+			return
+		}
+		add(d, nil)
+		if n < opts.Batch {
+			return
+		}
+	}
+}
+
+func applyBulk(ctx context.Context, tbl table.Table, keys []string, muts []*bigtable.Mutation) error {
+	errs, err := tbl.ApplyBulk(ctx, keys, muts)
+	if err != nil {
+		return err
+	}
+	for i, e := range errs {
+		if e != nil {
+			return fmt.Errorf("writing %q: %w", keys[i], e)
+		}
+	}
+	return nil
+}
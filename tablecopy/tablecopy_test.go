@@ -0,0 +1,49 @@
+package tablecopy
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"bigworkshop/pager"
+	"bigworkshop/table/tabletest"
+	"cloud.google.com/go/bigtable"
+)
+
+func TestShards(t *testing.T) {
+	got := shards(Options{Prefix: "doc:"}, []string{"doc:3", "doc:5", "doc:5", "doc:7"}, 3)
+	want := []pager.Range{
+		{Start: "doc:", Limit: "doc:5"},
+		{Start: "doc:5", Limit: "doc;"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("shards = %q, want %q", got, want)
+	}
+}
+
+func TestRun(t *testing.T) {
+	ctx := context.Background()
+	srv := tabletest.Start(t)
+	src, dst := srv.Table(t, "src", "f"), srv.Table(t, "dst", "f")
+	keys := []string{"a", "doc:", "doc:1", "doc:1\x00", "doc:1\x00\x00", "doc:2", "doc:\xff", "doc;"}
+	for _, k := range keys {
+		m := bigtable.NewMutation()
+		m.Set("f", "c", bigtable.Timestamp(1000), []byte(k))
+		if err := src.Apply(ctx, k, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, batch := range []int{1, 2, 500} {
+		rep, err := Run(ctx, src, dst, Options{Prefix: "doc:", Batch: batch, Shards: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rep.Rows != 6 {
+			t.Errorf("batch %d: copied %d rows, want 6", batch, rep.Rows)
+		}
+	}
+	if got, want := tabletest.Keys(t, dst), keys[1:7]; !reflect.DeepEqual(got, want) {
+		t.Errorf("copied %q, want %q", got, want)
+	}
+}
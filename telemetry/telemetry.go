@@ -0,0 +1,213 @@
+// Package telemetry instruments table operations. Wrapped tables record
+// latency histograms, operation and error counts by grpc code, rows and
+// bytes read and bytes written per table and method. Metrics are served in
+// the prometheus text format, spans go to an Exporter:
+//
+//	exp, _ := telemetry.CreateFileExporter("-")
+//	tel := telemetry.New(exp)
+//	tbl := tel.Wrap(retry.Wrap(client.Open("tokens"), retry.Policy{OnRetry: tel.OnRetry("tokens")}), "tokens")
+//	http.Handle("/metrics", tel.Handler())
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Telemetry holds the metrics of all tables it wraps.
+type Telemetry struct {
+	// Registry holds the metrics, more can be added to it.
+	Registry *Registry
+	exporter Exporter
+
+	duration     *Histogram
+	ops          *Counter
+	rowsRead     *Counter
+	bytesRead    *Counter
+	bytesWritten *Counter
+	retries      *Counter
+}
+
+// New returns a Telemetry exporting spans to exp, nil records no spans.
+func New(exp Exporter) *Telemetry {
+	r := NewRegistry()
+	return &Telemetry{
+		Registry:     r,
+		exporter:     exp,
+		duration:     r.Histogram("bigtable_op_duration_seconds", "Latency of table operations.", DefaultBuckets, "table", "method"),
+		ops:          r.Counter("bigtable_ops_total", "Table operations by result code.", "table", "method", "code"),
+		rowsRead:     r.Counter("bigtable_rows_read_total", "Rows returned by reads.", "table", "method"),
+		bytesRead:    r.Counter("bigtable_bytes_read_total", "Bytes of keys, columns and values returned by reads.", "table", "method"),
+		bytesWritten: r.Counter("bigtable_bytes_written_total", "Bytes of columns and values set by mutations.", "table", "method"),
+		retries:      r.Counter("bigtable_retries_total", "Retried attempts of table operations.", "table", "method"),
+	}
+}
+
+// Handler serves the metrics.
+func (t *Telemetry) Handler() http.Handler {
+	return t.Registry.Handler()
+}
+
+// OnRetry returns a hook for retry.Policy.OnRetry that counts retries of
+// the table.
+func (t *Telemetry) OnRetry(tableName string) func(op string, attempt int, err error, wait time.Duration) {
+	return func(op string, _ int, _ error, _ time.Duration) {
+		t.retries.Add(1, tableName, op)
+	}
+}
+
+// Wrap instruments tbl, name labels its metrics.
+func (t *Telemetry) Wrap(tbl table.Table, name string) *Table {
+	return &Table{tbl: tbl, name: name, t: t}
+}
+
+// Table is an instrumented table.Table.
+type Table struct {
+	tbl  table.Table
+	name string
+	t    *Telemetry
+}
+
+var _ table.Table = (*Table)(nil)
+
+// op is one running operation.
+type op struct {
+	t      *Table
+	method string
+	span   *Span
+	start  time.Time
+	rows   int
+	read   int
+	write  int
+}
+
+func (t *Table) begin(ctx context.Context, method string) (context.Context, *op) {
+	ctx, span := StartSpan(ctx, "bigtable."+method)
+	span.Attributes["table"] = t.name
+	return ctx, &op{t: t, method: method, span: span, start: time.Now()}
+}
+
+func (o *op) addRow(r bigtable.Row) {
+	o.rows++
+	o.read += table.RowSize(r)
+}
+
+func (o *op) end(err error) {
+	d := time.Since(o.start)
+	tel, name := o.t.t, o.t.name
+	code := errorCode(err)
+	tel.duration.Observe(d.Seconds(), name, o.method)
+	tel.ops.Add(1, name, o.method, code.String())
+	if o.rows > 0 {
+		tel.rowsRead.Add(float64(o.rows), name, o.method)
+	}
+	if o.read > 0 {
+		tel.bytesRead.Add(float64(o.read), name, o.method)
+	}
+	if o.write > 0 {
+		tel.bytesWritten.Add(float64(o.write), name, o.method)
+	}
+	if tel.exporter == nil {
+		return
+	}
+	o.span.Duration = d
+	o.span.Code = code.String()
+	if err != nil {
+		o.span.Error = err.Error()
+	}
+	if o.rows > 0 {
+		o.span.Attributes["rows"] = o.rows
+	}
+	if o.read > 0 {
+		o.span.Attributes["bytes_read"] = o.read
+	}
+	if o.write > 0 {
+		o.span.Attributes["bytes_written"] = o.write
+	}
+	tel.exporter.Export(o.span)
+}
+
+// errorCode is the grpc code of err, context errors of the caller count
+// as Canceled and DeadlineExceeded.
+func errorCode(err error) codes.Code {
+	if s, ok := status.FromError(err); ok {
+		return s.Code()
+	}
+	return status.FromContextError(err).Code()
+}
+
+func (t *Table) ReadRows(ctx context.Context, arg bigtable.RowSet, f func(bigtable.Row) bool, opts ...bigtable.ReadOption) (err error) {
+	ctx, o := t.begin(ctx, "ReadRows")
+	defer func() { o.end(err) }()
+	o.span.Attributes["row_set_hash"] = HashKey(fmt.Sprint(arg))
+	return t.tbl.ReadRows(ctx, arg, func(r bigtable.Row) bool {
+		o.addRow(r)
+		return f(r)
+	}, opts...)
+}
+
+func (t *Table) ReadRow(ctx context.Context, row string, opts ...bigtable.ReadOption) (r bigtable.Row, err error) {
+	ctx, o := t.begin(ctx, "ReadRow")
+	defer func() { o.end(err) }()
+	o.span.Attributes["row_key_hash"] = HashKey(row)
+	r, err = t.tbl.ReadRow(ctx, row, opts...)
+	if len(r) > 0 {
+		o.addRow(r)
+	}
+	return r, err
+}
+
+func (t *Table) Apply(ctx context.Context, row string, m *bigtable.Mutation, opts ...bigtable.ApplyOption) (err error) {
+	ctx, o := t.begin(ctx, "Apply")
+	defer func() { o.end(err) }()
+	o.span.Attributes["row_key_hash"] = HashKey(row)
+	o.write = table.MutationSize(m)
+	return t.tbl.Apply(ctx, row, m, opts...)
+}
+
+func (t *Table) ApplyBulk(ctx context.Context, rowKeys []string, muts []*bigtable.Mutation, opts ...bigtable.ApplyOption) (errs []error, err error) {
+	ctx, o := t.begin(ctx, "ApplyBulk")
+	defer func() { o.end(err) }()
+	o.span.Attributes["mutations"] = len(muts)
+	for _, m := range muts {
+		o.write += table.MutationSize(m)
+	}
+	errs, err = t.tbl.ApplyBulk(ctx, rowKeys, muts, opts...)
+	failed := 0
+	for _, e := range errs {
+		if e != nil {
+			failed++
+			t.t.ops.Add(1, t.name, "ApplyBulk.entry", errorCode(e).String())
+		}
+	}
+	if failed > 0 {
+		o.span.Attributes["failed_mutations"] = failed
+	}
+	return errs, err
+}
+
+func (t *Table) ApplyReadModifyWrite(ctx context.Context, row string, m *bigtable.ReadModifyWrite) (r bigtable.Row, err error) {
+	ctx, o := t.begin(ctx, "ApplyReadModifyWrite")
+	defer func() { o.end(err) }()
+	o.span.Attributes["row_key_hash"] = HashKey(row)
+	r, err = t.tbl.ApplyReadModifyWrite(ctx, row, m)
+	if len(r) > 0 {
+		o.addRow(r)
+	}
+	return r, err
+}
+
+func (t *Table) SampleRowKeys(ctx context.Context) (keys []string, err error) {
+	ctx, o := t.begin(ctx, "SampleRowKeys")
+	defer func() { o.end(err) }()
+	keys, err = t.tbl.SampleRowKeys(ctx)
+	o.span.Attributes["keys"] = len(keys)
+	return keys, err
+}
@@ -0,0 +1,107 @@
+package valuecodec
+
+import (
+	"context"
+	"sort"
+
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+)
+
+// AnalyzeOptions limit an analysis.
+type AnalyzeOptions struct {
+	// Prefix limits the scan to rows with this prefix, the whole table if
+	// empty.
+	Prefix string
+	// Limit is the number of rows sampled, all rows if zero.
+	Limit int64
+	// Codecs are tried on every value of at least Threshold bytes, as
+	// Encode would.
+	Codecs    []Codec
+	Threshold int
+}
+
+// FamilyStats are the sizes of the values of a family.
+type FamilyStats struct {
+	Family string
+	Cells  int64
+	// Compressed cells are stored compressed.
+	Compressed int64
+	// Stored is the size of the values as stored, Raw decompressed.
+	Stored, Raw int64
+	// Trial is the size the values would be stored with each of the
+	// analyzed codecs.
+	Trial map[string]int64
+}
+
+// Ratio is the achieved compression ratio, raw to stored size.
+func (s FamilyStats) Ratio() float64 {
+	return ratio(s.Raw, s.Stored)
+}
+
+// TrialRatio is the ratio a codec would achieve.
+func (s FamilyStats) TrialRatio(codec string) float64 {
+	return ratio(s.Raw, s.Trial[codec])
+}
+
+func ratio(raw, stored int64) float64 {
+	if stored == 0 {
+		return 1
+	}
+	return float64(raw) / float64(stored)
+}
+
+// Analyze reads the values of tbl, which must not decode them itself, and
+// reports per family how well they are and would be compressed.
+func Analyze(ctx context.Context, tbl table.Table, opts AnalyzeOptions) ([]FamilyStats, error) {
+	stats := map[string]*FamilyStats{}
+	var rs bigtable.RowSet = bigtable.InfiniteRange("")
+	if opts.Prefix != "" {
+		rs = bigtable.PrefixRange(opts.Prefix)
+	}
+	var ropts []bigtable.ReadOption
+	if opts.Limit > 0 {
+		ropts = append(ropts, bigtable.LimitRows(opts.Limit))
+	}
+	var derr error
+	err := tbl.ReadRows(ctx, rs, func(r bigtable.Row) bool {
+		for fam, items := range r {
+			s := stats[fam]
+			if s == nil {
+				s = &FamilyStats{Family: fam, Trial: map[string]int64{}}
+				stats[fam] = s
+			}
+			for _, it := range items {
+				v, err := Decode(it.Value)
+				if err != nil {
+					derr = err
+					return false
+				}
+				s.Cells++
+				s.Stored += int64(len(it.Value))
+				s.Raw += int64(len(v))
+				if _, ok := CodecOf(it.Value); ok {
+					s.Compressed++
+				}
+				for _, c := range opts.Codecs {
+					enc, err := Encode(Rule{Codec: c, Threshold: opts.Threshold}, v)
+					if err != nil {
+						derr = err
+						return false
+					}
+					s.Trial[c.Name()] += int64(len(enc))
+				}
+			}
+		}
+		return true
+	}, ropts...)
+	if err == nil {
+		err = derr
+	}
+	out := make([]FamilyStats, 0, len(stats))
+	for _, s := range stats {
+		out = append(out, *s)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Family < out[j].Family })
+	return out, err
+}
@@ -0,0 +1,31 @@
+package valuecodec
+
+import (
+	"errors"
+
+	"github.com/golang/snappy"
+)
+
+// Snappy is the snappy block format, id 2. It compresses less than gzip
+// but is several times faster.
+type Snappy struct{}
+
+func (Snappy) ID() byte     { return 2 }
+func (Snappy) Name() string { return "snappy" }
+
+var errTooLarge = errors.New("snappy block decodes to more than the largest cell")
+
+func (Snappy) Compress(v []byte) ([]byte, error) {
+	return snappy.Encode(nil, v), nil
+}
+
+func (Snappy) Decompress(v []byte) ([]byte, error) {
+	n, err := snappy.DecodedLen(v)
+	if err != nil {
+		return nil, err
+	}
+	if n > maxValue {
+		return nil, errTooLarge
+	}
+	return snappy.Decode(nil, v)
+}
@@ -0,0 +1,133 @@
+package valuecodec
+
+import (
+	"context"
+	"fmt"
+
+	"bigworkshop/table"
+	"cloud.google.com/go/bigtable"
+	btpb "google.golang.org/genproto/googleapis/bigtable/v2"
+)
+
+// Table compresses the values written to the table it wraps and
+// decompresses the values read from it.
+type Table struct {
+	tbl  table.Table
+	opts Options
+}
+
+var _ table.Table = (*Table)(nil)
+
+// Wrap returns tbl compressing values by opts.
+func Wrap(tbl table.Table, opts Options) *Table {
+	return &Table{tbl: tbl, opts: opts}
+}
+
+// encodeMutation returns m with its values encoded. The values of
+// conditional mutations cannot be reached and are written as they are,
+// reads still decode them.
+func (t *Table) encodeMutation(m *bigtable.Mutation) (*bigtable.Mutation, error) {
+	if table.IsConditional(m) {
+		return m, nil
+	}
+	ops := table.Ops(m)
+	var out []*btpb.Mutation
+	for i, op := range ops {
+		set := op.GetSetCell()
+		var v []byte
+		if set != nil {
+			var err error
+			if v, err = Encode(t.opts.rule(set.FamilyName), set.Value); err != nil {
+				return nil, err
+			}
+		}
+		if set == nil || len(v) == len(set.Value) {
+			if out != nil {
+				out = append(out, op)
+			}
+			continue
+		}
+		if out == nil {
+			out = append([]*btpb.Mutation(nil), ops[:i]...)
+		}
+		out = append(out, &btpb.Mutation{Mutation: &btpb.Mutation_SetCell_{SetCell: &btpb.Mutation_SetCell{
+			FamilyName:      set.FamilyName,
+			ColumnQualifier: set.ColumnQualifier,
+			TimestampMicros: set.TimestampMicros,
+			Value:           v,
+		}}})
+	}
+	if out == nil {
+		return m, nil
+	}
+	return table.NewMutation(out), nil
+}
+
+// decodeRow decodes the values of r in place.
+func decodeRow(r bigtable.Row) error {
+	for fam, items := range r {
+		for i, it := range items {
+			v, err := Decode(it.Value)
+			if err != nil {
+				return fmt.Errorf("row %q, %s: %w", it.Row, it.Column, err)
+			}
+			r[fam][i].Value = v
+		}
+	}
+	return nil
+}
+
+func (t *Table) ReadRows(ctx context.Context, arg bigtable.RowSet, f func(bigtable.Row) bool, opts ...bigtable.ReadOption) error {
+	var derr error
+	err := t.tbl.ReadRows(ctx, arg, func(r bigtable.Row) bool {
+		if derr = decodeRow(r); derr != nil {
+			return false
+		}
+		return f(r)
+	}, opts...)
+	if err == nil {
+		err = derr
+	}
+	return err
+}
+
+func (t *Table) ReadRow(ctx context.Context, row string, opts ...bigtable.ReadOption) (bigtable.Row, error) {
+	r, err := t.tbl.ReadRow(ctx, row, opts...)
+	if err != nil {
+		return r, err
+	}
+	return r, decodeRow(r)
+}
+
+func (t *Table) Apply(ctx context.Context, row string, m *bigtable.Mutation, opts ...bigtable.ApplyOption) error {
+	enc, err := t.encodeMutation(m)
+	if err != nil {
+		return err
+	}
+	return t.tbl.Apply(ctx, row, enc, opts...)
+}
+
+func (t *Table) ApplyBulk(ctx context.Context, rowKeys []string, muts []*bigtable.Mutation, opts ...bigtable.ApplyOption) ([]error, error) {
+	enc := make([]*bigtable.Mutation, len(muts))
+	for i, m := range muts {
+		var err error
+		if enc[i], err = t.encodeMutation(m); err != nil {
+			return nil, err
+		}
+	}
+	return t.tbl.ApplyBulk(ctx, rowKeys, enc, opts...)
+}
+
+// ApplyReadModifyWrite is passed through, appending to a compressed value
+// corrupts it; counters are 8 bytes and never compressed.
+func (t *Table) ApplyReadModifyWrite(ctx context.Context, row string, m *bigtable.ReadModifyWrite) (bigtable.Row, error) {
+	r, err := t.tbl.ApplyReadModifyWrite(ctx, row, m)
+	if err != nil {
+		return r, err
+	}
+	return r, decodeRow(r)
+}
+
+func (t *Table) SampleRowKeys(ctx context.Context) ([]string, error) {
+	return t.tbl.SampleRowKeys(ctx)
+}
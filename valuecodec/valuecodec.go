@@ -0,0 +1,242 @@
+// Package valuecodec compresses cell values above a size threshold and tags
+// them with a small header, so that reads decompress them whatever codec or
+// family they were written with:
+//
+//	opts, err := valuecodec.ParseOptions("gzip:1024,blob=snappy:256,img=none")
+//	tbl := valuecodec.Wrap(client.Open("tbl"), opts)
+//
+// A compressed value is stored as
+//
+//	magic | codec id | compressed value
+//
+// Values that do not get smaller are stored as they are, unless they start
+// with the magic themselves; those are escaped with codec id 0 so they are
+// not mistaken for compressed ones. Analyze reports the ratios a table
+// achieves and would achieve with other codecs.
+package valuecodec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// magic starts every encoded value, followed by the codec id.
+const magic = "\x00bwz1"
+
+// maxValue bounds decompressed values, the largest cell Bigtable accepts.
+const maxValue = 100 << 20
+
+// Codec compresses values.
+type Codec interface {
+	// ID is stored in front of the values, it must never change.
+	ID() byte
+	// Name is the codec's name in ParseOptions.
+	Name() string
+	Compress(v []byte) ([]byte, error)
+	Decompress(v []byte) ([]byte, error)
+}
+
+var (
+	mu     sync.RWMutex
+	byID   = map[byte]Codec{}
+	byName = map[string]Codec{}
+)
+
+func init() {
+	Register(Gzip{})
+	Register(Snappy{})
+	Register(Zstd{})
+}
+
+// Register makes a codec known to reads and ParseOptions. It panics if its
+// id or name is taken, id 0 is reserved for values stored as they are.
+func Register(c Codec) {
+	mu.Lock()
+	defer mu.Unlock()
+	if c.ID() == 0 || byID[c.ID()] != nil || byName[c.Name()] != nil {
+		panic(fmt.Sprintf("valuecodec: codec %s with id %d registered twice", c.Name(), c.ID()))
+	}
+	byID[c.ID()] = c
+	byName[c.Name()] = c
+}
+
+// Lookup returns the registered codec with a name.
+func Lookup(name string) (Codec, error) {
+	mu.RLock()
+	c := byName[name]
+	mu.RUnlock()
+	if c != nil {
+		return c, nil
+	}
+	return nil, fmt.Errorf("valuecodec: unknown codec %q", name)
+}
+
+// Codecs returns the names of the registered codecs.
+func Codecs() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Rule says how the values of a family are compressed.
+type Rule struct {
+	// Codec is nil for values stored as they are.
+	Codec Codec
+	// Threshold is the size from which values are compressed.
+	Threshold int
+}
+
+// DefaultThreshold is the threshold of rules without one, smaller values
+// rarely get smaller.
+const DefaultThreshold = 512
+
+// Options configure compression per family.
+type Options struct {
+	// Default applies to families without a rule of their own.
+	Default  Rule
+	Families map[string]Rule
+}
+
+func (o Options) rule(family string) Rule {
+	if r, ok := o.Families[family]; ok {
+		return r
+	}
+	return o.Default
+}
+
+// ParseOptions parses comma separated rules, codec[:threshold] for the
+// default and family=codec[:threshold] for a family. The codec none turns
+// compression off.
+func ParseOptions(s string) (Options, error) {
+	opts := Options{Families: map[string]Rule{}}
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		fam, spec, hasFam := strings.Cut(part, "=")
+		if !hasFam {
+			fam, spec = "", part
+		}
+		name, threshold, hasThreshold := strings.Cut(spec, ":")
+		r := Rule{Threshold: DefaultThreshold}
+		if hasThreshold {
+			n, err := strconv.Atoi(threshold)
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("valuecodec: bad threshold in %q", part)
+			}
+			r.Threshold = n
+		}
+		if name != "none" {
+			c, err := Lookup(name)
+			if err != nil {
+				return opts, err
+			}
+			r.Codec = c
+		}
+		if hasFam {
+			opts.Families[fam] = r
+		} else {
+			opts.Default = r
+		}
+	}
+	return opts, nil
+}
+
+// Encode returns the stored form of v under r.
+func Encode(r Rule, v []byte) ([]byte, error) {
+	if r.Codec != nil && len(v) >= r.Threshold {
+		c, err := r.Codec.Compress(v)
+		if err != nil {
+			return nil, err
+		}
+		if len(magic)+1+len(c) < len(v) {
+			return tag(r.Codec.ID(), c), nil
+		}
+	}
+	if bytes.HasPrefix(v, []byte(magic)) {
+		return tag(0, v), nil
+	}
+	return v, nil
+}
+
+func tag(id byte, v []byte) []byte {
+	out := make([]byte, 0, len(magic)+1+len(v))
+	out = append(out, magic...)
+	out = append(out, id)
+	return append(out, v...)
+}
+
+// CodecOf returns the id of the codec of a stored value, false if it is
+// stored as it is.
+func CodecOf(v []byte) (byte, bool) {
+	if len(v) <= len(magic) || !bytes.HasPrefix(v, []byte(magic)) || v[len(magic)] == 0 {
+		return 0, false
+	}
+	return v[len(magic)], true
+}
+
+// Decode returns the value of a stored value, written by Encode or not.
+func Decode(v []byte) ([]byte, error) {
+	if len(v) <= len(magic) || !bytes.HasPrefix(v, []byte(magic)) {
+		return v, nil
+	}
+	id, rest := v[len(magic)], v[len(magic)+1:]
+	if id == 0 {
+		return rest, nil
+	}
+	mu.RLock()
+	c := byID[id]
+	mu.RUnlock()
+	if c == nil {
+		return nil, fmt.Errorf("valuecodec: value compressed with unknown codec %d", id)
+	}
+	out, err := c.Decompress(rest)
+	if err != nil {
+		return nil, fmt.Errorf("valuecodec: %s: %w", c.Name(), err)
+	}
+	return out, nil
+}
+
+// Gzip is the gzip codec, id 1.
+type Gzip struct{}
+
+func (Gzip) ID() byte     { return 1 }
+func (Gzip) Name() string { return "gzip" }
+
+func (Gzip) Compress(v []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(v); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (Gzip) Decompress(v []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(v))
+	if err != nil {
+		return nil, err
+	}
+	out, err := io.ReadAll(io.LimitReader(r, maxValue+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxValue {
+		return nil, fmt.Errorf("value exceeds %d bytes", maxValue)
+	}
+	return out, nil
+}
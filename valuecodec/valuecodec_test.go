@@ -0,0 +1,113 @@
+package valuecodec
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+func testValues() map[string][]byte {
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+	return map[string][]byte{
+		"empty":  {},
+		"short":  []byte("v"),
+		"text":   []byte(strings.Repeat("the quick brown fox jumps over the lazy dog ", 200)),
+		"random": random,
+		"magic":  []byte(magic + "\x01not compressed"),
+		"zeros":  make([]byte, 1<<20),
+	}
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, name := range Codecs() {
+		c, err := Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for vname, v := range testValues() {
+			enc, err := c.Compress(v)
+			if err != nil {
+				t.Errorf("%s %s: compress: %v", name, vname, err)
+				continue
+			}
+			dec, err := c.Decompress(enc)
+			if err != nil {
+				t.Errorf("%s %s: decompress: %v", name, vname, err)
+				continue
+			}
+			if !bytes.Equal(dec, v) {
+				t.Errorf("%s %s: round trip changed the value", name, vname)
+			}
+		}
+	}
+}
+
+func TestEncodeDecode(t *testing.T) {
+	for _, name := range append(Codecs(), "none") {
+		opts, err := ParseOptions(name + ":16")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for vname, v := range testValues() {
+			stored, err := Encode(opts.Default, v)
+			if err != nil {
+				t.Fatalf("%s %s: %v", name, vname, err)
+			}
+			if _, compressed := CodecOf(stored); compressed && len(stored) >= len(v) {
+				t.Errorf("%s %s: compressed %d bytes to %d", name, vname, len(v), len(stored))
+			}
+			got, err := Decode(stored)
+			if err != nil {
+				t.Fatalf("%s %s: %v", name, vname, err)
+			}
+			if !bytes.Equal(got, v) {
+				t.Errorf("%s %s: got %q..., want %q...", name, vname, trunc(got), trunc(v))
+			}
+		}
+	}
+}
+
+func TestEncodeBelowThreshold(t *testing.T) {
+	opts, err := ParseOptions("gzip:1024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := []byte(strings.Repeat("a", 1000))
+	stored, err := Encode(opts.Default, v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, v) {
+		t.Errorf("value below the threshold was changed")
+	}
+}
+
+func TestParseOptions(t *testing.T) {
+	opts, err := ParseOptions("gzip:1024, blob=snappy:256,img=none")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Default.Codec.Name() != "gzip" || opts.Default.Threshold != 1024 {
+		t.Errorf("default rule %+v", opts.Default)
+	}
+	if r := opts.rule("blob"); r.Codec.Name() != "snappy" || r.Threshold != 256 {
+		t.Errorf("blob rule %+v", r)
+	}
+	if r := opts.rule("img"); r.Codec != nil {
+		t.Errorf("img rule %+v, want none", r)
+	}
+	for _, bad := range []string{"lz4", "gzip:x", "gzip:-1"} {
+		if _, err := ParseOptions(bad); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
+
+func trunc(v []byte) []byte {
+	if len(v) > 20 {
+		return v[:20]
+	}
+	return v
+}
@@ -0,0 +1,49 @@
+package valuecodec
+
+import (
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Zstd is the zstd codec, id 3. It compresses about like gzip at close to
+// the speed of snappy.
+type Zstd struct{}
+
+func (Zstd) ID() byte     { return 3 }
+func (Zstd) Name() string { return "zstd" }
+
+// The encoder and decoder are safe for concurrent EncodeAll and DecodeAll
+// calls and expensive to create, they are shared.
+var (
+	zstdOnce sync.Once
+	zstdEnc  *zstd.Encoder
+	zstdDec  *zstd.Decoder
+	zstdErr  error
+)
+
+func zstdCoders() (*zstd.Encoder, *zstd.Decoder, error) {
+	zstdOnce.Do(func() {
+		if zstdEnc, zstdErr = zstd.NewWriter(nil); zstdErr != nil {
+			return
+		}
+		zstdDec, zstdErr = zstd.NewReader(nil, zstd.WithDecoderMaxMemory(maxValue), zstd.WithDecoderConcurrency(0))
+	})
+	return zstdEnc, zstdDec, zstdErr
+}
+
+func (Zstd) Compress(v []byte) ([]byte, error) {
+	enc, _, err := zstdCoders()
+	if err != nil {
+		return nil, err
+	}
+	return enc.EncodeAll(v, nil), nil
+}
+
+func (Zstd) Decompress(v []byte) ([]byte, error) {
+	_, dec, err := zstdCoders()
+	if err != nil {
+		return nil, err
+	}
+	return dec.DecodeAll(v, nil)
+}
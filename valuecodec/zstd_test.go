@@ -0,0 +1,26 @@
+package valuecodec
+
+import (
+	"testing"
+)
+
+func TestZstdReference(t *testing.T) {
+	// printf 'hello, zstd hello, zstd hello, zstd' | zstd -c
+	frame := []byte{
+		0x28, 0xb5, 0x2f, 0xfd, 0x04, 0x58, 0x95, 0x00, 0x00, 0x60, 0x68, 0x65, 0x6c, 0x6c, 0x6f, 0x2c,
+		0x20, 0x7a, 0x73, 0x74, 0x64, 0x20, 0x01, 0x00, 0xaf, 0x4b, 0x12, 0x0a, 0x76, 0xd9, 0x9b,
+	}
+	got, err := Zstd{}.Decompress(frame)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "hello, zstd hello, zstd hello, zstd"; string(got) != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestZstdCorrupt(t *testing.T) {
+	if _, err := (Zstd{}).Decompress([]byte("not a zstd frame")); err == nil {
+		t.Error("no error")
+	}
+}
@@ -0,0 +1,197 @@
+'use strict';
+
+const state = {
+  config: null,
+  table: null,
+  next: '',
+  detailKey: null,
+};
+
+const $ = (id) => document.getElementById(id);
+
+async function api(path, params, init) {
+  const query = new URLSearchParams(params || {});
+  const resp = await fetch(`/api/${path}?${query}`, init);
+  const body = await resp.json();
+  if (!resp.ok) {
+    throw new Error(body.error || resp.statusText);
+  }
+  return body;
+}
+
+function showError(err) {
+  $('error').textContent = err ? err.message : '';
+}
+
+function el(tag, attrs, ...children) {
+  const e = document.createElement(tag);
+  Object.assign(e, attrs || {});
+  for (const c of children) {
+    e.append(c);
+  }
+  return e;
+}
+
+function options(select, values) {
+  select.replaceChildren(...values.map((v) => el('option', { value: v, textContent: v })));
+}
+
+async function loadTables() {
+  const { tables } = await api('tables');
+  $('tables').replaceChildren(...tables.map((t) => {
+    const li = el('li', { textContent: t });
+    li.onclick = () => selectTable(t).catch(showError);
+    return li;
+  }));
+  if (tables.length > 0) {
+    await selectTable(tables.includes('tbl') ? 'tbl' : tables[0]);
+  }
+}
+
+async function selectTable(table) {
+  state.table = table;
+  for (const li of $('tables').children) {
+    li.classList.toggle('selected', li.textContent === table);
+  }
+  const { families } = await api('schema', { table });
+  $('families').replaceChildren(...families.map((f) => el('tr', {},
+    el('td', { textContent: f.name }),
+    el('td', { textContent: f.gcPolicy || 'never' }))));
+  $('detail').hidden = true;
+  await search(false);
+}
+
+function searchParams() {
+  return {
+    table: state.table,
+    prefix: $('prefix').value,
+    filter: $('filter').value,
+    decode: $('decode').value,
+  };
+}
+
+// search reads the first page, or the next page when more is set, using the
+// last row key of the previous page like exercise 5.4.
+async function search(more) {
+  showError(null);
+  const params = searchParams();
+  if (more) {
+    params.after = state.next;
+  }
+  const { rows, next } = await api('rows', params);
+  const body = $('rows').tBodies[0];
+  if (!more) {
+    body.replaceChildren();
+  }
+  for (const row of rows) {
+    const key = el('td', { className: 'key', textContent: row.key, rowSpan: Math.max(row.cells.length, 1) });
+    key.onclick = () => showRow(row.key).catch(showError);
+    if (row.cells.length === 0) {
+      body.append(el('tr', {}, key, el('td'), el('td'), el('td')));
+    }
+    row.cells.forEach((c, i) => {
+      const tr = el('tr', {},
+        el('td', { textContent: `${c.family}:${c.qualifier}` }),
+        el('td', { textContent: c.time }),
+        el('td', { className: 'value' }, el('pre', { textContent: c.value })));
+      if (i === 0) {
+        tr.prepend(key);
+      }
+      body.append(tr);
+    });
+  }
+  state.next = next;
+  $('more').hidden = !next;
+}
+
+// showRow shows every version of every column of a row.
+async function showRow(key) {
+  showError(null);
+  state.detailKey = key;
+  const params = { table: state.table, key, decode: $('decode').value };
+  const { row } = await api('row', params);
+  renderRow(row);
+}
+
+function renderRow(row) {
+  $('detail').hidden = false;
+  if (!row) {
+    $('detail-key').textContent = `${state.detailKey} (deleted)`;
+    $('detail-cells').replaceChildren();
+    return;
+  }
+  $('detail-key').textContent = row.key;
+
+  const table = el('table', {}, el('tr', {},
+    el('th', { textContent: 'column' }),
+    el('th', { textContent: 'timestamp' }),
+    el('th', { textContent: 'bytes' }),
+    el('th', { textContent: 'value' })));
+  let prev = null;
+  for (const c of row.cells) {
+    const column = `${c.family}:${c.qualifier}`;
+    const tr = el('tr', {},
+      el('td', { textContent: column === prev ? '' : column }),
+      el('td', { textContent: c.time, className: column === prev ? 'old' : '' }),
+      el('td', { textContent: c.size }),
+      el('td', { className: 'value' }, el('pre', { textContent: c.value })));
+    if (state.config.writable && column !== prev) {
+      const del = el('button', { className: 'delete', textContent: 'delete column' });
+      del.onclick = () => deleteCells({ family: c.family, qualifier: c.qualifier }).catch(showError);
+      tr.append(el('td', {}, del));
+    }
+    table.append(tr);
+    prev = column;
+  }
+  $('detail-cells').replaceChildren(table);
+}
+
+async function deleteCells(what) {
+  const target = what.family ? `${what.family}:${what.qualifier}` : 'the whole row';
+  if (!confirm(`delete ${target} of ${state.detailKey}?`)) {
+    return;
+  }
+  const params = { table: state.table, key: state.detailKey, decode: $('decode').value, ...what };
+  const { row } = await api('row', params, { method: 'DELETE' });
+  renderRow(row);
+}
+
+async function setCell(e) {
+  e.preventDefault();
+  const params = { table: state.table, key: state.detailKey, decode: $('decode').value };
+  const body = JSON.stringify({
+    family: $('set-family').value,
+    qualifier: $('set-qualifier').value,
+    value: $('set-value').value,
+    encoding: $('set-encoding').value,
+  });
+  const { row } = await api('row', params, { method: 'POST', body });
+  renderRow(row);
+}
+
+async function main() {
+  state.config = await api('config');
+  $('mode').textContent = state.config.writable ? 'read write' : 'read only';
+  options($('decode'), state.config.decodings);
+  options($('set-encoding'), state.config.decodings.filter((d) => d !== 'auto'));
+  $('filter-help').replaceChildren(...state.config.filters.map((f) => el('li', { textContent: f })));
+  $('set').hidden = !state.config.writable;
+
+  $('search').onsubmit = (e) => {
+    e.preventDefault();
+    search(false).catch(showError);
+  };
+  $('decode').onchange = () => {
+    search(false).catch(showError);
+    if (state.detailKey && !$('detail').hidden) {
+      showRow(state.detailKey).catch(showError);
+    }
+  };
+  $('more').onclick = () => search(true).catch(showError);
+  $('set').onsubmit = (e) => setCell(e).catch(showError);
+  $('delete-row').onclick = () => deleteCells({}).catch(showError);
+
+  await loadTables();
+}
+
+main().catch(showError);
@@ -0,0 +1,356 @@
+// Package webui serves a small data explorer for people who would rather not
+// use cbt: list tables, search rows by key prefix, inspect a row with all of
+// its versions and run filter expressions. The page and its scripts are
+// embedded, the JSON api lives under /api/.
+//
+// The explorer is read only unless Options.Writable is set.
+package webui
+
+import (
+	"context"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"bigworkshop/cellfmt"
+	"bigworkshop/filterexpr"
+	"bigworkshop/pager"
+	"cloud.google.com/go/bigtable"
+	"github.com/sirupsen/logrus"
+)
+
+//go:embed static
+var static embed.FS
+
+// Options configure the explorer.
+type Options struct {
+	// Writable enables setting and deleting cells.
+	Writable bool
+	// PageSize is the default number of rows per page.
+	PageSize int
+	// Timeout bounds every bigtable call.
+	Timeout time.Duration
+}
+
+type server struct {
+	data  *bigtable.Client
+	admin *bigtable.AdminClient
+	opts  Options
+}
+
+// New returns the handler serving the explorer and its api.
+func New(data *bigtable.Client, admin *bigtable.AdminClient, opts Options) http.Handler {
+	if opts.PageSize <= 0 {
+		opts.PageSize = 25
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = time.Second * 30
+	}
+	s := &server{data: data, admin: admin, opts: opts}
+
+	assets, err := fs.Sub(static, "static")
+	if err != nil {
+		panic(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", http.FileServer(http.FS(assets)))
+	mux.HandleFunc("/api/config", s.handleConfig)
+	mux.HandleFunc("/api/tables", s.handleTables)
+	mux.HandleFunc("/api/schema", s.handleSchema)
+	mux.HandleFunc("/api/rows", s.handleRows)
+	mux.HandleFunc("/api/row", s.handleRow)
+	return mux
+}
+
+type apiError struct {
+	status int
+	err    error
+}
+
+func (e *apiError) Error() string { return e.err.Error() }
+
+func badRequest(format string, args ...interface{}) error {
+	return &apiError{http.StatusBadRequest, fmt.Errorf(format, args...)}
+}
+
+// handle checks the method and writes the JSON response or error of fn.
+func (s *server) handle(w http.ResponseWriter, r *http.Request, methods []string, fn func(ctx context.Context) (interface{}, error)) {
+	allowed := false
+	for _, m := range methods {
+		allowed = allowed || r.Method == m
+	}
+	if !allowed {
+		w.Header().Set("Allow", fmt.Sprint(methods))
+		writeJSON(w, http.StatusMethodNotAllowed, map[string]string{"error": "method not allowed"})
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.opts.Timeout)
+	defer cancel()
+	resp, err := fn(ctx)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if ae, ok := err.(*apiError); ok {
+			status = ae.status
+		}
+		logrus.WithError(err).WithField("path", r.URL.Path).Warn("api request failed")
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logrus.WithError(err).Warn("could not write response")
+	}
+}
+
+func (s *server) handleConfig(w http.ResponseWriter, r *http.Request) {
+	s.handle(w, r, []string{http.MethodGet}, func(context.Context) (interface{}, error) {
+		return map[string]interface{}{
+			"writable":  s.opts.Writable,
+			"pageSize":  s.opts.PageSize,
+			"decodings": cellfmt.Decodings(),
+			"filters":   filterexpr.Help(),
+		}, nil
+	})
+}
+
+func (s *server) handleTables(w http.ResponseWriter, r *http.Request) {
+	s.handle(w, r, []string{http.MethodGet}, func(ctx context.Context) (interface{}, error) {
+		tables, err := s.admin.Tables(ctx)
+		if err != nil {
+			return nil, err
+		}
+		sort.Strings(tables)
+		return map[string][]string{"tables": tables}, nil
+	})
+}
+
+type family struct {
+	Name     string `json:"name"`
+	GCPolicy string `json:"gcPolicy"`
+}
+
+func (s *server) handleSchema(w http.ResponseWriter, r *http.Request) {
+	s.handle(w, r, []string{http.MethodGet}, func(ctx context.Context) (interface{}, error) {
+		table, err := requireParam(r, "table")
+		if err != nil {
+			return nil, err
+		}
+		info, err := s.admin.TableInfo(ctx, table)
+		if err != nil {
+			return nil, err
+		}
+		fams := []family{}
+		for _, f := range info.FamilyInfos {
+			fams = append(fams, family{Name: f.Name, GCPolicy: f.GCPolicy})
+		}
+		sort.Slice(fams, func(i, j int) bool { return fams[i].Name < fams[j].Name })
+		return map[string]interface{}{"table": table, "families": fams}, nil
+	})
+}
+
+type cell struct {
+	Family    string   `json:"family"`
+	Qualifier string   `json:"qualifier"`
+	Timestamp int64    `json:"timestamp"`
+	Time      string   `json:"time"`
+	Size      int      `json:"size"`
+	Value     string   `json:"value"`
+	Labels    []string `json:"labels,omitempty"`
+}
+
+type row struct {
+	Key   string `json:"key"`
+	Cells []cell `json:"cells"`
+}
+
+func toRow(r bigtable.Row, d cellfmt.Decoding) row {
+	out := row{Key: r.Key(), Cells: []cell{}}
+	for _, c := range cellfmt.Cells(r) {
+		out.Cells = append(out.Cells, cell{
+			Family:    c.Family,
+			Qualifier: c.Qualifier,
+			Timestamp: int64(c.Timestamp),
+			Time:      c.Timestamp.Time().UTC().Format(time.RFC3339Nano),
+			Size:      len(c.Value),
+			Value:     cellfmt.DecodeIndent(d, c.Value),
+			Labels:    c.Labels,
+		})
+	}
+	return out
+}
+
+func requireParam(r *http.Request, name string) (string, error) {
+	v := r.URL.Query().Get(name)
+	if v == "" {
+		return "", badRequest("missing parameter %s", name)
+	}
+	return v, nil
+}
+
+func decoding(r *http.Request) (cellfmt.Decoding, error) {
+	d := r.URL.Query().Get("decode")
+	if d == "" {
+		return cellfmt.Auto, nil
+	}
+	dec, err := cellfmt.ParseDecoding(d)
+	if err != nil {
+		return "", badRequest("%v", err)
+	}
+	return dec, nil
+}
+
+func readOpts(r *http.Request) ([]bigtable.ReadOption, error) {
+	expr := r.URL.Query().Get("filter")
+	if expr == "" {
+		return nil, nil
+	}
+	f, err := filterexpr.Parse(expr)
+	if err != nil {
+		return nil, badRequest("%v", err)
+	}
+	return []bigtable.ReadOption{bigtable.RowFilter(f)}, nil
+}
+
+// handleRows searches rows by key prefix, one page at a time. The response
+// contains the key to pass as after for the next page.
+func (s *server) handleRows(w http.ResponseWriter, r *http.Request) {
+	s.handle(w, r, []string{http.MethodGet}, func(ctx context.Context) (interface{}, error) {
+		table, err := requireParam(r, "table")
+		if err != nil {
+			return nil, err
+		}
+		d, err := decoding(r)
+		if err != nil {
+			return nil, err
+		}
+		opts, err := readOpts(r)
+		if err != nil {
+			return nil, err
+		}
+		limit := s.opts.PageSize
+		if l := r.URL.Query().Get("limit"); l != "" {
+			if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+				return nil, badRequest("bad limit %q", l)
+			}
+		}
+
+		q := r.URL.Query()
+		rows, next, err := pager.Page(ctx, s.data.Open(table), pager.PrefixRange(q.Get("prefix")), q.Get("after"), limit, opts...)
+		if err != nil {
+			return nil, err
+		}
+		out := []row{}
+		for _, r := range rows {
+			out = append(out, toRow(r, d))
+		}
+		return map[string]interface{}{"rows": out, "next": next}, nil
+	})
+}
+
+// handleRow returns a single row with all versions. When writable, POST sets
+// a cell and DELETE removes a column, a family or the whole row.
+func (s *server) handleRow(w http.ResponseWriter, r *http.Request) {
+	methods := []string{http.MethodGet}
+	if s.opts.Writable {
+		methods = append(methods, http.MethodPost, http.MethodDelete)
+	}
+	s.handle(w, r, methods, func(ctx context.Context) (interface{}, error) {
+		table, err := requireParam(r, "table")
+		if err != nil {
+			return nil, err
+		}
+		key, err := requireParam(r, "key")
+		if err != nil {
+			return nil, err
+		}
+		d, err := decoding(r)
+		if err != nil {
+			return nil, err
+		}
+		tbl := s.data.Open(table)
+
+		switch r.Method {
+		case http.MethodPost:
+			if err := s.setCell(ctx, tbl, key, r); err != nil {
+				return nil, err
+			}
+		case http.MethodDelete:
+			if err := s.deleteCells(ctx, tbl, key, r); err != nil {
+				return nil, err
+			}
+		}
+
+		opts, err := readOpts(r)
+		if err != nil {
+			return nil, err
+		}
+		found, err := tbl.ReadRow(ctx, key, opts...)
+		if err != nil {
+			return nil, err
+		}
+		if len(found) == 0 {
+			if r.Method == http.MethodDelete {
+				return map[string]interface{}{"row": nil}, nil
+			}
+			return nil, &apiError{http.StatusNotFound, fmt.Errorf("row %q not found", key)}
+		}
+		return map[string]interface{}{"row": toRow(found, d)}, nil
+	})
+}
+
+type setRequest struct {
+	Family    string `json:"family"`
+	Qualifier string `json:"qualifier"`
+	Value     string `json:"value"`
+	// Encoding says how Value is encoded, see cellfmt.Encode.
+	Encoding string `json:"encoding"`
+}
+
+func (s *server) setCell(ctx context.Context, tbl *bigtable.Table, key string, r *http.Request) error {
+	var req setRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return badRequest("bad body: %v", err)
+	}
+	if req.Family == "" {
+		return badRequest("missing family")
+	}
+	enc := cellfmt.UTF8
+	if req.Encoding != "" {
+		var err error
+		if enc, err = cellfmt.ParseDecoding(req.Encoding); err != nil {
+			return badRequest("%v", err)
+		}
+	}
+	value, err := cellfmt.Encode(enc, req.Value)
+	if err != nil {
+		return badRequest("bad %s value: %v", enc, err)
+	}
+	mut := bigtable.NewMutation()
+	mut.Set(req.Family, req.Qualifier, bigtable.Now(), value)
+	return tbl.Apply(ctx, key, mut)
+}
+
+func (s *server) deleteCells(ctx context.Context, tbl *bigtable.Table, key string, r *http.Request) error {
+	q := r.URL.Query()
+	mut := bigtable.NewMutation()
+	switch {
+	case q.Get("family") != "" && q.Has("qualifier"):
+		mut.DeleteCellsInColumn(q.Get("family"), q.Get("qualifier"))
+	case q.Get("family") != "":
+		mut.DeleteCellsInFamily(q.Get("family"))
+	default:
+		mut.DeleteRow()
+	}
+	return tbl.Apply(ctx, key, mut)
+}